@@ -12,3 +12,12 @@ type Consumer interface {
 	WaitUntilWarm(*sync.WaitGroup) error
 	Stop() error
 }
+
+// Resumable consumers can tell a new carbonsearch process where they got to,
+// so it continues from there (see the handoff and snapshots in main)
+type Resumable interface {
+	// Position is where to resume from, by topic and partition. Every
+	// message before it is already in the database.
+	Position() map[string]map[int32]int64
+	ResumeFrom(map[string]map[int32]int64)
+}
@@ -24,15 +24,27 @@ type Config struct {
 	WarmThreshold float32 `yaml:"warm_threshold"`
 	Port          int     `yaml:"port"`
 	Endpoint      string  `yaml:"endpoint"`
+	// keeps the messages received, to replay them on startup
+	WAL WALConfig `yaml:"wal"`
 }
 
 // Consumer represents a carbonsearch HTTP API data source: it listens for POST
-// requests on '$endpoint/tag', '$endpoint/metric', and '$endpoint/custom'. The
-// Consumer uses any received messages to populate the carbonsearch Database.
+// requests on '$endpoint/tag', '$endpoint/metric', '$endpoint/custom', and
+// '$endpoint/link', and for deletions on '$endpoint/delete/tag',
+// '$endpoint/delete/metric', '$endpoint/delete/custom' and
+// '$endpoint/delete/join'. The
+// Consumer uses any received messages to populate the carbonsearch Database,
+// and with a WAL configured, replays the ones from before on Start.
 type Consumer struct {
 	port     int
 	endpoint string
 	listener *net.TCPListener
+	wal      *wal
+	// set by ResumeFrom: only replay the WAL after resumeAfter, or not at
+	// all without a position in it
+	resumed     bool
+	resumeAfter uint64
+	hasPosition bool
 
 	warmThreshold float32
 	progress      float32
@@ -54,9 +66,19 @@ func New(configPath string) (*Consumer, error) {
 		logger.Logf("HTTP consumer: warning, warm_threshold is very low or unset (value: %v). Carbonsearch may start serving requests before much data has been indexed from the HTTP API", config.WarmThreshold)
 	}
 
+	var log *wal
+	if config.WAL.Dir != "" {
+		log, err = newWAL(config.WAL)
+		if err != nil {
+			return nil, err
+		}
+		logger.Logf("HTTP consumer: keeping a WAL in %q", config.WAL.Dir)
+	}
+
 	return &Consumer{
 		port:     config.Port,
 		endpoint: config.Endpoint,
+		wal:      log,
 
 		warmThreshold: config.WarmThreshold,
 		progress:      0,
@@ -83,6 +105,18 @@ func (h *Consumer) WaitUntilWarm(wg *sync.WaitGroup) error {
 // Start starts an HTTP server listening on the configured endpoint, inserting
 // messages into Database as they're received.
 func (h *Consumer) Start(db *database.Database) error {
+	if h.wal != nil {
+		var err error
+		if h.resumed && !h.hasPosition {
+			err = h.wal.Skip(db)
+		} else {
+			err = h.wal.Replay(db, h.resumeAfter)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
 	mux := http.NewServeMux()
 	mux.HandleFunc(h.endpoint+"/progress", func(w http.ResponseWriter, req *http.Request) {
 		payload, err := ioutil.ReadAll(req.Body)
@@ -121,7 +155,11 @@ func (h *Consumer) Start(db *database.Database) error {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		err = db.InsertTags(msg)
+		kind, apply := walTag, func() error { return db.InsertTags(msg) }
+		if msg.Delete {
+			kind, apply = walDeleteTag, func() error { return db.DeleteTags(msg) }
+		}
+		err = h.write(kind, payload, apply)
 		if err != nil {
 			logger.Logf("blorg problem writing data! /consumer/tag %s, %s", err, string(payload))
 			http.Error(w, err.Error(), http.StatusBadRequest)
@@ -144,7 +182,13 @@ func (h *Consumer) Start(db *database.Database) error {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		err = db.InsertMetrics(msg)
+		kind, apply := walMetric, func() error { return db.InsertMetrics(msg) }
+		if msg.Delete && len(msg.Metrics) == 0 {
+			kind, apply = walDeleteJoin, func() error { return db.DeleteJoin(&m.Join{Key: msg.Key, Value: msg.Value}) }
+		} else if msg.Delete {
+			kind, apply = walDeleteMetric, func() error { return db.DeleteMetrics(msg) }
+		}
+		err = h.write(kind, payload, apply)
 		if err != nil {
 			logger.Logf("blorg problem writing data! /consumer/metric %s, %s", err, string(payload))
 			http.Error(w, err.Error(), http.StatusBadRequest)
@@ -167,7 +211,11 @@ func (h *Consumer) Start(db *database.Database) error {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		err = db.InsertCustom(msg)
+		kind, apply := walCustom, func() error { return db.InsertCustom(msg) }
+		if msg.Delete {
+			kind, apply = walDeleteCustom, func() error { return db.DeleteCustom(msg) }
+		}
+		err = h.write(kind, payload, apply)
 		if err != nil {
 			logger.Logf("blorg problem writing data! /consumer/custom %s, %s", err, string(payload))
 			http.Error(w, err.Error(), http.StatusBadRequest)
@@ -175,6 +223,121 @@ func (h *Consumer) Start(db *database.Database) error {
 		}
 	})
 
+	mux.HandleFunc(h.endpoint+"/link", func(w http.ResponseWriter, req *http.Request) {
+		payload, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			logger.Logf("couldn't read the body! /consumer/link %s, %s", err, string(payload))
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var msg *m.KeyLink
+		err = json.Unmarshal(payload, &msg)
+		if err != nil {
+			logger.Logf("failure to decode! /consumer/link %s, %s", err, string(payload))
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = h.write(walLink, payload, func() error { return db.InsertLinks(msg) })
+		if err != nil {
+			logger.Logf("blorg problem writing data! /consumer/link %s, %s", err, string(payload))
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	})
+
+	mux.HandleFunc(h.endpoint+"/delete/tag", func(w http.ResponseWriter, req *http.Request) {
+		payload, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			logger.Logf("couldn't read the body! /consumer/delete/tag %s, %s", err, string(payload))
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var msg *m.KeyTag
+		err = json.Unmarshal(payload, &msg)
+		if err != nil {
+			logger.Logf("failure to decode! /consumer/delete/tag %s, %s", err, string(payload))
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = h.write(walDeleteTag, payload, func() error { return db.DeleteTags(msg) })
+		if err != nil {
+			logger.Logf("problem deleting tags! /consumer/delete/tag %s, %s", err, string(payload))
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	})
+
+	mux.HandleFunc(h.endpoint+"/delete/metric", func(w http.ResponseWriter, req *http.Request) {
+		payload, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			logger.Logf("couldn't read the body! /consumer/delete/metric %s, %s", err, string(payload))
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var msg *m.KeyMetric
+		err = json.Unmarshal(payload, &msg)
+		if err != nil {
+			logger.Logf("failure to decode! /consumer/delete/metric %s, %s", err, string(payload))
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = h.write(walDeleteMetric, payload, func() error { return db.DeleteMetrics(msg) })
+		if err != nil {
+			logger.Logf("problem deleting metrics! /consumer/delete/metric %s, %s", err, string(payload))
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	})
+
+	mux.HandleFunc(h.endpoint+"/delete/custom", func(w http.ResponseWriter, req *http.Request) {
+		payload, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			logger.Logf("couldn't read the body! /consumer/delete/custom %s, %s", err, string(payload))
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var msg *m.TagMetric
+		err = json.Unmarshal(payload, &msg)
+		if err != nil {
+			logger.Logf("failure to decode! /consumer/delete/custom %s, %s", err, string(payload))
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = h.write(walDeleteCustom, payload, func() error { return db.DeleteCustom(msg) })
+		if err != nil {
+			logger.Logf("problem deleting custom associations! /consumer/delete/custom %s, %s", err, string(payload))
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	})
+
+	mux.HandleFunc(h.endpoint+"/delete/join", func(w http.ResponseWriter, req *http.Request) {
+		payload, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			logger.Logf("couldn't read the body! /consumer/delete/join %s, %s", err, string(payload))
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var msg *m.Join
+		err = json.Unmarshal(payload, &msg)
+		if err != nil {
+			logger.Logf("failure to decode! /consumer/delete/join %s, %s", err, string(payload))
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = h.write(walDeleteJoin, payload, func() error { return db.DeleteJoin(msg) })
+		if err != nil {
+			logger.Logf("problem deleting join! /consumer/delete/join %s, %s", err, string(payload))
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	})
+
 	portStr := fmt.Sprintf(":%d", h.port)
 	logger.Logf("HTTP consumer Listening on %s\n", portStr)
 	l, err := net.ListenTCP("tcp", &net.TCPAddr{Port: h.port})
@@ -189,7 +352,49 @@ func (h *Consumer) Start(db *database.Database) error {
 // Stop halts the consumer.
 func (h *Consumer) Stop() error {
 	logger.Logf("HTTP consumer on port %d stopping", h.port)
-	return h.listener.Close()
+	err := h.listener.Close()
+	if h.wal != nil {
+		walErr := h.wal.Close()
+		if err == nil {
+			err = walErr
+		}
+	}
+	return err
+}
+
+// write applies a message, logging it in the WAL first if there is one
+func (h *Consumer) write(kind walKind, payload []byte, apply func() error) error {
+	if h.wal == nil {
+		return apply()
+	}
+	return h.wal.Write(kind, payload, apply)
+}
+
+// the position of the WAL, as a topic and partition for Position
+const (
+	walTopic     = "wal"
+	walPartition = 0
+)
+
+// Position returns the sequence number of the last WAL message in the
+// Database. Without a WAL there's nothing to resume.
+func (h *Consumer) Position() map[string]map[int32]int64 {
+	if h.wal == nil {
+		return map[string]map[int32]int64{}
+	}
+	return map[string]map[int32]int64{walTopic: {walPartition: int64(h.wal.Position())}}
+}
+
+// ResumeFrom makes Start replay only the WAL messages after the position (as
+// returned by Position). The Database came from a snapshot or the previous
+// process, so without a position (nil, or from a process without a WAL) it
+// can't tell which messages it has, and nothing is replayed. It must be
+// called before Start.
+func (h *Consumer) ResumeFrom(position map[string]map[int32]int64) {
+	h.resumed = true
+	lsn, ok := position[walTopic][walPartition]
+	h.hasPosition = ok
+	h.resumeAfter = uint64(lsn)
 }
 
 // Name returns the name of the consumer
@@ -6,3 +6,6 @@ import (
 
 // make sure that it implements the Consumer interface
 var _ c.Consumer = &Consumer{}
+
+// and that it can hand its WAL position over on restart
+var _ c.Resumable = &Consumer{}
@@ -0,0 +1,1154 @@
+package httpapi
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	m "github.com/kanatohodets/carbonsearch/consumer/message"
+	"github.com/kanatohodets/carbonsearch/database"
+	"github.com/kanatohodets/carbonsearch/tag"
+)
+
+/*
+	the write-ahead log keeps every message the HTTP API accepts, so they can be
+	replayed when carbonsearch starts: unlike Kafka, nothing else remembers them.
+
+	the log is a directory of numbered segments. Each record in a segment is:
+
+		body length (uint32, big endian)
+		CRC-32 (Castagnoli) of the body (uint32, big endian)
+		body: the kind of message (1 byte), its log sequence number (uint64),
+		when it was written (unix seconds, int64), then the JSON as it was posted
+
+	a message is written (and synced, with fsync 'always') before it goes into
+	the database, but applied outside the lock of the log, in the order of the
+	sequence numbers. If the database rejects it, an 'abort' record with its
+	sequence number is written, and replay and compaction skip it. Once the
+	active segment is bigger than segment_size, a new one is started. A crash
+	can leave half a record at the end of the last segment; replay stops there
+	and truncates it.
+
+	the sequence number of the last message applied is the position of the
+	consumer in snapshots and handoffs. A database loaded from one only gets
+	the messages after it replayed, and one loaded from a snapshot without it
+	(taken before the log was kept) gets none. Replayed messages keep the time
+	they were written, so they expire as if they had never left.
+
+	compaction folds the sealed segments into the state they add up to (the
+	metrics, tags and links of each join, the metrics of each custom tag, and
+	the deletions that nothing later in the log undid, since they can apply to
+	data from other consumers) and writes that out as one segment, starting
+	with a 'compacted' record, which replaces them. Anything older than its TTL
+	in the database is left out, and everything else keeps the sequence number
+	of the message that last wrote it, and the time it was written. Replay
+	ignores anything older than the newest compacted segment, so a crash
+	halfway through compaction is harmless. The compacted inserts only add
+	things, so a 'replace' in the log isn't applied again to data from other
+	consumers.
+*/
+
+// WALConfig configures the write-ahead log of the HTTP consumer
+type WALConfig struct {
+	// no log without a directory
+	Dir string `yaml:"dir"`
+	// in bytes
+	SegmentSize int64 `yaml:"segment_size"`
+	// 'always' (before responding), 'interval' or 'never' (up to the OS)
+	Fsync         string `yaml:"fsync"`
+	FsyncInterval string `yaml:"fsync_interval"`
+	// compact once there are this many sealed segments
+	CompactAfter int `yaml:"compact_after"`
+}
+
+type walKind byte
+
+const (
+	walTag walKind = iota + 1
+	walMetric
+	walCustom
+	walLink
+	walDeleteTag
+	walDeleteMetric
+	walDeleteCustom
+	walDeleteJoin
+	// the first record of a segment written by compaction
+	walCompacted
+	// the database rejected a message. The payload is its sequence number
+	walAbort
+)
+
+type fsyncPolicy int
+
+const (
+	fsyncAlways fsyncPolicy = iota
+	fsyncInterval
+	fsyncNever
+)
+
+const walHeaderSize = 8
+
+// kind, sequence number and write time
+const walBodyHeaderSize = 1 + 8 + 8
+
+const walSuffix = ".wal"
+
+var walCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+type walRecord struct {
+	kind walKind
+	// the log sequence number of a message. Abort records have 0. The ones
+	// written by compaction have the number of the last message that wrote
+	// what they hold, and the compacted record has the last one it replaced
+	lsn uint64
+	// unix seconds
+	written int64
+	payload []byte
+}
+
+// isMessage is whether the record should be applied
+func (r walRecord) isMessage() bool {
+	return r.kind != walCompacted && r.kind != walAbort
+}
+
+type wal struct {
+	dir          string
+	segmentSize  int64
+	fsync        fsyncPolicy
+	compactAfter int
+	// from the database, for leaving expired data out of compaction
+	ttls database.TTLs
+	now  func() time.Time
+
+	mut        sync.Mutex
+	active     *os.File
+	activeSeq  uint64
+	activeSize int64
+	// written since the last fsync, for the interval policy
+	dirty      bool
+	compacting bool
+
+	// the sequence number of the next message, and the last one that was
+	// applied (or rejected). signalled on mut when that moves
+	nextLSN      uint64
+	applied      uint64
+	appliedMoved *sync.Cond
+
+	stop chan bool
+	done sync.WaitGroup
+}
+
+func newWAL(config WALConfig) (*wal, error) {
+	w := &wal{
+		dir:          config.Dir,
+		segmentSize:  config.SegmentSize,
+		compactAfter: config.CompactAfter,
+		now:          time.Now,
+		nextLSN:      1,
+		stop:         make(chan bool),
+	}
+	w.appliedMoved = sync.NewCond(&w.mut)
+	if w.segmentSize <= 0 {
+		w.segmentSize = 64 << 20
+	}
+	if w.compactAfter <= 0 {
+		w.compactAfter = 4
+	}
+
+	var interval time.Duration
+	switch config.Fsync {
+	case "always":
+		w.fsync = fsyncAlways
+	case "", "interval":
+		w.fsync = fsyncInterval
+		interval = time.Second
+		if config.FsyncInterval != "" {
+			var err error
+			interval, err = time.ParseDuration(config.FsyncInterval)
+			if err != nil || interval <= 0 {
+				return nil, fmt.Errorf("HTTP consumer: WAL fsync_interval %q should be a positive duration", config.FsyncInterval)
+			}
+		}
+	case "never":
+		w.fsync = fsyncNever
+	default:
+		return nil, fmt.Errorf("HTTP consumer: WAL fsync should be 'always', 'interval' or 'never', not %q", config.Fsync)
+	}
+
+	err := os.MkdirAll(w.dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("HTTP consumer: could not create WAL directory: %v", err)
+	}
+	// left over from a compaction that didn't finish
+	os.Remove(filepath.Join(w.dir, "compact.tmp"))
+
+	if w.fsync == fsyncInterval {
+		w.done.Add(1)
+		go w.syncEvery(interval)
+	}
+	return w, nil
+}
+
+// Replay applies the messages in the log after sequence number 'after' (the
+// database has the ones before it already), then starts a new segment to
+// write to. Messages the database rejects are logged and skipped.
+func (w *wal) Replay(db *database.Database, after uint64) error {
+	segments, err := w.segments()
+	if err != nil {
+		return err
+	}
+	segments = w.dropCompacted(segments)
+
+	aborted, last := w.scan(segments)
+	records, failed := 0, 0
+	for i, seq := range segments {
+		valid, err := readSegment(w.segmentPath(seq), func(record walRecord) {
+			if !record.isMessage() || aborted[record.lsn] || record.lsn <= after {
+				return
+			}
+			records++
+			if err := applyRecord(db, record.kind, record.payload, time.Unix(record.written, 0)); err != nil {
+				failed++
+				logger.Logf("HTTP consumer: WAL replay: skipping a message the database rejected: %v, %s", err, string(record.payload))
+			}
+		})
+		if err != nil {
+			logger.Logf("HTTP consumer: WAL segment %d is damaged after %d bytes, ignoring the rest of it: %v", seq, valid, err)
+			// the usual result of a crash halfway through a write
+			if i == len(segments)-1 {
+				os.Truncate(w.segmentPath(seq), valid)
+			}
+		}
+	}
+	logger.Logf("HTTP consumer: replayed %d messages from the WAL after message %d (%d rejected)", records, after, failed)
+
+	// the log can be behind the database, if it was lost. numbers carry on
+	// from the database, so that its position still means the same thing
+	if after > last {
+		last = after
+	}
+	return w.start(db, segments, last)
+}
+
+// Skip starts a new segment to write to without replaying anything, for a
+// database that has everything in the log already (or can't tell what it
+// has)
+func (w *wal) Skip(db *database.Database) error {
+	segments, err := w.segments()
+	if err != nil {
+		return err
+	}
+	segments = w.dropCompacted(segments)
+	_, last := w.scan(segments)
+	logger.Logf("HTTP consumer: not replaying the WAL, the database has no position in it")
+	return w.start(db, segments, last)
+}
+
+// start opens a new segment after the existing ones, for messages after
+// 'last'
+func (w *wal) start(db *database.Database, segments []uint64, last uint64) error {
+	next := uint64(1)
+	if len(segments) > 0 {
+		next = segments[len(segments)-1] + 1
+	}
+
+	w.mut.Lock()
+	defer w.mut.Unlock()
+	w.ttls = db.TTLs()
+	w.nextLSN = last + 1
+	w.applied = last
+	file, size, err := w.openSegment(next)
+	if err != nil {
+		return err
+	}
+	w.active, w.activeSeq, w.activeSize = file, next, size
+	w.maybeCompact(len(segments))
+	return nil
+}
+
+// Position is the sequence number of the last message that was applied (or
+// rejected): everything up to it is in the database
+func (w *wal) Position() uint64 {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+	return w.applied
+}
+
+// Write logs a message, then applies it. Messages are applied in the order
+// they were logged, but outside the lock of the log, so appending the next
+// one doesn't wait for the database. If apply fails the message is aborted in
+// the log.
+func (w *wal) Write(kind walKind, payload []byte, apply func() error) error {
+	lsn, err := w.append(walRecord{kind: kind, written: w.now().Unix(), payload: payload})
+	if err != nil {
+		return err
+	}
+
+	w.waitApplied(lsn - 1)
+	defer w.markApplied(lsn)
+	err = apply()
+	if err != nil {
+		w.abort(lsn)
+		return err
+	}
+	return nil
+}
+
+// Close syncs and closes the log
+func (w *wal) Close() error {
+	close(w.stop)
+	w.done.Wait()
+
+	w.mut.Lock()
+	defer w.mut.Unlock()
+	if w.active == nil {
+		return nil
+	}
+	err := w.active.Sync()
+	closeErr := w.active.Close()
+	w.active = nil
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// append logs a message, returning its sequence number
+func (w *wal) append(record walRecord) (uint64, error) {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+
+	if w.active == nil {
+		return 0, fmt.Errorf("HTTP consumer: the WAL is closed")
+	}
+	record.lsn = w.nextLSN
+	err := w.write(record)
+	if err != nil {
+		return 0, err
+	}
+	w.nextLSN++
+	// the message is in, whatever happens to the next segment
+	w.rotateIfFull()
+	return record.lsn, nil
+}
+
+// abort logs that the database rejected a message
+func (w *wal) abort(lsn uint64) {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+
+	if w.active == nil {
+		logger.Logf("HTTP consumer: the WAL was closed before message %d could be aborted, it will be replayed", lsn)
+		return
+	}
+	payload := make([]byte, 8)
+	binary.BigEndian.PutUint64(payload, lsn)
+	err := w.write(walRecord{kind: walAbort, written: w.now().Unix(), payload: payload})
+	if err != nil {
+		logger.Logf("HTTP consumer: could not abort message %d, it will be replayed: %v", lsn, err)
+		return
+	}
+	w.rotateIfFull()
+}
+
+func (w *wal) waitApplied(lsn uint64) {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+	for w.applied < lsn {
+		w.appliedMoved.Wait()
+	}
+}
+
+func (w *wal) markApplied(lsn uint64) {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+	w.applied = lsn
+	w.appliedMoved.Broadcast()
+}
+
+// must be called with mut held
+func (w *wal) write(record walRecord) error {
+	start := w.activeSize
+	n, err := w.active.Write(encodeRecord(record))
+	w.activeSize += int64(n)
+	if err == nil && w.fsync == fsyncAlways {
+		err = w.active.Sync()
+	}
+	if err != nil {
+		w.truncate(start)
+		return fmt.Errorf("HTTP consumer: could not write to the WAL: %v", err)
+	}
+	w.dirty = true
+	return nil
+}
+
+// must be called with mut held
+func (w *wal) truncate(size int64) {
+	err := w.active.Truncate(size)
+	if err != nil {
+		logger.Logf("HTTP consumer: could not remove a record from the WAL: %v", err)
+		return
+	}
+	w.activeSize = size
+	if w.fsync == fsyncAlways {
+		w.active.Sync()
+	}
+}
+
+// must be called with mut held
+func (w *wal) rotateIfFull() {
+	if w.activeSize < w.segmentSize {
+		return
+	}
+	err := w.rotate()
+	if err != nil {
+		logger.Logf("HTTP consumer: could not start a new WAL segment: %v", err)
+	}
+}
+
+// rotate seals the active segment and starts the next one. If anything goes
+// wrong, the active segment stays as it is, so messages keep going to it.
+// must be called with mut held
+func (w *wal) rotate() error {
+	err := w.active.Sync()
+	if err != nil {
+		return fmt.Errorf("HTTP consumer: could not sync WAL segment: %v", err)
+	}
+	sealed := w.activeSeq
+	file, size, err := w.openSegment(sealed + 1)
+	if err != nil {
+		return err
+	}
+
+	// synced, so nothing is lost if closing fails
+	err = w.active.Close()
+	if err != nil {
+		logger.Logf("HTTP consumer: could not close WAL segment %d: %v", sealed, err)
+	}
+	w.active, w.activeSeq, w.activeSize = file, sealed+1, size
+	w.dirty = false
+
+	segments, err := w.segments()
+	if err != nil {
+		return err
+	}
+	count := 0
+	for _, seq := range segments {
+		if seq <= sealed {
+			count++
+		}
+	}
+	w.maybeCompact(count)
+	return nil
+}
+
+// openSegment opens a segment for appending, returning it and its size
+func (w *wal) openSegment(seq uint64) (*os.File, int64, error) {
+	file, err := os.OpenFile(w.segmentPath(seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, 0, fmt.Errorf("HTTP consumer: could not open WAL segment: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, fmt.Errorf("HTTP consumer: could not open WAL segment: %v", err)
+	}
+	syncDir(w.dir)
+	return file, info.Size(), nil
+}
+
+// must be called with mut held
+func (w *wal) maybeCompact(sealed int) {
+	if w.compacting || sealed < w.compactAfter {
+		return
+	}
+	w.compacting = true
+	through := w.activeSeq - 1
+	last := w.nextLSN - 1
+	w.done.Add(1)
+	go func() {
+		defer w.done.Done()
+		// the messages in the sealed segments have to be applied or aborted
+		// before compaction can tell which ones to keep
+		w.waitApplied(last)
+		err := w.compact(through, last)
+		if err != nil {
+			logger.Logf("HTTP consumer: WAL compaction failed: %v", err)
+		}
+		w.mut.Lock()
+		w.compacting = false
+		w.mut.Unlock()
+	}()
+}
+
+// compact replaces the sealed segments up to and including 'through' with a
+// single segment holding what they add up to. 'last' is the sequence number
+// of the last message in them.
+func (w *wal) compact(through, last uint64) error {
+	segments, err := w.segments()
+	if err != nil {
+		return err
+	}
+	segments = w.dropCompacted(segments)
+
+	// a message can be aborted in a later segment than its own
+	aborted, _ := w.scan(segments)
+	state := newWALState()
+	compacted := []uint64{}
+	for _, seq := range segments {
+		if seq > through {
+			break
+		}
+		compacted = append(compacted, seq)
+		valid, err := readSegment(w.segmentPath(seq), func(record walRecord) {
+			if !aborted[record.lsn] {
+				state.apply(record)
+			}
+		})
+		if err != nil {
+			logger.Logf("HTTP consumer: WAL segment %d is damaged after %d bytes, compacting what's before that: %v", seq, valid, err)
+		}
+	}
+	if len(compacted) < 2 {
+		return nil
+	}
+	state.expire(w.ttls, w.now().Unix())
+
+	tmpPath := filepath.Join(w.dir, "compact.tmp")
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	err = state.write(tmp, last)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	lastSegment := compacted[len(compacted)-1]
+	err = os.Rename(tmpPath, w.segmentPath(lastSegment))
+	if err != nil {
+		return err
+	}
+	syncDir(w.dir)
+	for _, seq := range compacted[:len(compacted)-1] {
+		os.Remove(w.segmentPath(seq))
+	}
+	logger.Logf("HTTP consumer: compacted WAL segments %d to %d", compacted[0], lastSegment)
+	return nil
+}
+
+// scan returns the sequence numbers of the aborted messages in some segments,
+// and the highest sequence number in them. It reads up to the first damaged
+// record of each segment; reporting that is left to the caller.
+func (w *wal) scan(segments []uint64) (map[uint64]bool, uint64) {
+	aborted := map[uint64]bool{}
+	last := uint64(0)
+	for _, seq := range segments {
+		readSegment(w.segmentPath(seq), func(record walRecord) {
+			if record.lsn > last {
+				last = record.lsn
+			}
+			if record.kind == walAbort && len(record.payload) == 8 {
+				aborted[binary.BigEndian.Uint64(record.payload)] = true
+			}
+		})
+	}
+	return aborted, last
+}
+
+// dropCompacted removes the segments older than the newest compacted one, and
+// returns the rest
+func (w *wal) dropCompacted(segments []uint64) []uint64 {
+	for i := len(segments) - 1; i > 0; i-- {
+		if !isCompacted(w.segmentPath(segments[i])) {
+			continue
+		}
+		for _, seq := range segments[:i] {
+			os.Remove(w.segmentPath(seq))
+		}
+		return segments[i:]
+	}
+	return segments
+}
+
+func (w *wal) syncEvery(interval time.Duration) {
+	defer w.done.Done()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-time.After(interval):
+			w.mut.Lock()
+			if w.dirty && w.active != nil {
+				err := w.active.Sync()
+				if err != nil {
+					logger.Logf("HTTP consumer: could not sync the WAL: %v", err)
+				}
+				w.dirty = false
+			}
+			w.mut.Unlock()
+		}
+	}
+}
+
+// segments returns the sequence numbers of the segments, oldest first
+func (w *wal) segments() ([]uint64, error) {
+	files, err := ioutil.ReadDir(w.dir)
+	if err != nil {
+		return nil, fmt.Errorf("HTTP consumer: could not list WAL segments: %v", err)
+	}
+
+	segments := []uint64{}
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), walSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(file.Name(), walSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, seq)
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return segments, nil
+}
+
+func (w *wal) segmentPath(seq uint64) string {
+	return filepath.Join(w.dir, fmt.Sprintf("%020d%s", seq, walSuffix))
+}
+
+func encodeRecord(r walRecord) []byte {
+	record := make([]byte, walHeaderSize+walBodyHeaderSize+len(r.payload))
+	body := record[walHeaderSize:]
+	body[0] = byte(r.kind)
+	binary.BigEndian.PutUint64(body[1:], r.lsn)
+	binary.BigEndian.PutUint64(body[9:], uint64(r.written))
+	copy(body[walBodyHeaderSize:], r.payload)
+	binary.BigEndian.PutUint32(record, uint32(len(body)))
+	binary.BigEndian.PutUint32(record[4:], crc32.Checksum(body, walCRCTable))
+	return record
+}
+
+func decodeBody(body []byte) walRecord {
+	return walRecord{
+		kind:    walKind(body[0]),
+		lsn:     binary.BigEndian.Uint64(body[1:]),
+		written: int64(binary.BigEndian.Uint64(body[9:])),
+		payload: body[walBodyHeaderSize:],
+	}
+}
+
+// readSegment calls fn for each record in a segment. It stops at the first
+// damaged record, returning an error and how many bytes were fine before it.
+func readSegment(path string, fn func(walRecord)) (int64, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	offset := 0
+	for offset < len(contents) {
+		if len(contents)-offset < walHeaderSize {
+			return int64(offset), fmt.Errorf("incomplete record header")
+		}
+		length := int(binary.BigEndian.Uint32(contents[offset:]))
+		checksum := binary.BigEndian.Uint32(contents[offset+4:])
+		if length == 0 || len(contents)-offset-walHeaderSize < length {
+			return int64(offset), fmt.Errorf("incomplete record")
+		}
+		body := contents[offset+walHeaderSize : offset+walHeaderSize+length]
+		if crc32.Checksum(body, walCRCTable) != checksum {
+			return int64(offset), fmt.Errorf("record checksum doesn't match")
+		}
+		if length < walBodyHeaderSize {
+			return int64(offset), fmt.Errorf("record is too short")
+		}
+		fn(decodeBody(body))
+		offset += walHeaderSize + length
+	}
+	return int64(offset), nil
+}
+
+func isCompacted(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	// the compacted record has no payload, so it's just the headers
+	first := make([]byte, walHeaderSize+walBodyHeaderSize)
+	_, err = io.ReadFull(file, first)
+	if err != nil {
+		return false
+	}
+	return binary.BigEndian.Uint32(first) == walBodyHeaderSize &&
+		binary.BigEndian.Uint32(first[4:]) == crc32.Checksum(first[walHeaderSize:], walCRCTable) &&
+		walKind(first[walHeaderSize]) == walCompacted
+}
+
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
+
+func decodeRecord(kind walKind, payload []byte) (interface{}, error) {
+	var msg interface{}
+	switch kind {
+	case walTag, walDeleteTag:
+		msg = &m.KeyTag{}
+	case walMetric, walDeleteMetric:
+		msg = &m.KeyMetric{}
+	case walCustom, walDeleteCustom:
+		msg = &m.TagMetric{}
+	case walLink:
+		msg = &m.KeyLink{}
+	case walDeleteJoin:
+		msg = &m.Join{}
+	default:
+		return nil, fmt.Errorf("unknown kind of WAL record: %d", kind)
+	}
+	err := json.Unmarshal(payload, msg)
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// applyRecord applies a message from the log as if it had been written at
+// 'written' (the zero time means now)
+func applyRecord(db *database.Database, kind walKind, payload []byte, written time.Time) error {
+	msg, err := decodeRecord(kind, payload)
+	if err != nil {
+		return err
+	}
+
+	switch kind {
+	case walTag:
+		return db.InsertTagsAt(msg.(*m.KeyTag), written)
+	case walMetric:
+		return db.InsertMetricsAt(msg.(*m.KeyMetric), written)
+	case walCustom:
+		return db.InsertCustomAt(msg.(*m.TagMetric), written)
+	case walLink:
+		return db.InsertLinksAt(msg.(*m.KeyLink), written)
+	case walDeleteTag:
+		return db.DeleteTags(msg.(*m.KeyTag))
+	case walDeleteMetric:
+		return db.DeleteMetrics(msg.(*m.KeyMetric))
+	case walDeleteCustom:
+		return db.DeleteCustom(msg.(*m.TagMetric))
+	default:
+		return db.DeleteJoin(msg.(*m.Join))
+	}
+}
+
+// walState is what a run of WAL records adds up to. Like the write buffer of
+// the database, it remembers when everything was last written, so compaction
+// can leave out what's expired, and by which message, so a replay can still
+// skip what a snapshot has.
+type walState struct {
+	metrics map[m.Join]map[string]walStamp
+	// service-key => raw tags
+	tags  map[m.Join]map[string]walTags
+	links map[m.Join]walLinks
+	// custom tag => metrics
+	custom map[string]map[string]walStamp
+
+	// deletions that nothing later in the log undid. They can apply to data
+	// from other consumers, so they're kept whatever their TTL
+	deletedJoins   map[m.Join]walStamp
+	deletedMetrics map[m.Join]map[string]walStamp
+	// raw tags
+	deletedTags map[m.Join]map[string]walStamp
+	// custom tag => metrics
+	deletedCustom map[string]map[string]walStamp
+}
+
+// walStamp is the last message that wrote something: its sequence number,
+// and when it was written (in unix seconds)
+type walStamp struct {
+	lsn     uint64
+	written int64
+}
+
+// the values of a service-key for a join
+type walTags struct {
+	values []string
+	stamp  walStamp
+}
+
+type walLinks struct {
+	links []string
+	stamp walStamp
+}
+
+func newWALState() *walState {
+	return &walState{
+		metrics:        map[m.Join]map[string]walStamp{},
+		tags:           map[m.Join]map[string]walTags{},
+		links:          map[m.Join]walLinks{},
+		custom:         map[string]map[string]walStamp{},
+		deletedJoins:   map[m.Join]walStamp{},
+		deletedMetrics: map[m.Join]map[string]walStamp{},
+		deletedTags:    map[m.Join]map[string]walStamp{},
+		deletedCustom:  map[string]map[string]walStamp{},
+	}
+}
+
+func (s *walState) apply(record walRecord) {
+	if !record.isMessage() {
+		return
+	}
+	msg, err := decodeRecord(record.kind, record.payload)
+	if err != nil {
+		logger.Logf("HTTP consumer: WAL compaction: skipping a record that doesn't decode: %v", err)
+		return
+	}
+
+	stamp := walStamp{lsn: record.lsn, written: record.written}
+	switch record.kind {
+	case walTag:
+		s.insertTags(msg.(*m.KeyTag), stamp)
+	case walMetric:
+		msg := msg.(*m.KeyMetric)
+		join := m.Join{Key: msg.Key, Value: msg.Value}
+		if msg.Replace || s.metrics[join] == nil {
+			s.metrics[join] = map[string]walStamp{}
+		}
+		for _, metric := range msg.Metrics {
+			s.metrics[join][metric] = stamp
+			delete(s.deletedMetrics[join], metric)
+		}
+		if len(s.deletedMetrics[join]) == 0 {
+			delete(s.deletedMetrics, join)
+		}
+	case walCustom:
+		msg := msg.(*m.TagMetric)
+		for _, t := range msg.Tags {
+			if s.custom[t] == nil {
+				s.custom[t] = map[string]walStamp{}
+			}
+			for _, metric := range msg.Metrics {
+				s.custom[t][metric] = stamp
+				delete(s.deletedCustom[t], metric)
+			}
+			if len(s.deletedCustom[t]) == 0 {
+				delete(s.deletedCustom, t)
+			}
+		}
+	case walLink:
+		msg := msg.(*m.KeyLink)
+		s.links[m.Join{Key: msg.Key, Value: msg.Value}] = walLinks{links: msg.Links, stamp: stamp}
+	case walDeleteTag:
+		s.deleteTags(msg.(*m.KeyTag), stamp)
+	case walDeleteMetric:
+		msg := msg.(*m.KeyMetric)
+		join := m.Join{Key: msg.Key, Value: msg.Value}
+		if s.deletedMetrics[join] == nil {
+			s.deletedMetrics[join] = map[string]walStamp{}
+		}
+		for _, metric := range msg.Metrics {
+			delete(s.metrics[join], metric)
+			s.deletedMetrics[join][metric] = stamp
+		}
+		if len(s.metrics[join]) == 0 {
+			delete(s.metrics, join)
+		}
+	case walDeleteCustom:
+		msg := msg.(*m.TagMetric)
+		for _, t := range msg.Tags {
+			if s.deletedCustom[t] == nil {
+				s.deletedCustom[t] = map[string]walStamp{}
+			}
+			for _, metric := range msg.Metrics {
+				delete(s.custom[t], metric)
+				s.deletedCustom[t][metric] = stamp
+			}
+			if len(s.custom[t]) == 0 {
+				delete(s.custom, t)
+			}
+		}
+	case walDeleteJoin:
+		join := *msg.(*m.Join)
+		delete(s.metrics, join)
+		delete(s.tags, join)
+		delete(s.links, join)
+		// covered by deleting the join
+		delete(s.deletedMetrics, join)
+		delete(s.deletedTags, join)
+		s.deletedJoins[join] = stamp
+	}
+}
+
+// insertTags follows the database: the values of each key in the message
+// replace the ones before them, deleted or not
+func (s *walState) insertTags(msg *m.KeyTag, stamp walStamp) {
+	join := m.Join{Key: msg.Key, Value: msg.Value}
+	keys := s.tags[join]
+	if keys == nil {
+		keys = map[string]walTags{}
+		s.tags[join] = keys
+	}
+
+	inMessage := map[string]bool{}
+	for _, t := range msg.Tags {
+		sk, err := serviceKey(t)
+		if err != nil {
+			continue
+		}
+		if !inMessage[sk] {
+			inMessage[sk] = true
+			keys[sk] = walTags{stamp: stamp}
+		}
+		assignment := keys[sk]
+		if !containsString(assignment.values, t) {
+			assignment.values = append(assignment.values, t)
+			keys[sk] = assignment
+		}
+	}
+
+	if msg.Replace {
+		for sk := range keys {
+			if !inMessage[sk] {
+				delete(keys, sk)
+			}
+		}
+	}
+	if len(keys) == 0 {
+		delete(s.tags, join)
+	}
+
+	deleted := s.deletedTags[join]
+	for t := range deleted {
+		sk, err := serviceKey(t)
+		if err == nil && inMessage[sk] {
+			delete(deleted, t)
+		}
+	}
+	if len(deleted) == 0 {
+		delete(s.deletedTags, join)
+	}
+}
+
+func (s *walState) deleteTags(msg *m.KeyTag, stamp walStamp) {
+	join := m.Join{Key: msg.Key, Value: msg.Value}
+	keys := s.tags[join]
+	deleted := s.deletedTags[join]
+	if deleted == nil {
+		deleted = map[string]walStamp{}
+		s.deletedTags[join] = deleted
+	}
+	for _, t := range msg.Tags {
+		sk, err := serviceKey(t)
+		if err != nil {
+			continue
+		}
+		deleted[t] = stamp
+
+		assignment := keys[sk]
+		remaining := []string{}
+		for _, value := range assignment.values {
+			if value != t {
+				remaining = append(remaining, value)
+			}
+		}
+		if len(remaining) == 0 {
+			delete(keys, sk)
+			continue
+		}
+		assignment.values = remaining
+		keys[sk] = assignment
+	}
+	if len(keys) == 0 {
+		delete(s.tags, join)
+	}
+	if len(deleted) == 0 {
+		delete(s.deletedTags, join)
+	}
+}
+
+// expire leaves out what the database would have expired by 'now'
+func (s *walState) expire(ttls database.TTLs, now int64) {
+	for join, metrics := range s.metrics {
+		expireSet(metrics, ttls.Metrics(join.Key), now)
+		if len(metrics) == 0 {
+			delete(s.metrics, join)
+		}
+	}
+	for join, links := range s.links {
+		if expired(links.stamp.written, ttls.Metrics(join.Key), now) {
+			delete(s.links, join)
+		}
+	}
+	for join, keys := range s.tags {
+		for sk, assignment := range keys {
+			service, err := tag.ParseService(assignment.values[0])
+			if err == nil && expired(assignment.stamp.written, ttls.Tags(join.Key, service), now) {
+				delete(keys, sk)
+			}
+		}
+		if len(keys) == 0 {
+			delete(s.tags, join)
+		}
+	}
+	for t, metrics := range s.custom {
+		expireSet(metrics, ttls.Custom(), now)
+		if len(metrics) == 0 {
+			delete(s.custom, t)
+		}
+	}
+}
+
+// expired follows the database: with a TTL, anything last written before
+// now - TTL is gone
+func expired(written int64, ttl time.Duration, now int64) bool {
+	return ttl > 0 && written < now-int64(ttl/time.Second)
+}
+
+func expireSet(set map[string]walStamp, ttl time.Duration, now int64) {
+	for item, stamp := range set {
+		if expired(stamp.written, ttl, now) {
+			delete(set, item)
+		}
+	}
+}
+
+// write writes the state out as a compacted segment, with one message for
+// each message that last wrote something, so it keeps its sequence number
+// and age. The deletions go first: none of them undoes an insert that's in
+// the state.
+func (s *walState) write(file *os.File, last uint64) error {
+	records := [][]byte{encodeRecord(walRecord{kind: walCompacted, lsn: last})}
+	add := func(kind walKind, stamp walStamp, msg interface{}) error {
+		payload, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		records = append(records, encodeRecord(walRecord{kind: kind, lsn: stamp.lsn, written: stamp.written, payload: payload}))
+		return nil
+	}
+
+	for join, stamp := range s.deletedJoins {
+		if err := add(walDeleteJoin, stamp, &join); err != nil {
+			return err
+		}
+	}
+	for join, metrics := range s.deletedMetrics {
+		for stamp, metrics := range byStamp(metrics) {
+			if err := add(walDeleteMetric, stamp, &m.KeyMetric{Key: join.Key, Value: join.Value, Metrics: metrics}); err != nil {
+				return err
+			}
+		}
+	}
+	for join, tags := range s.deletedTags {
+		for stamp, tags := range byStamp(tags) {
+			if err := add(walDeleteTag, stamp, &m.KeyTag{Key: join.Key, Value: join.Value, Tags: tags}); err != nil {
+				return err
+			}
+		}
+	}
+	for t, metrics := range s.deletedCustom {
+		for stamp, metrics := range byStamp(metrics) {
+			if err := add(walDeleteCustom, stamp, &m.TagMetric{Tags: []string{t}, Metrics: metrics}); err != nil {
+				return err
+			}
+		}
+	}
+
+	for join, metrics := range s.metrics {
+		for stamp, metrics := range byStamp(metrics) {
+			if err := add(walMetric, stamp, &m.KeyMetric{Key: join.Key, Value: join.Value, Metrics: metrics}); err != nil {
+				return err
+			}
+		}
+	}
+	for join, keys := range s.tags {
+		sks := make([]string, 0, len(keys))
+		for sk := range keys {
+			sks = append(sks, sk)
+		}
+		sort.Strings(sks)
+		tags := map[walStamp][]string{}
+		for _, sk := range sks {
+			assignment := keys[sk]
+			tags[assignment.stamp] = append(tags[assignment.stamp], assignment.values...)
+		}
+		for stamp, tags := range tags {
+			if err := add(walTag, stamp, &m.KeyTag{Key: join.Key, Value: join.Value, Tags: tags}); err != nil {
+				return err
+			}
+		}
+	}
+	for join, links := range s.links {
+		if err := add(walLink, links.stamp, &m.KeyLink{Key: join.Key, Value: join.Value, Links: links.links}); err != nil {
+			return err
+		}
+	}
+	for t, metrics := range s.custom {
+		for stamp, metrics := range byStamp(metrics) {
+			if err := add(walCustom, stamp, &m.TagMetric{Tags: []string{t}, Metrics: metrics}); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, record := range records {
+		if _, err := file.Write(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func serviceKey(rawTag string) (string, error) {
+	s, k, _, err := tag.Parse(rawTag)
+	if err != nil {
+		return "", err
+	}
+	return s + "-" + k, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// byStamp groups a set by the message that last wrote its items, sorting
+// each group
+func byStamp(set map[string]walStamp) map[walStamp][]string {
+	groups := map[walStamp][]string{}
+	for item, stamp := range set {
+		groups[stamp] = append(groups[stamp], item)
+	}
+	for _, items := range groups {
+		sort.Strings(items)
+	}
+	return groups
+}
@@ -0,0 +1,473 @@
+package httpapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	m "github.com/kanatohodets/carbonsearch/consumer/message"
+	"github.com/kanatohodets/carbonsearch/database"
+	"github.com/kanatohodets/carbonsearch/util"
+)
+
+var stats = util.InitStats()
+
+func newDatabase() *database.Database {
+	return database.New(100, 1000, "custom", "text", map[string][]string{"fqdn": {"servers", "lb"}}, stats)
+}
+
+func writeMessage(t *testing.T, w *wal, db *database.Database, kind walKind, msg interface{}) {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Write(kind, payload, func() error { return applyRecord(db, kind, payload, time.Time{}) })
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func tempWAL(t *testing.T, config WALConfig) (*wal, func()) {
+	dir, err := ioutil.TempDir("", "carbonsearch-wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Dir = dir
+	w, err := newWAL(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w, func() { os.RemoveAll(dir) }
+}
+
+func TestWALReplay(t *testing.T) {
+	config := WALConfig{Fsync: "always", SegmentSize: 200, CompactAfter: 1000}
+	w, cleanup := tempWAL(t, config)
+	defer cleanup()
+
+	db := newDatabase()
+	err := w.Replay(db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		host := fmt.Sprintf("host%d.example.com", i)
+		writeMessage(t, w, db, walMetric, &m.KeyMetric{Key: "fqdn", Value: host, Metrics: []string{"server." + host + ".cpu"}})
+		writeMessage(t, w, db, walTag, &m.KeyTag{Key: "fqdn", Value: host, Tags: []string{"servers-dc:lhr", "lb-pool:www"}})
+	}
+	writeMessage(t, w, db, walCustom, &m.TagMetric{Tags: []string{"custom-favorites:btyler"}, Metrics: []string{"monitors.was_the_site_up"}})
+	writeMessage(t, w, db, walDeleteTag, &m.KeyTag{Key: "fqdn", Value: "host1.example.com", Tags: []string{"lb-pool:www"}})
+	writeMessage(t, w, db, walDeleteJoin, &m.Join{Key: "fqdn", Value: "host2.example.com"})
+
+	// rejected by the database, so it shouldn't be replayed either
+	payload := []byte(`{"Key": "nope", "Value": "host1.example.com", "Tags": ["servers-dc:ams"]}`)
+	err = w.Write(walTag, payload, func() error { return applyRecord(db, walTag, payload, time.Time{}) })
+	if err == nil {
+		t.Errorf("wal: a message the database rejects should be an error")
+	}
+	// the database would take this one on replay, but it was aborted
+	payload = []byte(`{"Key": "fqdn", "Value": "host3.example.com", "Tags": ["servers-dc:ams"]}`)
+	err = w.Write(walTag, payload, func() error { return fmt.Errorf("rejected") })
+	if err == nil {
+		t.Errorf("wal: a message that fails to apply should be an error")
+	}
+
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	segments, err := w.segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) < 3 {
+		t.Errorf("wal: expected the log to be split into several segments, got %v", segments)
+	}
+
+	// half a record, like a crash in the middle of a write
+	last, err := os.OpenFile(w.segmentPath(segments[len(segments)-1]), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last.Write(encodeRecord(walRecord{kind: walCustom, lsn: 100, payload: []byte(`{"Tags": ["custom-favorites:nope"]}`)})[:10])
+	last.Close()
+
+	replayed := newDatabase()
+	reopened, err := newWAL(WALConfig{Dir: w.dir, Fsync: "always", SegmentSize: 200, CompactAfter: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	err = reopened.Replay(replayed, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected, table := db.TableOfContents(), replayed.TableOfContents(); !reflect.DeepEqual(expected, table) {
+		t.Errorf("wal: replayed table of contents expected %v, got %v", expected, table)
+	}
+}
+
+func TestWALCompaction(t *testing.T) {
+	w, cleanup := tempWAL(t, WALConfig{Fsync: "never", SegmentSize: 1, CompactAfter: 1000})
+	defer cleanup()
+	written := time.Unix(1500000000, 0)
+	w.now = func() time.Time { return written }
+
+	// as if from another consumer
+	fromKafka := &m.KeyMetric{Key: "fqdn", Value: "bazhost", Metrics: []string{"server.bazhost.cpu", "server.bazhost.mem"}}
+	db := newDatabase()
+	err := db.InsertMetrics(fromKafka)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Replay(db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeMessage(t, w, db, walMetric, &m.KeyMetric{Key: "fqdn", Value: "foohost", Metrics: []string{"server.foohost.cpu", "server.foohost.disk"}})
+	writeMessage(t, w, db, walMetric, &m.KeyMetric{Key: "fqdn", Value: "foohost", Metrics: []string{"server.foohost.load"}, Replace: true})
+	writeMessage(t, w, db, walTag, &m.KeyTag{Key: "fqdn", Value: "foohost", Tags: []string{"servers-dc:lhr", "servers-hw:shiny"}})
+	writeMessage(t, w, db, walTag, &m.KeyTag{Key: "fqdn", Value: "foohost", Tags: []string{"servers-dc:ams"}})
+	writeMessage(t, w, db, walMetric, &m.KeyMetric{Key: "fqdn", Value: "barhost", Metrics: []string{"server.barhost.cpu"}})
+	writeMessage(t, w, db, walTag, &m.KeyTag{Key: "fqdn", Value: "barhost", Tags: []string{"servers-dc:lhr"}})
+	writeMessage(t, w, db, walDeleteJoin, &m.Join{Key: "fqdn", Value: "barhost"})
+	writeMessage(t, w, db, walCustom, &m.TagMetric{Tags: []string{"custom-favorites:btyler"}, Metrics: []string{"server.foohost.load", "server.barhost.cpu"}})
+	writeMessage(t, w, db, walDeleteCustom, &m.TagMetric{Tags: []string{"custom-favorites:btyler"}, Metrics: []string{"server.barhost.cpu"}})
+	writeMessage(t, w, db, walDeleteMetric, &m.KeyMetric{Key: "fqdn", Value: "bazhost", Metrics: []string{"server.bazhost.cpu"}})
+	// undone by the insert after it
+	writeMessage(t, w, db, walDeleteTag, &m.KeyTag{Key: "fqdn", Value: "foohost", Tags: []string{"servers-hw:shiny"}})
+	writeMessage(t, w, db, walTag, &m.KeyTag{Key: "fqdn", Value: "foohost", Tags: []string{"servers-hw:shiny"}})
+
+	err = w.compact(w.activeSeq-1, w.nextLSN-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	segments, err := w.segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the compacted one and the empty active one
+	if len(segments) != 2 || !isCompacted(w.segmentPath(segments[0])) {
+		t.Errorf("wal: expected a compacted segment and the active one, got %v", segments)
+	}
+
+	state := newWALState()
+	readSegment(w.segmentPath(segments[0]), state.apply)
+	// by the sequence number of the message that last wrote each thing
+	stamp := func(lsn uint64) walStamp { return walStamp{lsn: lsn, written: written.Unix()} }
+	expected := newWALState()
+	expected.metrics[m.Join{Key: "fqdn", Value: "foohost"}] = map[string]walStamp{"server.foohost.load": stamp(2)}
+	expected.tags[m.Join{Key: "fqdn", Value: "foohost"}] = map[string]walTags{
+		"servers-dc": {values: []string{"servers-dc:ams"}, stamp: stamp(4)},
+		"servers-hw": {values: []string{"servers-hw:shiny"}, stamp: stamp(12)},
+	}
+	expected.custom["custom-favorites:btyler"] = map[string]walStamp{"server.foohost.load": stamp(8)}
+	expected.deletedJoins[m.Join{Key: "fqdn", Value: "barhost"}] = stamp(7)
+	expected.deletedMetrics[m.Join{Key: "fqdn", Value: "bazhost"}] = map[string]walStamp{"server.bazhost.cpu": stamp(10)}
+	expected.deletedCustom["custom-favorites:btyler"] = map[string]walStamp{"server.barhost.cpu": stamp(9)}
+	if !reflect.DeepEqual(expected, state) {
+		t.Errorf("wal: compacted state expected %+v, got %+v", expected, state)
+	}
+
+	replayed := newDatabase()
+	err = replayed.InsertMetrics(fromKafka)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := newWAL(WALConfig{Dir: w.dir, Fsync: "never"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	err = reopened.Replay(replayed, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, table := db.TableOfContents(), replayed.TableOfContents(); !reflect.DeepEqual(expected, table) {
+		t.Errorf("wal: table of contents after compaction expected %v, got %v", expected, table)
+	}
+}
+
+func TestWALCompactionExpiry(t *testing.T) {
+	w, cleanup := tempWAL(t, WALConfig{Fsync: "never", SegmentSize: 1, CompactAfter: 1000})
+	defer cleanup()
+	clock := time.Unix(1500000000, 0)
+	w.now = func() time.Time { return clock }
+
+	db := newDatabase()
+	err := db.EnableExpiry(map[string]time.Duration{"fqdn": time.Hour}, map[string]time.Duration{"lb": 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Replay(db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeMessage(t, w, db, walMetric, &m.KeyMetric{Key: "fqdn", Value: "foohost", Metrics: []string{"server.foohost.cpu", "server.foohost.mem"}})
+	writeMessage(t, w, db, walTag, &m.KeyTag{Key: "fqdn", Value: "foohost", Tags: []string{"servers-dc:lhr", "lb-pool:www"}})
+	writeMessage(t, w, db, walCustom, &m.TagMetric{Tags: []string{"custom-favorites:btyler"}, Metrics: []string{"server.foohost.cpu"}})
+
+	clock = clock.Add(2 * time.Hour)
+	fresh := clock.Unix()
+	writeMessage(t, w, db, walMetric, &m.KeyMetric{Key: "fqdn", Value: "foohost", Metrics: []string{"server.foohost.mem"}})
+
+	err = w.compact(w.activeSeq-1, w.nextLSN-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	segments, err := w.segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := newWALState()
+	readSegment(w.segmentPath(segments[0]), state.apply)
+
+	// the lb service never expires, and the custom tags have no TTL
+	expected := newWALState()
+	expected.metrics[m.Join{Key: "fqdn", Value: "foohost"}] = map[string]walStamp{"server.foohost.mem": {lsn: 4, written: fresh}}
+	expected.tags[m.Join{Key: "fqdn", Value: "foohost"}] = map[string]walTags{
+		"lb-pool": {values: []string{"lb-pool:www"}, stamp: walStamp{lsn: 2, written: fresh - 2*60*60}},
+	}
+	expected.custom["custom-favorites:btyler"] = map[string]walStamp{"server.foohost.cpu": {lsn: 3, written: fresh - 2*60*60}}
+	if !reflect.DeepEqual(expected, state) {
+		t.Errorf("wal: compacted state expected %+v, got %+v", expected, state)
+	}
+}
+
+// concurrent messages are applied in the order they're in the log
+func TestWALWriteOrder(t *testing.T) {
+	w, cleanup := tempWAL(t, WALConfig{Fsync: "never", SegmentSize: 1 << 20, CompactAfter: 1000})
+	defer cleanup()
+	err := w.Replay(newDatabase(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	applied := []string{}
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			payload := []byte(fmt.Sprintf(`{"Tags": ["custom-favorites:%d"]}`, i))
+			err := w.Write(walCustom, payload, func() error {
+				applied = append(applied, string(payload))
+				return nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	logged := []string{}
+	_, err = readSegment(w.segmentPath(w.activeSeq), func(record walRecord) {
+		logged = append(logged, string(record.payload))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(logged, applied) {
+		t.Errorf("wal: messages were applied in a different order than they were logged: %v, %v", logged, applied)
+	}
+
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// a WAL resumes from the position saved in a snapshot
+func TestWALResume(t *testing.T) {
+	w, cleanup := tempWAL(t, WALConfig{Fsync: "never", SegmentSize: 1, CompactAfter: 1000})
+	defer cleanup()
+
+	db := newDatabase()
+	err := w.Replay(db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeMessage(t, w, db, walMetric, &m.KeyMetric{Key: "fqdn", Value: "foohost", Metrics: []string{"server.foohost.cpu"}})
+	writeMessage(t, w, db, walDeleteMetric, &m.KeyMetric{Key: "fqdn", Value: "bazhost", Metrics: []string{"server.bazhost.cpu"}})
+	// as if from another consumer. replaying the deletion again would undo it
+	err = db.InsertMetrics(&m.KeyMetric{Key: "fqdn", Value: "bazhost", Metrics: []string{"server.bazhost.cpu"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	position := w.Position()
+	var snap bytes.Buffer
+	err = db.Snapshot(&snap, database.Positions{"httpapi": {walTopic: {walPartition: int64(position)}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeMessage(t, w, db, walMetric, &m.KeyMetric{Key: "fqdn", Value: "foohost", Metrics: []string{"server.foohost.mem"}})
+	writeMessage(t, w, db, walTag, &m.KeyTag{Key: "fqdn", Value: "foohost", Tags: []string{"servers-dc:lhr"}})
+	// compacted, too: what's in the compacted segment keeps its number
+	err = w.compact(w.activeSeq-1, w.nextLSN-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := newDatabase()
+	positions, err := loaded.LoadSnapshot(&snap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := newWAL(WALConfig{Dir: w.dir, Fsync: "never"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	err = reopened.Replay(loaded, uint64(positions["httpapi"][walTopic][walPartition]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, table := db.TableOfContents(), loaded.TableOfContents(); !reflect.DeepEqual(expected, table) {
+		t.Errorf("wal: resumed table of contents expected %v, got %v", expected, table)
+	}
+	expectedMetrics, metrics := db.MetricList(), loaded.MetricList()
+	sort.Strings(expectedMetrics)
+	sort.Strings(metrics)
+	if !reflect.DeepEqual(expectedMetrics, metrics) {
+		t.Errorf("wal: resumed metrics expected %v, got %v", expectedMetrics, metrics)
+	}
+	if reopened.Position() != 4 {
+		t.Errorf("wal: expected to carry on after message 4, got %d", reopened.Position())
+	}
+
+	// without a position, a warm database gets nothing from the log
+	skipped, err := newWAL(WALConfig{Dir: w.dir, Fsync: "never"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer skipped.Close()
+	warm := newDatabase()
+	err = warm.InsertMetrics(&m.KeyMetric{Key: "fqdn", Value: "barhost", Metrics: []string{"server.barhost.cpu"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := warm.TableOfContents()
+	err = skipped.Skip(warm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table := warm.TableOfContents(); !reflect.DeepEqual(expected, table) {
+		t.Errorf("wal: skipping replay expected %v, got %v", expected, table)
+	}
+}
+
+// replayed messages expire from when they were written, not when they were
+// replayed
+func TestWALReplayKeepsWriteTimes(t *testing.T) {
+	w, cleanup := tempWAL(t, WALConfig{Fsync: "never", CompactAfter: 1000})
+	defer cleanup()
+	w.now = func() time.Time { return time.Now().Add(-2 * time.Hour) }
+
+	err := w.Replay(newDatabase(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := newDatabase()
+	writeMessage(t, w, db, walMetric, &m.KeyMetric{Key: "fqdn", Value: "foohost", Metrics: []string{"server.foohost.cpu"}})
+	writeMessage(t, w, db, walTag, &m.KeyTag{Key: "fqdn", Value: "foohost", Tags: []string{"servers-dc:lhr"}})
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replayed := newDatabase()
+	err = replayed.EnableExpiry(map[string]time.Duration{"fqdn": time.Hour}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := newWAL(WALConfig{Dir: w.dir, Fsync: "never"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	err = reopened.Replay(replayed, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayed.MaterializeIndexes()
+
+	expected := map[string]map[string]map[string]map[string]int{
+		"full index": {"custom": {}},
+		"fqdn":       {"servers": {}, "lb": {}},
+	}
+	if table := replayed.TableOfContents(); !reflect.DeepEqual(expected, table) {
+		t.Errorf("wal: expected everything replayed to expire, got %v", table)
+	}
+}
+
+// a segment that can't be started leaves the old one taking messages
+func TestWALRotateFailure(t *testing.T) {
+	w, cleanup := tempWAL(t, WALConfig{Fsync: "always", SegmentSize: 1, CompactAfter: 1000})
+	defer cleanup()
+	db := newDatabase()
+	err := w.Replay(db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// in the way of the next segment
+	blocked := w.segmentPath(w.activeSeq + 1)
+	err = os.Mkdir(blocked, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	active := w.activeSeq
+	writeMessage(t, w, db, walMetric, &m.KeyMetric{Key: "fqdn", Value: "foohost", Metrics: []string{"server.foohost.cpu"}})
+	writeMessage(t, w, db, walTag, &m.KeyTag{Key: "fqdn", Value: "foohost", Tags: []string{"servers-dc:lhr"}})
+	if w.activeSeq != active {
+		t.Errorf("wal: expected segment %d to stay active, got %d", active, w.activeSeq)
+	}
+
+	os.Remove(blocked)
+	writeMessage(t, w, db, walTag, &m.KeyTag{Key: "fqdn", Value: "foohost", Tags: []string{"servers-dc:ams"}})
+	if w.activeSeq == active {
+		t.Errorf("wal: expected a new segment once it could be opened")
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replayed := newDatabase()
+	reopened, err := newWAL(WALConfig{Dir: w.dir, Fsync: "never"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	err = reopened.Replay(replayed, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, table := db.TableOfContents(), replayed.TableOfContents(); !reflect.DeepEqual(expected, table) {
+		t.Errorf("wal: replayed table of contents expected %v, got %v", expected, table)
+	}
+}
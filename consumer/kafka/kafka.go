@@ -38,6 +38,14 @@ type Consumer struct {
 
 	progress    map[string]map[int32]float32
 	progressMut sync.Mutex
+
+	// the next offset of each partition: every message before it is in the
+	// Database
+	offsets    map[string]map[int32]int64
+	offsetsMut sync.Mutex
+	// offsets to start from instead of initialOffset, from a previous process
+	resume  map[string]map[int32]int64
+	readers sync.WaitGroup
 }
 
 // New reads the kafka consumer config at the given path, and returns an initialized consumer, ready to Start.
@@ -71,6 +79,7 @@ func New(configPath string, stats *util.Stats) (*Consumer, error) {
 
 	// map[topic]map[partition]progress%
 	progress := map[string]map[int32]float32{}
+	offsets := map[string]map[int32]int64{}
 	partitionsByTopic := make(map[string][]int32)
 	for topic := range config.TopicMapping {
 		//NOTE(btyler) always fetching all partitions
@@ -81,6 +90,7 @@ func New(configPath string, stats *util.Stats) (*Consumer, error) {
 		partitionsByTopic[topic] = partitionList
 
 		progress[topic] = map[int32]float32{}
+		offsets[topic] = map[int32]int64{}
 		for _, partition := range partitionList {
 			progress[topic][partition] = 0
 		}
@@ -97,6 +107,8 @@ func New(configPath string, stats *util.Stats) (*Consumer, error) {
 
 		progress:    progress,
 		progressMut: sync.Mutex{},
+
+		offsets: offsets,
 	}, nil
 }
 
@@ -135,7 +147,7 @@ func (k *Consumer) WaitUntilWarm(wg *sync.WaitGroup) error {
 func (k *Consumer) Start(db *database.Database) error {
 	for topic, partitionList := range k.partitionsByTopic {
 		for _, partition := range partitionList {
-			pc, err := k.consumer.ConsumePartition(topic, partition, k.initialOffset)
+			pc, err := k.consumePartition(topic, partition)
 			if err != nil {
 				close(k.shutdown)
 				return fmt.Errorf("kafka consumer: Failed to start consumer of topic %s for partition %d: %s", topic, partition, err)
@@ -151,44 +163,97 @@ func (k *Consumer) Start(db *database.Database) error {
 			}(pc)
 
 			k.trackPosition(topic, partition, 0, 0, pc.HighWaterMarkOffset())
+			var read func(sarama.PartitionConsumer, *database.Database)
 			switch k.topicMapping[topic] {
 			case "metric":
-				go k.readMetric(pc, db)
+				read = k.readMetric
 			case "tag":
-				go k.readTag(pc, db)
+				read = k.readTag
 			case "custom":
-				go k.readCustom(pc, db)
+				read = k.readCustom
+			case "link":
+				read = k.readLink
+			case "delete-tag", "delete-metric", "delete-custom", "delete-join":
+				panic(fmt.Sprintf("Topic %s is mapped to %q in the kafka consumer config file, but deletions aren't a topic of their own: nothing would order them against the messages they delete. Send them on the 'tag', 'metric' or 'custom' topic instead, with \"delete\": true", topic, k.topicMapping[topic]))
 			default:
-				panic(fmt.Sprintf("There's no topic mapping for %s in the kafka consumer config file. Topic mappings can be 'metric', 'tag', or 'custom'", topic))
+				panic(fmt.Sprintf("There's no topic mapping for %s in the kafka consumer config file. Topic mappings can be 'metric', 'tag', 'custom', or 'link'", topic))
 			}
+
+			k.readers.Add(1)
+			go func(pc sarama.PartitionConsumer) {
+				defer k.readers.Done()
+				read(pc, db)
+			}(pc)
 		}
 	}
 	return nil
 }
 
-// Stop halts the consumer. Note: calling Stop and then later calling Start on the same consumer is undefined.
+// Stop halts the consumer, once the messages being read are in the Database.
+// Note: calling Stop and then later calling Start on the same consumer is undefined.
 func (k *Consumer) Stop() error {
 	close(k.shutdown)
+	k.readers.Wait()
 	return k.consumer.Close()
 }
 
+// Position returns the offset of each partition to resume from. Everything
+// before it is already in the Database, so it can be taken while reading, to
+// go along with a snapshot, or after Stop.
+func (k *Consumer) Position() map[string]map[int32]int64 {
+	k.offsetsMut.Lock()
+	defer k.offsetsMut.Unlock()
+
+	position := make(map[string]map[int32]int64, len(k.offsets))
+	for topic, partitions := range k.offsets {
+		position[topic] = make(map[int32]int64, len(partitions))
+		for partition, offset := range partitions {
+			position[topic][partition] = offset
+		}
+	}
+	return position
+}
+
+// ResumeFrom makes Start read from the given offsets (as returned by Position)
+// rather than the configured one. It must be called before Start.
+func (k *Consumer) ResumeFrom(position map[string]map[int32]int64) {
+	k.resume = position
+}
+
+func (k *Consumer) consumePartition(topic string, partition int32) (sarama.PartitionConsumer, error) {
+	offset, ok := k.resume[topic][partition]
+	if !ok {
+		return k.consumer.ConsumePartition(topic, partition, k.initialOffset)
+	}
+
+	pc, err := k.consumer.ConsumePartition(topic, partition, offset)
+	if err != nil {
+		logger.Logf("kafka consumer: could not resume topic %s partition %d from offset %d, starting from the configured offset instead: %v", topic, partition, offset, err)
+		return k.consumer.ConsumePartition(topic, partition, k.initialOffset)
+	}
+	k.offsetsMut.Lock()
+	k.offsets[topic][partition] = offset
+	k.offsetsMut.Unlock()
+	return pc, nil
+}
+
 // Name returns the name of the consumer
 func (k *Consumer) Name() string {
 	return "kafka"
 }
 
 func (k *Consumer) readMetric(pc sarama.PartitionConsumer, db *database.Database) {
-	var initialOffset int64 = sarama.OffsetOldest
-	for kafkaMsg := range pc.Messages() {
-		if initialOffset == sarama.OffsetOldest {
-			initialOffset = kafkaMsg.Offset
-		}
-		k.trackPosition(kafkaMsg.Topic, kafkaMsg.Partition, initialOffset, kafkaMsg.Offset, pc.HighWaterMarkOffset())
+	k.consume(pc, func(kafkaMsg *sarama.ConsumerMessage) {
 		var msg *m.KeyMetric
 		if err := json.Unmarshal(kafkaMsg.Value, &msg); err != nil {
 			logger.Logln("ermg decoding problem :( ", err)
-			continue
+			return
 		}
+		if msg.Delete {
+			deleteMetrics(db, msg)
+			return
+		}
+
 		// TODO(btyler): fix malformed messages and let this get caught by database validation
 		if msg.Value != "" && len(msg.Metrics) != 0 {
 			err := db.InsertMetrics(msg)
@@ -196,20 +261,23 @@ func (k *Consumer) readMetric(pc sarama.PartitionConsumer, db *database.Database
 				logger.Logf("kafka consumer: could not insert metrics: %v", err)
 			}
 		}
-	}
+	})
 }
 
 func (k *Consumer) readTag(pc sarama.PartitionConsumer, db *database.Database) {
-	var initialOffset int64 = sarama.OffsetOldest
-	for kafkaMsg := range pc.Messages() {
-		if initialOffset == sarama.OffsetOldest {
-			initialOffset = kafkaMsg.Offset
-		}
-		k.trackPosition(kafkaMsg.Topic, kafkaMsg.Partition, initialOffset, kafkaMsg.Offset, pc.HighWaterMarkOffset())
+	k.consume(pc, func(kafkaMsg *sarama.ConsumerMessage) {
 		var msg *m.KeyTag
 		if err := json.Unmarshal(kafkaMsg.Value, &msg); err != nil {
 			logger.Logln("ermg decoding problem :( ", err)
-			continue
+			return
+		}
+
+		if msg.Delete {
+			err := db.DeleteTags(msg)
+			if err != nil {
+				logger.Logf("kafka consumer: could not delete tags: %v", err)
+			}
+			return
 		}
 
 		// TODO(btyler): fix malformed messages and let this get caught by database validation
@@ -219,20 +287,23 @@ func (k *Consumer) readTag(pc sarama.PartitionConsumer, db *database.Database) {
 				logger.Logf("kafka consumer: could not insert tags: %v", err)
 			}
 		}
-	}
+	})
 }
 
 func (k *Consumer) readCustom(pc sarama.PartitionConsumer, db *database.Database) {
-	var initialOffset int64 = sarama.OffsetOldest
-	for kafkaMsg := range pc.Messages() {
-		if initialOffset == sarama.OffsetOldest {
-			initialOffset = kafkaMsg.Offset
-		}
-		k.trackPosition(kafkaMsg.Topic, kafkaMsg.Partition, initialOffset, kafkaMsg.Offset, pc.HighWaterMarkOffset())
+	k.consume(pc, func(kafkaMsg *sarama.ConsumerMessage) {
 		var msg *m.TagMetric
 		if err := json.Unmarshal(kafkaMsg.Value, &msg); err != nil {
 			logger.Logln("ermg decoding problem :( ", err)
-			continue
+			return
+		}
+
+		if msg.Delete {
+			err := db.DeleteCustom(msg)
+			if err != nil {
+				logger.Logf("kafka consumer: could not delete custom associations: %v", err)
+			}
+			return
 		}
 
 		// TODO(btyler): fix malformed messages and let this get caught by database validation
@@ -242,6 +313,59 @@ func (k *Consumer) readCustom(pc sarama.PartitionConsumer, db *database.Database
 				logger.Logf("kafka consumer: could not insert custom associations: %v", err)
 			}
 		}
+	})
+}
+
+func (k *Consumer) readLink(pc sarama.PartitionConsumer, db *database.Database) {
+	k.consume(pc, func(kafkaMsg *sarama.ConsumerMessage) {
+		var msg *m.KeyLink
+		if err := json.Unmarshal(kafkaMsg.Value, &msg); err != nil {
+			logger.Logln("ermg decoding problem :( ", err)
+			return
+		}
+
+		err := db.InsertLinks(msg)
+		if err != nil {
+			logger.Logf("kafka consumer: could not insert links: %v", err)
+		}
+	})
+}
+
+// deleteMetrics removes metrics from a join, or the whole join if the message
+// doesn't list any. Deletions come on the same topic (and so, keyed by join,
+// the same partition) as the messages they undo, which keeps them in order.
+func deleteMetrics(db *database.Database, msg *m.KeyMetric) {
+	if len(msg.Metrics) == 0 {
+		err := db.DeleteJoin(&m.Join{Key: msg.Key, Value: msg.Value})
+		if err != nil {
+			logger.Logf("kafka consumer: could not delete join: %v", err)
+		}
+		return
+	}
+
+	err := db.DeleteMetrics(msg)
+	if err != nil {
+		logger.Logf("kafka consumer: could not delete metrics: %v", err)
+	}
+}
+
+// consume reads the messages of a partition, handing each one to apply. The
+// offset to resume from only moves past a message once apply is done with it,
+// so that a position taken before a snapshot never skips a message the
+// snapshot doesn't have.
+func (k *Consumer) consume(pc sarama.PartitionConsumer, apply func(*sarama.ConsumerMessage)) {
+	var initialOffset int64 = sarama.OffsetOldest
+	for kafkaMsg := range pc.Messages() {
+		if initialOffset == sarama.OffsetOldest {
+			initialOffset = kafkaMsg.Offset
+		}
+		k.trackPosition(kafkaMsg.Topic, kafkaMsg.Partition, initialOffset, kafkaMsg.Offset, pc.HighWaterMarkOffset())
+
+		apply(kafkaMsg)
+
+		k.offsetsMut.Lock()
+		k.offsets[kafkaMsg.Topic][kafkaMsg.Partition] = kafkaMsg.Offset + 1
+		k.offsetsMut.Unlock()
 	}
 }
 
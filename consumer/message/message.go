@@ -4,15 +4,41 @@ type KeyMetric struct {
 	Key     string
 	Value   string
 	Metrics []string
+	// replace all of the join's metrics, rather than adding to them
+	Replace bool
+	// remove Metrics from the join instead. without any Metrics, remove
+	// everything about the join: its metrics, tags and links
+	Delete bool
 }
 
 type KeyTag struct {
 	Key   string
 	Value string
 	Tags  []string
+	// replace all of the join's tags, rather than only the keys in Tags
+	Replace bool
+	// remove Tags from the join instead
+	Delete bool
+}
+
+// KeyLink links a value of a join key to values of another join key, as
+// configured for its split index (for example, an IP to hostnames)
+type KeyLink struct {
+	Key   string
+	Value string
+	Links []string
 }
 
 type TagMetric struct {
 	Tags    []string
 	Metrics []string
+	// remove the associations instead
+	Delete bool
+}
+
+// Join is a single value of a join key, for deleting everything carbonsearch
+// knows about it
+type Join struct {
+	Key   string
+	Value string
 }
@@ -0,0 +1,159 @@
+package database
+
+import (
+	"container/list"
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/kanatohodets/carbonsearch/util"
+)
+
+/*
+	the query cache remembers query results until the indexes change.
+
+	dashboards ask for the same handful of queries every few seconds, but the
+	indexes only change when MaterializeIndexes runs. So the cache key is the
+	normalized query plus the generation of the view the query runs against
+	(see view.go): once the indexes rotate, the old entries simply stop being
+	asked for and fall out of the LRU.
+
+	identical queries that arrive while one is already running wait for that
+	one to finish instead of evaluating the query again.
+*/
+
+type queryCache struct {
+	size  int
+	stats *util.Stats
+
+	mut      sync.Mutex
+	entries  map[string]*list.Element
+	lru      *list.List // of *cacheEntry, most recently used at the front
+	inFlight map[string]*inFlightQuery
+}
+
+type cacheEntry struct {
+	key     string
+	metrics []string
+}
+
+type inFlightQuery struct {
+	wg      sync.WaitGroup
+	metrics []string
+	err     error
+}
+
+func newQueryCache(size int, stats *util.Stats) *queryCache {
+	return &queryCache{
+		size:     size,
+		stats:    stats,
+		entries:  map[string]*list.Element{},
+		lru:      list.New(),
+		inFlight: map[string]*inFlightQuery{},
+	}
+}
+
+// get returns the cached result for key, or runs evaluate to produce it.
+// Concurrent calls for the same key share a single call to evaluate. Only
+// successful results are cached, and only if keep says they're worth keeping:
+// e.g. that the indexes haven't changed while evaluate was running.
+//
+// the returned slice is shared between callers, so it must not be modified.
+func (c *queryCache) get(key string, evaluate func() ([]string, error), keep func([]string) bool) ([]string, error) {
+	c.mut.Lock()
+	if elem, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(elem)
+		c.mut.Unlock()
+		c.stats.QueryCacheHits.Add(1)
+		return elem.Value.(*cacheEntry).metrics, nil
+	}
+
+	if call, ok := c.inFlight[key]; ok {
+		c.mut.Unlock()
+		c.stats.QueryCacheCoalesced.Add(1)
+		call.wg.Wait()
+		return call.metrics, call.err
+	}
+
+	call := &inFlightQuery{}
+	call.wg.Add(1)
+	c.inFlight[key] = call
+	c.mut.Unlock()
+	c.stats.QueryCacheMisses.Add(1)
+
+	c.run(key, call, evaluate, keep)
+	return call.metrics, call.err
+}
+
+// run evaluates an in-flight query. However evaluate ends, the query stops
+// being in flight and its waiters are woken up: a panic becomes an error for
+// all of them, rather than leaving them waiting forever.
+func (c *queryCache) run(key string, call *inFlightQuery, evaluate func() ([]string, error), keep func([]string) bool) {
+	defer call.wg.Done()
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Logf("query cache: evaluating %q panicked: %v\n%s", key, r, debug.Stack())
+			call.metrics, call.err = nil, fmt.Errorf("database: evaluating the query failed: %v", r)
+		}
+
+		c.mut.Lock()
+		defer c.mut.Unlock()
+		delete(c.inFlight, key)
+		if call.err == nil && keep(call.metrics) {
+			c.add(key, call.metrics)
+		}
+	}()
+
+	call.metrics, call.err = evaluate()
+}
+
+// add must be called with c.mut held
+func (c *queryCache) add(key string, metrics []string) {
+	if elem, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, metrics: metrics})
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+		c.stats.QueryCacheEvictions.Add(1)
+	}
+}
+
+// EnableQueryCache turns on caching of query results in Evaluate, keeping up
+// to size results. It should be called before the database starts serving
+// queries.
+func (db *Database) EnableQueryCache(size int) {
+	if size <= 0 {
+		return
+	}
+	db.queryCache = newQueryCache(size, db.stats)
+}
+
+// Normalize renders a parsed query so that equivalent queries look the same:
+// the order of tags in an AND or OR doesn't matter.
+func Normalize(node Node) string {
+	switch n := node.(type) {
+	case *AndNode:
+		return "and(" + normalizeChildren(n.Children) + ")"
+	case *OrNode:
+		return "or(" + normalizeChildren(n.Children) + ")"
+	case *NotNode:
+		return "not(" + Normalize(n.Child) + ")"
+	}
+	return node.String()
+}
+
+func normalizeChildren(children []Node) string {
+	rendered := make([]string, len(children))
+	for i, child := range children {
+		rendered[i] = Normalize(child)
+	}
+	sort.Strings(rendered)
+	return strings.Join(rendered, ",")
+}
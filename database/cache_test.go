@@ -0,0 +1,230 @@
+package database
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"testing"
+
+	m "github.com/kanatohodets/carbonsearch/consumer/message"
+)
+
+func TestQueryCache(t *testing.T) {
+	db := New(queryLimit, resultLimit, fullService, textService, splitIndexes, stats)
+	db.EnableQueryCache(2)
+	populateSplitIndex(t, db, "query cache",
+		"fqdn",
+		map[string]map[string][]string{
+			"foohost-4335.staging.example.com": {
+				"metrics": {"server.foohost-4335_staging_example_com.cpu.loadavg"},
+				"tags":    {"servers-hw:shiny", "servers-dc:us_west"},
+			},
+			"quxhost-0003.dev.example.com": {
+				"metrics": {"server.quxhost-0003_dev_example_com.iowait.5m"},
+				"tags":    {"servers-hw:rusty", "servers-dc:us_west"},
+			},
+		},
+	)
+
+	hits, misses, evictions := stats.QueryCacheHits.Value(), stats.QueryCacheMisses.Value(), stats.QueryCacheEvictions.Value()
+	evaluateTest(t, db, "query cache: first query",
+		"servers-dc:us_west.servers-hw:shiny",
+		[]string{"server.foohost-4335_staging_example_com.cpu.loadavg"},
+	)
+	evaluateTest(t, db, "query cache: same query with tags in a different order",
+		"servers-hw:shiny.servers-dc:us_west",
+		[]string{"server.foohost-4335_staging_example_com.cpu.loadavg"},
+	)
+	if got := stats.QueryCacheHits.Value() - hits; got != 1 {
+		t.Errorf("query cache: expected 1 hit, got %d", got)
+	}
+	if got := stats.QueryCacheMisses.Value() - misses; got != 1 {
+		t.Errorf("query cache: expected 1 miss, got %d", got)
+	}
+
+	// new data rotates the indexes, so the cached result must not be used
+	err := db.InsertTags(&m.KeyTag{
+		Key:   "fqdn",
+		Value: "quxhost-0003.dev.example.com",
+		Tags:  []string{"servers-hw:shiny"},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	db.MaterializeIndexes()
+
+	evaluateTest(t, db, "query cache: after rotation",
+		"servers-dc:us_west.servers-hw:shiny",
+		[]string{
+			"server.foohost-4335_staging_example_com.cpu.loadavg",
+			"server.quxhost-0003_dev_example_com.iowait.5m",
+		},
+	)
+	if got := stats.QueryCacheMisses.Value() - misses; got != 2 {
+		t.Errorf("query cache: expected 2 misses after rotation, got %d", got)
+	}
+
+	evaluateTest(t, db, "query cache: another query",
+		"servers-dc:us_west",
+		[]string{
+			"server.foohost-4335_staging_example_com.cpu.loadavg",
+			"server.quxhost-0003_dev_example_com.iowait.5m",
+		},
+	)
+
+	// the cache only has room for 2 results
+	if got := stats.QueryCacheEvictions.Value() - evictions; got != 1 {
+		t.Errorf("query cache: expected 1 eviction, got %d", got)
+	}
+}
+
+func TestQueryCacheResultLimit(t *testing.T) {
+	db := New(queryLimit, resultLimit, fullService, textService, splitIndexes, stats)
+	db.EnableQueryCache(10)
+	metrics := []string{}
+	for i := 0; i <= resultLimit; i++ {
+		metrics = append(metrics, fmt.Sprintf("server.foohost_prod_example_com.cpu%d", i))
+	}
+	populateSplitIndex(t, db, "query cache result limit", "fqdn", map[string]map[string][]string{
+		"foohost.prod.example.com": {
+			"metrics": metrics,
+			"tags":    {"servers-dc:lhr"},
+		},
+	})
+	root, err := db.Parse("servers-dc:lhr")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	hits := stats.QueryCacheHits.Value()
+	for i := 0; i < 2; i++ {
+		page, err := db.EvaluatePage(root, 0, 0)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if page.Total != len(metrics) {
+			t.Errorf("query cache result limit: expected %d metrics, got %d", len(metrics), page.Total)
+		}
+	}
+	if got := stats.QueryCacheHits.Value() - hits; got != 0 {
+		t.Errorf("query cache result limit: a result over the limit shouldn't be cached, but got %d hits", got)
+	}
+}
+
+func TestQueryCacheCoalescing(t *testing.T) {
+	cache := newQueryCache(10, stats)
+	valid := func([]string) bool { return true }
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	evaluations := 0
+	evaluate := func() ([]string, error) {
+		evaluations++
+		close(started)
+		<-release
+		return []string{"monitors.was_the_site_up"}, nil
+	}
+
+	coalesced := stats.QueryCacheCoalesced.Value()
+	var wg sync.WaitGroup
+	results := make([][]string, 5)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		results[0], _ = cache.get("query", evaluate, valid)
+	}()
+	<-started
+
+	for i := 1; i < len(results); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = cache.get("query", evaluate, valid)
+		}(i)
+	}
+
+	// wait for every other query to find the one in flight
+	for stats.QueryCacheCoalesced.Value()-coalesced != int64(len(results)-1) {
+		runtime.Gosched()
+	}
+	close(release)
+	wg.Wait()
+
+	if evaluations != 1 {
+		t.Errorf("query cache coalescing: expected 1 evaluation, got %d", evaluations)
+	}
+	for i, result := range results {
+		if len(result) != 1 || result[0] != "monitors.was_the_site_up" {
+			t.Errorf("query cache coalescing: query %d got %v", i, result)
+		}
+	}
+}
+
+func TestQueryCachePanic(t *testing.T) {
+	cache := newQueryCache(10, stats)
+	valid := func([]string) bool { return true }
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	evaluate := func() ([]string, error) {
+		close(started)
+		<-release
+		panic("broken index")
+	}
+
+	coalesced := stats.QueryCacheCoalesced.Value()
+	errs := make([]error, 2)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, errs[0] = cache.get("query", evaluate, valid)
+	}()
+	<-started
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, errs[1] = cache.get("query", evaluate, valid)
+	}()
+	for stats.QueryCacheCoalesced.Value() == coalesced {
+		runtime.Gosched()
+	}
+	close(release)
+	wg.Wait()
+
+	for i, err := range errs {
+		if err == nil {
+			t.Errorf("query cache panic: query %d should have gotten an error", i)
+		}
+	}
+
+	// the query isn't stuck in flight
+	metrics, err := cache.get("query", func() ([]string, error) {
+		return []string{"monitors.was_the_site_up"}, nil
+	}, valid)
+	if err != nil || len(metrics) != 1 {
+		t.Errorf("query cache panic: the query should be evaluated again, got %v, %v", metrics, err)
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	db := New(queryLimit, resultLimit, fullService, textService, splitIndexes, stats)
+	a, err := db.Parse("(servers-dc:lhr|servers-dc:ams).lb-pool:www.!servers-hw:rusty")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	b, err := db.Parse("!servers-hw:rusty.lb-pool:www.(servers-dc:ams|servers-dc:lhr)")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if Normalize(a) != Normalize(b) {
+		t.Errorf("normalize: expected %v and %v to normalize the same way, got %q and %q", a, b, Normalize(a), Normalize(b))
+	}
+}
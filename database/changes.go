@@ -0,0 +1,93 @@
+package database
+
+import (
+	"github.com/kanatohodets/carbonsearch/index"
+	"github.com/kanatohodets/carbonsearch/index/split"
+	"github.com/kanatohodets/carbonsearch/tag"
+)
+
+/*
+	the write buffer keeps track of what changed since the last
+	materialization, so the split and full indexes only rebuild the posting
+	lists that changed and share the rest with their current generation.
+
+	only changes to the sets matter: writing the same metrics, tags or links
+	again refreshes their timestamps for expiry, but doesn't change the index.
+	nil changes mean the index has to be rebuilt from scratch, as it is the
+	first time and after loading a snapshot.
+*/
+
+// takeChanges returns what changed since it was last called, and starts
+// keeping track from scratch
+func (w *writeBuffer) takeChanges() (map[string]*split.Changes, map[index.Tag]struct{}) {
+	splitChanges, fullChanges := w.splitChanges, w.fullChanges
+
+	w.splitChanges = make(map[string]*split.Changes, len(w.splits))
+	for indexName := range w.splits {
+		w.splitChanges[indexName] = split.NewChanges()
+	}
+	w.fullChanges = map[index.Tag]struct{}{}
+	return splitChanges, fullChanges
+}
+
+// rebuildAll throws away the changes, so that every index is rebuilt from
+// scratch the next time
+func (w *writeBuffer) rebuildAll() {
+	w.splitChanges = nil
+	w.fullChanges = nil
+}
+
+// splitChangesFor returns the changes to a split index, or nil if it's going
+// to be rebuilt anyway
+func (w *writeBuffer) splitChangesFor(indexName string) *split.Changes {
+	if w.splitChanges == nil {
+		return nil
+	}
+	return w.splitChanges[indexName]
+}
+
+func (w *writeBuffer) metricsChanged(indexName string, join split.Join) {
+	if changes := w.splitChangesFor(indexName); changes != nil {
+		changes.Metrics[join] = struct{}{}
+	}
+}
+
+func (w *writeBuffer) linksChanged(indexName string, join split.Join) {
+	if changes := w.splitChangesFor(indexName); changes != nil {
+		changes.Links[join] = struct{}{}
+	}
+}
+
+// joinTagsChanged records which tags a join gained and lost when the values
+// of one of its keys went from oldTags to tags
+func (w *writeBuffer) joinTagsChanged(indexName string, sk tag.ServiceKey, join split.Join, oldTags, tags []index.Tag) {
+	changes := w.splitChangesFor(indexName)
+	if changes == nil {
+		return
+	}
+
+	mark := func(hashedTag index.Tag, has bool) {
+		change, ok := changes.Tags[hashedTag]
+		if !ok {
+			change = &split.TagChange{ServiceKey: sk, Joins: map[split.Join]bool{}}
+			changes.Tags[hashedTag] = change
+		}
+		change.Joins[join] = has
+	}
+	for _, hashedTag := range oldTags {
+		if !containsTag(tags, hashedTag) {
+			mark(hashedTag, false)
+		}
+	}
+	for _, hashedTag := range tags {
+		if !containsTag(oldTags, hashedTag) {
+			mark(hashedTag, true)
+		}
+	}
+}
+
+func (w *writeBuffer) customTagChanged(hashedTag index.Tag) {
+	if w.fullChanges != nil {
+		w.fullChanges[hashedTag] = struct{}{}
+	}
+}
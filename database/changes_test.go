@@ -0,0 +1,153 @@
+package database
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	m "github.com/kanatohodets/carbonsearch/consumer/message"
+	"github.com/kanatohodets/carbonsearch/index"
+	"github.com/kanatohodets/carbonsearch/index/split"
+	"github.com/kanatohodets/carbonsearch/tag"
+)
+
+// indexContents is everything the split and full indexes of a database have,
+// as plain lists of IDs
+type indexContents struct {
+	tags            map[string]map[index.Tag][]uint64
+	metrics         map[string]map[split.Join][]uint64
+	links           map[string]map[split.Join][]uint64
+	numericValues   map[string][]string
+	readableMetrics map[string]uint32
+	full            map[index.Tag][]uint64
+}
+
+func contents(db *Database) indexContents {
+	c := indexContents{
+		tags:            map[string]map[index.Tag][]uint64{},
+		metrics:         map[string]map[split.Join][]uint64{},
+		links:           map[string]map[split.Join][]uint64{},
+		numericValues:   map[string][]string{},
+		readableMetrics: map[string]uint32{},
+		full:            map[index.Tag][]uint64{},
+	}
+	all, _, err := tag.ParseComparison(">-1e300")
+	if err != nil {
+		panic(err)
+	}
+
+	current := db.view()
+	for name, si := range db.splitIndexes {
+		g := current.splits[name]
+		c.tags[name] = map[index.Tag][]uint64{}
+		for t, joins := range g.TagIndex() {
+			c.tags[name][t] = postingsIDs(joins)
+		}
+		c.metrics[name] = map[split.Join][]uint64{}
+		for join, metrics := range g.MetricIndex() {
+			c.metrics[name][join] = postingsIDs(metrics)
+		}
+		c.links[name] = map[split.Join][]uint64{}
+		for join, links := range g.LinkIndex() {
+			c.links[name][join] = postingsIDs(links)
+		}
+		values := g.CompareValues(tag.ServiceKey(db.view().hashers.serviceKeys.Hash("servers-num_cpus")), all)
+		sort.Strings(values)
+		c.numericValues[name] = values
+		c.readableMetrics[name] = si.ReadableMetrics()
+	}
+	for t, metrics := range current.full.Index() {
+		c.full[t] = postingsIDs(metrics)
+	}
+	return c
+}
+
+func postingsIDs(p index.Postings) []uint64 {
+	ids := []uint64{}
+	for it := p.Iter(); !it.End(); it.Next() {
+		ids = append(ids, it.At())
+	}
+	return ids
+}
+
+func TestIncrementalMaterialize(t *testing.T) {
+	linkedSplitIndexes := map[string][]string{
+		"fqdn": {"servers"},
+		"ip":   {"lb", "->fqdn"},
+	}
+	db := New(queryLimit, resultLimit, fullService, textService, linkedSplitIndexes, stats)
+	populateSplitIndex(t, db, "incremental materialize", "fqdn", map[string]map[string][]string{
+		"foohost.prod.example.com": {
+			"metrics": {"server.foohost_prod_example_com.cpu", "server.foohost_prod_example_com.mem"},
+			"tags":    {"servers-dc:lhr", "servers-num_cpus:16"},
+		},
+		"barhost.prod.example.com": {
+			"metrics": {"server.barhost_prod_example_com.cpu"},
+			"tags":    {"servers-dc:ams", "servers-num_cpus:8"},
+		},
+		"bazhost.prod.example.com": {
+			"metrics": {"server.bazhost_prod_example_com.cpu"},
+			"tags":    {"servers-dc:ams", "servers-num_cpus:32"},
+		},
+	})
+	steps := []error{
+		db.InsertLinks(&m.KeyLink{Key: "ip", Value: "10.1.2.3", Links: []string{"foohost.prod.example.com"}}),
+		db.InsertLinks(&m.KeyLink{Key: "ip", Value: "10.1.2.4", Links: []string{"barhost.prod.example.com"}}),
+		db.InsertCustom(&m.TagMetric{Tags: []string{"custom-favorites:yes"}, Metrics: []string{"server.foohost_prod_example_com.cpu"}}),
+		db.InsertCustom(&m.TagMetric{Tags: []string{"custom-team:infra"}, Metrics: []string{"server.barhost_prod_example_com.cpu"}}),
+	}
+	for _, err := range steps {
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	db.MaterializeIndexes()
+	untouched := db.view().full.Index()[index.Tag(db.view().hashers.tags.Hash("custom-team:infra"))]
+	untouchedJoins := db.view().splits["fqdn"].TagIndex()[index.Tag(db.view().hashers.tags.Hash("servers-dc:lhr"))]
+
+	steps = []error{
+		db.InsertTags(&m.KeyTag{Key: "fqdn", Value: "barhost.prod.example.com", Tags: []string{"servers-num_cpus:12"}}),
+		db.InsertMetrics(&m.KeyMetric{Key: "fqdn", Value: "barhost.prod.example.com", Metrics: []string{"server.barhost_prod_example_com.disk"}}),
+		db.DeleteMetrics(&m.KeyMetric{Key: "fqdn", Value: "foohost.prod.example.com", Metrics: []string{"server.foohost_prod_example_com.mem"}}),
+		db.DeleteJoin(&m.Join{Key: "fqdn", Value: "bazhost.prod.example.com"}),
+		db.InsertLinks(&m.KeyLink{Key: "ip", Value: "10.1.2.3", Links: []string{"foohost.prod.example.com", "barhost.prod.example.com"}}),
+		db.DeleteJoin(&m.Join{Key: "ip", Value: "10.1.2.4"}),
+		db.InsertCustom(&m.TagMetric{Tags: []string{"custom-favorites:yes"}, Metrics: []string{"server.barhost_prod_example_com.disk"}}),
+		db.DeleteCustom(&m.TagMetric{Tags: []string{"custom-favorites:yes"}, Metrics: []string{"server.foohost_prod_example_com.cpu"}}),
+		// written again, but not changed
+		db.InsertTags(&m.KeyTag{Key: "fqdn", Value: "foohost.prod.example.com", Tags: []string{"servers-dc:lhr"}}),
+	}
+	for _, err := range steps {
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	db.MaterializeIndexes()
+	incremental := contents(db)
+
+	if reflect.ValueOf(db.view().full.Index()[index.Tag(db.view().hashers.tags.Hash("custom-team:infra"))]).Pointer() != reflect.ValueOf(untouched).Pointer() {
+		t.Errorf("incremental materialize: a custom tag that didn't change should keep its posting list")
+	}
+	joins := db.view().splits["fqdn"].TagIndex()[index.Tag(db.view().hashers.tags.Hash("servers-dc:lhr"))]
+	if reflect.ValueOf(joins).Pointer() != reflect.ValueOf(untouchedJoins).Pointer() {
+		t.Errorf("incremental materialize: a tag that was written again without changing should keep its posting list")
+	}
+
+	db.writeMut.Lock()
+	db.writeBuffer.rebuildAll()
+	db.writeMut.Unlock()
+	db.MaterializeIndexes()
+	rebuilt := contents(db)
+
+	if !reflect.DeepEqual(incremental, rebuilt) {
+		t.Errorf("incremental materialize: the indexes differ from a full rebuild.\nincremental: %+v\nrebuilt: %+v", incremental, rebuilt)
+	}
+
+	queryTest(t, db, "incremental materialize: numeric values", "servers-num_cpus:>10", []string{
+		"server.foohost_prod_example_com.cpu",
+		"server.barhost_prod_example_com.cpu",
+		"server.barhost_prod_example_com.disk",
+	})
+}
@@ -0,0 +1,296 @@
+package database
+
+import (
+	"fmt"
+
+	"github.com/kanatohodets/carbonsearch/index"
+	"github.com/kanatohodets/carbonsearch/index/split"
+	"github.com/kanatohodets/carbonsearch/tag"
+	"github.com/kanatohodets/carbonsearch/util"
+)
+
+/*
+	tags, join keys and service keys are stored as 64-bit hashes, so two of
+	them hashing to the same value would silently become one: two hosts
+	sharing their tags, say. The write buffer keeps every string it has by
+	hash, one dictionary per domain, and checks new strings against it.
+
+	a string that collides with an older one is either rejected (the batch it
+	came in fails), or salted and rehashed until its hash is free. The salted
+	hash is what that string hashes to everywhere from then on, queries
+	included. Salts belong to the database's hashers, not to the process.
+	Metric names are interned rather than hashed, so they can't collide.
+
+	the dictionaries count how many places in the write buffer use each
+	string. Strings that nothing uses anymore, because they were deleted or
+	expired, are forgotten (and unsalted) before the next materialization.
+
+	queries don't use the write buffer's hashers, but a copy of them taken
+	along with the view they run against (see view.go). A string that's
+	unsalted (or salted) keeps hashing the old way for queries until the view
+	without (or with) it is published, with the same atomic store.
+*/
+
+type CollisionPolicy int
+
+const (
+	RejectCollisions CollisionPolicy = iota
+	SaltCollisions
+)
+
+// ParseCollisionPolicy reads a collision policy from the config: "reject" or
+// "salt"
+func ParseCollisionPolicy(policy string) (CollisionPolicy, error) {
+	switch policy {
+	case "", "reject":
+		return RejectCollisions, nil
+	case "salt":
+		return SaltCollisions, nil
+	}
+	return RejectCollisions, fmt.Errorf("database: unknown hash collision policy %q, it should be 'reject' or 'salt'", policy)
+}
+
+// hashers hash the tags, join keys and service keys of a database
+type hashers struct {
+	tags        *util.Hasher
+	joins       *util.Hasher
+	serviceKeys *util.Hasher
+}
+
+func newHashers() hashers {
+	return hashers{
+		tags:        util.NewHasher(),
+		joins:       util.NewHasher(),
+		serviceKeys: util.NewHasher(),
+	}
+}
+
+// snapshot copies the hashers for a view
+func (h hashers) snapshot() hashers {
+	return hashers{
+		tags:        h.tags.Snapshot(),
+		joins:       h.joins.Snapshot(),
+		serviceKeys: h.serviceKeys.Snapshot(),
+	}
+}
+
+// hashDomain is the dictionary of the strings of one domain, by hash
+type hashDomain struct {
+	name    string
+	hasher  *util.Hasher
+	strings map[uint64]string
+	// how many places in the write buffer use each string
+	refs map[uint64]int
+	// strings that weren't used anywhere the last time they were checked
+	unused map[uint64]struct{}
+}
+
+func newHashDomain(name string, hasher *util.Hasher) *hashDomain {
+	return &hashDomain{
+		name:    name,
+		hasher:  hasher,
+		strings: map[uint64]string{},
+		refs:    map[uint64]int{},
+		unused:  map[uint64]struct{}{},
+	}
+}
+
+// record adds a string to the dictionary. Until something refs it, it's
+// unused.
+func (d *hashDomain) record(hash uint64, raw string) {
+	d.strings[hash] = raw
+	d.unused[hash] = struct{}{}
+	if d.hasher.Hash(raw) != hash {
+		d.hasher.SetSalted(raw, hash)
+	}
+}
+
+func (d *hashDomain) ref(hash uint64) {
+	d.refs[hash]++
+}
+
+func (d *hashDomain) unref(hash uint64) {
+	d.refs[hash]--
+	if d.refs[hash] <= 0 {
+		delete(d.refs, hash)
+		d.unused[hash] = struct{}{}
+	}
+}
+
+// sweep forgets the strings that are still unused. It's lazy, rather than
+// part of unref, so that a string can be unreffed and reffed again in the
+// same write without being forgotten in between.
+func (d *hashDomain) sweep() {
+	for hash := range d.unused {
+		if d.refs[hash] > 0 {
+			continue
+		}
+		raw, ok := d.strings[hash]
+		if !ok {
+			continue
+		}
+		delete(d.strings, hash)
+		d.hasher.Unsalt(raw)
+	}
+	d.unused = map[uint64]struct{}{}
+}
+
+// SetCollisionPolicy picks what happens to a tag, join key or service key
+// that hashes to the same value as a different one seen before
+func (db *Database) SetCollisionPolicy(policy CollisionPolicy) {
+	db.writeMut.Lock()
+	defer db.writeMut.Unlock()
+	db.writeBuffer.collisionPolicy = policy
+}
+
+// hashBatch hashes the strings of one write. Nothing is recorded until
+// commit, and only if none of the strings were rejected, so a rejected batch
+// leaves the dictionaries as they were.
+type hashBatch struct {
+	w       *writeBuffer
+	pending map[*hashDomain]*pendingStrings
+	// the first rejected string. once it's set, hash doesn't do anything
+	err error
+}
+
+// pendingStrings are the strings of a batch that their domain doesn't have
+// yet
+type pendingStrings struct {
+	byHash map[uint64]string
+	hashes map[string]uint64
+}
+
+func (w *writeBuffer) newHashBatch() *hashBatch {
+	return &hashBatch{
+		w:       w,
+		pending: map[*hashDomain]*pendingStrings{},
+	}
+}
+
+// hash hashes a string of a domain, checking it against the strings the
+// domain has and the rest of the batch
+func (b *hashBatch) hash(domain *hashDomain, raw string) uint64 {
+	if b.err != nil {
+		return 0
+	}
+
+	pending, ok := b.pending[domain]
+	if !ok {
+		pending = &pendingStrings{byHash: map[uint64]string{}, hashes: map[string]uint64{}}
+		b.pending[domain] = pending
+	}
+	if hash, ok := pending.hashes[raw]; ok {
+		return hash
+	}
+
+	existing := func(hash uint64) (string, bool) {
+		if s, ok := domain.strings[hash]; ok {
+			return s, true
+		}
+		s, ok := pending.byHash[hash]
+		return s, ok
+	}
+
+	hash := domain.hasher.Hash(raw)
+	other, ok := existing(hash)
+	if ok && other == raw {
+		return hash
+	}
+
+	if ok {
+		b.w.stats.HashCollisions.Add(1)
+		if b.w.collisionPolicy == RejectCollisions {
+			logger.Logf("warning: %s %q has the same hash as %q. rejecting it", domain.name, raw, other)
+			b.err = fmt.Errorf("database write buffer: %s %q has the same hash as %q, which was seen first. rejecting it", domain.name, raw, other)
+			return 0
+		}
+
+		hash = domain.hasher.Salt(raw, func(salted uint64) bool {
+			_, taken := existing(salted)
+			return !taken
+		})
+		logger.Logf("warning: %s %q has the same hash as %q. salted it to %d", domain.name, raw, other, hash)
+	}
+
+	pending.byHash[hash] = raw
+	pending.hashes[raw] = hash
+	return hash
+}
+
+func (b *hashBatch) join(rawJoin string) split.Join {
+	return split.Join(b.hash(b.w.joinHashes, rawJoin))
+}
+
+func (b *hashBatch) joins(rawJoins []string) []split.Join {
+	joins := make([]split.Join, len(rawJoins))
+	for i, rawJoin := range rawJoins {
+		joins[i] = b.join(rawJoin)
+	}
+	return joins
+}
+
+func (b *hashBatch) tag(rawTag string) index.Tag {
+	return index.Tag(b.hash(b.w.tagHashes, rawTag))
+}
+
+func (b *hashBatch) tags(rawTags []string) []index.Tag {
+	tags := make([]index.Tag, len(rawTags))
+	for i, rawTag := range rawTags {
+		tags[i] = b.tag(rawTag)
+	}
+	return tags
+}
+
+func (b *hashBatch) serviceKey(rawServiceKey string) tag.ServiceKey {
+	return tag.ServiceKey(b.hash(b.w.serviceKeyHashes, rawServiceKey))
+}
+
+// commit records the new strings of the batch, or returns the error for the
+// string that was rejected
+func (b *hashBatch) commit() error {
+	if b.err != nil {
+		return b.err
+	}
+	for domain, pending := range b.pending {
+		for hash, raw := range pending.byHash {
+			domain.record(hash, raw)
+		}
+	}
+	return nil
+}
+
+// lookupJoin, lookupTag and lookupServiceKey hash strings for deletions:
+// unlike a batch, they don't record anything
+
+func (w *writeBuffer) lookupJoin(rawJoin string) split.Join {
+	return split.Join(w.joinHashes.hasher.Hash(rawJoin))
+}
+
+func (w *writeBuffer) lookupTag(rawTag string) index.Tag {
+	return index.Tag(w.tagHashes.hasher.Hash(rawTag))
+}
+
+func (w *writeBuffer) lookupServiceKey(rawServiceKey string) tag.ServiceKey {
+	return tag.ServiceKey(w.serviceKeyHashes.hasher.Hash(rawServiceKey))
+}
+
+// hashers are the hashers of the write buffer's dictionaries
+func (w *writeBuffer) hashers() hashers {
+	return hashers{
+		tags:        w.tagHashes.hasher,
+		joins:       w.joinHashes.hasher,
+		serviceKeys: w.serviceKeyHashes.hasher,
+	}
+}
+
+// hashDomains are the write buffer's dictionaries
+func (w *writeBuffer) hashDomains() []*hashDomain {
+	return []*hashDomain{w.tagHashes, w.joinHashes, w.serviceKeyHashes}
+}
+
+// sweepHashes forgets the strings nothing uses anymore
+func (w *writeBuffer) sweepHashes() {
+	for _, domain := range w.hashDomains() {
+		domain.sweep()
+	}
+}
@@ -0,0 +1,143 @@
+package database
+
+import (
+	"bytes"
+	"testing"
+
+	m "github.com/kanatohodets/carbonsearch/consumer/message"
+	"github.com/kanatohodets/carbonsearch/index"
+)
+
+// collide makes the write buffer believe another string already has the hash
+// of raw
+func collide(domain *hashDomain, raw string) {
+	domain.record(domain.hasher.Hash(raw), raw+"-but-different")
+	domain.ref(domain.hasher.Hash(raw))
+}
+
+func TestRejectCollisions(t *testing.T) {
+	db := New(queryLimit, resultLimit, fullService, textService, splitIndexes, stats)
+	collide(db.writeBuffer.tagHashes, "custom-favorites:rejected")
+	collide(db.writeBuffer.joinHashes, "rejected.prod.example.com")
+
+	before := stats.HashCollisions.Value()
+	err := db.InsertCustom(&m.TagMetric{
+		Tags:    []string{"custom-favorites:fine", "custom-favorites:rejected"},
+		Metrics: []string{"monitors.was_the_site_up"},
+	})
+	if err == nil {
+		t.Errorf("reject collisions: a colliding tag should be an error")
+	}
+	err = db.InsertMetrics(&m.KeyMetric{Key: "fqdn", Value: "rejected.prod.example.com", Metrics: []string{"server.rejected_prod_example_com.cpu"}})
+	if err == nil {
+		t.Errorf("reject collisions: a colliding join key should be an error")
+	}
+	if collisions := stats.HashCollisions.Value() - before; collisions != 2 {
+		t.Errorf("reject collisions: expected to count 2 collisions, got %d", collisions)
+	}
+
+	if _, ok := db.writeBuffer.tagHashes.strings[uint64(index.HashTag("custom-favorites:fine"))]; ok {
+		t.Errorf("reject collisions: the rest of a rejected batch shouldn't be recorded")
+	}
+}
+
+func TestSaltCollisions(t *testing.T) {
+	db := New(queryLimit, resultLimit, fullService, textService, splitIndexes, stats)
+	db.SetCollisionPolicy(SaltCollisions)
+	collide(db.writeBuffer.tagHashes, "custom-favorites:salted")
+	collide(db.writeBuffer.joinHashes, "salted.prod.example.com")
+
+	err := db.InsertCustom(&m.TagMetric{
+		Tags:    []string{"custom-favorites:salted"},
+		Metrics: []string{"monitors.was_the_site_up"},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	populateSplitIndex(t, db, "salt collisions", "fqdn", map[string]map[string][]string{
+		"salted.prod.example.com": {
+			"metrics": {"server.salted_prod_example_com.cpu"},
+			"tags":    {"servers-dc:lhr"},
+		},
+	})
+
+	salted := db.view().hashers.tags.Hash("custom-favorites:salted")
+	if salted == uint64(index.HashTag("custom-favorites:salted")) {
+		t.Errorf("salt collisions: the colliding tag still has its old hash")
+	}
+	evaluateTest(t, db, "salt collisions: salted tag", "custom-favorites:salted", []string{"monitors.was_the_site_up"})
+	evaluateTest(t, db, "salt collisions: salted join key", "servers-dc:lhr", []string{"server.salted_prod_example_com.cpu"})
+
+	if other := New(queryLimit, resultLimit, fullService, textService, splitIndexes, stats); other.view().hashers.tags.Hash("custom-favorites:salted") == salted {
+		t.Errorf("salt collisions: the salt leaked into another database")
+	}
+
+	var snap bytes.Buffer
+	err = db.Snapshot(&snap, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	loaded := New(queryLimit, resultLimit, fullService, textService, splitIndexes, stats)
+	_, err = loaded.LoadSnapshot(bytes.NewReader(snap.Bytes()))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	loaded.MaterializeIndexes()
+	if hash := loaded.view().hashers.tags.Hash("custom-favorites:salted"); hash != salted {
+		t.Errorf("salt collisions: expected the snapshot to keep the salted hash %d, got %d", salted, hash)
+	}
+	evaluateTest(t, loaded, "salt collisions: salted tag after loading", "custom-favorites:salted", []string{"monitors.was_the_site_up"})
+}
+
+func TestForgetUnusedHashes(t *testing.T) {
+	db := New(queryLimit, resultLimit, fullService, textService, splitIndexes, stats)
+	db.SetCollisionPolicy(SaltCollisions)
+	collide(db.writeBuffer.tagHashes, "custom-favorites:salted")
+
+	err := db.InsertCustom(&m.TagMetric{
+		Tags:    []string{"custom-favorites:salted"},
+		Metrics: []string{"monitors.was_the_site_up"},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	populateSplitIndex(t, db, "forget hashes", "fqdn", map[string]map[string][]string{
+		"foohost.prod.example.com": {
+			"metrics": {"server.foohost_prod_example_com.cpu"},
+			"tags":    {"servers-dc:lhr"},
+		},
+	})
+
+	err = db.DeleteCustom(&m.TagMetric{Tags: []string{"custom-favorites:salted"}, Metrics: []string{"monitors.was_the_site_up"}})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = db.DeleteJoin(&m.Join{Key: "fqdn", Value: "foohost.prod.example.com"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	salted := db.view().hashers.tags.Hash("custom-favorites:salted")
+	// swept, but the view that has the tag is still the current one
+	db.expire()
+	if hash := db.view().hashers.tags.Hash("custom-favorites:salted"); hash != salted {
+		t.Errorf("forget hashes: the salt went away before the view without the tag was published")
+	}
+	evaluateTest(t, db, "forget hashes: before materializing", "custom-favorites:salted", []string{"monitors.was_the_site_up"})
+
+	db.MaterializeIndexes()
+
+	w := db.writeBuffer
+	// only the fake string from collide is left
+	if len(w.tagHashes.strings) != 1 || len(w.joinHashes.strings) != 0 || len(w.serviceKeyHashes.strings) != 0 {
+		t.Errorf("forget hashes: expected deleted strings to be forgotten, still have tags %v, join keys %v and service keys %v", w.tagHashes.strings, w.joinHashes.strings, w.serviceKeyHashes.strings)
+	}
+	if hash := db.view().hashers.tags.Hash("custom-favorites:salted"); hash != uint64(index.HashTag("custom-favorites:salted")) {
+		t.Errorf("forget hashes: a forgotten tag should lose its salt")
+	}
+}
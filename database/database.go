@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/dgryski/carbonzipper/mlog"
@@ -41,9 +42,18 @@ type Database struct {
 
 	writeMut    sync.RWMutex
 	writeBuffer *writeBuffer
+	// only one materialization at a time: publishing the metric names changes
+	// which IDs are free, and that only holds the read side of writeMut
+	materializeMut sync.Mutex
 
 	toc *toc.TableOfContents
 
+	// nil unless EnableQueryCache was called
+	queryCache *queryCache
+
+	// the generations of the indexes that queries run against
+	current atomic.Value //*view
+
 	FullIndex *full.Index
 	TextIndex *text.Index
 }
@@ -74,87 +84,149 @@ type Database struct {
 // Query takes a set of "service-tag:value" queries organized by "service".
 // Eg. "service" => [ "service-tag:value", "service-tag:value" ]
 // The appropriate search index is queried for each "service"'s set of queries.
-// The ending set of results is intersected (AND) to produce the final results.
+// Tags with alternation ("service-tag:{a,b}") are resolved as a union inside
+// their index. The ending set of results is intersected (AND) to produce the
+// final results, and then any metrics matching a negated tag
+// ("!service-tag:value") are removed.
+//
+// This is the flat, AND-only form of a query: see Evaluate for the full query
+// language.
 func (db *Database) Query(tagsByService map[string][]string) ([]string, error) {
-	queriesByIndex := map[index.Index]*index.Query{}
-
-	// translate from text queries to index.Query and from text services to index.Index
+	children := []Node{}
 	for service, tags := range tagsByService {
-		mappedIndex, ok := db.serviceToIndex[service]
-		if !ok {
-			logger.Logf("warning: there's no index for service %q. as a result, these tags will be ignored: %v", service, tags)
-			logger.Logln("this means that no tags have been added to the database with this service; the producer has not started yet")
-			continue
-		}
-		q, ok := queriesByIndex[mappedIndex]
-		if ok {
-			q.AddTags(tags)
-		} else {
-			queriesByIndex[mappedIndex] = index.NewQuery(tags)
+		for _, queryTag := range tags {
+			positiveTag, negated := tag.ParseNegation(queryTag)
+			if negated {
+				children = append(children, &NotNode{Child: &TagNode{Service: service, Tag: positiveTag}})
+				continue
+			}
+			children = append(children, &TagNode{Service: service, Tag: queryTag})
 		}
 	}
 
-	// query indexes, take intersection of metrics
-	metricSets := make([][]index.Metric, 0, len(queriesByIndex))
-	for targetIndex, query := range queriesByIndex {
-		metrics, err := targetIndex.Query(query)
+	return db.Evaluate(&AndNode{Children: children})
+}
+
+// expand resolves alternation ('servers-dc:{lhr,ams}') and value globs
+// ('servers-hw:dell*') into the concrete tags they stand for. Globs are
+// resolved using the table of contents as of the view, so they match any value
+// the view's generations have for that key. The boolean result is true if the tags should be
+// treated as a union, rather than a single plain tag.
+func (db *Database) expand(current *view, service string, targetIndex index.Index, queryTag string) ([]string, bool, error) {
+	if service == db.textIndexService && db.TextIndex.IsRegex(queryTag) {
+		return []string{queryTag}, false, nil
+	}
+
+	alternatives, err := tag.Expand(queryTag, db.queryLimit)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// the text index has its own notion of what a search means
+	if service == db.textIndexService {
+		return alternatives, len(alternatives) > 1, nil
+	}
+
+	union := len(alternatives) > 1
+	expanded := make([]string, 0, len(alternatives))
+	for _, alternative := range alternatives {
+		isGlob := tag.IsGlob(alternative)
+		isComparison := tag.IsComparison(alternative)
+		if !isGlob && !isComparison {
+			expanded = append(expanded, alternative)
+			continue
+		}
+
+		union = true
+		s, k, v, err := tag.Parse(alternative)
 		if err != nil {
-			return nil, fmt.Errorf("database: error while querying index %s: %s", targetIndex.Name(), err)
+			return nil, false, err
 		}
 
-		metricSets = append(metricSets, metrics)
-	}
+		if isComparison {
+			values, err := db.compareValues(current, targetIndex, s, k, v)
+			if err != nil {
+				return nil, false, err
+			}
+			for _, value := range values {
+				expanded = append(expanded, s+"-"+k+":"+value)
+			}
+			continue
+		}
 
-	metrics := index.IntersectMetrics(metricSets)
+		matches, err := current.values.MatchValues(targetIndex.Name(), s, k, v)
+		if err != nil {
+			return nil, false, err
+		}
+		expanded = append(expanded, matches...)
+	}
+	return expanded, union, nil
+}
 
-	stringMetrics, err := db.TextIndex.UnmapMetrics(metrics)
-	// TODO(btyler): try to figure out how to annotate this error with better
-	// information, since just seeing a random int64 will not be very handy
+// compareValues resolves a numeric comparison like 'servers-num_cpus:>=16'
+// to the matching values using the split index's numeric value table.
+func (db *Database) compareValues(current *view, targetIndex index.Index, service, key, value string) ([]string, error) {
+	comparison, _, err := tag.ParseComparison(value)
 	if err != nil {
 		return nil, err
 	}
 
-	textQueries, ok := tagsByService[db.textIndexService]
-	if ok {
-		stringMetrics = db.TextIndex.Filter(textQueries, stringMetrics)
+	si, ok := targetIndex.(*split.Index)
+	if !ok {
+		return nil, fmt.Errorf("database: %q uses a numeric comparison, but those are only supported for services in split indexes", service+"-"+key+":"+value)
 	}
 
-	if len(stringMetrics) > db.resultLimit {
-		return nil, fmt.Errorf("database: query selected %d metrics, which is over the limit of %d results in a single query", len(stringMetrics), db.resultLimit)
+	return current.splits[si.Name()].CompareValues(tag.ServiceKey(current.hashers.serviceKeys.Hash(service+"-"+key)), comparison), nil
+}
+
+func (db *Database) parseNegation(service, queryTag string) (string, bool) {
+	stripped, negated := tag.ParseNegation(queryTag)
+	if negated {
+		return stripped, true
+	}
+
+	if service == db.textIndexService && db.textIndexService != "" {
+		s, k, v, err := tag.Parse(queryTag)
+		if err == nil {
+			search, negated := tag.ParseNegation(v)
+			if negated {
+				return s + "-" + k + ":" + search, true
+			}
+		}
 	}
 
-	return stringMetrics, nil
+	return queryTag, false
 }
 
-// if consistency becomes an issue (symptoms: metrics without mappings, or
-// queries with mysteriously lacking metrics), we can put a lock around AddMetrics
-// that globally protects indexes from writes during materialization
-// TODO: do these concurrently, then only do atomic swap when they're all done generating the thing
+// MaterializeIndexes builds a new generation of every index from the write
+// buffer, and then publishes them all together (see view.go)
 func (db *Database) MaterializeIndexes() {
-	db.writeMut.RLock()
-	defer db.writeMut.RUnlock()
+	db.materializeMut.Lock()
+	defer db.materializeMut.Unlock()
 
-	wg := &sync.WaitGroup{}
-	wg.Add(1)
-	go db.TextIndex.Materialize(wg, db.writeBuffer.MetricList())
+	db.expire()
 
-	for name, index := range db.splitIndexes {
-		buf, ok := db.writeBuffer.splits[name]
-		if !ok {
-			panic(fmt.Sprintf("there's an index without a matching write buffer. this is an error in the code that initializes the database/split indexes: it must call writeBuffer.AddSplitIndex(%q)", name))
-		}
-		wg.Add(1)
-		go index.Materialize(wg, buf.joinToMetric, buf.tagToJoin)
-	}
+	db.writeMut.Lock()
+	splitChanges, fullChanges := db.writeBuffer.takeChanges()
+	db.writeMut.Unlock()
 
-	wg.Add(1)
-	go db.FullIndex.Materialize(wg, db.writeBuffer.full)
-	wg.Wait()
+	db.writeMut.RLock()
+	next := db.buildView(splitChanges, fullChanges)
+	db.writeMut.RUnlock()
+
+	db.current.Store(next)
 }
 
 // InsertMetrics TODO:...
 //NOTE(nnuss) -- to me this is logically the right-hand or downstream side of the si
 func (db *Database) InsertMetrics(msg *m.KeyMetric) error {
+	return db.InsertMetricsAt(msg, time.Time{})
+}
+
+// InsertMetricsAt inserts metrics as if they had been written at 'written',
+// for messages that are older than their arrival, like the ones replayed from
+// a log. The zero time means now.
+func (db *Database) InsertMetricsAt(msg *m.KeyMetric, written time.Time) error {
 	if msg.Value == "" {
 		return fmt.Errorf("database: metric batch has an empty join key value")
 	}
@@ -171,7 +243,7 @@ func (db *Database) InsertMetrics(msg *m.KeyMetric) error {
 	validMetrics := db.validateMetrics(msg.Metrics)
 
 	db.writeMut.Lock()
-	err := db.writeBuffer.BufferMetrics(msg.Key, msg.Value, validMetrics)
+	err := db.writeBuffer.BufferMetrics(msg.Key, msg.Value, validMetrics, msg.Replace, db.writeBuffer.writtenAt(written))
 	db.writeMut.Unlock()
 	if err != nil {
 		//TODO(btyler): metric for metric add errors
@@ -186,6 +258,12 @@ func (db *Database) InsertMetrics(msg *m.KeyMetric) error {
 // InsertTags TODO:...
 //NOTE(nnuss) -- to me this is logically the left-hand or upstream side of the si
 func (db *Database) InsertTags(msg *m.KeyTag) error {
+	return db.InsertTagsAt(msg, time.Time{})
+}
+
+// InsertTagsAt inserts tags as if they had been written at 'written' (see
+// InsertMetricsAt)
+func (db *Database) InsertTagsAt(msg *m.KeyTag, written time.Time) error {
 	if msg.Value == "" {
 		return fmt.Errorf("database: tag batch has an empty join key value")
 	}
@@ -207,7 +285,7 @@ func (db *Database) InsertTags(msg *m.KeyTag) error {
 	validTags := db.validateTags(msg.Tags)
 
 	db.writeMut.Lock()
-	err = db.writeBuffer.BufferTags(msg.Key, msg.Value, validTags)
+	err = db.writeBuffer.BufferTags(msg.Key, msg.Value, validTags, msg.Replace, db.writeBuffer.writtenAt(written))
 	db.writeMut.Unlock()
 	if err != nil {
 		//TODO(btyler): metric for tag add errors
@@ -219,8 +297,56 @@ func (db *Database) InsertTags(msg *m.KeyTag) error {
 	return nil
 }
 
+// InsertLinks links a value of a join key to values of the join key that its
+// split index is linked to (as in, an IP to the hostnames using it). Any links
+// from an earlier message for the same value are replaced.
+func (db *Database) InsertLinks(msg *m.KeyLink) error {
+	return db.InsertLinksAt(msg, time.Time{})
+}
+
+// InsertLinksAt inserts links as if they had been written at 'written' (see
+// InsertMetricsAt)
+func (db *Database) InsertLinksAt(msg *m.KeyLink, written time.Time) error {
+	if msg.Value == "" {
+		return fmt.Errorf("database: link batch has an empty join key value")
+	}
+	if len(msg.Links) == 0 {
+		return fmt.Errorf("database: link batch must have at least one link")
+	}
+
+	si, ok := db.splitIndexes[msg.Key]
+	if !ok {
+		return fmt.Errorf("database InsertLinks: no split index for join key %q", msg.Key)
+	}
+	if si.Link() == nil {
+		return fmt.Errorf("database InsertLinks: the split index for join key %q isn't linked to another index. if it should be, add it to carbonsearch.yaml", msg.Key)
+	}
+
+	for _, link := range msg.Links {
+		if link == "" {
+			return fmt.Errorf("database: link batch for %q has an empty link", msg.Value)
+		}
+	}
+
+	db.writeMut.Lock()
+	err := db.writeBuffer.BufferLinks(msg.Key, msg.Value, si.Link().Name(), msg.Links, db.writeBuffer.writtenAt(written))
+	db.writeMut.Unlock()
+	if err != nil {
+		return fmt.Errorf("database: error buffering link batch: %v", err)
+	}
+
+	db.stats.LinkMessages.Add(1)
+	return nil
+}
+
 // InsertCustom makes a custom index association
 func (db *Database) InsertCustom(msg *m.TagMetric) error {
+	return db.InsertCustomAt(msg, time.Time{})
+}
+
+// InsertCustomAt makes a custom index association as if it had been written
+// at 'written' (see InsertMetricsAt)
+func (db *Database) InsertCustomAt(msg *m.TagMetric, written time.Time) error {
 	if len(msg.Metrics) == 0 {
 		return fmt.Errorf("database: custom batch must have at least one metric")
 	}
@@ -237,7 +363,7 @@ func (db *Database) InsertCustom(msg *m.TagMetric) error {
 	validTags := db.validateTags(msg.Tags)
 
 	db.writeMut.Lock()
-	err = db.writeBuffer.BufferCustom(validTags, validMetrics)
+	err = db.writeBuffer.BufferCustom(validTags, validMetrics, db.writeBuffer.writtenAt(written))
 	db.writeMut.Unlock()
 	if err != nil {
 		return fmt.Errorf("database: error buffering metric batch: %v", err)
@@ -309,7 +435,7 @@ func New(
 		serviceToIndex[textIndexService] = textIndex
 	}
 
-	writeBuffer := NewWriteBuffer(fullIndex.Name(), toc)
+	writeBuffer := NewWriteBuffer(fullIndex.Name(), toc, newHashers(), stats)
 	splitIndexes := map[string]*split.Index{}
 	for joinKey, services := range splitIndexConfig {
 		index := split.NewIndex(joinKey)
@@ -320,6 +446,10 @@ func New(
 		}
 
 		for _, service := range services {
+			if strings.HasPrefix(service, linkPrefix) {
+				continue
+			}
+
 			_, ok := serviceToIndex[service]
 			if ok {
 				panic(fmt.Sprintf("database: service %v has already been attached to index %v. This likely means the config file has %q listed multiple times under %q in the 'split_indexes' section", service, joinKey, service, joinKey))
@@ -330,6 +460,8 @@ func New(
 		}
 	}
 
+	linkSplitIndexes(splitIndexConfig, splitIndexes, toc)
+
 	db := &Database{
 		stats:          stats,
 		serviceToIndex: serviceToIndex,
@@ -348,6 +480,7 @@ func New(
 		FullIndex: fullIndex,
 		TextIndex: textIndex,
 	}
+	db.current.Store(db.initialView())
 	go func() {
 		for {
 			time.Sleep(5 * time.Second)
@@ -372,6 +505,44 @@ func New(
 	return db
 }
 
+// an entry like '->fqdn' in the list of services for a split index links it
+// to the 'fqdn' split index
+const linkPrefix = "->"
+
+// linkSplitIndexes sets up the links between split indexes from the config.
+// Like the rest of the config checks in New, mistakes are a panic.
+func linkSplitIndexes(splitIndexConfig map[string][]string, splitIndexes map[string]*split.Index, toc *toc.TableOfContents) {
+	for joinKey, services := range splitIndexConfig {
+		for _, service := range services {
+			if !strings.HasPrefix(service, linkPrefix) {
+				continue
+			}
+
+			target := strings.TrimPrefix(service, linkPrefix)
+			targetIndex, ok := splitIndexes[target]
+			if !ok {
+				panic(fmt.Sprintf("database: split index %q is linked to %q, but there's no split index for %q in the 'split_indexes' section of the config", joinKey, target, target))
+			}
+			if splitIndexes[joinKey].Link() != nil {
+				panic(fmt.Sprintf("database: split index %q is linked to more than one index. a split index can only link to one other", joinKey))
+			}
+			splitIndexes[joinKey].LinkTo(targetIndex)
+			toc.AddLink(joinKey, target)
+		}
+	}
+
+	// links are followed at query time, so a cycle would never end
+	for joinKey, si := range splitIndexes {
+		seen := map[*split.Index]bool{si: true}
+		for linked := si.Link(); linked != nil; linked = linked.Link() {
+			if seen[linked] {
+				panic(fmt.Sprintf("database: the links between split indexes starting from %q form a cycle. check the '%s' entries in the 'split_indexes' section of the config", joinKey, linkPrefix))
+			}
+			seen[linked] = true
+		}
+	}
+}
+
 // TODO(btyler) convert tags to byte slices right away so hash functions don't need casting
 func (db *Database) ParseQuery(query string) (map[string][]string, error) {
 	/*
@@ -386,90 +557,33 @@ func (db *Database) ParseQuery(query string) (map[string][]string, error) {
 		where a 'tag' is a complete "prefix-key:value" item, such as "server-state:live".
 
 		these will be used to search the "left" side of our indexes: tag -> [$join_key, $join_key...]
-	*/
 
-	//NOTE(btyler) v1 only supports (implicit) 'and': otherwise we need precedence rules and...yuck
-	// additionally, you can get 'or' by adding more metrics to your query
-	var tags []string
-	// dopey quote matching (we don't support nested quotes, so don't bother with a stack)
-	// note that this parsing drops the quote characters from the query
-	if strings.ContainsAny(query, Quotes) {
-		inQuotes := false
-		currentTag := make([]rune, 0, 50)
-		for i, char := range query {
-			if i == len(query)-1 {
-				if inQuotes {
-					if char == CloseQuote {
-						tags = append(tags, string(currentTag))
-						continue
-					} else {
-						return nil, fmt.Errorf("database ParseQuery: invalid query (hanging quotes): %q", query)
-					}
-				}
-
-				currentTag = append(currentTag, char)
-				tags = append(tags, string(currentTag))
-			}
-
-			if inQuotes {
-				if char == CloseQuote {
-					inQuotes = false
-					continue
-				}
-
-				if char == OpenQuote {
-					return nil, fmt.Errorf("database ParseQuery: invalid query (two open quotes in a row): %q", query)
-				}
-			}
-
-			if !inQuotes {
-				if char == OpenQuote {
-					inQuotes = true
-					continue
-				}
-
-				if char == CloseQuote {
-					return nil, fmt.Errorf("database ParseQuery: invalid query (close quote without matching open): %q", query)
-				}
-
-				// found the end of a tag, reset and start on the next one
-				if char == '.' {
-					tags = append(tags, string(currentTag))
-					currentTag = make([]rune, 0, 50)
-					continue
-				}
-			}
-
-			currentTag = append(currentTag, char)
-		}
-	} else {
-		// no quotes, so our parsing is trivial
-		tags = strings.Split(query, ".")
+		this only works for queries that are a plain AND of (maybe negated)
+		tags. Use Parse and Evaluate for queries with OR or grouping.
+	*/
+	root, err := db.Parse(query)
+	if err != nil {
+		return nil, err
 	}
 
-	if len(tags) > db.queryLimit {
-		return nil, fmt.Errorf(
-			"database ParseQuery: max query size is %v, but this query has %v tags. try again with a smaller query",
-			db.queryLimit,
-			len(tags),
-		)
+	tagNodes, negations, ok := flatten(root)
+	if !ok {
+		return nil, fmt.Errorf("database ParseQuery: %q uses OR or negated groups, so it can't be expressed as a list of tags", query)
 	}
 
 	tagsByService := make(map[string][]string)
-	for _, queryTag := range tags {
-		service, err := tag.ParseService(queryTag)
-		if err != nil {
-			return nil, err
+	for i, tagNode := range tagNodes {
+		queryTag := tagNode.Tag
+		if negations[i] {
+			queryTag = "!" + queryTag
 		}
 
-		db.stats.QueryTagsByService.Add(service, 1)
-
-		_, ok := tagsByService[service]
+		_, ok := tagsByService[tagNode.Service]
 		if !ok {
-			tagsByService[service] = []string{}
+			tagsByService[tagNode.Service] = []string{}
 		}
 
-		tagsByService[service] = append(tagsByService[service], queryTag)
+		tagsByService[tagNode.Service] = append(tagsByService[tagNode.Service], queryTag)
 	}
 	return tagsByService, nil
 }
@@ -478,6 +592,56 @@ func (db *Database) TableOfContents() map[string]map[string]map[string]map[strin
 	return db.toc.GetTable()
 }
 
+// Links returns the links between split indexes, as index name => the name of
+// the index it links to
+func (db *Database) Links() map[string]string {
+	return db.toc.GetLinks()
+}
+
+// EnableMultiValuedServices lets tag messages for the given services include
+// more than one value for the same key, like a host in several 'lb-pool's. A
+// tag message replaces the whole set of values of each key it mentions, and a
+// query on any one of the values matches the join.
+func (db *Database) EnableMultiValuedServices(services []string) error {
+	db.writeMut.Lock()
+	defer db.writeMut.Unlock()
+
+	for _, service := range services {
+		mappedIndex, ok := db.serviceToIndex[service]
+		if !ok {
+			return fmt.Errorf("database: service %q can't have multi-valued keys: it has no mapped index. add it to 'split_indexes' in carbonsearch.yaml", service)
+		}
+		if _, ok := mappedIndex.(*split.Index); !ok {
+			return fmt.Errorf("database: service %q can't have multi-valued keys: only services of split indexes can, but it's mapped to the %v index", service, mappedIndex.Name())
+		}
+		db.writeBuffer.AllowMultipleValues(service)
+	}
+	return nil
+}
+
+// SetPostingsFormat picks how the split and full indexes store their posting
+// lists from the next materialization on. It has to be called before the
+// database is used.
+func (db *Database) SetPostingsFormat(format index.PostingsFormat) {
+	db.writeMut.Lock()
+	defer db.writeMut.Unlock()
+
+	db.FullIndex.SetPostingsFormat(format)
+	for _, si := range db.splitIndexes {
+		si.SetPostingsFormat(format)
+	}
+}
+
+// SetTextBackend picks how the text index finds the candidate metrics for
+// text searches. It has to be called before the database is used.
+func (db *Database) SetTextBackend(backend text.BackendType) {
+	db.writeMut.Lock()
+	defer db.writeMut.Unlock()
+
+	db.TextIndex.SetBackend(backend)
+	db.current.Store(db.initialView())
+}
+
 func (db *Database) MetricList() []string {
 	db.writeMut.RLock()
 	defer db.writeMut.RUnlock()
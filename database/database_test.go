@@ -9,6 +9,7 @@ import (
 
 	m "github.com/kanatohodets/carbonsearch/consumer/message"
 	"github.com/kanatohodets/carbonsearch/index"
+	"github.com/kanatohodets/carbonsearch/index/text"
 	"github.com/kanatohodets/carbonsearch/util"
 	"github.com/kanatohodets/carbonsearch/util/test"
 )
@@ -25,6 +26,8 @@ var resultLimit = 10
 var fullService = "custom"
 var textService = "tekst"
 var textMatchPrefix = textService + "-match:"
+var textRegexPrefix = textService + "-regex:"
+var textIMatchPrefix = textService + "-imatch:"
 var splitIndexes = map[string][]string{
 	"fqdn": []string{"servers"},
 }
@@ -124,6 +127,71 @@ func TestFullQuery(t *testing.T) {
 		t.Errorf("database test: query %q expected only 'monitors.was_the_site_up', but got %q", query, result)
 		return
 	}
+
+	// alternation query
+	query = map[string][]string{
+		"custom": {"custom-favorites:{tester,nobody}", "custom-dislikedByUser:jane"},
+	}
+	result, err = db.Query(query)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if len(result) != 1 || result[0] != "monitors.was_the_site_up" {
+		t.Errorf("database test: query %q expected only 'monitors.was_the_site_up', but got %q", query, result)
+		return
+	}
+
+	// negated query
+	query = map[string][]string{
+		"custom": {"custom-dislikedByUser:jane", "!custom-quux:argh"},
+	}
+	result, err = db.Query(query)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if len(result) != 1 || result[0] != "monitors.was_the_site_up" {
+		t.Errorf("database test: query %q expected only 'monitors.was_the_site_up', but got %q", query, result)
+		return
+	}
+
+	// glob query
+	query = map[string][]string{
+		"custom": {"custom-favorites:test*", "custom-dislikedByUser:*"},
+	}
+	result, err = db.Query(query)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if len(result) != 1 || result[0] != "monitors.was_the_site_up" {
+		t.Errorf("database test: query %q expected only 'monitors.was_the_site_up', but got %q", query, result)
+		return
+	}
+
+	// numeric comparisons need a split index
+	query = map[string][]string{
+		"custom": {"custom-foo:bar", "custom-rating:>=3"},
+	}
+	result, err = db.Query(query)
+	if err == nil {
+		t.Errorf("database test: query %q has a numeric comparison on the full index and should have failed, but got %q", query, result)
+		return
+	}
+
+	// purely negative query
+	query = map[string][]string{
+		"custom": {"!custom-quux:argh"},
+	}
+	result, err = db.Query(query)
+	if err == nil {
+		t.Errorf("database test: query %q has only negated tags and should have failed, but got %q", query, result)
+		return
+	}
 	//TODO(btyler) regex filter, split index query, intersecting between split and full index, multiple split indexes
 }
 
@@ -200,20 +268,29 @@ func queryTest(t *testing.T, db *Database, testName string, query string, expect
 		// ensure results are sorted. breaking this is a symptom that some of the
 		// sets are stored unsorted at some point, which breaks a boatload of
 		// assumptions
-		expectedHashes := index.HashMetrics(expectedMetrics)
-		index.SortMetrics(expectedHashes)
+		expectedIDs := metricIDs(db, expectedMetrics)
+		index.SortMetrics(expectedIDs)
 
-		resultHashes := index.HashMetrics(result)
-		if fmt.Sprintf("%v", expectedHashes) != fmt.Sprintf("%v", resultHashes) {
+		resultIDs := metricIDs(db, result)
+		if fmt.Sprintf("%v", expectedIDs) != fmt.Sprintf("%v", resultIDs) {
 			t.Errorf("%v: expected and result metrics are the same, but in a different order!", testName)
-			logger.Logf("%v expected: %q, %q", testName, expectedMetrics, expectedHashes)
-			logger.Logf("%v result: %q, %q", testName, result, resultHashes)
+			logger.Logf("%v expected: %q, %v", testName, expectedMetrics, expectedIDs)
+			logger.Logf("%v result: %q, %v", testName, result, resultIDs)
 
 			return
 		}
 	}
 }
 
+// metricIDs looks up the IDs of metric names in the database's dictionary
+func metricIDs(db *Database, names []string) []index.Metric {
+	ids := make([]index.Metric, len(names))
+	for i, name := range names {
+		ids[i], _ = db.writeBuffer.metrics.ID(name)
+	}
+	return ids
+}
+
 func TestSplitQuery(t *testing.T) {
 	db := New(queryLimit, resultLimit, fullService, textService, splitIndexes, stats)
 
@@ -231,6 +308,7 @@ func TestSplitQuery(t *testing.T) {
 					"servers-dc:us_west",
 					"servers-status:live",
 					"servers-roles:foo",
+					"servers-num_cpus:16",
 				},
 			},
 			"barhost-1000.prod.example.com": map[string][]string{
@@ -242,6 +320,7 @@ func TestSplitQuery(t *testing.T) {
 					"servers-dc:us_west",
 					"servers-status:live",
 					"servers-roles:bar",
+					"servers-num_cpus:8",
 				},
 			},
 			"quxhost-0003.dev.example.com": map[string][]string{
@@ -253,6 +332,7 @@ func TestSplitQuery(t *testing.T) {
 					"servers-dc:us_east",
 					"servers-status:borked",
 					"servers-roles:qux",
+					"servers-num_cpus:32",
 				},
 			},
 		},
@@ -347,6 +427,72 @@ func TestTextQuery(t *testing.T) {
 	searchTest(t, db, "full long metric name, but broken pins", []string{"$rose_daffodil_cron^"}, []string{})
 
 	searchTest(t, db, "text filter intersects, not unions", []string{"^kpop", "bazz"}, []string{"kpopbazz"})
+	searchTest(t, db, "alternation", []string{"{^foox,cron$}"}, []string{"foox", "rose_daffodil_cron"})
+	searchTest(t, db, "alternation and a plain search", []string{"{kpop,blorg}", "bazz"}, []string{"kpopbazz", "bazzkpop"})
+	searchTest(t, db, "negated search", []string{"foox", "!^foox"}, []string{"blorgfoox", "mug_foox_ugh"})
+	searchTest(t, db, "negated alternation", []string{"foox", "!{blorg,ugh$}"}, []string{"foox"})
+
+	searchTest(t, db, "glob", []string{"<ron.*.option>"}, []string{"ron.crocodile.option"})
+	searchTest(t, db, "glob wildcards stay inside of a path node", []string{"<ron.*>"}, []string{})
+	searchTest(t, db, "glob matches the whole name", []string{"<*crocodile>"}, []string{})
+	searchTest(t, db, "glob character class", []string{"<rose_daffodil_cro[mn]>"}, []string{"rose_daffodil_cron"})
+	searchTest(t, db, "glob single character", []string{"<kpop???z>"}, []string{"kpopbazz"})
+	searchTest(t, db, "glob alternation", []string{"<{kpop,bazz}*>"}, []string{"bazz", "kpopbazz", "bazzkpop"})
+	searchTest(t, db, "negated glob", []string{"foox", "!<*_foox_*>"}, []string{"foox", "blorgfoox"})
+
+	parseTagsErrorCase(t, db, "glob without enough literal characters",
+		textMatchPrefix+"<*.*>",
+		"database ParseQuery: text index: *.* has no literal part long enough to search on (at least 4 characters without wildcards)",
+	)
+	queryTest(t, db, "text test: regex", textRegexPrefix+"<^r.*_cro[mn]$>", []string{"rose_daffodil_cron"})
+	queryTest(t, db, "text test: regex with repetition", textRegexPrefix+"<^(kpop){1,2}(bazz){1}$>", []string{"kpopbazz"})
+	queryTest(t, db, "text test: regex and a plain search", textRegexPrefix+"<^bazz.+p$>."+textMatchPrefix+"kpop", []string{"bazzkpop"})
+	queryTest(t, db, "text test: negated regex", textMatchPrefix+"foox.!"+textRegexPrefix+"<_.+_>", []string{"foox", "blorgfoox"})
+	parseTagsErrorCase(t, db, "regex without enough literal characters",
+		textRegexPrefix+"<^(kpop|bazz)$>",
+		"database ParseQuery: text index: ^(kpop|bazz)$ has no literal part long enough to search on (at least 4 characters without wildcards)",
+	)
+	parseTagsErrorCase(t, db, "regex that doesn't compile",
+		textRegexPrefix+"<foox(>",
+		"database ParseQuery: text index: \"foox(\" is not a valid regular expression: error parsing regexp: missing closing ): `foox(`",
+	)
+
+	parseTagsErrorCase(t, db, "glob with an unclosed character class",
+		textMatchPrefix+"<foox[ab>",
+		`database ParseQuery: text index: "foox[ab" has an unclosed '['`,
+	)
+}
+
+func TestCaseInsensitiveTextQuery(t *testing.T) {
+	db := New(queryLimit, resultLimit, fullService, textService, splitIndexes, stats)
+	err := db.InsertCustom(&m.TagMetric{
+		Tags: []string{"custom-favorites:tester"},
+		Metrics: []string{
+			"collector_a.host-1.CPU.user",
+			"collector_b.host-1.cpu.user",
+			"collector_c.host-1.Cpu.user",
+			"collector_c.host-1.Mem.free",
+		},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	db.MaterializeIndexes()
+
+	queryTest(t, db, "imatch", textIMatchPrefix+"<cpu.user>", []string{
+		"collector_a.host-1.CPU.user",
+		"collector_b.host-1.cpu.user",
+		"collector_c.host-1.Cpu.user",
+	})
+	queryTest(t, db, "match is still case sensitive", textMatchPrefix+"<Cpu.user>", []string{"collector_c.host-1.Cpu.user"})
+	queryTest(t, db, "negated imatch", "custom-favorites:tester.!"+textIMatchPrefix+"<CPU.USER>", []string{"collector_c.host-1.Mem.free"})
+	queryTest(t, db, "imatch glob", textIMatchPrefix+"<collector_?.*.{cpu,mem}.*>", []string{
+		"collector_a.host-1.CPU.user",
+		"collector_b.host-1.cpu.user",
+		"collector_c.host-1.Cpu.user",
+		"collector_c.host-1.Mem.free",
+	})
 }
 
 func searchTest(t *testing.T, db *Database, testName string, searches, expected []string) {
@@ -392,6 +538,128 @@ func splitIndexQueryTests(t *testing.T, db *Database, prefix string) {
 			"monitors.was_the_site_up",
 		},
 	)
+
+	queryTest(t, db, fmt.Sprintf("%v alternation query", prefix),
+		"servers-roles:{foo,qux}",
+		[]string{
+			"server.foohost-4335_staging_example_com.cpu.loadavg",
+			"monitors.was_the_site_up",
+			"server.quxhost-0003_dev_example_com.iowait.5m",
+		},
+	)
+
+	queryTest(t, db, fmt.Sprintf("%v alternation query AND plain tag", prefix),
+		"servers-roles:{foo,qux}.servers-status:live",
+		[]string{
+			"server.foohost-4335_staging_example_com.cpu.loadavg",
+			"monitors.was_the_site_up",
+		},
+	)
+
+	queryTest(t, db, fmt.Sprintf("%v alternation query with a missing alternative", prefix),
+		"servers-roles:{bar,no_such_role}",
+		[]string{
+			"server.barhost-1000_prod_example_com.tcp.tx_byte",
+		},
+	)
+
+	queryTest(t, db, fmt.Sprintf("%v alternation query with no matching alternatives", prefix),
+		"servers-roles:{no_such_role,nor_this_one}",
+		[]string{},
+	)
+
+	queryTest(t, db, fmt.Sprintf("%v negated query", prefix),
+		"servers-dc:us_west.!servers-roles:bar",
+		[]string{
+			"server.foohost-4335_staging_example_com.cpu.loadavg",
+			"monitors.was_the_site_up",
+		},
+	)
+
+	queryTest(t, db, fmt.Sprintf("%v negated alternation query", prefix),
+		"servers-hw:{shiny,rusty}.!servers-roles:{foo,bar}",
+		[]string{
+			"server.quxhost-0003_dev_example_com.iowait.5m",
+		},
+	)
+
+	queryTest(t, db, fmt.Sprintf("%v negated query excluding everything", prefix),
+		"servers-status:live.!servers-hw:shiny",
+		[]string{},
+	)
+
+	queryTest(t, db, fmt.Sprintf("%v glob query", prefix),
+		"servers-dc:us_*.servers-roles:*o*",
+		[]string{
+			"server.foohost-4335_staging_example_com.cpu.loadavg",
+			"monitors.was_the_site_up",
+		},
+	)
+
+	queryTest(t, db, fmt.Sprintf("%v glob query without any matching values", prefix),
+		"servers-dc:eu_*",
+		[]string{},
+	)
+
+	queryTest(t, db, fmt.Sprintf("%v negated glob query", prefix),
+		"servers-status:live.!servers-roles:b??",
+		[]string{
+			"server.foohost-4335_staging_example_com.cpu.loadavg",
+			"monitors.was_the_site_up",
+		},
+	)
+
+	queryTest(t, db, fmt.Sprintf("%v glob query inside alternation", prefix),
+		"servers-roles:{fo*,qux}",
+		[]string{
+			"server.foohost-4335_staging_example_com.cpu.loadavg",
+			"monitors.was_the_site_up",
+			"server.quxhost-0003_dev_example_com.iowait.5m",
+		},
+	)
+
+	queryTest(t, db, fmt.Sprintf("%v numeric comparison query", prefix),
+		"servers-num_cpus:>=16",
+		[]string{
+			"server.foohost-4335_staging_example_com.cpu.loadavg",
+			"monitors.was_the_site_up",
+			"server.quxhost-0003_dev_example_com.iowait.5m",
+		},
+	)
+
+	queryTest(t, db, fmt.Sprintf("%v numeric comparison query AND plain tag", prefix),
+		"servers-num_cpus:<16.servers-status:live",
+		[]string{
+			"server.barhost-1000_prod_example_com.tcp.tx_byte",
+		},
+	)
+
+	queryTest(t, db, fmt.Sprintf("%v numeric comparisons inside alternation", prefix),
+		"servers-num_cpus:{<10,>20}",
+		[]string{
+			"server.barhost-1000_prod_example_com.tcp.tx_byte",
+			"server.quxhost-0003_dev_example_com.iowait.5m",
+		},
+	)
+
+	queryTest(t, db, fmt.Sprintf("%v negated numeric comparison", prefix),
+		"servers-status:live.!servers-num_cpus:>8",
+		[]string{
+			"server.barhost-1000_prod_example_com.tcp.tx_byte",
+		},
+	)
+
+	queryTest(t, db, fmt.Sprintf("%v numeric comparison without any matching values", prefix),
+		"servers-num_cpus:>64",
+		[]string{},
+	)
+
+	queryTest(t, db, fmt.Sprintf("%v negated tag without any matches", prefix),
+		"servers-status:borked.!servers-roles:no_such_role",
+		[]string{
+			"server.quxhost-0003_dev_example_com.iowait.5m",
+		},
+	)
 }
 
 func TestTooVagueQuery(t *testing.T) {
@@ -471,6 +739,302 @@ func TestTableOfContents(t *testing.T) {
 	}
 }
 
+func TestLinkedSplitQuery(t *testing.T) {
+	linkedSplitIndexes := map[string][]string{
+		"fqdn": {"servers"},
+		"ip":   {"lb", "->fqdn"},
+		"vip":  {"dns", "->ip"},
+	}
+	db := New(queryLimit, resultLimit, fullService, textService, linkedSplitIndexes, stats)
+	populateSplitIndex(t, db, "linked split query", "fqdn", map[string]map[string][]string{
+		"foohost.prod.example.com": {
+			"metrics": {"server.foohost_prod_example_com.cpu"},
+			"tags":    {"servers-dc:lhr"},
+		},
+		"barhost.prod.example.com": {
+			"metrics": {"server.barhost_prod_example_com.cpu"},
+			"tags":    {"servers-dc:ams"},
+		},
+	})
+
+	links := []*m.KeyLink{
+		{Key: "ip", Value: "10.1.2.3", Links: []string{"foohost.prod.example.com"}},
+		{Key: "ip", Value: "10.1.2.4", Links: []string{"barhost.prod.example.com"}},
+		{Key: "vip", Value: "192.168.0.1", Links: []string{"10.1.2.3", "10.1.2.4"}},
+	}
+	for _, msg := range links {
+		err := db.InsertLinks(msg)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	tags := []*m.KeyTag{
+		{Key: "ip", Value: "10.1.2.3", Tags: []string{"lb-pool:www"}},
+		{Key: "ip", Value: "10.1.2.4", Tags: []string{"lb-pool:api"}},
+		{Key: "vip", Value: "192.168.0.1", Tags: []string{"dns-name:example_com"}},
+	}
+	for _, msg := range tags {
+		err := db.InsertTags(msg)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	db.MaterializeIndexes()
+
+	queryTest(t, db, "linked query", "lb-pool:www", []string{"server.foohost_prod_example_com.cpu"})
+	queryTest(t, db, "linked query and a tag from the linked index", "lb-pool:{www,api}.servers-dc:ams", []string{"server.barhost_prod_example_com.cpu"})
+	queryTest(t, db, "chained links", "dns-name:example_com", []string{
+		"server.foohost_prod_example_com.cpu",
+		"server.barhost_prod_example_com.cpu",
+	})
+
+	// a new link message replaces the old links
+	err := db.InsertLinks(&m.KeyLink{Key: "ip", Value: "10.1.2.3", Links: []string{"barhost.prod.example.com"}})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	db.MaterializeIndexes()
+	queryTest(t, db, "relinked", "lb-pool:www", []string{"server.barhost_prod_example_com.cpu"})
+
+	table := db.TableOfContents()
+	if table["ip"]["lb"]["pool"]["www"] != 1 || table["vip"]["dns"]["name"]["example_com"] != 2 {
+		t.Errorf("linked split query: the table of contents doesn't count metrics through links: %v", table)
+	}
+
+	expectedLinks := map[string]string{"ip": "fqdn", "vip": "ip"}
+	if !reflect.DeepEqual(db.Links(), expectedLinks) {
+		t.Errorf("linked split query: expected links %v, got %v", expectedLinks, db.Links())
+	}
+
+	err = db.InsertLinks(&m.KeyLink{Key: "fqdn", Value: "foohost.prod.example.com", Links: []string{"10.1.2.3"}})
+	if err == nil {
+		t.Errorf("linked split query: links for an index that isn't linked to anything should be an error")
+	}
+}
+
+func TestLinkedSplitIndexConfig(t *testing.T) {
+	badConfigs := map[string]map[string][]string{
+		"missing target": {"ip": {"lb", "->fqdn"}},
+		"cycle":          {"ip": {"lb", "->fqdn"}, "fqdn": {"servers", "->ip"}},
+		"two links":      {"ip": {"lb", "->fqdn", "->host"}, "fqdn": {"servers"}, "host": {"hosts"}},
+	}
+
+	for name, config := range badConfigs {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("linked split index config: %s: expected a panic", name)
+				}
+			}()
+			New(queryLimit, resultLimit, fullService, textService, config, stats)
+		}()
+	}
+}
+
+func TestCompressedPostings(t *testing.T) {
+	db := New(queryLimit, resultLimit, fullService, textService, splitIndexes, stats)
+	db.SetPostingsFormat(index.CompressedPostingsFormat)
+
+	populateSplitIndex(t, db, "compressed postings", "fqdn", map[string]map[string][]string{
+		"foohost.prod.example.com": {
+			"metrics": {"server.foohost_prod_example_com.cpu", "server.foohost_prod_example_com.mem"},
+			"tags":    {"servers-dc:lhr", "servers-status:live"},
+		},
+		"barhost.prod.example.com": {
+			"metrics": {"server.barhost_prod_example_com.cpu"},
+			"tags":    {"servers-dc:ams", "servers-status:live"},
+		},
+	})
+	err := db.InsertCustom(&m.TagMetric{
+		Tags:    []string{"custom-favorites:tester"},
+		Metrics: []string{"server.foohost_prod_example_com.cpu", "server.barhost_prod_example_com.cpu"},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	db.MaterializeIndexes()
+
+	queryTest(t, db, "compressed split query", "servers-status:live.servers-dc:lhr", []string{
+		"server.foohost_prod_example_com.cpu",
+		"server.foohost_prod_example_com.mem",
+	})
+	queryTest(t, db, "compressed split union", "servers-dc:{lhr,ams}", []string{
+		"server.foohost_prod_example_com.cpu",
+		"server.foohost_prod_example_com.mem",
+		"server.barhost_prod_example_com.cpu",
+	})
+	queryTest(t, db, "compressed split and full", "servers-dc:ams.custom-favorites:tester", []string{
+		"server.barhost_prod_example_com.cpu",
+	})
+}
+
+func TestPostingsTextBackend(t *testing.T) {
+	db := New(queryLimit, resultLimit, fullService, textService, splitIndexes, stats)
+	db.SetTextBackend(text.PostingsBackend)
+
+	populateSplitIndex(t, db, "postings text backend", "fqdn", map[string]map[string][]string{
+		"foohost.prod.example.com": {
+			"metrics": {"server.foohost_prod_example_com.cpu", "server.foohost_prod_example_com.mem"},
+			"tags":    {"servers-dc:lhr"},
+		},
+		"barhost.prod.example.com": {
+			"metrics": {"server.barhost_prod_example_com.cpu"},
+			"tags":    {"servers-dc:ams"},
+		},
+	})
+
+	searchTest(t, db, "postings text backend", []string{"host_prod"}, []string{
+		"server.foohost_prod_example_com.cpu",
+		"server.foohost_prod_example_com.mem",
+		"server.barhost_prod_example_com.cpu",
+	})
+	searchTest(t, db, "postings text backend: pinned", []string{"^server", "rhost"}, []string{
+		"server.barhost_prod_example_com.cpu",
+	})
+	queryTest(t, db, "postings text backend and split", "servers-dc:lhr."+textMatchPrefix+"example", []string{
+		"server.foohost_prod_example_com.cpu",
+		"server.foohost_prod_example_com.mem",
+	})
+
+	err := db.DeleteMetrics(&m.KeyMetric{Key: "fqdn", Value: "foohost.prod.example.com", Metrics: []string{"server.foohost_prod_example_com.cpu"}})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	db.MaterializeIndexes()
+	searchTest(t, db, "postings text backend after delete", []string{"foohost"}, []string{
+		"server.foohost_prod_example_com.mem",
+	})
+}
+
+func TestMultiValuedKeys(t *testing.T) {
+	db := New(queryLimit, resultLimit, fullService, textService, map[string][]string{"fqdn": {"servers", "lb"}}, stats)
+	err := db.EnableMultiValuedServices([]string{"lb"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	populateSplitIndex(t, db, "multi-valued keys", "fqdn", map[string]map[string][]string{
+		"foohost.prod.example.com": {
+			"metrics": {"server.foohost_prod_example_com.cpu"},
+			"tags":    {"lb-pool:www", "lb-pool:api", "lb-pool:www", "servers-dc:lhr"},
+		},
+		"barhost.prod.example.com": {
+			"metrics": {"server.barhost_prod_example_com.cpu"},
+			"tags":    {"lb-pool:api"},
+		},
+	})
+
+	queryTest(t, db, "multi-valued keys: one of several values", "lb-pool:www", []string{"server.foohost_prod_example_com.cpu"})
+	queryTest(t, db, "multi-valued keys: shared value", "lb-pool:api", []string{
+		"server.foohost_prod_example_com.cpu",
+		"server.barhost_prod_example_com.cpu",
+	})
+	evaluateTest(t, db, "multi-valued keys: intersection of values", "lb-pool:www.lb-pool:api", []string{"server.foohost_prod_example_com.cpu"})
+	evaluateTest(t, db, "multi-valued keys: negation", "lb-pool:api.!lb-pool:www", []string{"server.barhost_prod_example_com.cpu"})
+
+	// a new message replaces the set of values, but leaves other keys alone
+	err = db.InsertTags(&m.KeyTag{Key: "fqdn", Value: "foohost.prod.example.com", Tags: []string{"lb-pool:static", "lb-pool:www"}})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	db.MaterializeIndexes()
+
+	queryTest(t, db, "multi-valued keys: replaced value", "lb-pool:api", []string{"server.barhost_prod_example_com.cpu"})
+	queryTest(t, db, "multi-valued keys: new value", "lb-pool:static", []string{"server.foohost_prod_example_com.cpu"})
+	queryTest(t, db, "multi-valued keys: other keys are untouched", "servers-dc:lhr", []string{"server.foohost_prod_example_com.cpu"})
+
+	err = db.InsertTags(&m.KeyTag{Key: "fqdn", Value: "foohost.prod.example.com", Tags: []string{"servers-dc:lhr", "servers-dc:ams"}})
+	if err == nil {
+		t.Errorf("multi-valued keys: several values for a key of a service without multi-valued keys should be an error")
+	}
+
+	for _, service := range []string{"nope", fullService, textService} {
+		err = db.EnableMultiValuedServices([]string{service})
+		if err == nil {
+			t.Errorf("multi-valued keys: enabling multi-valued keys for %q should be an error", service)
+		}
+	}
+}
+
+func TestReplaceMessages(t *testing.T) {
+	db := New(queryLimit, resultLimit, fullService, textService, splitIndexes, stats)
+	populateSplitIndex(t, db, "replace messages", "fqdn", map[string]map[string][]string{
+		"foohost.prod.example.com": {
+			"metrics": {"server.foohost_prod_example_com.cpu", "server.foohost_prod_example_com.disk"},
+			"tags":    {"servers-dc:lhr", "servers-status:live", "servers-hw:shiny"},
+		},
+	})
+
+	err := db.InsertMetrics(&m.KeyMetric{
+		Key:     "fqdn",
+		Value:   "foohost.prod.example.com",
+		Metrics: []string{"server.foohost_prod_example_com.cpu", "server.foohost_prod_example_com.net"},
+		Replace: true,
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = db.InsertTags(&m.KeyTag{
+		Key:     "fqdn",
+		Value:   "foohost.prod.example.com",
+		Tags:    []string{"servers-dc:ams", "servers-status:live"},
+		Replace: true,
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	db.MaterializeIndexes()
+
+	evaluateTest(t, db, "replace messages: replaced metrics", "servers-status:live", []string{
+		"server.foohost_prod_example_com.cpu",
+		"server.foohost_prod_example_com.net",
+	})
+	searchTest(t, db, "replaced metrics leave the text index", []string{"foohost"}, []string{
+		"server.foohost_prod_example_com.cpu",
+		"server.foohost_prod_example_com.net",
+	})
+	evaluateTest(t, db, "replace messages: replaced value", "servers-dc:lhr", []string{})
+	evaluateTest(t, db, "replace messages: new value", "servers-dc:ams", []string{
+		"server.foohost_prod_example_com.cpu",
+		"server.foohost_prod_example_com.net",
+	})
+	evaluateTest(t, db, "replace messages: key missing from the batch", "servers-hw:shiny", []string{})
+
+	expected := map[string]map[string]int{
+		"dc":     {"ams": 2},
+		"status": {"live": 2},
+	}
+	if table := db.TableOfContents()["fqdn"]["servers"]; !reflect.DeepEqual(expected, table) {
+		t.Errorf("replace messages: table of contents expected %v, got %v", expected, table)
+	}
+
+	// a bad batch doesn't change anything
+	err = db.InsertTags(&m.KeyTag{
+		Key:     "fqdn",
+		Value:   "foohost.prod.example.com",
+		Tags:    []string{"servers-hw:rusty", "servers-hw:shiny"},
+		Replace: true,
+	})
+	if err == nil {
+		t.Errorf("replace messages: a batch with two values for a key should be an error")
+	}
+	db.MaterializeIndexes()
+	evaluateTest(t, db, "replace messages: after a bad batch", "servers-dc:ams", []string{
+		"server.foohost_prod_example_com.cpu",
+		"server.foohost_prod_example_com.net",
+	})
+}
+
 func TestInsertMetrics(t *testing.T) {
 
 }
@@ -512,6 +1076,56 @@ func TestParseQuery(t *testing.T) {
 		},
 	)
 
+	parseTagsTestCase(t, db, "alternation",
+		"server-dc:{lhr,ams}.lb-pool:www",
+		map[string][]string{
+			"server": {"server-dc:{lhr,ams}"},
+			"lb":     {"lb-pool:www"},
+		},
+	)
+
+	parseTagsTestCase(t, db, "alternation with dots inside of the braces",
+		"server-fqdn:{foo.example.com,bar.example.com}.lb-pool:www",
+		map[string][]string{
+			"server": {"server-fqdn:{foo.example.com,bar.example.com}"},
+			"lb":     {"lb-pool:www"},
+		},
+	)
+
+	parseTagsTestCase(t, db, "negation",
+		"server-state:live.!lb-pool:www."+textMatchPrefix+"!staging",
+		map[string][]string{
+			"server":    {"server-state:live"},
+			"lb":        {"!lb-pool:www"},
+			textService: {textMatchPrefix + "!staging"},
+		},
+	)
+
+	parseTagsTestCase(t, db, "numeric comparisons",
+		"server-num_cpus:>=16.server-ram_gb:<128.server-load:<0.5.lb-weight:>10",
+		map[string][]string{
+			"server": {"server-num_cpus:>=16", "server-ram_gb:<128", "server-load:<0.5"},
+			"lb":     {"lb-weight:>10"},
+		},
+	)
+
+	parseTagsTestCase(t, db, "negated numeric comparison, and comparisons inside alternation",
+		"!server-num_cpus:>8.server-num_cpus:{<4,>=16}",
+		map[string][]string{
+			"server": {"!server-num_cpus:>8", "server-num_cpus:{<4,>=16}"},
+		},
+	)
+
+	parseTagsErrorCase(t, db, "alternation across services",
+		"{server,lb}-dc:lhr",
+		"database ParseQuery: alternation in \"{server,lb}-dc:lhr\" spans more than one service (\"{server,lb}\" and \"server\"), which is not supported",
+	)
+
+	parseTagsErrorCase(t, db, "unbalanced alternation",
+		"server-dc:{lhr,ams.lb-pool:www",
+		"database ParseQuery: tag: \"server-dc:{lhr,ams.lb-pool:www\" has unbalanced alternation braces",
+	)
+
 	// check query size limit
 	smallQueryLimit := 1
 	db = New(smallQueryLimit, resultLimit, fullService, textService, splitIndexes, stats)
@@ -549,6 +1163,20 @@ func TestParseQueryWithQuotes(t *testing.T) {
 		},
 	)
 
+	parseTagsTestCase(t, db, "quoted value that starts with a number isn't a comparison",
+		"server-ip:<10.1.2.3>.server-num_cpus:<16",
+		map[string][]string{
+			"server": {"server-ip:10.1.2.3", "server-num_cpus:<16"},
+		},
+	)
+
+	parseTagsTestCase(t, db, "no comparisons in text searches",
+		textMatchPrefix+"<200.count>",
+		map[string][]string{
+			textService: {textMatchPrefix + "200.count"},
+		},
+	)
+
 	parseTagsErrorCase(t, db, "double quote open",
 		translateQuotes(textMatchPrefix+"<<foo.bar>"),
 		"database ParseQuery: invalid query (two open quotes in a row): \""+textMatchPrefix+"<<foo.bar>\"",
@@ -0,0 +1,120 @@
+package database
+
+import (
+	"fmt"
+
+	m "github.com/kanatohodets/carbonsearch/consumer/message"
+)
+
+/*
+	deletions are tombstone messages: they remove data written by the other
+	message types from the write buffer, and so from the indexes once they're
+	next materialized. The table of contents is updated right away, same as for
+	writes.
+
+	deleting something that isn't there is not an error, so tombstones can be
+	replayed safely.
+*/
+
+// DeleteTags removes tags from a value of a join key
+func (db *Database) DeleteTags(msg *m.KeyTag) error {
+	if msg.Value == "" {
+		return fmt.Errorf("database: tag deletion has an empty join key value")
+	}
+	if len(msg.Tags) == 0 {
+		return fmt.Errorf("database: tag deletion must have at least one tag")
+	}
+
+	si, ok := db.splitIndexes[msg.Key]
+	if !ok {
+		return fmt.Errorf("database DeleteTags: no split index for join key %q", msg.Key)
+	}
+
+	err := db.validateServiceIndexPairs(msg.Tags, si, msg.Key)
+	if err != nil {
+		return fmt.Errorf("database: tag deletion failed validation for index %q: %s", msg.Key, err)
+	}
+
+	db.writeMut.Lock()
+	err = db.writeBuffer.DeleteTags(msg.Key, msg.Value, msg.Tags)
+	db.writeMut.Unlock()
+	if err != nil {
+		return fmt.Errorf("database: error deleting tags: %v", err)
+	}
+
+	db.stats.DeleteMessages.Add(1)
+	return nil
+}
+
+// DeleteMetrics removes metrics from a value of a join key
+func (db *Database) DeleteMetrics(msg *m.KeyMetric) error {
+	if msg.Value == "" {
+		return fmt.Errorf("database: metric deletion has an empty join key value")
+	}
+	if len(msg.Metrics) == 0 {
+		return fmt.Errorf("database: metric deletion must have at least one metric")
+	}
+
+	_, ok := db.splitIndexes[msg.Key]
+	if !ok {
+		return fmt.Errorf("database DeleteMetrics: no split index for join key %q", msg.Key)
+	}
+
+	db.writeMut.Lock()
+	err := db.writeBuffer.DeleteMetrics(msg.Key, msg.Value, msg.Metrics)
+	db.writeMut.Unlock()
+	if err != nil {
+		return fmt.Errorf("database: error deleting metrics: %v", err)
+	}
+
+	db.stats.DeleteMessages.Add(1)
+	return nil
+}
+
+// DeleteJoin removes a value of a join key entirely: its metrics, tags and
+// links
+func (db *Database) DeleteJoin(msg *m.Join) error {
+	if msg.Value == "" {
+		return fmt.Errorf("database: join deletion has an empty join key value")
+	}
+
+	_, ok := db.splitIndexes[msg.Key]
+	if !ok {
+		return fmt.Errorf("database DeleteJoin: no split index for join key %q", msg.Key)
+	}
+
+	db.writeMut.Lock()
+	err := db.writeBuffer.DeleteJoin(msg.Key, msg.Value)
+	db.writeMut.Unlock()
+	if err != nil {
+		return fmt.Errorf("database: error deleting join: %v", err)
+	}
+
+	db.stats.DeleteMessages.Add(1)
+	return nil
+}
+
+// DeleteCustom removes custom index associations between the tags and metrics
+func (db *Database) DeleteCustom(msg *m.TagMetric) error {
+	if len(msg.Metrics) == 0 {
+		return fmt.Errorf("database: custom deletion must have at least one metric")
+	}
+	if len(msg.Tags) == 0 {
+		return fmt.Errorf("database: custom deletion must have at least one tag")
+	}
+
+	err := db.validateServiceIndexPairs(msg.Tags, db.FullIndex, db.fullIndexService)
+	if err != nil {
+		return fmt.Errorf("database: custom deletion failed validation: %s", err)
+	}
+
+	db.writeMut.Lock()
+	err = db.writeBuffer.DeleteCustom(msg.Tags, msg.Metrics)
+	db.writeMut.Unlock()
+	if err != nil {
+		return fmt.Errorf("database: error deleting custom associations: %v", err)
+	}
+
+	db.stats.DeleteMessages.Add(1)
+	return nil
+}
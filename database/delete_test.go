@@ -0,0 +1,219 @@
+package database
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	m "github.com/kanatohodets/carbonsearch/consumer/message"
+)
+
+func TestDelete(t *testing.T) {
+	db := New(queryLimit, resultLimit, fullService, textService, splitIndexes, stats)
+	populateSplitIndex(t, db, "delete", "fqdn", map[string]map[string][]string{
+		"foohost.prod.example.com": {
+			"metrics": {"server.foohost_prod_example_com.cpu", "server.foohost_prod_example_com.disk"},
+			"tags":    {"servers-dc:lhr", "servers-hw:shiny"},
+		},
+		"barhost.prod.example.com": {
+			"metrics": {"server.barhost_prod_example_com.cpu", "server.barhost_prod_example_com.disk"},
+			"tags":    {"servers-dc:lhr", "servers-hw:rusty"},
+		},
+	})
+	err := db.InsertCustom(&m.TagMetric{
+		Tags:    []string{"custom-favorites:btyler"},
+		Metrics: []string{"server.foohost_prod_example_com.cpu", "monitors.was_the_site_up"},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	db.MaterializeIndexes()
+
+	err = db.DeleteTags(&m.KeyTag{Key: "fqdn", Value: "foohost.prod.example.com", Tags: []string{"servers-hw:shiny", "servers-hw:never_written"}})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = db.DeleteMetrics(&m.KeyMetric{Key: "fqdn", Value: "barhost.prod.example.com", Metrics: []string{"server.barhost_prod_example_com.disk"}})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = db.DeleteCustom(&m.TagMetric{Tags: []string{"custom-favorites:btyler"}, Metrics: []string{"monitors.was_the_site_up"}})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	db.MaterializeIndexes()
+
+	evaluateTest(t, db, "delete: deleted tag", "servers-hw:shiny", []string{})
+	evaluateTest(t, db, "delete: remaining tag", "servers-dc:lhr", []string{
+		"server.foohost_prod_example_com.cpu",
+		"server.foohost_prod_example_com.disk",
+		"server.barhost_prod_example_com.cpu",
+	})
+	evaluateTest(t, db, "delete: custom association", "custom-favorites:btyler", []string{"server.foohost_prod_example_com.cpu"})
+	searchTest(t, db, "deleted metrics are gone from the text index", []string{"barhost"}, []string{"server.barhost_prod_example_com.cpu"})
+	searchTest(t, db, "metrics of another join or custom tag stay", []string{"foohost"}, []string{
+		"server.foohost_prod_example_com.cpu",
+		"server.foohost_prod_example_com.disk",
+	})
+	searchTest(t, db, "metrics without any custom tag are gone", []string{"monitors"}, []string{})
+
+	err = db.DeleteJoin(&m.Join{Key: "fqdn", Value: "foohost.prod.example.com"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	db.MaterializeIndexes()
+
+	evaluateTest(t, db, "delete: deleted join", "servers-dc:lhr", []string{"server.barhost_prod_example_com.cpu"})
+	// still associated with the custom tag
+	searchTest(t, db, "deleted join", []string{"foohost"}, []string{"server.foohost_prod_example_com.cpu"})
+
+	expected := map[string]map[string]map[string]map[string]int{
+		"full index": {
+			"custom": {
+				"favorites": {"btyler": 1},
+			},
+		},
+		"fqdn": {
+			"servers": {
+				"dc": {"lhr": 1},
+				"hw": {"rusty": 1},
+			},
+		},
+	}
+	if table := db.TableOfContents(); !reflect.DeepEqual(expected, table) {
+		t.Errorf("delete: table of contents expected %v, got %v", expected, table)
+	}
+
+	err = db.DeleteCustom(&m.TagMetric{Tags: []string{"custom-favorites:btyler"}, Metrics: []string{"server.foohost_prod_example_com.cpu"}})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	db.MaterializeIndexes()
+	searchTest(t, db, "last association deleted", []string{"foohost"}, []string{})
+	if _, ok := db.TableOfContents()["full index"]["custom"]["favorites"]; ok {
+		t.Errorf("delete: a custom tag without metrics should be gone from the table of contents")
+	}
+
+	err = db.DeleteJoin(&m.Join{Key: "nope", Value: "foohost.prod.example.com"})
+	if err == nil {
+		t.Errorf("delete: deleting from a split index that doesn't exist should be an error")
+	}
+}
+
+func TestReplacedTagsLeaveTableOfContents(t *testing.T) {
+	db := New(queryLimit, resultLimit, fullService, textService, splitIndexes, stats)
+	populateSplitIndex(t, db, "replaced tags", "fqdn", map[string]map[string][]string{
+		"foohost.prod.example.com": {
+			"metrics": {"server.foohost_prod_example_com.cpu"},
+			"tags":    {"servers-status:maint"},
+		},
+	})
+
+	err := db.InsertTags(&m.KeyTag{Key: "fqdn", Value: "foohost.prod.example.com", Tags: []string{"servers-status:live"}})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	expected := map[string]int{"live": 1}
+	if values := db.TableOfContents()["fqdn"]["servers"]["status"]; !reflect.DeepEqual(expected, values) {
+		t.Errorf("replaced tags: expected %v in the table of contents, got %v", expected, values)
+	}
+}
+
+func TestUnusedTagsAreForgotten(t *testing.T) {
+	db := New(queryLimit, resultLimit, fullService, textService, splitIndexes, stats)
+	populateSplitIndex(t, db, "unused tags", "fqdn", map[string]map[string][]string{
+		"foohost.prod.example.com": {
+			"metrics": {"server.foohost_prod_example_com.cpu"},
+			"tags":    {"servers-status:maint", "servers-num_cpus:16"},
+		},
+		"barhost.prod.example.com": {
+			"metrics": {"server.barhost_prod_example_com.cpu"},
+			"tags":    {"servers-status:maint", "servers-num_cpus:16"},
+		},
+	})
+
+	replace := func(host string, tags ...string) {
+		err := db.InsertTags(&m.KeyTag{Key: "fqdn", Value: host, Tags: tags})
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	replace("foohost.prod.example.com", "servers-status:live", "servers-num_cpus:32")
+	err := db.DeleteTags(&m.KeyTag{Key: "fqdn", Value: "barhost.prod.example.com", Tags: []string{"servers-num_cpus:16"}})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// barhost still has 'maint'; nothing has '16' anymore
+	expectedRaw := []string{"servers-num_cpus:32", "servers-status:live", "servers-status:maint"}
+	expectedNumeric := []string{"32"}
+	check := func(name string) {
+		splitBuffer := db.writeBuffer.splits["fqdn"]
+		raw := []string{}
+		for _, rawTag := range splitBuffer.rawTags {
+			raw = append(raw, rawTag)
+		}
+		numeric := []string{}
+		for _, value := range splitBuffer.numericTags {
+			numeric = append(numeric, value)
+		}
+		sort.Strings(raw)
+		if !reflect.DeepEqual(expectedRaw, raw) {
+			t.Errorf("%s: expected raw tags %v, got %v", name, expectedRaw, raw)
+		}
+		if !reflect.DeepEqual(expectedNumeric, numeric) {
+			t.Errorf("%s: expected numeric tags %v, got %v", name, expectedNumeric, numeric)
+		}
+	}
+	check("unused tags")
+
+	err = db.DeleteJoin(&m.Join{Key: "fqdn", Value: "barhost.prod.example.com"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	expectedRaw = expectedRaw[:2]
+	check("unused tags after deleting a join")
+}
+
+func TestDeletedMetricIDsAreReused(t *testing.T) {
+	db := New(queryLimit, resultLimit, fullService, textService, splitIndexes, stats)
+	populateSplitIndex(t, db, "reused IDs", "fqdn", map[string]map[string][]string{
+		"foohost.prod.example.com": {
+			"metrics": {"server.foohost_prod_example_com.cpu"},
+			"tags":    {"servers-dc:lhr"},
+		},
+	})
+
+	err := db.DeleteJoin(&m.Join{Key: "fqdn", Value: "foohost.prod.example.com"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	db.MaterializeIndexes()
+
+	// the new metric gets the ID the deleted one had
+	populateSplitIndex(t, db, "reused IDs", "fqdn", map[string]map[string][]string{
+		"barhost.prod.example.com": {
+			"metrics": {"server.barhost_prod_example_com.cpu"},
+			"tags":    {"servers-dc:ams"},
+		},
+	})
+	if ids := metricIDs(db, []string{"server.barhost_prod_example_com.cpu"}); ids[0] != 0 {
+		t.Errorf("reused IDs: expected the new metric to reuse ID 0, got %d", ids[0])
+	}
+
+	evaluateTest(t, db, "reused IDs: deleted join", "servers-dc:lhr", []string{})
+	evaluateTest(t, db, "reused IDs: new join", "servers-dc:ams", []string{"server.barhost_prod_example_com.cpu"})
+	searchTest(t, db, "reused IDs: the deleted metric's document is stale", []string{"foohost"}, []string{})
+	searchTest(t, db, "reused IDs: the new metric has its own document", []string{"barhost"}, []string{"server.barhost_prod_example_com.cpu"})
+}
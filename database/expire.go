@@ -0,0 +1,252 @@
+package database
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/kanatohodets/carbonsearch/index"
+	"github.com/kanatohodets/carbonsearch/index/split"
+	"github.com/kanatohodets/carbonsearch/tag"
+)
+
+/*
+	expiry drops data that hasn't been written again for a while, like the
+	metrics and tags of hosts that were decommissioned.
+
+	the write buffer remembers when each join->metric association, tag
+	assignment (all the values of a key for a join), link and custom
+	association was last written. Before each materialization, anything older
+	than its TTL is removed, just as if a deletion message had been sent for it.
+
+	TTLs are set per split index, for everything in it, and per service, which
+	overrides the split index TTL for the tags of that service. The custom
+	associations of the full index only expire with a TTL for the full index
+	service. Metrics leave the text index once nothing has them anymore.
+*/
+
+// expired counts what a sweep removed
+type expired struct {
+	// join->metric and custom tag->metric associations
+	metrics int
+	// tag assignments
+	tags  int
+	links int
+}
+
+func (w *writeBuffer) SetIndexTTL(indexName string, ttl time.Duration) {
+	w.indexTTLs[indexName] = ttl
+}
+
+func (w *writeBuffer) SetServiceTTL(service string, ttl time.Duration) {
+	w.serviceTTLs[service] = ttl
+}
+
+func (w *writeBuffer) SetFullTTL(ttl time.Duration) {
+	w.fullTTL = ttl
+}
+
+// Expire removes everything that hasn't been written within its TTL
+func (w *writeBuffer) Expire() expired {
+	now := w.now().Unix()
+	result := expired{}
+
+	for indexName, splitBuffer := range w.splits {
+		indexTTL := w.indexTTLs[indexName]
+		if indexTTL > 0 {
+			cutoff := now - int64(indexTTL/time.Second)
+			for join, joinMetrics := range splitBuffer.joinToMetric {
+				removed := w.expireMetrics(joinMetrics, cutoff)
+				if removed == 0 {
+					continue
+				}
+				result.metrics += removed
+				w.metricsChanged(indexName, join)
+				if len(joinMetrics) == 0 {
+					delete(splitBuffer.joinToMetric, join)
+					w.joinHashes.unref(uint64(join))
+				}
+				w.toc.SetMetricCount(indexName, uint64(join), len(joinMetrics))
+			}
+
+			for join, seen := range splitBuffer.linkSeen {
+				if seen >= cutoff {
+					continue
+				}
+				w.removeLinks(indexName, splitBuffer, join)
+				w.toc.RemoveLinks(indexName, uint64(join))
+				result.links++
+			}
+		}
+
+		for sk, joinsSeen := range splitBuffer.tagSeen {
+			ttl, ok := w.serviceTTLs[splitBuffer.services[sk]]
+			if !ok {
+				ttl = indexTTL
+			}
+			if ttl <= 0 {
+				continue
+			}
+
+			cutoff := now - int64(ttl/time.Second)
+			for join, seen := range joinsSeen {
+				if seen >= cutoff {
+					continue
+				}
+				w.setJoinTags(indexName, splitBuffer, sk, join, nil)
+				result.tags++
+			}
+		}
+	}
+
+	if w.fullTTL > 0 {
+		cutoff := now - int64(w.fullTTL/time.Second)
+		for hashedTag, tagMetrics := range w.full {
+			removed := w.expireMetrics(tagMetrics, cutoff)
+			if removed == 0 {
+				continue
+			}
+			result.metrics += removed
+			w.customTagChanged(hashedTag)
+			if len(tagMetrics) != 0 {
+				w.toc.SetMetricCount(w.fullIndexName, uint64(hashedTag), len(tagMetrics))
+				continue
+			}
+
+			s, k, v, err := tag.Parse(w.fullTags[hashedTag])
+			if err != nil {
+				panic(fmt.Sprintf("database write buffer: custom tag %q doesn't parse anymore: %v. it was parsed before going into the write buffer, hence the panic", w.fullTags[hashedTag], err))
+			}
+			w.removeCustomTag(hashedTag)
+			w.toc.RemoveTag(w.fullIndexName, s, k, v, uint64(hashedTag))
+		}
+	}
+
+	return result
+}
+
+// expireMetrics removes the metrics last written before cutoff from a set,
+// returning how many it removed
+func (w *writeBuffer) expireMetrics(metrics map[index.Metric]int64, cutoff int64) int {
+	removed := 0
+	for metric, seen := range metrics {
+		if seen >= cutoff {
+			continue
+		}
+		delete(metrics, metric)
+		w.metrics.Unref(metric)
+		removed++
+	}
+	return removed
+}
+
+// EnableExpiry sets TTLs for split indexes (by join key) and services. Metrics,
+// tags, links and custom associations that aren't written again within their
+// TTL are removed before the next materialization. A service TTL of 0 keeps
+// the tags of that service forever, even if its split index has a TTL.
+func (db *Database) EnableExpiry(indexTTLs, serviceTTLs map[string]time.Duration) error {
+	for indexName, ttl := range indexTTLs {
+		if _, ok := db.splitIndexes[indexName]; !ok {
+			return fmt.Errorf("database: there's a TTL for index %q, but no split index for that join key", indexName)
+		}
+		if err := validateTTL(indexName, ttl); err != nil {
+			return err
+		}
+	}
+
+	for service, ttl := range serviceTTLs {
+		mappedIndex, ok := db.serviceToIndex[service]
+		if !ok {
+			return fmt.Errorf("database: there's a TTL for service %q, but it has no mapped index", service)
+		}
+		if mappedIndex == db.TextIndex {
+			return fmt.Errorf("database: the text index service %q can't have a TTL: metrics expire from the text index along with their joins and custom tags", service)
+		}
+		if err := validateTTL(service, ttl); err != nil {
+			return err
+		}
+	}
+
+	db.writeMut.Lock()
+	defer db.writeMut.Unlock()
+	for indexName, ttl := range indexTTLs {
+		db.writeBuffer.SetIndexTTL(indexName, ttl)
+	}
+	for service, ttl := range serviceTTLs {
+		if _, ok := db.serviceToIndex[service].(*split.Index); ok {
+			db.writeBuffer.SetServiceTTL(service, ttl)
+			continue
+		}
+		db.writeBuffer.SetFullTTL(ttl)
+	}
+	return nil
+}
+
+// TTLs are the expiry settings of a database, for consumers that keep their
+// own copy of what they wrote. The zero value expires nothing.
+type TTLs struct {
+	indexes  map[string]time.Duration
+	services map[string]time.Duration
+	full     time.Duration
+}
+
+// TTLs returns a copy of the TTLs set with EnableExpiry
+func (db *Database) TTLs() TTLs {
+	db.writeMut.RLock()
+	defer db.writeMut.RUnlock()
+
+	ttls := TTLs{
+		indexes:  make(map[string]time.Duration, len(db.writeBuffer.indexTTLs)),
+		services: make(map[string]time.Duration, len(db.writeBuffer.serviceTTLs)),
+		full:     db.writeBuffer.fullTTL,
+	}
+	for indexName, ttl := range db.writeBuffer.indexTTLs {
+		ttls.indexes[indexName] = ttl
+	}
+	for service, ttl := range db.writeBuffer.serviceTTLs {
+		ttls.services[service] = ttl
+	}
+	return ttls
+}
+
+// Metrics is the TTL of the join->metric associations and links of a split
+// index, 0 if they don't expire
+func (t TTLs) Metrics(joinKey string) time.Duration {
+	return t.indexes[joinKey]
+}
+
+// Tags is the TTL of the tags of a service in a split index: the service TTL
+// if there is one, otherwise the index TTL
+func (t TTLs) Tags(joinKey, service string) time.Duration {
+	if ttl, ok := t.services[service]; ok {
+		return ttl
+	}
+	return t.indexes[joinKey]
+}
+
+// Custom is the TTL of custom tag->metric associations
+func (t TTLs) Custom() time.Duration {
+	return t.full
+}
+
+func validateTTL(name string, ttl time.Duration) error {
+	if ttl < 0 {
+		return fmt.Errorf("database: the TTL for %q is negative (%v)", name, ttl)
+	}
+	if ttl > 0 && ttl < time.Second {
+		return fmt.Errorf("database: the TTL for %q is %v, but TTLs can't be shorter than a second", name, ttl)
+	}
+	return nil
+}
+
+// expire sweeps the write buffer for anything past its TTL, and forgets the
+// strings that nothing has anymore
+func (db *Database) expire() {
+	db.writeMut.Lock()
+	result := db.writeBuffer.Expire()
+	db.writeBuffer.sweepHashes()
+	db.writeMut.Unlock()
+
+	db.stats.ExpiredMetrics.Add(int64(result.metrics))
+	db.stats.ExpiredTags.Add(int64(result.tags))
+	db.stats.ExpiredLinks.Add(int64(result.links))
+}
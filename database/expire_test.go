@@ -0,0 +1,146 @@
+package database
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	m "github.com/kanatohodets/carbonsearch/consumer/message"
+)
+
+func TestExpiry(t *testing.T) {
+	db := New(queryLimit, resultLimit, fullService, textService, map[string][]string{"fqdn": {"servers", "lb"}}, stats)
+	err := db.EnableExpiry(
+		map[string]time.Duration{"fqdn": time.Hour},
+		map[string]time.Duration{"lb": 10 * time.Minute, fullService: time.Hour},
+	)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	now := time.Unix(1500000000, 0)
+	db.writeBuffer.now = func() time.Time { return now }
+
+	populateSplitIndex(t, db, "expiry", "fqdn", map[string]map[string][]string{
+		"foohost.prod.example.com": {
+			"metrics": {"server.foohost_prod_example_com.cpu", "server.foohost_prod_example_com.disk"},
+			"tags":    {"servers-dc:lhr", "lb-pool:www"},
+		},
+	})
+	err = db.InsertCustom(&m.TagMetric{
+		Tags:    []string{"custom-favorites:btyler"},
+		Metrics: []string{"monitors.was_the_site_up"},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	db.MaterializeIndexes()
+	evaluateTest(t, db, "expiry: before", "lb-pool:www", []string{
+		"server.foohost_prod_example_com.cpu",
+		"server.foohost_prod_example_com.disk",
+	})
+
+	expiredMetrics, expiredTags := stats.ExpiredMetrics.Value(), stats.ExpiredTags.Value()
+
+	now = now.Add(30 * time.Minute)
+	err = db.InsertMetrics(&m.KeyMetric{Key: "fqdn", Value: "foohost.prod.example.com", Metrics: []string{"server.foohost_prod_example_com.cpu"}})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	db.MaterializeIndexes()
+
+	// the service TTL is shorter than the index one
+	evaluateTest(t, db, "expiry: service TTL", "lb-pool:www", []string{})
+	evaluateTest(t, db, "expiry: index TTL not reached yet", "servers-dc:lhr", []string{
+		"server.foohost_prod_example_com.cpu",
+		"server.foohost_prod_example_com.disk",
+	})
+
+	now = now.Add(40 * time.Minute)
+	db.MaterializeIndexes()
+
+	evaluateTest(t, db, "expiry: index TTL", "servers-dc:lhr", []string{})
+	evaluateTest(t, db, "expiry: custom associations", "custom-favorites:btyler", []string{})
+	searchTest(t, db, "expired metrics leave the text index", []string{"foohost"}, []string{"server.foohost_prod_example_com.cpu"})
+	searchTest(t, db, "expired custom metrics leave the text index", []string{"monitors"}, []string{})
+
+	if got := stats.ExpiredMetrics.Value() - expiredMetrics; got != 2 {
+		t.Errorf("expiry: expected 2 expired metrics, got %d", got)
+	}
+	if got := stats.ExpiredTags.Value() - expiredTags; got != 2 {
+		t.Errorf("expiry: expected 2 expired tag assignments, got %d", got)
+	}
+
+	expected := map[string]map[string]map[string]map[string]int{
+		"full index": {"custom": {}},
+		"fqdn":       {"servers": {}, "lb": {}},
+	}
+	if table := db.TableOfContents(); !reflect.DeepEqual(expected, table) {
+		t.Errorf("expiry: table of contents expected %v, got %v", expected, table)
+	}
+	if rawTags := db.writeBuffer.splits["fqdn"].rawTags; len(rawTags) != 0 {
+		t.Errorf("expiry: expected expired tags to be forgotten, got %v", rawTags)
+	}
+}
+
+func TestExpiryConfig(t *testing.T) {
+	db := New(queryLimit, resultLimit, fullService, textService, splitIndexes, stats)
+	badConfigs := map[string][2]map[string]time.Duration{
+		"unknown index":      {{"nope": time.Hour}, nil},
+		"unknown service":    {nil, {"nope": time.Hour}},
+		"text service":       {nil, {textService: time.Hour}},
+		"negative TTL":       {{"fqdn": -time.Hour}, nil},
+		"sub-second TTL":     {nil, {"servers": time.Millisecond}},
+		"index as service":   {nil, {"fqdn": time.Hour}},
+		"service as index":   {{"servers": time.Hour}, nil},
+		"full service index": {{fullService: time.Hour}, nil},
+	}
+
+	for name, config := range badConfigs {
+		err := db.EnableExpiry(config[0], config[1])
+		if err == nil {
+			t.Errorf("expiry config: %s: expected an error", name)
+		}
+	}
+}
+
+func TestExpiryOfOlderWrites(t *testing.T) {
+	db := New(queryLimit, resultLimit, fullService, textService, map[string][]string{"fqdn": {"servers"}}, stats)
+	err := db.EnableExpiry(map[string]time.Duration{"fqdn": time.Hour}, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	now := time.Unix(1500000000, 0)
+	db.writeBuffer.now = func() time.Time { return now }
+
+	// written long enough ago to expire right away, as a message replayed
+	// from a log might have been
+	written := now.Add(-2 * time.Hour)
+	err = db.InsertMetricsAt(&m.KeyMetric{Key: "fqdn", Value: "foohost.prod.example.com", Metrics: []string{"server.foohost_prod_example_com.cpu"}}, written)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = db.InsertTagsAt(&m.KeyTag{Key: "fqdn", Value: "foohost.prod.example.com", Tags: []string{"servers-dc:lhr"}}, written)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = db.InsertMetrics(&m.KeyMetric{Key: "fqdn", Value: "barhost.prod.example.com", Metrics: []string{"server.barhost_prod_example_com.cpu"}})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = db.InsertTags(&m.KeyTag{Key: "fqdn", Value: "barhost.prod.example.com", Tags: []string{"servers-dc:lhr"}})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	db.MaterializeIndexes()
+
+	evaluateTest(t, db, "expiry: older writes", "servers-dc:lhr", []string{"server.barhost_prod_example_com.cpu"})
+}
@@ -0,0 +1,53 @@
+package database
+
+import (
+	"time"
+
+	"github.com/kanatohodets/carbonsearch/index"
+)
+
+// Explanation describes how a query was run: how many joins or metrics each
+// tag matched, and how big the result was after every step, along with
+// timings. It's meant to answer "which tag eliminated everything?"
+type Explanation struct {
+	Query string `json:"query"`
+	// the parsed query, as the planner saw it
+	Plan    string        `json:"plan,omitempty"`
+	Count   int           `json:"count"`
+	Metrics []string      `json:"metrics"`
+	Error   string        `json:"error,omitempty"`
+	Took    time.Duration `json:"took_ns"`
+	Trace   *index.Trace  `json:"trace"`
+}
+
+// Explain parses and runs a query like Evaluate does, but records everything
+// that happens along the way. Errors are reported in the explanation, since
+// an explanation of a failed query is still useful (especially one that
+// selected too many metrics).
+func (db *Database) Explain(query string) *Explanation {
+	start := time.Now()
+	explanation := &Explanation{
+		Query:   query,
+		Metrics: []string{},
+		Trace:   &index.Trace{Tags: []index.TagTrace{}, Steps: []index.StepTrace{}},
+	}
+
+	root, err := db.Parse(query)
+	if err != nil {
+		explanation.Error = err.Error()
+		explanation.Took = time.Since(start)
+		return explanation
+	}
+	explanation.Plan = root.String()
+
+	metrics, err := db.run(root, explanation.Trace)
+	explanation.Count = len(metrics)
+	if err != nil {
+		explanation.Error = err.Error()
+	} else {
+		explanation.Metrics = metrics
+	}
+
+	explanation.Took = time.Since(start)
+	return explanation
+}
@@ -0,0 +1,86 @@
+package database
+
+import (
+	"testing"
+
+	"github.com/kanatohodets/carbonsearch/index"
+)
+
+func TestExplain(t *testing.T) {
+	smallResultLimit := 2
+	db := New(queryLimit, smallResultLimit, fullService, textService, splitIndexes, stats)
+	populateSplitIndex(t, db, "explain",
+		"fqdn",
+		map[string]map[string][]string{
+			"foohost-4335.staging.example.com": {
+				"metrics": {"server.foohost-4335_staging_example_com.cpu.loadavg", "monitors.was_the_site_up"},
+				"tags":    {"servers-dc:us_west", "servers-status:live"},
+			},
+			"barhost-1000.prod.example.com": {
+				"metrics": {"server.barhost-1000_prod_example_com.tcp.tx_byte"},
+				"tags":    {"servers-dc:us_west", "servers-status:borked"},
+			},
+		},
+	)
+
+	explanation := db.Explain("servers-dc:us_west.servers-status:maint")
+	if explanation.Error != "" {
+		t.Errorf("explain test: unexpected error explaining a query: %v", explanation.Error)
+		return
+	}
+
+	if explanation.Count != 0 || len(explanation.Metrics) != 0 {
+		t.Errorf("explain test: expected no metrics, but got %v: %q", explanation.Count, explanation.Metrics)
+	}
+
+	expectedTags := map[string]int{
+		"servers-dc:us_west":   2,
+		"servers-status:maint": 0,
+	}
+	for _, tagTrace := range explanation.Trace.Tags {
+		expected, ok := expectedTags[tagTrace.Tag]
+		if !ok {
+			t.Errorf("explain test: found a trace for unexpected tag %q", tagTrace.Tag)
+			continue
+		}
+		if tagTrace.Matched != expected || tagTrace.Unit != "joins" || tagTrace.Index != "fqdn" {
+			t.Errorf("explain test: expected %q to match %v joins in fqdn, but got %+v", tagTrace.Tag, expected, tagTrace)
+		}
+		delete(expectedTags, tagTrace.Tag)
+	}
+	if len(expectedTags) != 0 {
+		t.Errorf("explain test: tags missing from the trace: %v", expectedTags)
+	}
+
+	explanation = db.Explain("servers-dc:us_west.!servers-status:borked")
+	expectedSteps := []index.StepTrace{
+		{Index: "fqdn", Stage: "joins after intersection", Count: 2},
+		{Index: "fqdn", Stage: "metrics after union", Count: 3},
+		{Query: `and("servers-dc:us_west",not("servers-status:borked"))`, Stage: "metrics after intersection", Count: 3},
+		{Index: "fqdn", Stage: "joins after intersection", Count: 1},
+		{Index: "fqdn", Stage: "metrics after union", Count: 1},
+		{Query: `and("servers-dc:us_west",not("servers-status:borked"))`, Stage: "metrics after removing negated tags", Count: 2},
+		{Stage: "metrics after unmapping", Count: 2},
+	}
+	if len(explanation.Trace.Steps) != len(expectedSteps) {
+		t.Errorf("explain test: expected %v steps, but got %+v", len(expectedSteps), explanation.Trace.Steps)
+		return
+	}
+	for i, step := range explanation.Trace.Steps {
+		step.Took = 0
+		if step != expectedSteps[i] {
+			t.Errorf("explain test: step %v expected %+v, but got %+v", i, expectedSteps[i], step)
+		}
+	}
+
+	// explaining a query that's too big still says how big it was
+	explanation = db.Explain("servers-dc:us_west")
+	if explanation.Count != 3 || len(explanation.Metrics) != 0 || explanation.Error == "" {
+		t.Errorf("explain test: expected an error for selecting 3 metrics, but got %+v", explanation)
+	}
+
+	explanation = db.Explain("servers-dc:us_west.(")
+	if explanation.Error == "" || explanation.Plan != "" {
+		t.Errorf("explain test: expected a parse error, but got %+v", explanation)
+	}
+}
@@ -0,0 +1,401 @@
+package database
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/kanatohodets/carbonsearch/index"
+)
+
+/*
+	the planner evaluates a parsed query against the indexes. The goal is to
+	hand each index as much of the query as possible in a single index.Query,
+	since the indexes can do set operations on their own terms (for example,
+	the split index unions and intersects join keys before ever looking at
+	metrics):
+
+		- tags ANDed together are grouped into one index.Query per index
+		- negated tags ANDed with those become negated tags in that query
+		- an OR of plain tags from the same (non-text) index becomes a union
+		  group in that query, just like alternation
+
+	anything else (an OR across indexes, a negated group, a nested AND inside
+	an OR) is evaluated on its own and combined with the rest at the metric
+	level, which is always correct, just not as cheap.
+*/
+
+// Evaluate runs a parsed query against the indexes and returns the names of
+// the matching metrics. If the query cache is enabled, the result may be
+// shared with other callers, so it must not be modified.
+func (db *Database) Evaluate(root Node) ([]string, error) {
+	stringMetrics, err := db.evaluateAll(root)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.checkResultLimit(stringMetrics)
+	if err != nil {
+		return nil, err
+	}
+	return stringMetrics, nil
+}
+
+// Page is part of the result of a query, from EvaluatePage
+type Page struct {
+	Metrics []string
+	// how many metrics the whole query selected
+	Total int
+	// true if Metrics doesn't hold every metric the query selected
+	Truncated bool
+}
+
+// EvaluatePage runs a parsed query like Evaluate, but instead of failing when
+// the query selects too many metrics, it sorts the metrics and returns up to
+// limit of them, starting at offset. The limit is capped at the result limit.
+func (db *Database) EvaluatePage(root Node, offset, limit int) (*Page, error) {
+	if offset < 0 {
+		return nil, fmt.Errorf("database: offset %d is negative", offset)
+	}
+	if limit <= 0 || limit > db.resultLimit {
+		limit = db.resultLimit
+	}
+
+	stringMetrics, err := db.evaluateAll(root)
+	if err != nil {
+		return nil, err
+	}
+
+	// the result may be shared with the query cache, so sort a copy
+	sorted := make([]string, len(stringMetrics))
+	copy(sorted, stringMetrics)
+	sort.Strings(sorted)
+
+	if offset > len(sorted) {
+		offset = len(sorted)
+	}
+	end := offset + limit
+	if end > len(sorted) {
+		end = len(sorted)
+	}
+
+	page := sorted[offset:end]
+	return &Page{
+		Metrics:   page,
+		Total:     len(sorted),
+		Truncated: len(page) < len(sorted),
+	}, nil
+}
+
+// evaluateAll runs the query (or finds it in the query cache) without
+// checking the result limit
+func (db *Database) evaluateAll(root Node) ([]string, error) {
+	current := db.view()
+	if db.queryCache == nil {
+		return db.resolve(current, root, nil)
+	}
+
+	key := fmt.Sprintf("%s@%d", Normalize(root), current.generation)
+	return db.queryCache.get(key, func() ([]string, error) {
+		return db.resolve(current, root, nil)
+	}, func(metrics []string) bool {
+		// results over the limit are only wanted by truncated searches,
+		// which can afford to evaluate them again. caching them would let a
+		// few huge queries push everything else out of the cache
+		return len(metrics) <= db.resultLimit && db.view() == current
+	})
+}
+
+// run evaluates the query, recording what happens in trace (if it isn't nil).
+// If the query selects too many metrics, the metrics are returned along with
+// the error, so explain can still say how many there were.
+func (db *Database) run(root Node, trace *index.Trace) ([]string, error) {
+	stringMetrics, err := db.resolve(db.view(), root, trace)
+	if err != nil {
+		return nil, err
+	}
+	return stringMetrics, db.checkResultLimit(stringMetrics)
+}
+
+// resolve evaluates the query and maps the resulting metrics back to names
+func (db *Database) resolve(current *view, root Node, trace *index.Trace) ([]string, error) {
+	metrics, err := db.evaluate(current, root, trace)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	stringMetrics, err := current.text.UnmapMetrics(metrics)
+	// TODO(btyler): try to figure out how to annotate this error with better
+	// information, since just seeing a random int64 will not be very handy
+	if err != nil {
+		return nil, err
+	}
+	trace.Step("", "", "metrics after unmapping", len(stringMetrics), start)
+	return stringMetrics, nil
+}
+
+func (db *Database) checkResultLimit(stringMetrics []string) error {
+	if len(stringMetrics) > db.resultLimit {
+		return fmt.Errorf("database: query selected %d metrics, which is over the limit of %d results in a single query", len(stringMetrics), db.resultLimit)
+	}
+	return nil
+}
+
+func (db *Database) evaluate(current *view, node Node, trace *index.Trace) ([]index.Metric, error) {
+	switch n := node.(type) {
+	case *TagNode:
+		return db.evaluateAnd(current, []Node{n}, trace)
+	case *AndNode:
+		return db.evaluateAnd(current, n.Children, trace)
+	case *OrNode:
+		return db.evaluateOr(current, n.Children, trace)
+	case *NotNode:
+		return nil, fmt.Errorf("database: this query only has negated tags. please add at least one tag to select metrics with (negated tags can only remove metrics from the result)")
+	}
+	return nil, fmt.Errorf("database: unknown query node %v", node)
+}
+
+func (db *Database) evaluateAnd(current *view, children []Node, trace *index.Trace) ([]index.Metric, error) {
+	queriesByIndex := map[index.Index]*index.Query{}
+	metricSets := [][]index.Metric{}
+	excludedSets := [][]index.Metric{}
+	positive := 0
+	for _, child := range children {
+		switch c := child.(type) {
+		case *TagNode:
+			isPositive, err := db.foldTag(current, queriesByIndex, c, false)
+			if err != nil {
+				return nil, err
+			}
+			if isPositive {
+				positive++
+			}
+		case *NotNode:
+			if tagNode, ok := c.Child.(*TagNode); ok {
+				isPositive, err := db.foldTag(current, queriesByIndex, tagNode, true)
+				if err != nil {
+					return nil, err
+				}
+				if isPositive {
+					positive++
+				}
+				continue
+			}
+
+			excluded, err := db.evaluate(current, c.Child, trace)
+			if err != nil {
+				return nil, err
+			}
+			excludedSets = append(excludedSets, excluded)
+		case *OrNode:
+			positive++
+			if targetIndex, alternatives, ok := db.foldableUnion(current, c.Children); ok {
+				q, ok := queriesByIndex[targetIndex]
+				if !ok {
+					q = current.newQuery()
+					queriesByIndex[targetIndex] = q
+				}
+				q.AddUnion(alternatives)
+				continue
+			}
+
+			metrics, err := db.evaluateOr(current, c.Children, trace)
+			if err != nil {
+				return nil, err
+			}
+			metricSets = append(metricSets, metrics)
+		default:
+			positive++
+			metrics, err := db.evaluate(current, c, trace)
+			if err != nil {
+				return nil, err
+			}
+			metricSets = append(metricSets, metrics)
+		}
+	}
+
+	if positive == 0 {
+		return nil, fmt.Errorf("database: this query only has negated tags. please add at least one tag to select metrics with (negated tags can only remove metrics from the result)")
+	}
+
+	// query indexes, take intersection of metrics
+	for targetIndex, query := range queriesByIndex {
+		if query.Empty() {
+			continue
+		}
+
+		query.Trace = trace
+		metrics, err := current.index(targetIndex).Query(query)
+		if err != nil {
+			return nil, fmt.Errorf("database: error while querying index %s: %s", targetIndex.Name(), err)
+		}
+
+		metricSets = append(metricSets, metrics)
+	}
+
+	start := time.Now()
+	metrics := index.IntersectMetrics(metricSets)
+	var label string
+	if trace != nil {
+		label = newAnd(children).String()
+	}
+	trace.Step("", label, "metrics after intersection", len(metrics), start)
+
+	// query indexes for anything matching a negated tag, and remove it
+	for targetIndex, query := range queriesByIndex {
+		// the text index can only give a superset of the real matches, so
+		// negated text tags are handled by Filter instead
+		if len(query.Negated) == 0 || targetIndex == db.TextIndex {
+			continue
+		}
+
+		negatedQuery := current.newQuery()
+		negatedQuery.AddUnion(query.RawNegated)
+		negatedQuery.Trace = trace
+		excluded, err := current.index(targetIndex).Query(negatedQuery)
+		if err != nil {
+			return nil, fmt.Errorf("database: error while querying index %s for negated tags: %s", targetIndex.Name(), err)
+		}
+
+		excludedSets = append(excludedSets, excluded)
+	}
+
+	if len(excludedSets) > 0 {
+		start := time.Now()
+		metrics = index.DifferenceMetrics(metrics, index.UnionMetrics(excludedSets))
+		trace.Step("", label, "metrics after removing negated tags", len(metrics), start)
+	}
+
+	textQuery, ok := queriesByIndex[db.TextIndex]
+	if !ok {
+		return metrics, nil
+	}
+
+	return db.filterText(current, textQuery, metrics, trace, label)
+}
+
+func (db *Database) evaluateOr(current *view, children []Node, trace *index.Trace) ([]index.Metric, error) {
+	alternativesByIndex := map[index.Index][]string{}
+	metricSets := [][]index.Metric{}
+	for _, child := range children {
+		if _, ok := child.(*NotNode); ok {
+			return nil, fmt.Errorf("database: %v is negated, but it is part of an OR. negated tags can only remove metrics from other tags they're ANDed with", child)
+		}
+
+		tagNode, ok := child.(*TagNode)
+		if ok && tagNode.Service != db.textIndexService {
+			targetIndex, ok := db.serviceToIndex[tagNode.Service]
+			if !ok {
+				logger.Logf("warning: there's no index for service %q. as a result, this tag will not match anything: %v", tagNode.Service, tagNode.Tag)
+				continue
+			}
+
+			alternatives, _, err := db.expand(current, tagNode.Service, targetIndex, tagNode.Tag)
+			if err != nil {
+				return nil, fmt.Errorf("database: error while expanding %q: %s", tagNode.Tag, err)
+			}
+			alternativesByIndex[targetIndex] = append(alternativesByIndex[targetIndex], alternatives...)
+			continue
+		}
+
+		metrics, err := db.evaluate(current, child, trace)
+		if err != nil {
+			return nil, err
+		}
+		metricSets = append(metricSets, metrics)
+	}
+
+	for targetIndex, alternatives := range alternativesByIndex {
+		query := current.newQuery()
+		query.AddUnion(alternatives)
+		query.Trace = trace
+		metrics, err := current.index(targetIndex).Query(query)
+		if err != nil {
+			return nil, fmt.Errorf("database: error while querying index %s: %s", targetIndex.Name(), err)
+		}
+		metricSets = append(metricSets, metrics)
+	}
+
+	start := time.Now()
+	metrics := index.UnionMetrics(metricSets)
+	if trace != nil {
+		trace.Step("", newOr(children).String(), "metrics after union", len(metrics), start)
+	}
+	return metrics, nil
+}
+
+// foldTag adds a tag to the query for its index. The boolean result is true
+// if the tag selects metrics (rather than removing them).
+func (db *Database) foldTag(current *view, queriesByIndex map[index.Index]*index.Query, tagNode *TagNode, negated bool) (bool, error) {
+	queryTag, textNegated := db.parseNegation(tagNode.Service, tagNode.Tag)
+	// '!text-match:!foo' is a double negative
+	negated = negated != textNegated
+
+	targetIndex, ok := db.serviceToIndex[tagNode.Service]
+	if !ok {
+		logger.Logf("warning: there's no index for service %q. as a result, this tag will be ignored: %v", tagNode.Service, tagNode.Tag)
+		logger.Logln("this means that no tags have been added to the database with this service; the producer has not started yet")
+		return !negated, nil
+	}
+
+	q, ok := queriesByIndex[targetIndex]
+	if !ok {
+		q = current.newQuery()
+		queriesByIndex[targetIndex] = q
+	}
+
+	alternatives, union, err := db.expand(current, tagNode.Service, targetIndex, queryTag)
+	if err != nil {
+		return false, fmt.Errorf("database: error while expanding %q: %s", queryTag, err)
+	}
+
+	if negated {
+		q.AddNegated(alternatives)
+	} else if union {
+		q.AddUnion(alternatives)
+	} else {
+		q.AddTags(alternatives)
+	}
+	return !negated, nil
+}
+
+// foldableUnion checks whether an OR is made of plain tags from a single
+// non-text index, so it can be folded into that index's query as a union
+// group. If so, it returns the index and all of the alternatives.
+func (db *Database) foldableUnion(current *view, children []Node) (index.Index, []string, bool) {
+	var targetIndex index.Index
+	alternatives := []string{}
+	for _, child := range children {
+		tagNode, ok := child.(*TagNode)
+		if !ok || tagNode.Service == db.textIndexService {
+			return nil, nil, false
+		}
+
+		childIndex, ok := db.serviceToIndex[tagNode.Service]
+		if !ok || (targetIndex != nil && childIndex != targetIndex) {
+			return nil, nil, false
+		}
+		targetIndex = childIndex
+
+		expanded, _, err := db.expand(current, tagNode.Service, targetIndex, tagNode.Tag)
+		if err != nil {
+			// evaluateOr will report the error
+			return nil, nil, false
+		}
+		alternatives = append(alternatives, expanded...)
+	}
+	return targetIndex, alternatives, true
+}
+
+// filterText checks metrics against the text searches exactly: the text index
+// query only gives a superset of the real matches.
+func (db *Database) filterText(current *view, textQuery *index.Query, metrics []index.Metric, trace *index.Trace, label string) ([]index.Metric, error) {
+	start := time.Now()
+	filtered, err := current.text.FilterMetrics(textQuery, metrics)
+	if err != nil {
+		return nil, err
+	}
+	trace.Step(db.TextIndex.Name(), label, "metrics after text filter", len(filtered), start)
+	return filtered, nil
+}
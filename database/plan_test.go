@@ -0,0 +1,208 @@
+package database
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	m "github.com/kanatohodets/carbonsearch/consumer/message"
+)
+
+func TestEvaluate(t *testing.T) {
+	db := New(queryLimit, resultLimit, fullService, textService, splitIndexes, stats)
+	err := db.InsertCustom(&m.TagMetric{
+		Tags:    []string{"custom-favorites:tester"},
+		Metrics: []string{"monitors.was_the_site_up", "server.quxhost-0003_dev_example_com.iowait.5m"},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	populateSplitIndex(t, db, "boolean queries",
+		"fqdn",
+		map[string]map[string][]string{
+			"foohost-4335.staging.example.com": {
+				"metrics": {
+					"server.foohost-4335_staging_example_com.cpu.loadavg",
+					"monitors.was_the_site_up",
+				},
+				"tags": {"servers-hw:shiny", "servers-dc:us_west", "servers-status:live", "servers-roles:foo"},
+			},
+			"barhost-1000.prod.example.com": {
+				"metrics": {"server.barhost-1000_prod_example_com.tcp.tx_byte"},
+				"tags":    {"servers-hw:shiny", "servers-dc:us_west", "servers-status:live", "servers-roles:bar"},
+			},
+			"quxhost-0003.dev.example.com": {
+				"metrics": {"server.quxhost-0003_dev_example_com.iowait.5m"},
+				"tags":    {"servers-hw:rusty", "servers-dc:us_east", "servers-status:borked", "servers-roles:qux"},
+			},
+		},
+	)
+
+	evaluateTest(t, db, "OR in one index",
+		"servers-roles:foo|servers-roles:qux",
+		[]string{
+			"server.foohost-4335_staging_example_com.cpu.loadavg",
+			"monitors.was_the_site_up",
+			"server.quxhost-0003_dev_example_com.iowait.5m",
+		},
+	)
+
+	evaluateTest(t, db, "OR across indexes",
+		"servers-roles:bar|custom-favorites:tester",
+		[]string{
+			"server.barhost-1000_prod_example_com.tcp.tx_byte",
+			"monitors.was_the_site_up",
+			"server.quxhost-0003_dev_example_com.iowait.5m",
+		},
+	)
+
+	evaluateTest(t, db, "negated group",
+		"servers-status:live.!(servers-roles:foo|servers-roles:qux)",
+		[]string{
+			"server.barhost-1000_prod_example_com.tcp.tx_byte",
+		},
+	)
+
+	evaluateTest(t, db, "AND inside of OR",
+		"(servers-roles:foo.servers-dc:us_west)|servers-hw:rusty",
+		[]string{
+			"server.foohost-4335_staging_example_com.cpu.loadavg",
+			"monitors.was_the_site_up",
+			"server.quxhost-0003_dev_example_com.iowait.5m",
+		},
+	)
+
+	evaluateTest(t, db, "text search inside of OR",
+		fmt.Sprintf("servers-hw:shiny.(custom-favorites:tester|%stx_byte)", textMatchPrefix),
+		[]string{
+			"monitors.was_the_site_up",
+			"server.barhost-1000_prod_example_com.tcp.tx_byte",
+		},
+	)
+
+	evaluateTest(t, db, "negated group of text searches",
+		fmt.Sprintf("servers-hw:{shiny,rusty}.!(%sloadavg|%siowait)", textMatchPrefix, textMatchPrefix),
+		[]string{
+			"monitors.was_the_site_up",
+			"server.barhost-1000_prod_example_com.tcp.tx_byte",
+		},
+	)
+
+	evaluateErrorTest(t, db, "negated tag inside of OR",
+		"servers-roles:foo|!servers-roles:bar",
+		"database: not(\"servers-roles:bar\") is negated, but it is part of an OR. negated tags can only remove metrics from other tags they're ANDed with",
+	)
+
+	evaluateErrorTest(t, db, "only a negated group",
+		"!(servers-roles:foo|servers-roles:bar)",
+		"database: this query only has negated tags. please add at least one tag to select metrics with (negated tags can only remove metrics from the result)",
+	)
+}
+
+func TestEvaluatePage(t *testing.T) {
+	smallResultLimit := 2
+	db := New(queryLimit, smallResultLimit, fullService, textService, splitIndexes, stats)
+	err := db.InsertCustom(&m.TagMetric{
+		Tags:    []string{"custom-favorites:tester"},
+		Metrics: []string{"charlie.metric", "alpha.metric", "bravo.metric"},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	db.MaterializeIndexes()
+
+	evaluateErrorTest(t, db, "too many results without paging",
+		"custom-favorites:tester",
+		"database: query selected 3 metrics, which is over the limit of 2 results in a single query",
+	)
+
+	evaluatePageTest(t, db, "first page", "custom-favorites:tester", 0, 0,
+		&Page{Metrics: []string{"alpha.metric", "bravo.metric"}, Total: 3, Truncated: true},
+	)
+	evaluatePageTest(t, db, "offset", "custom-favorites:tester", 1, 1,
+		&Page{Metrics: []string{"bravo.metric"}, Total: 3, Truncated: true},
+	)
+	evaluatePageTest(t, db, "last page", "custom-favorites:tester", 2, 2,
+		&Page{Metrics: []string{"charlie.metric"}, Total: 3, Truncated: true},
+	)
+	evaluatePageTest(t, db, "past the end", "custom-favorites:tester", 10, 2,
+		&Page{Metrics: []string{}, Total: 3, Truncated: true},
+	)
+	evaluatePageTest(t, db, "everything fits", "custom-favorites:tester."+textMatchPrefix+"alpha", 0, 0,
+		&Page{Metrics: []string{"alpha.metric"}, Total: 1, Truncated: false},
+	)
+}
+
+func evaluatePageTest(t *testing.T, db *Database, testName, query string, offset, limit int, expected *Page) {
+	root, err := db.Parse(query)
+	if err != nil {
+		t.Errorf("%v: error parsing query (this is not what this test is testing, so probably a buggy test): %v", testName, err)
+		return
+	}
+
+	page, err := db.EvaluatePage(root, offset, limit)
+	if err != nil {
+		t.Errorf("%v: error during db.EvaluatePage: %v", testName, err)
+		return
+	}
+
+	if !reflect.DeepEqual(page, expected) {
+		t.Errorf("%v: expected %+v, got %+v", testName, expected, page)
+	}
+}
+
+func evaluateTest(t *testing.T, db *Database, testName, query string, expectedMetrics []string) {
+	root, err := db.Parse(query)
+	if err != nil {
+		t.Errorf("%v: error parsing query (this is not what this test is testing, so probably a buggy test): %v", testName, err)
+		return
+	}
+
+	result, err := db.Evaluate(root)
+	if err != nil {
+		t.Errorf("%v: error during db.Evaluate: %v", testName, err)
+		return
+	}
+
+	expectedSet := map[string]bool{}
+	for _, metric := range expectedMetrics {
+		expectedSet[metric] = true
+	}
+
+	resultSet := map[string]bool{}
+	for _, metric := range result {
+		resultSet[metric] = true
+		if !expectedSet[metric] {
+			t.Errorf("%v: found %q in the result, but we shouldn't have!", testName, metric)
+			return
+		}
+	}
+
+	for expected := range expectedSet {
+		if !resultSet[expected] {
+			t.Errorf("%v: expected to find %q in the query result, but it wasn't there!", testName, expected)
+			return
+		}
+	}
+}
+
+func evaluateErrorTest(t *testing.T, db *Database, testName, query, expectedErr string) {
+	root, err := db.Parse(query)
+	if err != nil {
+		t.Errorf("%v: error parsing query (this is not what this test is testing, so probably a buggy test): %v", testName, err)
+		return
+	}
+
+	_, err = db.Evaluate(root)
+	if err == nil {
+		t.Errorf("error case %q failed to throw error", testName)
+		return
+	}
+
+	if err.Error() != expectedErr {
+		t.Errorf("error case %q threw an unexpected error: got %q, expected %q", testName, err, expectedErr)
+	}
+}
@@ -0,0 +1,529 @@
+package database
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/kanatohodets/carbonsearch/tag"
+)
+
+/*
+	the query language is a small boolean language over tags:
+
+		servers-dc:lhr.(lb-pool:www|lb-pool:api).!(servers-status:maint|servers-hw:rusty)
+
+	'.' is AND, '|' is OR, a leading '!' is NOT, and parentheses group. NOT
+	binds tightest, then AND, then OR, so 'a.b|c' is '(a.b)|c'. A query that
+	only uses '.' and '!' is the same dot-AND query language we've always had.
+
+	quoting with '<...>' works like before: everything inside the quotes is
+	part of the tag, including dots, pipes and parens. Alternation braces
+	('servers-dc:{lhr,ams}') are also kept together as part of one tag.
+*/
+
+// Node is a node in a parsed query: one of *TagNode, *AndNode, *OrNode, or
+// *NotNode.
+type Node interface {
+	// String renders the node in an unambiguous (but not re-parseable) form,
+	// for logging.
+	String() string
+}
+
+// TagNode is a single query tag, like 'servers-dc:lhr'. The tag may still
+// use alternation, globs, or numeric comparisons: those are resolved while
+// planning the query.
+type TagNode struct {
+	Service string
+	Tag     string
+}
+
+// AndNode matches metrics matched by all of its children
+type AndNode struct {
+	Children []Node
+}
+
+// OrNode matches metrics matched by any of its children
+type OrNode struct {
+	Children []Node
+}
+
+// NotNode removes the metrics matched by its child. It can only be used as
+// part of an AND with at least one non-negated term.
+type NotNode struct {
+	Child Node
+}
+
+func (n *TagNode) String() string { return fmt.Sprintf("%q", n.Tag) }
+func (n *AndNode) String() string { return "and(" + joinNodes(n.Children) + ")" }
+func (n *OrNode) String() string  { return "or(" + joinNodes(n.Children) + ")" }
+func (n *NotNode) String() string { return "not(" + n.Child.String() + ")" }
+
+func joinNodes(nodes []Node) string {
+	rendered := make([]string, len(nodes))
+	for i, node := range nodes {
+		rendered[i] = node.String()
+	}
+	return strings.Join(rendered, ",")
+}
+
+// newAnd and newOr flatten nested nodes of the same kind, so '(a.b).c'
+// becomes a single AND with three children
+func newAnd(children []Node) Node {
+	if len(children) == 1 {
+		return children[0]
+	}
+
+	flat := make([]Node, 0, len(children))
+	for _, child := range children {
+		if and, ok := child.(*AndNode); ok {
+			flat = append(flat, and.Children...)
+			continue
+		}
+		flat = append(flat, child)
+	}
+	return &AndNode{Children: flat}
+}
+
+func newOr(children []Node) Node {
+	if len(children) == 1 {
+		return children[0]
+	}
+
+	flat := make([]Node, 0, len(children))
+	for _, child := range children {
+		if or, ok := child.(*OrNode); ok {
+			flat = append(flat, or.Children...)
+			continue
+		}
+		flat = append(flat, child)
+	}
+	return &OrNode{Children: flat}
+}
+
+func newNot(child Node) Node {
+	// '!!a' is just 'a'
+	if not, ok := child.(*NotNode); ok {
+		return not.Child
+	}
+	return &NotNode{Child: child}
+}
+
+type tokenKind int
+
+const (
+	tagToken tokenKind = iota
+	andToken
+	orToken
+	notToken
+	openParenToken
+	closeParenToken
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tagToken:
+		return fmt.Sprintf("tag %q", t.text)
+	case andToken:
+		return "'.'"
+	case orToken:
+		return "'|'"
+	case notToken:
+		return "'!'"
+	case openParenToken:
+		return "'('"
+	case closeParenToken:
+		return "')'"
+	}
+	return "unknown token"
+}
+
+// a numeric comparison in a query, followed by whatever ends the tag value
+var comparisonPattern = regexp.MustCompile(`^([<>]=?-?[0-9]+(?:\.[0-9]+)?)(?:\.[^0-9]|[|),}]|$)`)
+
+// Parse parses a query into a tree of nodes. Every tag is checked to be
+// a valid tag, and the query can't have more than the query limit of tags.
+func (db *Database) Parse(query string) (Node, error) {
+	tokens, err := db.lex(query)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{query: query, tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("database ParseQuery: unexpected %v in %q", p.tokens[p.pos], query)
+	}
+
+	if len(p.tags) > db.queryLimit {
+		return nil, fmt.Errorf(
+			"database ParseQuery: max query size is %v, but this query has %v tags. try again with a smaller query",
+			db.queryLimit,
+			len(p.tags),
+		)
+	}
+
+	negated := negatedTags(root)
+	for _, tagNode := range p.tags {
+		service, err := tag.ParseService(tagNode.Tag)
+		if err != nil {
+			return nil, err
+		}
+
+		if service == db.textIndexService {
+			err := db.validateText(tagNode.Tag, negated[tagNode])
+			if err != nil {
+				return nil, fmt.Errorf("database ParseQuery: %v", err)
+			}
+		} else if tag.HasAlternation(tagNode.Tag) {
+			err := validateAlternation(service, tagNode.Tag, db.queryLimit)
+			if err != nil {
+				return nil, fmt.Errorf("database ParseQuery: %v", err)
+			}
+		}
+
+		tagNode.Service = service
+		db.stats.QueryTagsByService.Add(service, 1)
+	}
+
+	return root, nil
+}
+
+// lex splits a query into tags and operators.
+//
+// dopey quote matching (we don't support nested quotes, so don't bother with a stack)
+// note that this parsing drops the quote characters from the query.
+// alternation braces are kept, and operators inside of them are part of the tag.
+// a quote character at the start of a tag value might also be a numeric
+// comparison, as in 'servers-ram_gb:<128'; see comparisonLength.
+func (db *Database) lex(query string) ([]token, error) {
+	tokens := []token{}
+	inQuotes := false
+	inBraces := false
+	chars := []rune(query)
+	currentTag := make([]rune, 0, 50)
+	quoted := false
+
+	endTag := func() {
+		if len(currentTag) > 0 || quoted {
+			tokens = append(tokens, token{kind: tagToken, text: string(currentTag)})
+		}
+		currentTag = make([]rune, 0, 50)
+		quoted = false
+	}
+
+	for i := 0; i < len(chars); i++ {
+		char := chars[i]
+		if inQuotes {
+			if char == OpenQuote {
+				return nil, fmt.Errorf("database ParseQuery: invalid query (two open quotes in a row): %q", query)
+			}
+
+			if char == CloseQuote {
+				inQuotes = false
+				continue
+			}
+
+			currentTag = append(currentTag, char)
+			continue
+		}
+
+		switch {
+		case char == OpenQuote || char == CloseQuote:
+			if n := db.comparisonLength(currentTag, chars[i:]); n > 0 {
+				currentTag = append(currentTag, chars[i:i+n]...)
+				i += n - 1
+				continue
+			}
+
+			if char == CloseQuote {
+				return nil, fmt.Errorf("database ParseQuery: invalid query (close quote without matching open): %q", query)
+			}
+
+			inQuotes = true
+			quoted = true
+		case inBraces:
+			if char == '}' {
+				inBraces = false
+			}
+			currentTag = append(currentTag, char)
+		case char == '{':
+			inBraces = true
+			currentTag = append(currentTag, char)
+		case char == '.':
+			// found the end of a tag, reset and start on the next one
+			endTag()
+			tokens = append(tokens, token{kind: andToken})
+		case char == '|':
+			endTag()
+			tokens = append(tokens, token{kind: orToken})
+		case char == '(':
+			endTag()
+			tokens = append(tokens, token{kind: openParenToken})
+		case char == ')':
+			endTag()
+			tokens = append(tokens, token{kind: closeParenToken})
+		case char == '!' && len(currentTag) == 0 && !quoted:
+			tokens = append(tokens, token{kind: notToken})
+		default:
+			currentTag = append(currentTag, char)
+		}
+	}
+
+	if inQuotes {
+		return nil, fmt.Errorf("database ParseQuery: invalid query (hanging quotes): %q", query)
+	}
+
+	endTag()
+	return tokens, nil
+}
+
+// comparisonLength returns how many characters of rest make up a numeric
+// comparison, like '>=16' in 'servers-num_cpus:>=16', or 0 if rest doesn't
+// start with one. Comparisons only count at the start of a tag value (or of
+// an alternative inside braces) in a non-text service, and the number has to
+// end the value. Otherwise the '<' is a quote, so 'servers-ip:<10.1.2.3>'
+// keeps working.
+func (db *Database) comparisonLength(currentTag []rune, rest []rune) int {
+	service, _, valueSoFar, err := tag.Parse(string(currentTag))
+	if err != nil || service == db.textIndexService {
+		return 0
+	}
+
+	startsValue := valueSoFar == ""
+	startsAlternative := strings.HasPrefix(valueSoFar, "{") &&
+		!strings.Contains(valueSoFar, "}") &&
+		(strings.HasSuffix(valueSoFar, "{") || strings.HasSuffix(valueSoFar, ","))
+	if !startsValue && !startsAlternative {
+		return 0
+	}
+
+	match := comparisonPattern.FindStringSubmatch(string(rest))
+	if match == nil {
+		return 0
+	}
+	return len(match[1])
+}
+
+// parser is a recursive descent parser over the lexed tokens:
+//
+//	or    := and ('|' and)*
+//	and   := unary ('.' unary)*
+//	unary := '!' unary | '(' or ')' | tag
+type parser struct {
+	query  string
+	tokens []token
+	pos    int
+	tags   []*TagNode
+}
+
+func (p *parser) peek() (token, bool) {
+	if p.pos >= len(p.tokens) {
+		return token{}, false
+	}
+	return p.tokens[p.pos], true
+}
+
+func (p *parser) parseOr() (Node, error) {
+	children := []Node{}
+	for {
+		child, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, child)
+
+		next, ok := p.peek()
+		if !ok || next.kind != orToken {
+			return newOr(children), nil
+		}
+		p.pos++
+	}
+}
+
+func (p *parser) parseAnd() (Node, error) {
+	children := []Node{}
+	for {
+		child, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, child)
+
+		next, ok := p.peek()
+		if !ok || next.kind != andToken {
+			return newAnd(children), nil
+		}
+		p.pos++
+	}
+}
+
+func (p *parser) parseUnary() (Node, error) {
+	next, ok := p.peek()
+	if !ok {
+		return nil, fmt.Errorf("database ParseQuery: query ended where a tag was expected: %q", p.query)
+	}
+	p.pos++
+
+	switch next.kind {
+	case notToken:
+		child, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return newNot(child), nil
+	case openParenToken:
+		child, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+
+		closing, ok := p.peek()
+		if !ok || closing.kind != closeParenToken {
+			return nil, fmt.Errorf("database ParseQuery: invalid query (unclosed parenthesis): %q", p.query)
+		}
+		p.pos++
+		return child, nil
+	case tagToken:
+		tagNode := &TagNode{Tag: next.text}
+		p.tags = append(p.tags, tagNode)
+		return tagNode, nil
+	}
+
+	return nil, fmt.Errorf("database ParseQuery: unexpected %v where a tag was expected in %q", next, p.query)
+}
+
+// flatten turns a query that only uses AND and negated tags back into a list
+// of tags, with a leading '!' for negated ones. The boolean result is false
+// if the query uses anything else.
+func flatten(node Node) ([]*TagNode, []bool, bool) {
+	switch n := node.(type) {
+	case *TagNode:
+		return []*TagNode{n}, []bool{false}, true
+	case *NotNode:
+		if tagNode, ok := n.Child.(*TagNode); ok {
+			return []*TagNode{tagNode}, []bool{true}, true
+		}
+	case *AndNode:
+		tags := []*TagNode{}
+		negations := []bool{}
+		for _, child := range n.Children {
+			childTags, childNegations, ok := flatten(child)
+			if !ok {
+				return nil, nil, false
+			}
+			tags = append(tags, childTags...)
+			negations = append(negations, childNegations...)
+		}
+		return tags, negations, true
+	}
+	return nil, nil, false
+}
+
+// negatedTags finds the tags that are negated on their own, like '!a'. Those
+// only remove metrics, so a text search in one is only used as a filter.
+func negatedTags(node Node) map[*TagNode]bool {
+	negated := map[*TagNode]bool{}
+	var walk func(node Node)
+	walk = func(node Node) {
+		switch n := node.(type) {
+		case *NotNode:
+			if tagNode, ok := n.Child.(*TagNode); ok {
+				negated[tagNode] = true
+				return
+			}
+			walk(n.Child)
+		case *AndNode:
+			for _, child := range n.Children {
+				walk(child)
+			}
+		case *OrNode:
+			for _, child := range n.Children {
+				walk(child)
+			}
+		}
+	}
+	walk(node)
+	return negated
+}
+
+// validateText checks each of the searches in a text tag. Regular expressions
+// use '{...}' for repetition, so only text matches can use alternation. A
+// negated search only filters, so it doesn't need anything to look up in the
+// index.
+func (db *Database) validateText(queryTag string, notNegated bool) error {
+	search, textNegated := db.parseNegation(db.textIndexService, queryTag)
+	// '!text-match:!foo' is a double negative
+	negated := notNegated != textNegated
+	if db.TextIndex.IsRegex(search) {
+		err := validateNotEmpty(search)
+		if err != nil {
+			return err
+		}
+		return db.TextIndex.Validate(search, negated)
+	}
+
+	if tag.HasAlternation(search) {
+		err := validateAlternation(db.textIndexService, search, db.queryLimit)
+		if err != nil {
+			return err
+		}
+	}
+
+	alternatives, err := tag.Expand(search, db.queryLimit)
+	if err != nil {
+		return err
+	}
+
+	for _, alternative := range alternatives {
+		err := validateNotEmpty(alternative)
+		if err != nil {
+			return err
+		}
+		err = db.TextIndex.Validate(alternative, negated)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateNotEmpty rejects text searches with nothing to search for, like
+// 'text-match:!' or an empty alternative
+func validateNotEmpty(search string) error {
+	_, _, v, err := tag.Parse(search)
+	if err != nil {
+		return err
+	}
+	if v == "" {
+		return fmt.Errorf("text search %q is empty", search)
+	}
+	return nil
+}
+
+func validateAlternation(service, queryTag string, limit int) error {
+	alternatives, err := tag.Expand(queryTag, limit)
+	if err != nil {
+		return err
+	}
+
+	for _, alternative := range alternatives {
+		alternativeService, err := tag.ParseService(alternative)
+		if err != nil {
+			return err
+		}
+		if alternativeService != service {
+			return fmt.Errorf("alternation in %q spans more than one service (%q and %q), which is not supported", queryTag, service, alternativeService)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package database
+
+import (
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	db := New(queryLimit, resultLimit, fullService, textService, splitIndexes, stats)
+
+	parseTestCase(t, db, "single tag",
+		"servers-dc:lhr",
+		`"servers-dc:lhr"`,
+	)
+
+	parseTestCase(t, db, "dot-AND",
+		"servers-dc:lhr.lb-pool:www",
+		`and("servers-dc:lhr","lb-pool:www")`,
+	)
+
+	parseTestCase(t, db, "OR",
+		"servers-dc:lhr|servers-dc:ams",
+		`or("servers-dc:lhr","servers-dc:ams")`,
+	)
+
+	parseTestCase(t, db, "AND binds tighter than OR",
+		"servers-dc:lhr.lb-pool:www|servers-dc:ams",
+		`or(and("servers-dc:lhr","lb-pool:www"),"servers-dc:ams")`,
+	)
+
+	parseTestCase(t, db, "grouping",
+		"servers-dc:lhr.(lb-pool:www|lb-pool:api)",
+		`and("servers-dc:lhr",or("lb-pool:www","lb-pool:api"))`,
+	)
+
+	parseTestCase(t, db, "negated tag and negated group",
+		"servers-dc:lhr.!lb-pool:www.!(servers-status:maint|servers-hw:rusty)",
+		`and("servers-dc:lhr",not("lb-pool:www"),not(or("servers-status:maint","servers-hw:rusty")))`,
+	)
+
+	parseTestCase(t, db, "double negation",
+		"servers-dc:lhr.!!lb-pool:www",
+		`and("servers-dc:lhr","lb-pool:www")`,
+	)
+
+	parseTestCase(t, db, "nested groups of the same kind are flattened",
+		"(servers-dc:lhr.(lb-pool:www.servers-hw:shiny))",
+		`and("servers-dc:lhr","lb-pool:www","servers-hw:shiny")`,
+	)
+
+	parseTestCase(t, db, "operators inside of quotes and braces are part of the tag",
+		translateQuotes(textMatchPrefix+"<foo.(bar|baz)>.servers-fqdn:{a.example.com,b.example.com}|servers-dc:lhr"),
+		`or(and("`+textMatchPrefix+`foo.(bar|baz)","servers-fqdn:{a.example.com,b.example.com}"),"servers-dc:lhr")`,
+	)
+
+	parseTestCase(t, db, "negated text search value is part of the tag",
+		textMatchPrefix+"!staging|servers-dc:lhr",
+		`or("`+textMatchPrefix+`!staging","servers-dc:lhr")`,
+	)
+
+	parseTestCase(t, db, "numeric comparisons next to operators",
+		"(servers-num_cpus:>=16|servers-ram_gb:<128).servers-load:<0.5",
+		`and(or("servers-num_cpus:>=16","servers-ram_gb:<128"),"servers-load:<0.5")`,
+	)
+
+	parseTagsErrorCase(t, db, "unclosed parenthesis",
+		"(servers-dc:lhr|servers-dc:ams",
+		"database ParseQuery: invalid query (unclosed parenthesis): \"(servers-dc:lhr|servers-dc:ams\"",
+	)
+
+	parseTagsErrorCase(t, db, "unopened parenthesis",
+		"servers-dc:lhr|servers-dc:ams)",
+		"database ParseQuery: unexpected ')' in \"servers-dc:lhr|servers-dc:ams)\"",
+	)
+
+	parseTagsErrorCase(t, db, "empty group",
+		"servers-dc:lhr.()",
+		"database ParseQuery: unexpected ')' where a tag was expected in \"servers-dc:lhr.()\"",
+	)
+
+	parseTagsErrorCase(t, db, "dangling operator",
+		"servers-dc:lhr|",
+		"database ParseQuery: query ended where a tag was expected: \"servers-dc:lhr|\"",
+	)
+
+	parseTagsErrorCase(t, db, "two operators in a row",
+		"servers-dc:lhr.|servers-dc:ams",
+		"database ParseQuery: unexpected '|' where a tag was expected in \"servers-dc:lhr.|servers-dc:ams\"",
+	)
+
+	parseTagsErrorCase(t, db, "alternation over the query limit",
+		"servers-dc:{a,b,c,d}{e,f,g}",
+		"database ParseQuery: tag: \"servers-dc:{a,b,c,d}{e,f,g}\" expands to more than 10 tags",
+	)
+
+	parseTagsErrorCase(t, db, "empty negated text search",
+		textMatchPrefix+"!.servers-dc:lhr",
+		"database ParseQuery: text search \""+textMatchPrefix+"\" is empty",
+	)
+
+	parseTagsErrorCase(t, db, "empty text alternative",
+		textMatchPrefix+"{,foo}",
+		"database ParseQuery: text search \""+textMatchPrefix+"\" is empty",
+	)
+
+	parseTagsErrorCase(t, db, "OR can't be flattened into a list of tags",
+		"servers-dc:lhr|servers-dc:ams",
+		"database ParseQuery: \"servers-dc:lhr|servers-dc:ams\" uses OR or negated groups, so it can't be expressed as a list of tags",
+	)
+}
+
+func parseTestCase(t *testing.T, db *Database, testName, query, expected string) {
+	root, err := db.Parse(query)
+	if err != nil {
+		t.Errorf("%v parse error: %v", testName, err)
+		return
+	}
+
+	if root.String() != expected {
+		t.Errorf("%v: parsed %q into %v, expected %v", testName, query, root, expected)
+	}
+}
@@ -0,0 +1,506 @@
+package database
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+
+	"github.com/kanatohodets/carbonsearch/database/toc"
+	"github.com/kanatohodets/carbonsearch/index"
+	"github.com/kanatohodets/carbonsearch/index/split"
+	"github.com/kanatohodets/carbonsearch/tag"
+)
+
+/*
+	snapshots save the write buffer to disk, so a restart can load it instead of
+	replaying every message from Kafka.
+
+	the file looks like this:
+
+		"carbonsearch snapshot\n"
+		version (uint32, big endian)
+		payload length (uint64, big endian)
+		payload (gob encoded snapshot)
+		CRC-32 (Castagnoli) of the payload (uint32, big endian)
+
+	the payload also has the position of each resumable consumer (like the
+	offset of each Kafka partition) when it was taken, so that they continue
+	from there after it's loaded rather than from their configured offsets.
+
+	the payload includes the index configuration it was taken with, and a
+	snapshot taken with a different configuration won't load: the hashed service
+	keys and joins in it could end up in the wrong indexes. The table of
+	contents isn't saved, since it can be rebuilt from the write buffer.
+*/
+
+const snapshotMagic = "carbonsearch snapshot\n"
+
+// bump this whenever the snapshot struct changes
+const snapshotVersion uint32 = 4
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Positions are where each resumable consumer got to: consumer name => topic =>
+// partition => offset
+type Positions map[string]map[string]map[int32]int64
+
+type snapshot struct {
+	Config    snapshotConfig
+	Positions Positions
+	// raw metric names by ID. the IDs only mean something within the snapshot:
+	// names are interned again on load
+	Metrics  map[index.Metric]string
+	Splits   map[string]snapshotSplit
+	Full     map[index.Tag]map[index.Metric]int64
+	FullTags map[index.Tag]string
+	// the dictionary of every tag, join key and service key in the buffer, by
+	// domain and hash. salted hashes are restored from it
+	Hashes map[string]map[uint64]string
+}
+
+// snapshotConfig is what a snapshot has to agree with the configuration on
+type snapshotConfig struct {
+	FullIndexService string
+	TextIndexService string
+	// join key => sorted services, including links
+	SplitIndexes map[string][]string
+}
+
+type snapshotSplit struct {
+	JoinToMetric map[split.Join]map[index.Metric]int64
+	TagToJoin    map[tag.ServiceKey]map[split.Join][]index.Tag
+	TagSeen      map[tag.ServiceKey]map[split.Join]int64
+	Services     map[tag.ServiceKey]string
+	NumericTags  map[index.Tag]string
+	RawTags      map[index.Tag]string
+	// gob can't encode the struct{} values of the buffer's sets
+	JoinToLink map[split.Join][]split.Join
+	LinkSeen   map[split.Join]int64
+}
+
+// Snapshot writes the contents of the write buffer to w, along with the
+// positions of the consumers. Every message before the positions has to be in
+// the write buffer already, so they should be taken first. Writers only wait
+// for the write buffer to be copied, not for it to be encoded and written.
+func (db *Database) Snapshot(w io.Writer, positions Positions) error {
+	db.writeMut.RLock()
+	snap := db.writeBuffer.snapshot(db.snapshotConfig())
+	db.writeMut.RUnlock()
+
+	var payload bytes.Buffer
+	snap.Positions = positions
+	err := gob.NewEncoder(&payload).Encode(snap)
+	if err != nil {
+		return fmt.Errorf("database: could not encode snapshot: %v", err)
+	}
+	return writeSnapshot(w, payload.Bytes())
+}
+
+// writeSnapshot frames an encoded snapshot with its header and checksum
+func writeSnapshot(w io.Writer, payload []byte) error {
+	header := make([]byte, len(snapshotMagic)+4+8)
+	copy(header, snapshotMagic)
+	binary.BigEndian.PutUint32(header[len(snapshotMagic):], snapshotVersion)
+	binary.BigEndian.PutUint64(header[len(snapshotMagic)+4:], uint64(len(payload)))
+
+	trailer := make([]byte, 4)
+	binary.BigEndian.PutUint32(trailer, crc32.Checksum(payload, crcTable))
+
+	for _, part := range [][]byte{header, payload, trailer} {
+		if _, err := w.Write(part); err != nil {
+			return fmt.Errorf("database: could not write snapshot: %v", err)
+		}
+	}
+	return nil
+}
+
+// SnapshotToFile writes a snapshot to path, replacing the previous one only
+// once the new one is safely on disk
+func (db *Database) SnapshotToFile(path string, positions Positions) error {
+	err := db.snapshotToFile(path, positions)
+	if err != nil {
+		db.stats.SnapshotErrors.Add(1)
+		return err
+	}
+	db.stats.SnapshotsWritten.Add(1)
+	return nil
+}
+
+func (db *Database) snapshotToFile(path string, positions Positions) error {
+	tmp, err := os.Create(path + ".tmp")
+	if err != nil {
+		return fmt.Errorf("database: could not create snapshot file: %v", err)
+	}
+
+	err = db.Snapshot(tmp, positions)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("database: could not write snapshot file %q: %v", path, err)
+	}
+
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return fmt.Errorf("database: could not move snapshot into place at %q: %v", path, err)
+	}
+
+	// make the rename itself durable
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return nil
+	}
+	dir.Sync()
+	dir.Close()
+	return nil
+}
+
+// LoadSnapshot fills an empty database from a snapshot written by Snapshot,
+// returning the positions the consumers should resume from. Either all of the
+// snapshot is loaded or none of it. The indexes still have to be materialized
+// afterwards.
+func (db *Database) LoadSnapshot(r io.Reader) (Positions, error) {
+	header := make([]byte, len(snapshotMagic)+4+8)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, fmt.Errorf("database: could not read snapshot header: %v", err)
+	}
+	if string(header[:len(snapshotMagic)]) != snapshotMagic {
+		return nil, fmt.Errorf("database: not a carbonsearch snapshot")
+	}
+	version := binary.BigEndian.Uint32(header[len(snapshotMagic):])
+	if version != snapshotVersion {
+		return nil, fmt.Errorf("database: snapshot is version %d, but this carbonsearch only reads version %d", version, snapshotVersion)
+	}
+	length := binary.BigEndian.Uint64(header[len(snapshotMagic)+4:])
+
+	// a corrupt length shouldn't turn into a huge allocation, so only read
+	// what's actually there
+	var payload bytes.Buffer
+	_, err = payload.ReadFrom(io.LimitReader(r, int64(length)))
+	if err != nil {
+		return nil, fmt.Errorf("database: could not read snapshot: %v", err)
+	}
+	if uint64(payload.Len()) != length {
+		return nil, fmt.Errorf("database: snapshot is truncated: expected %d bytes, got %d", length, payload.Len())
+	}
+
+	trailer := make([]byte, 4)
+	_, err = io.ReadFull(r, trailer)
+	if err != nil {
+		return nil, fmt.Errorf("database: snapshot is truncated: could not read the checksum: %v", err)
+	}
+	if binary.BigEndian.Uint32(trailer) != crc32.Checksum(payload.Bytes(), crcTable) {
+		return nil, fmt.Errorf("database: snapshot checksum doesn't match, it's corrupt")
+	}
+
+	var snap snapshot
+	err = gob.NewDecoder(&payload).Decode(&snap)
+	if err != nil {
+		return nil, fmt.Errorf("database: could not decode snapshot: %v", err)
+	}
+
+	config := db.snapshotConfig()
+	if !reflect.DeepEqual(snap.Config, config) {
+		return nil, fmt.Errorf("database: snapshot was taken with a different index configuration (%+v, now %+v). refusing to load it", snap.Config, config)
+	}
+
+	db.writeMut.Lock()
+	defer db.writeMut.Unlock()
+	if !db.writeBuffer.empty() {
+		return nil, fmt.Errorf("database: snapshots can only be loaded into an empty database")
+	}
+
+	// loaded on the side, so that a snapshot that fails halfway leaves the
+	// database as empty as it was, salts included
+	table := db.toc.Blank()
+	loaded := db.writeBuffer.emptyCopy(table, newHashers())
+	err = loaded.load(&snap, table.GetLinks())
+	if err != nil {
+		return nil, err
+	}
+	db.toc.Replace(table)
+	loaded.toc = db.toc
+	db.writeBuffer = loaded
+	return snap.Positions, nil
+}
+
+// LoadSnapshotFile loads the snapshot at path (see LoadSnapshot)
+func (db *Database) LoadSnapshotFile(path string) (Positions, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return db.LoadSnapshot(file)
+}
+
+func (db *Database) snapshotConfig() snapshotConfig {
+	config := snapshotConfig{
+		FullIndexService: db.fullIndexService,
+		TextIndexService: db.textIndexService,
+		SplitIndexes:     map[string][]string{},
+	}
+	for service, mappedIndex := range db.serviceToIndex {
+		if _, ok := mappedIndex.(*split.Index); ok {
+			config.SplitIndexes[mappedIndex.Name()] = append(config.SplitIndexes[mappedIndex.Name()], service)
+		}
+	}
+	for name, linkedIndexName := range db.toc.GetLinks() {
+		config.SplitIndexes[name] = append(config.SplitIndexes[name], linkPrefix+linkedIndexName)
+	}
+	for _, services := range config.SplitIndexes {
+		sort.Strings(services)
+	}
+	return config
+}
+
+// snapshot copies the write buffer, so that it can be encoded once writes
+// have carried on. It must be called with the database's writeMut held.
+func (w *writeBuffer) snapshot(config snapshotConfig) *snapshot {
+	snap := &snapshot{
+		Config:   config,
+		Metrics:  make(map[index.Metric]string, w.metrics.Len()),
+		Splits:   make(map[string]snapshotSplit, len(w.splits)),
+		Full:     make(map[index.Tag]map[index.Metric]int64, len(w.full)),
+		FullTags: make(map[index.Tag]string, len(w.fullTags)),
+		Hashes:   map[string]map[uint64]string{},
+	}
+	for hashedTag, metrics := range w.full {
+		snap.Full[hashedTag] = copyMetrics(metrics)
+	}
+	for hashedTag, rawTag := range w.fullTags {
+		snap.FullTags[hashedTag] = rawTag
+	}
+	for _, domain := range w.hashDomains() {
+		dictionary := make(map[uint64]string, len(domain.strings))
+		for hash, raw := range domain.strings {
+			dictionary[hash] = raw
+		}
+		snap.Hashes[domain.name] = dictionary
+	}
+	w.metrics.Each(func(metric index.Metric, name string) {
+		snap.Metrics[metric] = name
+	})
+
+	for name, splitBuffer := range w.splits {
+		joinToLink := make(map[split.Join][]split.Join, len(splitBuffer.joinToLink))
+		for join, links := range splitBuffer.joinToLink {
+			for link := range links {
+				joinToLink[join] = append(joinToLink[join], link)
+			}
+		}
+
+		saved := snapshotSplit{
+			JoinToMetric: make(map[split.Join]map[index.Metric]int64, len(splitBuffer.joinToMetric)),
+			TagToJoin:    make(map[tag.ServiceKey]map[split.Join][]index.Tag, len(splitBuffer.tagToJoin)),
+			TagSeen:      make(map[tag.ServiceKey]map[split.Join]int64, len(splitBuffer.tagSeen)),
+			Services:     make(map[tag.ServiceKey]string, len(splitBuffer.services)),
+			NumericTags:  make(map[index.Tag]string, len(splitBuffer.numericTags)),
+			RawTags:      make(map[index.Tag]string, len(splitBuffer.rawTags)),
+			JoinToLink:   joinToLink,
+			LinkSeen:     make(map[split.Join]int64, len(splitBuffer.linkSeen)),
+		}
+		for join, metrics := range splitBuffer.joinToMetric {
+			saved.JoinToMetric[join] = copyMetrics(metrics)
+		}
+		for sk, tagValueForJoins := range splitBuffer.tagToJoin {
+			joins := make(map[split.Join][]index.Tag, len(tagValueForJoins))
+			for join, hashedTags := range tagValueForJoins {
+				joins[join] = append([]index.Tag(nil), hashedTags...)
+			}
+			saved.TagToJoin[sk] = joins
+		}
+		for sk, joinsSeen := range splitBuffer.tagSeen {
+			seen := make(map[split.Join]int64, len(joinsSeen))
+			for join, written := range joinsSeen {
+				seen[join] = written
+			}
+			saved.TagSeen[sk] = seen
+		}
+		for sk, service := range splitBuffer.services {
+			saved.Services[sk] = service
+		}
+		for hashedTag, value := range splitBuffer.numericTags {
+			saved.NumericTags[hashedTag] = value
+		}
+		for hashedTag, rawTag := range splitBuffer.rawTags {
+			saved.RawTags[hashedTag] = rawTag
+		}
+		for join, written := range splitBuffer.linkSeen {
+			saved.LinkSeen[join] = written
+		}
+		snap.Splits[name] = saved
+	}
+	return snap
+}
+
+func copyMetrics(metrics map[index.Metric]int64) map[index.Metric]int64 {
+	copied := make(map[index.Metric]int64, len(metrics))
+	for metric, written := range metrics {
+		copied[metric] = written
+	}
+	return copied
+}
+
+func (w *writeBuffer) empty() bool {
+	if w.metrics.Len() != 0 || len(w.full) != 0 {
+		return false
+	}
+	for _, splitBuffer := range w.splits {
+		if len(splitBuffer.joinToMetric) != 0 || len(splitBuffer.tagToJoin) != 0 || len(splitBuffer.joinToLink) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// emptyCopy returns an empty write buffer configured like w, which keeps its
+// table of contents in toc
+func (w *writeBuffer) emptyCopy(toc *toc.TableOfContents, hashers hashers) *writeBuffer {
+	empty := NewWriteBuffer(w.fullIndexName, toc, hashers, w.stats)
+	for name := range w.splits {
+		empty.AddSplitIndex(name)
+	}
+	for service := range w.multiValued {
+		empty.AllowMultipleValues(service)
+	}
+	for name, ttl := range w.indexTTLs {
+		empty.indexTTLs[name] = ttl
+	}
+	for service, ttl := range w.serviceTTLs {
+		empty.serviceTTLs[service] = ttl
+	}
+	empty.fullTTL = w.fullTTL
+	empty.now = w.now
+	empty.collisionPolicy = w.collisionPolicy
+	return empty
+}
+
+// load fills an empty write buffer from a snapshot, and rebuilds the table of
+// contents to match. It must be called with the database's writeMut held.
+func (w *writeBuffer) load(snap *snapshot, linkedIndexes map[string]string) error {
+	// counted again as the rest is loaded
+	for _, domain := range w.hashDomains() {
+		for hash, raw := range snap.Hashes[domain.name] {
+			domain.strings[hash] = raw
+			domain.unused[hash] = struct{}{}
+		}
+	}
+
+	for name, saved := range snap.Splits {
+		splitBuffer, ok := w.splits[name]
+		if !ok {
+			return fmt.Errorf("database: snapshot has a split index %q the database doesn't", name)
+		}
+
+		// copied into the buffer's own maps, since gob leaves empty ones nil
+		for join, savedMetrics := range saved.JoinToMetric {
+			metrics, err := w.loadMetrics(snap, savedMetrics)
+			if err != nil {
+				return err
+			}
+			splitBuffer.joinToMetric[join] = metrics
+			w.joinHashes.ref(uint64(join))
+			w.toc.SetMetricCount(name, uint64(join), len(metrics))
+		}
+		for sk, service := range saved.Services {
+			splitBuffer.services[sk] = service
+		}
+		for sk, joinsSeen := range saved.TagSeen {
+			splitBuffer.tagSeen[sk] = joinsSeen
+		}
+		for sk, tagValueForJoins := range saved.TagToJoin {
+			splitBuffer.tagToJoin[sk] = tagValueForJoins
+			for join, hashedTags := range tagValueForJoins {
+				w.joinHashes.ref(uint64(join))
+				w.serviceKeyHashes.ref(uint64(sk))
+				for _, hashedTag := range hashedTags {
+					w.tagHashes.ref(uint64(hashedTag))
+					// only the tags some join has, which leaves out any
+					// that older snapshots kept after their last join
+					rawTag := saved.RawTags[hashedTag]
+					s, k, v, err := tag.Parse(rawTag)
+					if err != nil {
+						return fmt.Errorf("database: snapshot has a bad tag %q in index %q: %v", rawTag, name, err)
+					}
+					splitBuffer.rawTags[hashedTag] = rawTag
+					if value, ok := saved.NumericTags[hashedTag]; ok {
+						splitBuffer.numericTags[hashedTag] = value
+					}
+					splitBuffer.tagJoins[hashedTag]++
+					w.toc.AddTag(name, s, k, v, uint64(join))
+				}
+			}
+		}
+		for join, links := range saved.JoinToLink {
+			linkSet := make(map[split.Join]struct{}, len(links))
+			hashes := make([]uint64, len(links))
+			for i, link := range links {
+				linkSet[link] = struct{}{}
+				hashes[i] = uint64(link)
+				w.joinHashes.ref(uint64(link))
+			}
+			w.joinHashes.ref(uint64(join))
+			splitBuffer.joinToLink[join] = linkSet
+			w.toc.SetLinks(name, uint64(join), linkedIndexes[name], hashes)
+		}
+		for join, seen := range saved.LinkSeen {
+			splitBuffer.linkSeen[join] = seen
+		}
+	}
+
+	for hashedTag, metrics := range snap.Full {
+		s, k, v, err := tag.Parse(snap.FullTags[hashedTag])
+		if err != nil {
+			return fmt.Errorf("database: snapshot has a bad custom tag %q: %v", snap.FullTags[hashedTag], err)
+		}
+		metrics, err = w.loadMetrics(snap, metrics)
+		if err != nil {
+			return err
+		}
+		w.full[hashedTag] = metrics
+		w.fullTags[hashedTag] = snap.FullTags[hashedTag]
+		w.tagHashes.ref(uint64(hashedTag))
+		w.toc.AddTag(w.fullIndexName, s, k, v, uint64(hashedTag))
+		w.toc.SetMetricCount(w.fullIndexName, uint64(hashedTag), len(metrics))
+	}
+
+	// last, so a snapshot that fails to load doesn't leave salts behind
+	for _, domain := range w.hashDomains() {
+		for hash, raw := range domain.strings {
+			if domain.hasher.Hash(raw) != hash {
+				domain.hasher.SetSalted(raw, hash)
+			}
+		}
+	}
+	// none of what was loaded was marked as changed
+	w.rebuildAll()
+	return nil
+}
+
+// loadMetrics interns the metrics of a join or custom tag from a snapshot,
+// returning them keyed by their IDs in the write buffer
+func (w *writeBuffer) loadMetrics(snap *snapshot, saved map[index.Metric]int64) (map[index.Metric]int64, error) {
+	metrics := make(map[index.Metric]int64, len(saved))
+	for savedMetric, seen := range saved {
+		name, ok := snap.Metrics[savedMetric]
+		if !ok {
+			return nil, fmt.Errorf("database: snapshot has the metric ID '%d' without its name", savedMetric)
+		}
+		metrics[w.metrics.Ref(name)] = seen
+	}
+	return metrics, nil
+}
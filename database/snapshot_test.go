@@ -0,0 +1,199 @@
+package database
+
+import (
+	"bytes"
+	"encoding/gob"
+	"reflect"
+	"testing"
+
+	m "github.com/kanatohodets/carbonsearch/consumer/message"
+	"github.com/kanatohodets/carbonsearch/index"
+)
+
+func TestSnapshot(t *testing.T) {
+	db := New(queryLimit, resultLimit, fullService, textService, splitIndexes, stats)
+	populateSplitIndex(t, db, "snapshot", "fqdn", map[string]map[string][]string{
+		"foohost.prod.example.com": {
+			"metrics": {"server.foohost_prod_example_com.cpu", "server.foohost_prod_example_com.disk"},
+			"tags":    {"servers-dc:lhr", "servers-num_cpus:16"},
+		},
+		"barhost.prod.example.com": {
+			"metrics": {"server.barhost_prod_example_com.cpu"},
+			"tags":    {"servers-dc:ams", "servers-num_cpus:8"},
+		},
+	})
+	err := db.InsertCustom(&m.TagMetric{
+		Tags:    []string{"custom-favorites:btyler"},
+		Metrics: []string{"monitors.was_the_site_up"},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	positions := Positions{"kafka": {"carbonsearch_tags": {0: 42, 1: 7}}}
+	var snap bytes.Buffer
+	err = db.Snapshot(&snap, positions)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	loaded := New(queryLimit, resultLimit, fullService, textService, splitIndexes, stats)
+	loadedPositions, err := loaded.LoadSnapshot(bytes.NewReader(snap.Bytes()))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	loaded.MaterializeIndexes()
+	if !reflect.DeepEqual(positions, loadedPositions) {
+		t.Errorf("snapshot: expected the consumers to resume from %v, got %v", positions, loadedPositions)
+	}
+
+	evaluateTest(t, loaded, "snapshot: tag", "servers-dc:lhr", []string{
+		"server.foohost_prod_example_com.cpu",
+		"server.foohost_prod_example_com.disk",
+	})
+	evaluateTest(t, loaded, "snapshot: numeric tag", "servers-num_cpus:>=10", []string{
+		"server.foohost_prod_example_com.cpu",
+		"server.foohost_prod_example_com.disk",
+	})
+	evaluateTest(t, loaded, "snapshot: custom association", "custom-favorites:btyler", []string{"monitors.was_the_site_up"})
+	searchTest(t, loaded, "snapshot: text index", []string{"barhost"}, []string{"server.barhost_prod_example_com.cpu"})
+
+	if expected, table := db.TableOfContents(), loaded.TableOfContents(); !reflect.DeepEqual(expected, table) {
+		t.Errorf("snapshot: table of contents expected %v, got %v", expected, table)
+	}
+
+	// the loaded buffer keeps working like one that was written normally
+	err = loaded.DeleteJoin(&m.Join{Key: "fqdn", Value: "barhost.prod.example.com"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	loaded.MaterializeIndexes()
+	searchTest(t, loaded, "snapshot: deleting after loading", []string{"barhost"}, []string{})
+
+	_, err = loaded.LoadSnapshot(bytes.NewReader(snap.Bytes()))
+	if err == nil {
+		t.Errorf("snapshot: loading into a database with data in it should be an error")
+	}
+}
+
+func TestSnapshotIsACopy(t *testing.T) {
+	db := New(queryLimit, resultLimit, fullService, textService, splitIndexes, stats)
+	populateSplitIndex(t, db, "snapshot copy", "fqdn", map[string]map[string][]string{
+		"foohost.prod.example.com": {
+			"metrics": {"server.foohost_prod_example_com.cpu"},
+			"tags":    {"servers-dc:lhr"},
+		},
+	})
+
+	// encoded after the lock is released, so writes can't show up in it
+	snap := db.writeBuffer.snapshot(db.snapshotConfig())
+	err := db.InsertMetrics(&m.KeyMetric{Key: "fqdn", Value: "foohost.prod.example.com", Metrics: []string{"server.foohost_prod_example_com.disk"}})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = db.InsertTags(&m.KeyTag{Key: "fqdn", Value: "foohost.prod.example.com", Tags: []string{"servers-dc:ams"}})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	saved := snap.Splits["fqdn"]
+	for _, metrics := range saved.JoinToMetric {
+		if len(metrics) != 1 {
+			t.Errorf("snapshot copy: expected the join to have 1 metric, got %d", len(metrics))
+		}
+	}
+	raw := []string{}
+	for _, rawTag := range saved.RawTags {
+		raw = append(raw, rawTag)
+	}
+	if expected := []string{"servers-dc:lhr"}; !reflect.DeepEqual(expected, raw) {
+		t.Errorf("snapshot copy: expected raw tags %v, got %v", expected, raw)
+	}
+}
+
+func TestBadSnapshots(t *testing.T) {
+	db := New(queryLimit, resultLimit, fullService, textService, splitIndexes, stats)
+	populateSplitIndex(t, db, "bad snapshots", "fqdn", map[string]map[string][]string{
+		"foohost.prod.example.com": {
+			"metrics": {"server.foohost_prod_example_com.cpu"},
+			"tags":    {"servers-dc:lhr"},
+		},
+	})
+
+	var snap bytes.Buffer
+	err := db.Snapshot(&snap, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	good := snap.Bytes()
+
+	corrupt := append([]byte{}, good...)
+	corrupt[len(corrupt)/2] ^= 0xff
+
+	wrongVersion := append([]byte{}, good...)
+	wrongVersion[len(snapshotMagic)+3]++
+
+	badSnapshots := map[string][]byte{
+		"corrupt":        corrupt,
+		"truncated":      good[:len(good)-10],
+		"wrong version":  wrongVersion,
+		"not a snapshot": []byte("definitely not a carbonsearch snapshot, no sir"),
+	}
+	for name, bad := range badSnapshots {
+		fresh := New(queryLimit, resultLimit, fullService, textService, splitIndexes, stats)
+		_, err := fresh.LoadSnapshot(bytes.NewReader(bad))
+		if err == nil {
+			t.Errorf("bad snapshots: %s: expected an error", name)
+		}
+	}
+
+	otherConfig := New(queryLimit, resultLimit, fullService, textService, map[string][]string{"fqdn": {"servers", "lb"}}, stats)
+	_, err = otherConfig.LoadSnapshot(bytes.NewReader(good))
+	if err == nil {
+		t.Errorf("bad snapshots: a snapshot taken with a different config should be refused")
+	}
+	if table := otherConfig.TableOfContents(); len(table["fqdn"]["servers"]) != 0 {
+		t.Errorf("bad snapshots: a refused snapshot shouldn't leave anything behind, but the table of contents has %v", table)
+	}
+
+	// passes the checks, but fails to load once the split index is in
+	snapshot := db.writeBuffer.snapshot(db.snapshotConfig())
+	missing := index.Tag(db.view().hashers.tags.Hash("custom-favorites:missing"))
+	snapshot.Full = map[index.Tag]map[index.Metric]int64{missing: {12345: 0}}
+	snapshot.FullTags = map[index.Tag]string{missing: "custom-favorites:missing"}
+	var payload bytes.Buffer
+	err = gob.NewEncoder(&payload).Encode(snapshot)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	var broken bytes.Buffer
+	err = writeSnapshot(&broken, payload.Bytes())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	fresh := New(queryLimit, resultLimit, fullService, textService, splitIndexes, stats)
+	_, err = fresh.LoadSnapshot(&broken)
+	if err == nil {
+		t.Errorf("bad snapshots: a snapshot with a metric without a name should fail to load")
+	}
+	if !fresh.writeBuffer.empty() {
+		t.Errorf("bad snapshots: a snapshot that failed to load left metrics or tags in the write buffer")
+	}
+	if table := fresh.TableOfContents(); len(table["fqdn"]["servers"]) != 0 {
+		t.Errorf("bad snapshots: a snapshot that failed to load left %v in the table of contents", table)
+	}
+	_, err = fresh.LoadSnapshot(bytes.NewReader(good))
+	if err != nil {
+		t.Errorf("bad snapshots: a good snapshot should load after a broken one: %v", err)
+	}
+}
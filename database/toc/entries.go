@@ -9,6 +9,19 @@ import (
 
 type metricCounter struct {
 	count int
+	// counters for the join keys of a linked index, which also count towards
+	// this one
+	links []*metricCounter
+}
+
+// total is the number of metrics for a join key, including the ones it links
+// to. Links between indexes can't form a cycle, so this ends.
+func (mc *metricCounter) total() int {
+	total := mc.count
+	for _, link := range mc.links {
+		total += link.total()
+	}
+	return total
 }
 
 type tagTable map[serviceT]map[keyT]map[valueT]map[*metricCounter]struct{}
@@ -16,6 +29,7 @@ type tagTable map[serviceT]map[keyT]map[valueT]map[*metricCounter]struct{}
 type indexEntry interface {
 	SetMetricCount(uint64, int)
 	AddTag(uint64, string, string, string)
+	RemoveTag(uint64, string, string, string)
 	AddService(string) error
 	getEntries() tagTable
 }
@@ -26,13 +40,17 @@ type splitEntry struct {
 }
 
 func (se *splitEntry) SetMetricCount(hash uint64, metricCount int) {
+	se.counter(hash).count = metricCount
+}
+
+func (se *splitEntry) counter(hash uint64) *metricCounter {
 	join := split.Join(hash)
 	counter, ok := se.joins[join]
 	if !ok {
 		counter = &metricCounter{}
 		se.joins[join] = counter
 	}
-	counter.count = metricCount
+	return counter
 }
 
 func (se *splitEntry) AddService(service string) error {
@@ -46,13 +64,27 @@ func (se *splitEntry) AddService(service string) error {
 }
 
 func (se *splitEntry) AddTag(hash uint64, service, key, value string) {
-	join := split.Join(hash)
-	counter, ok := se.joins[join]
+	addTag(se, service, key, value, se.counter(hash))
+}
+
+func (se *splitEntry) RemoveTag(hash uint64, service, key, value string) {
+	counter, ok := se.joins[split.Join(hash)]
 	if !ok {
-		counter = &metricCounter{}
-		se.joins[join] = counter
+		return
+	}
+	removeTag(se, service, key, value, counter)
+}
+
+// RemoveJoin zeroes the counter of a join, rather than dropping it: the joins
+// of a linked index may still point to it, and should count its metrics again
+// if it comes back
+func (se *splitEntry) RemoveJoin(hash uint64) {
+	counter, ok := se.joins[split.Join(hash)]
+	if !ok {
+		return
 	}
-	addTag(se, service, key, value, counter)
+	counter.count = 0
+	counter.links = nil
 }
 
 func (se *splitEntry) getEntries() tagTable {
@@ -98,6 +130,16 @@ func (fe *fullEntry) AddTag(hash uint64, service, key, value string) {
 	addTag(fe, service, key, value, counter)
 }
 
+func (fe *fullEntry) RemoveTag(hash uint64, service, key, value string) {
+	tag := index.Tag(hash)
+	counter, ok := fe.tags[tag]
+	if !ok {
+		return
+	}
+	removeTag(fe, service, key, value, counter)
+	delete(fe.tags, tag)
+}
+
 func addTag(ie indexEntry, service, key, value string, counter *metricCounter) {
 	typedService := serviceT(service)
 	typedKey := keyT(key)
@@ -123,3 +165,22 @@ func addTag(ie indexEntry, service, key, value string, counter *metricCounter) {
 
 	countersForValue[counter] = struct{}{}
 }
+
+// removeTag removes the counter from a value, and then the value and key too if
+// nothing is left under them
+func removeTag(ie indexEntry, service, key, value string, counter *metricCounter) {
+	typedKey := keyT(key)
+	typedValue := valueT(value)
+
+	keys := ie.getEntries()[serviceT(service)]
+	values := keys[typedKey]
+	countersForValue := values[typedValue]
+
+	delete(countersForValue, counter)
+	if len(countersForValue) == 0 {
+		delete(values, typedValue)
+	}
+	if len(values) == 0 {
+		delete(keys, typedKey)
+	}
+}
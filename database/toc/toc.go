@@ -2,6 +2,8 @@ package toc
 
 import (
 	"fmt"
+	"path"
+	"sort"
 	"strings"
 	"sync"
 
@@ -17,11 +19,26 @@ type valueT string
 type TableOfContents struct {
 	mut   sync.RWMutex
 	table map[string]indexEntry
+	// split index name => the split index it's linked to
+	links map[string]string
+
+	// the last copy of the values made by Values, and the keys whose values
+	// may have changed since. a nil copy has to be made from scratch
+	values  *Values
+	changed map[valueKey]struct{}
+}
+
+type valueKey struct {
+	index   string
+	service serviceT
+	key     keyT
 }
 
 func NewToC() *TableOfContents {
 	return &TableOfContents{
-		table: map[string]indexEntry{},
+		table:   map[string]indexEntry{},
+		links:   map[string]string{},
+		changed: map[valueKey]struct{}{},
 	}
 }
 
@@ -42,7 +59,7 @@ func (toc *TableOfContents) GetTable() map[string]map[string]map[string]map[stri
 				for typedValue, metricCounterMap := range valueMap {
 					value := string(typedValue)
 					for metricCounter, _ := range metricCounterMap {
-						res[indexName][service][key][value] += metricCounter.count
+						res[indexName][service][key][value] += metricCounter.total()
 					}
 				}
 			}
@@ -61,6 +78,7 @@ func (toc *TableOfContents) AddTag(indexName string, service, key, value string,
 	}
 
 	ie.AddTag(hash, service, key, value)
+	toc.changed[valueKey{indexName, serviceT(service), keyT(key)}] = struct{}{}
 }
 
 func (toc *TableOfContents) SetMetricCount(index string, hash uint64, metricCount int) {
@@ -75,6 +93,91 @@ func (toc *TableOfContents) SetMetricCount(index string, hash uint64, metricCoun
 	ie.SetMetricCount(hash, metricCount)
 }
 
+// RemoveTag removes a join (or a full index tag) from the entry for a tag. Once
+// nothing has the tag, it's removed from the table
+func (toc *TableOfContents) RemoveTag(indexName string, service, key, value string, hash uint64) {
+	toc.mut.Lock()
+	defer toc.mut.Unlock()
+
+	ie, ok := toc.table[indexName]
+	if !ok {
+		panic(fmt.Sprintf("trying to remove a tag for an index (%q) the ToC doesn't know about!", indexName))
+	}
+
+	ie.RemoveTag(hash, service, key, value)
+	toc.changed[valueKey{indexName, serviceT(service), keyT(key)}] = struct{}{}
+}
+
+// RemoveJoin forgets the metric count and links of a join in a split index.
+// Its tags should be removed with RemoveTag
+func (toc *TableOfContents) RemoveJoin(indexName string, hash uint64) {
+	toc.mut.Lock()
+	defer toc.mut.Unlock()
+
+	se, ok := toc.table[indexName].(*splitEntry)
+	if !ok {
+		panic(fmt.Sprintf("trying to remove a join for an index (%q) the ToC doesn't know about, or which isn't a split index!", indexName))
+	}
+	se.RemoveJoin(hash)
+}
+
+// RemoveLinks forgets the links of a join in a split index, so the metrics it
+// linked to no longer count towards its tags
+func (toc *TableOfContents) RemoveLinks(indexName string, hash uint64) {
+	toc.mut.Lock()
+	defer toc.mut.Unlock()
+
+	se, ok := toc.table[indexName].(*splitEntry)
+	if !ok {
+		panic(fmt.Sprintf("trying to remove links for an index (%q) the ToC doesn't know about, or which isn't a split index!", indexName))
+	}
+	if counter, ok := se.joins[split.Join(hash)]; ok {
+		counter.links = nil
+	}
+}
+
+// AddLink records that a split index is linked to another one
+func (toc *TableOfContents) AddLink(indexName, linkedIndexName string) {
+	toc.mut.Lock()
+	defer toc.mut.Unlock()
+	toc.links[indexName] = linkedIndexName
+}
+
+// GetLinks returns the links between split indexes, as index name => linked
+// index name
+func (toc *TableOfContents) GetLinks() map[string]string {
+	toc.mut.RLock()
+	defer toc.mut.RUnlock()
+
+	res := make(map[string]string, len(toc.links))
+	for indexName, linkedIndexName := range toc.links {
+		res[indexName] = linkedIndexName
+	}
+	return res
+}
+
+// SetLinks sets the join keys of the linked index that a join key links to, so
+// that the metrics for those count towards the tags of the join key
+func (toc *TableOfContents) SetLinks(indexName string, hash uint64, linkedIndexName string, linkedHashes []uint64) {
+	toc.mut.Lock()
+	defer toc.mut.Unlock()
+
+	se, ok := toc.table[indexName].(*splitEntry)
+	if !ok {
+		panic(fmt.Sprintf("trying to set links for an index (%q) the ToC doesn't know about, or which isn't a split index!", indexName))
+	}
+	linked, ok := toc.table[linkedIndexName].(*splitEntry)
+	if !ok {
+		panic(fmt.Sprintf("trying to link to an index (%q) the ToC doesn't know about, or which isn't a split index!", linkedIndexName))
+	}
+
+	counters := make([]*metricCounter, len(linkedHashes))
+	for i, linkedHash := range linkedHashes {
+		counters[i] = linked.counter(linkedHash)
+	}
+	se.counter(hash).links = counters
+}
+
 func (toc *TableOfContents) AddIndexServiceEntry(indexType, indexName, service string) {
 	toc.mut.Lock()
 	defer toc.mut.Unlock()
@@ -103,6 +206,51 @@ func (toc *TableOfContents) AddIndexServiceEntry(indexType, indexName, service s
 	if err != nil {
 		panic(fmt.Sprintf("could not register %v to split entry for index %v: %v", service, indexName, err))
 	}
+	toc.values = nil
+}
+
+// Blank returns a table of contents with the same indexes, services and links,
+// but no tags. It can be filled in on the side, then swapped in with Replace.
+func (toc *TableOfContents) Blank() *TableOfContents {
+	toc.mut.RLock()
+	defer toc.mut.RUnlock()
+
+	blank := NewToC()
+	for indexName, ie := range toc.table {
+		var blankEntry indexEntry
+		switch ie.(type) {
+		case *splitEntry:
+			blankEntry = &splitEntry{
+				joins:   map[split.Join]*metricCounter{},
+				entries: tagTable{},
+			}
+		case *fullEntry:
+			blankEntry = &fullEntry{
+				tags:    map[index.Tag]*metricCounter{},
+				entries: tagTable{},
+			}
+		}
+		for service := range ie.getEntries() {
+			blankEntry.AddService(string(service))
+		}
+		blank.table[indexName] = blankEntry
+	}
+	for indexName, linkedIndexName := range toc.links {
+		blank.links[indexName] = linkedIndexName
+	}
+	return blank
+}
+
+// Replace makes toc hold the contents of other, which mustn't be used
+// afterwards
+func (toc *TableOfContents) Replace(other *TableOfContents) {
+	toc.mut.Lock()
+	defer toc.mut.Unlock()
+
+	toc.table = other.table
+	toc.links = other.links
+	toc.values = nil
+	toc.changed = map[valueKey]struct{}{}
 }
 
 func (toc *TableOfContents) CompleteKey(index, service, key string) []string {
@@ -145,6 +293,102 @@ func (toc *TableOfContents) CompleteValue(index, service, key, value string) []s
 	return results
 }
 
+// Values is a read-only copy of the values of every key in the table of
+// contents, as they were at one moment. Each view of the indexes has the one
+// from when it was built, so that globs resolve against the same tags as the
+// generations they're queried on.
+type Values struct {
+	// index => service => key => sorted values
+	values map[string]map[serviceT]map[keyT][]string
+}
+
+// Values returns a copy of the values of every key. Only the keys that
+// changed since the last copy are sorted again, the rest are shared with it.
+func (toc *TableOfContents) Values() *Values {
+	toc.mut.Lock()
+	defer toc.mut.Unlock()
+
+	if toc.values != nil && len(toc.changed) == 0 {
+		return toc.values
+	}
+
+	next := &Values{values: make(map[string]map[serviceT]map[keyT][]string, len(toc.table))}
+	if toc.values == nil {
+		for indexName, ie := range toc.table {
+			services := map[serviceT]map[keyT][]string{}
+			for service, keys := range ie.getEntries() {
+				services[service] = make(map[keyT][]string, len(keys))
+				for key, values := range keys {
+					services[service][key] = sortedValues(values)
+				}
+			}
+			next.values[indexName] = services
+		}
+	} else {
+		for indexName, services := range toc.values.values {
+			nextServices := make(map[serviceT]map[keyT][]string, len(services))
+			for service, keys := range services {
+				nextKeys := make(map[keyT][]string, len(keys))
+				for key, values := range keys {
+					nextKeys[key] = values
+				}
+				nextServices[service] = nextKeys
+			}
+			next.values[indexName] = nextServices
+		}
+		for changed := range toc.changed {
+			services, ok := next.values[changed.index]
+			if !ok {
+				continue
+			}
+			keys, ok := services[changed.service]
+			if !ok {
+				keys = map[keyT][]string{}
+				services[changed.service] = keys
+			}
+			values, ok := toc.table[changed.index].getEntries()[changed.service][changed.key]
+			if !ok {
+				delete(keys, changed.key)
+				continue
+			}
+			keys[changed.key] = sortedValues(values)
+		}
+	}
+
+	toc.values = next
+	toc.changed = map[valueKey]struct{}{}
+	return next
+}
+
+func sortedValues(values map[valueT]map[*metricCounter]struct{}) []string {
+	sorted := make([]string, 0, len(values))
+	for value := range values {
+		sorted = append(sorted, string(value))
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// MatchValues returns the complete tags for every value of the given key which
+// matches the glob pattern (see path.Match for the syntax), sorted
+func (v *Values) MatchValues(index, service, key, pattern string) ([]string, error) {
+	// check the pattern up front, since path.Match only reports a bad pattern
+	// when it gets far enough to notice
+	_, err := path.Match(pattern, "")
+	if err != nil {
+		return nil, fmt.Errorf("toc: bad glob pattern %q: %v", pattern, err)
+	}
+
+	results := []string{}
+	for _, value := range v.values[index][serviceT(service)][keyT(key)] {
+		matched, _ := path.Match(pattern, value)
+		if matched {
+			results = append(results, fmt.Sprintf("%s-%s:%s", service, key, value))
+		}
+	}
+	return results, nil
+}
+
 func (toc *TableOfContents) getCompleterKeys(index, service string) map[keyT]map[valueT]map[*metricCounter]struct{} {
 	ie, ok := toc.table[index]
 	if !ok {
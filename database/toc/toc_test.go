@@ -45,3 +45,92 @@ func TestAddJoinTag(t *testing.T) {
 		t.Errorf("table of contents with two joins on the same tag not what was expected. expected %v, got %v. this likely means that the metrics for different joins aren't being properly summed together to create the total metric count for a given tag", expected, table)
 	}
 }
+
+func TestMatchValues(t *testing.T) {
+	toc := NewToC()
+	toc.AddIndexServiceEntry("split", "foo-index", "servers")
+	join := uint64(split.HashJoin("bar-hostname"))
+	toc.AddTag("foo-index", "servers", "dc", "us_west", join)
+	toc.AddTag("foo-index", "servers", "dc", "us_east", join)
+	toc.AddTag("foo-index", "servers", "dc", "eu_west", join)
+	values := toc.Values()
+
+	cases := map[string][]string{
+		"us_*":         {"servers-dc:us_east", "servers-dc:us_west"},
+		"*_west":       {"servers-dc:eu_west", "servers-dc:us_west"},
+		"??_east":      {"servers-dc:us_east"},
+		"*":            {"servers-dc:eu_west", "servers-dc:us_east", "servers-dc:us_west"},
+		"ap_*":         {},
+		"us_[ew][ae]*": {"servers-dc:us_east", "servers-dc:us_west"},
+	}
+
+	for pattern, expected := range cases {
+		matches, err := values.MatchValues("foo-index", "servers", "dc", pattern)
+		if err != nil {
+			t.Errorf("toc MatchValues test: %q returned an error: %v", pattern, err)
+			continue
+		}
+		if !reflect.DeepEqual(expected, matches) {
+			t.Errorf("toc MatchValues test: %q expected %q, got %q", pattern, expected, matches)
+		}
+	}
+
+	matches, err := values.MatchValues("foo-index", "servers", "no_such_key", "*")
+	if err != nil || len(matches) != 0 {
+		t.Errorf("toc MatchValues test: missing key expected no matches and no error, got %q and %v", matches, err)
+	}
+
+	_, err = values.MatchValues("foo-index", "servers", "dc", "us_[")
+	if err == nil {
+		t.Errorf("toc MatchValues test: bad pattern failed to error")
+	}
+
+	// the copy doesn't change with the table, but the next one has the change
+	toc.AddTag("foo-index", "servers", "dc", "us_north", join)
+	toc.RemoveTag("foo-index", "servers", "dc", "eu_west", join)
+	matches, _ = values.MatchValues("foo-index", "servers", "dc", "*")
+	if expected := []string{"servers-dc:eu_west", "servers-dc:us_east", "servers-dc:us_west"}; !reflect.DeepEqual(expected, matches) {
+		t.Errorf("toc MatchValues test: old copy expected %q, got %q", expected, matches)
+	}
+	matches, _ = toc.Values().MatchValues("foo-index", "servers", "dc", "*")
+	if expected := []string{"servers-dc:us_east", "servers-dc:us_north", "servers-dc:us_west"}; !reflect.DeepEqual(expected, matches) {
+		t.Errorf("toc MatchValues test: new copy expected %q, got %q", expected, matches)
+	}
+}
+
+func TestRemoveTag(t *testing.T) {
+	toc := NewToC()
+	toc.AddIndexServiceEntry("split", "foo-index", "servers")
+	barJoin := uint64(split.HashJoin("bar-hostname"))
+	quxJoin := uint64(split.HashJoin("qux-hostname"))
+	toc.AddTag("foo-index", "servers", "dc", "us_west", barJoin)
+	toc.AddTag("foo-index", "servers", "status", "live", barJoin)
+	toc.AddTag("foo-index", "servers", "dc", "us_west", quxJoin)
+	toc.SetMetricCount("foo-index", barJoin, 3)
+	toc.SetMetricCount("foo-index", quxJoin, 5)
+
+	toc.RemoveTag("foo-index", "servers", "status", "live", barJoin)
+	toc.RemoveTag("foo-index", "servers", "dc", "us_west", quxJoin)
+	// not there, so nothing happens
+	toc.RemoveTag("foo-index", "servers", "dc", "us_east", barJoin)
+
+	expected := map[string]map[string]map[string]map[string]int{
+		"foo-index": {
+			"servers": {
+				"dc": {"us_west": 3},
+			},
+		},
+	}
+	table := toc.GetTable()
+	if !reflect.DeepEqual(expected, table) {
+		t.Errorf("table of contents after removing tags not what was expected. expected %v, got %v", expected, table)
+	}
+
+	toc.RemoveTag("foo-index", "servers", "dc", "us_west", barJoin)
+	toc.RemoveJoin("foo-index", barJoin)
+	expected["foo-index"]["servers"] = map[string]map[string]int{}
+	table = toc.GetTable()
+	if !reflect.DeepEqual(expected, table) {
+		t.Errorf("table of contents after removing a join not what was expected. expected %v, got %v", expected, table)
+	}
+}
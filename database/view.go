@@ -0,0 +1,135 @@
+package database
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/kanatohodets/carbonsearch/database/toc"
+	"github.com/kanatohodets/carbonsearch/index"
+	"github.com/kanatohodets/carbonsearch/index/full"
+	"github.com/kanatohodets/carbonsearch/index/split"
+	"github.com/kanatohodets/carbonsearch/index/text"
+)
+
+/*
+	queries run against a view: one generation of every index, all built
+	from the write buffer as it was at the same moment. MaterializeIndexes
+	builds the new generations of all of the indexes first, and then
+	publishes them together, as a new view, with a single atomic store. Each
+	query loads the view once and uses it throughout, so it never sees a
+	split index generation with metrics that the text index generation can't
+	map back to names.
+*/
+
+type view struct {
+	// counts the views that were published, for the query cache
+	generation uint64
+
+	text   *text.Generation
+	full   *full.Generation
+	splits map[string]*split.Generation
+	// the tag values in the table of contents when the view was built, for
+	// resolving globs
+	values *toc.Values
+	// the salts of the write buffer when the view was built, for hashing
+	// the tags of queries the way its generations did
+	hashers hashers
+}
+
+func (db *Database) view() *view {
+	return db.current.Load().(*view)
+}
+
+// newQuery starts an empty index query, which hashes its tags the way the
+// generations of the view do
+func (v *view) newQuery() *index.Query {
+	q := index.NewQuery(nil)
+	q.Hasher = v.hashers.tags
+	return q
+}
+
+// index returns the generation of an index in the view
+func (v *view) index(targetIndex index.Index) index.Generation {
+	switch targetIndex := targetIndex.(type) {
+	case *split.Index:
+		return v.splits[targetIndex.Name()]
+	case *full.Index:
+		return v.full
+	case *text.Index:
+		return v.text
+	}
+	panic(fmt.Sprintf("database: the view has no generation for index %s. this is an error in the code that sets up the indexes", targetIndex.Name()))
+}
+
+// linkSplits links the split index generations to each other the way their
+// indexes are linked
+func (v *view) linkSplits(splitIndexes map[string]*split.Index) {
+	for name, si := range splitIndexes {
+		if linked := si.Link(); linked != nil {
+			v.splits[name].LinkTo(v.splits[linked.Name()])
+		}
+	}
+}
+
+// initialView is the view of a new database, made of the empty generations
+// the indexes start with
+func (db *Database) initialView() *view {
+	v := &view{
+		text:    db.TextIndex.Current(),
+		full:    db.FullIndex.Current(),
+		splits:  make(map[string]*split.Generation, len(db.splitIndexes)),
+		values:  db.toc.Values(),
+		hashers: db.writeBuffer.hashers().snapshot(),
+	}
+	for name, si := range db.splitIndexes {
+		v.splits[name] = si.Current()
+	}
+	v.linkSplits(db.splitIndexes)
+	return v
+}
+
+// buildView materializes a new generation of every index at once. It must be
+// called with materializeMut and the read side of writeMut held.
+func (db *Database) buildView(splitChanges map[string]*split.Changes, fullChanges map[index.Tag]struct{}) *view {
+	next := &view{
+		generation: db.view().generation + 1,
+		splits:     make(map[string]*split.Generation, len(db.splitIndexes)),
+		values:     db.toc.Values(),
+		hashers:    db.writeBuffer.hashers().snapshot(),
+	}
+
+	// the names go to the text index, which is what maps query results back
+	// to strings
+	names := db.writeBuffer.metrics.Publish()
+
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		next.text = db.TextIndex.Materialize(names)
+	}()
+	go func() {
+		defer wg.Done()
+		next.full = db.FullIndex.Materialize(db.writeBuffer.full, fullChanges)
+	}()
+
+	var splitMut sync.Mutex
+	for name, si := range db.splitIndexes {
+		buf, ok := db.writeBuffer.splits[name]
+		if !ok {
+			panic(fmt.Sprintf("there's an index without a matching write buffer. this is an error in the code that initializes the database/split indexes: it must call writeBuffer.AddSplitIndex(%q)", name))
+		}
+		wg.Add(1)
+		go func(name string, si *split.Index, buf splitBuffer) {
+			defer wg.Done()
+			g := si.Materialize(buf.joinToMetric, buf.tagToJoin, buf.numericTags, buf.joinToLink, splitChanges[name])
+			splitMut.Lock()
+			next.splits[name] = g
+			splitMut.Unlock()
+		}(name, si, buf)
+	}
+	wg.Wait()
+
+	next.linkSplits(db.splitIndexes)
+	return next
+}
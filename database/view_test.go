@@ -0,0 +1,95 @@
+package database
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	m "github.com/kanatohodets/carbonsearch/consumer/message"
+)
+
+func TestConsistentView(t *testing.T) {
+	db := New(queryLimit, 1000, fullService, textService, splitIndexes, stats)
+	populateSplitIndex(t, db, "consistent view", "fqdn", map[string]map[string][]string{
+		"foohost.prod.example.com": {
+			"metrics": {"server.foohost_prod_example_com.cpu.0"},
+			"tags":    {"servers-dc:lhr"},
+		},
+	})
+
+	// every round replaces the metrics of the join, so their IDs are
+	// released and then given to new names
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for round := 1; round <= 20; round++ {
+			metrics := []string{}
+			for i := 0; i < 20; i++ {
+				metrics = append(metrics, fmt.Sprintf("server.foohost_prod_example_com.cpu.%d", round*20+i))
+			}
+			err := db.InsertMetrics(&m.KeyMetric{Key: "fqdn", Value: "foohost.prod.example.com", Metrics: metrics, Replace: true})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			db.MaterializeIndexes()
+		}
+	}()
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				metrics, err := db.Query(map[string][]string{
+					"servers":   {"servers-dc:lhr"},
+					textService: {textMatchPrefix + "example_com.cpu"},
+				})
+				if err != nil {
+					t.Errorf("consistent view: query failed while the indexes were rotating: %v", err)
+					return
+				}
+				for _, metric := range metrics {
+					if !strings.HasPrefix(metric, "server.foohost_prod_example_com.cpu.") {
+						t.Errorf("consistent view: query returned %q, which isn't one of the join's metrics", metric)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// globs resolve against the tag values of the view, not whatever was written
+// since it was built
+func TestGlobView(t *testing.T) {
+	db := New(queryLimit, 1000, fullService, textService, splitIndexes, stats)
+	populateSplitIndex(t, db, "glob view", "fqdn", map[string]map[string][]string{
+		"foohost.prod.example.com": {
+			"metrics": {"server.foohost_prod_example_com.cpu.0"},
+			"tags":    {"servers-dc:lhr"},
+		},
+	})
+
+	err := db.InsertTags(&m.KeyTag{Key: "fqdn", Value: "foohost.prod.example.com", Tags: []string{"servers-dc:lon"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metrics, err := db.Query(map[string][]string{"servers": {"servers-dc:l*"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metrics) != 1 {
+		t.Errorf("glob view: expected the join's metric from the view where it's in lhr, got %v", metrics)
+	}
+}
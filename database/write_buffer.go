@@ -2,37 +2,115 @@ package database
 
 import (
 	"fmt"
+	"strconv"
+	"time"
 
 	"github.com/kanatohodets/carbonsearch/database/toc"
 	"github.com/kanatohodets/carbonsearch/index"
 	"github.com/kanatohodets/carbonsearch/index/split"
 	"github.com/kanatohodets/carbonsearch/tag"
+	"github.com/kanatohodets/carbonsearch/util"
 )
 
+// the write buffer keeps track of when things were last written as unix
+// seconds, so they can expire (see expire.go)
+
 type splitBuffer struct {
-	joinToMetric map[split.Join]map[index.Metric]struct{}
-	tagToJoin    map[tag.ServiceKey]map[split.Join]index.Tag
+	// metric => last written
+	joinToMetric map[split.Join]map[index.Metric]int64
+	// usually a single value per key, but services set up for multi-valued
+	// keys can have several, like a host in more than one pool
+	tagToJoin map[tag.ServiceKey]map[split.Join][]index.Tag
+	// when the values of each key were last written for a join
+	tagSeen map[tag.ServiceKey]map[split.Join]int64
+	// the service of each key, for looking up its TTL
+	services map[tag.ServiceKey]string
+	// raw values of tags that look like numbers, so the split index can
+	// build a table for range comparisons like 'servers-num_cpus:>=16'
+	numericTags map[index.Tag]string
+	// the raw form of every tag, to find its table of contents entry when a
+	// join loses it
+	rawTags map[index.Tag]string
+	// how many joins have each tag. the raw and numeric forms of a tag go
+	// with the last one
+	tagJoins map[index.Tag]int
+	// join keys of the linked index, for split indexes linked to another
+	joinToLink map[split.Join]map[split.Join]struct{}
+	linkSeen   map[split.Join]int64
 }
 
 type writeBuffer struct {
-	metrics map[string]struct{} //TODO: time.Time so things can expire out after some duration
+	// metric names and their IDs. metrics expire from the dictionary (and so
+	// the text index) along with the last join or custom tag that has them
+	metrics *index.MetricDictionary
 	splits  map[string]splitBuffer
 	//TODO: probably 'full' associations shouldn't be updated? that is, use index.Tag instead of tag.ServiceKey
-	full          map[index.Tag]map[index.Metric]struct{}
+	// metric => last written
+	full map[index.Tag]map[index.Metric]int64
+	// the raw form of every custom tag, for the table of contents
+	fullTags      map[index.Tag]string
 	fullIndexName string
 	toc           *toc.TableOfContents
+	// services whose keys can have more than one value per join
+	multiValued map[string]struct{}
+
+	// nothing expires unless it has a TTL
+	indexTTLs   map[string]time.Duration
+	serviceTTLs map[string]time.Duration
+	fullTTL     time.Duration
+	now         func() time.Time
+
+	// every tag, join key and service key in the buffer, by hash (see
+	// collision.go)
+	tagHashes        *hashDomain
+	joinHashes       *hashDomain
+	serviceKeyHashes *hashDomain
+	collisionPolicy  CollisionPolicy
+
+	// what changed since the last materialization, by split index and
+	// custom tag (see changes.go). nil means everything has to be rebuilt
+	splitChanges map[string]*split.Changes
+	fullChanges  map[index.Tag]struct{}
+
+	stats *util.Stats
 }
 
-func NewWriteBuffer(fullIndexName string, toc *toc.TableOfContents) *writeBuffer {
+func NewWriteBuffer(fullIndexName string, toc *toc.TableOfContents, hashers hashers, stats *util.Stats) *writeBuffer {
 	return &writeBuffer{
-		metrics:       map[string]struct{}{},
+		metrics:       index.NewMetricDictionary(),
 		splits:        map[string]splitBuffer{},
-		full:          map[index.Tag]map[index.Metric]struct{}{},
+		full:          map[index.Tag]map[index.Metric]int64{},
+		fullTags:      map[index.Tag]string{},
 		fullIndexName: fullIndexName,
 		toc:           toc,
+		multiValued:   map[string]struct{}{},
+		indexTTLs:     map[string]time.Duration{},
+		serviceTTLs:   map[string]time.Duration{},
+		now:           time.Now,
+
+		tagHashes:        newHashDomain("tag", hashers.tags),
+		joinHashes:       newHashDomain("join key", hashers.joins),
+		serviceKeyHashes: newHashDomain("service key", hashers.serviceKeys),
+
+		stats: stats,
 	}
 }
 
+// writtenAt is when to say something was written, in unix seconds: now,
+// unless it's known to be older
+func (w *writeBuffer) writtenAt(written time.Time) int64 {
+	if written.IsZero() {
+		return w.now().Unix()
+	}
+	return written.Unix()
+}
+
+// AllowMultipleValues lets tag batches for the service carry several values for
+// the same key. The values in a batch replace the whole set for that join.
+func (w *writeBuffer) AllowMultipleValues(service string) {
+	w.multiValued[service] = struct{}{}
+}
+
 func (w *writeBuffer) AddSplitIndex(indexName string) error {
 	_, ok := w.splits[indexName]
 	if ok {
@@ -40,38 +118,83 @@ func (w *writeBuffer) AddSplitIndex(indexName string) error {
 	}
 
 	w.splits[indexName] = splitBuffer{
-		joinToMetric: map[split.Join]map[index.Metric]struct{}{},
-		tagToJoin:    map[tag.ServiceKey]map[split.Join]index.Tag{},
+		joinToMetric: map[split.Join]map[index.Metric]int64{},
+		tagToJoin:    map[tag.ServiceKey]map[split.Join][]index.Tag{},
+		tagSeen:      map[tag.ServiceKey]map[split.Join]int64{},
+		services:     map[tag.ServiceKey]string{},
+		numericTags:  map[index.Tag]string{},
+		rawTags:      map[index.Tag]string{},
+		tagJoins:     map[index.Tag]int{},
+		joinToLink:   map[split.Join]map[split.Join]struct{}{},
+		linkSeen:     map[split.Join]int64{},
 	}
 	return nil
 }
 
-func (w *writeBuffer) BufferMetrics(indexName, rawJoin string, rawMetrics []string) error {
+// BufferMetrics adds metrics to a join. With replace, they replace all of the
+// join's metrics instead.
+func (w *writeBuffer) BufferMetrics(indexName, rawJoin string, rawMetrics []string, replace bool, now int64) error {
 	splitBuffer, ok := w.splits[indexName]
 	if !ok {
 		return fmt.Errorf("database write buffer: no write buffer for index %q", indexName)
 	}
 
-	join := split.HashJoin(rawJoin)
+	hashes := w.newHashBatch()
+	join := hashes.join(rawJoin)
+	if err := hashes.commit(); err != nil {
+		return err
+	}
 
+	var replaced map[index.Metric]int64
 	joinMetrics, ok := splitBuffer.joinToMetric[join]
 	if !ok {
-		joinMetrics = map[index.Metric]struct{}{}
+		w.joinHashes.ref(uint64(join))
+	}
+	if !ok || replace {
+		replaced = joinMetrics
+		joinMetrics = map[index.Metric]int64{}
 		splitBuffer.joinToMetric[join] = joinMetrics
 	}
 
+	changed := false
 	for _, rawMetric := range rawMetrics {
-		w.metrics[rawMetric] = struct{}{}
+		metric, ok := w.metrics.ID(rawMetric)
+		if _, buffered := joinMetrics[metric]; !ok || !buffered {
+			metric = w.metrics.Ref(rawMetric)
+			if _, had := replaced[metric]; !had {
+				changed = true
+			}
+		}
+		joinMetrics[metric] = now
+	}
 
-		metric := index.HashMetric(rawMetric)
-		joinMetrics[metric] = struct{}{}
+	// only once the new metrics are counted, so that metrics in both sets
+	// don't drop out of the text index in between
+	for metric := range replaced {
+		if _, kept := joinMetrics[metric]; !kept {
+			changed = true
+		}
+		w.metrics.Unref(metric)
+	}
+
+	if changed {
+		w.metricsChanged(indexName, join)
 	}
 
 	w.toc.SetMetricCount(indexName, uint64(join), len(joinMetrics))
 	return nil
 }
 
-func (w *writeBuffer) BufferTags(indexName, rawJoin string, rawTags []string) error {
+type parsedTag struct {
+	service, key, value string
+	sk                  tag.ServiceKey
+	hashed              index.Tag
+}
+
+// BufferTags sets the values of the keys in the batch for a join, leaving
+// other keys alone. With replace, keys that aren't in the batch are removed
+// from the join.
+func (w *writeBuffer) BufferTags(indexName, rawJoin string, rawTags []string, replace bool, now int64) error {
 	if len(rawTags) == 0 {
 		return fmt.Errorf("database write buffer: cannot add 0 tags to join %q", rawJoin)
 	}
@@ -81,44 +204,333 @@ func (w *writeBuffer) BufferTags(indexName, rawJoin string, rawTags []string) er
 		return fmt.Errorf("database write buffer: no write buffer for index %q", indexName)
 	}
 
-	join := split.HashJoin(rawJoin)
-	hashedTags := index.HashTags(rawTags)
-
-	seenServiceKeys := map[tag.ServiceKey]string{}
-
+	// check the whole batch before changing anything, so a bad batch isn't
+	// half applied
+	parsed := make([]parsedTag, len(rawTags))
+	seenKeys := map[string]string{}
 	for i, rawTag := range rawTags {
 		s, k, v, err := tag.Parse(rawTag)
 		if err != nil {
 			return fmt.Errorf("database write buffer: could not add tags to split buffer -- failure to parse tag %q: %v", rawTag, err)
 		}
-		sk := split.HashServiceKey(s + "-" + k)
 
-		oldTag, ok := seenServiceKeys[sk]
-		if ok {
-			return fmt.Errorf("database write buffer: multiple tags (%q and %q) with key %q have been included in a batch for join %q in index %q. This is going to result in unpredictable queries for this join key (last-write-wins behavior). Bailing out on this batch.", rawTag, oldTag, s+"-"+k, rawJoin, indexName)
+		// for most services the easiest thing to reason about is a single
+		// value per key. services that opted in get a set of values instead.
+		oldTag, ok := seenKeys[s+"-"+k]
+		if _, multiValued := w.multiValued[s]; ok && !multiValued {
+			return fmt.Errorf("database write buffer: multiple tags (%q and %q) with key %q have been included in a batch for join %q in index %q. This is going to result in unpredictable queries for this join key (last-write-wins behavior). Bailing out on this batch. If the service should allow more than one value per key, add it to 'multi_valued_services' in carbonsearch.yaml", rawTag, oldTag, s+"-"+k, rawJoin, indexName)
 		}
-		seenServiceKeys[sk] = rawTag
+		seenKeys[s+"-"+k] = rawTag
+		parsed[i] = parsedTag{service: s, key: k, value: v}
+	}
+
+	hashes := w.newHashBatch()
+	join := hashes.join(rawJoin)
+	seenServiceKeys := map[tag.ServiceKey]struct{}{}
+	for i, rawTag := range rawTags {
+		parsed[i].sk = hashes.serviceKey(parsed[i].service + "-" + parsed[i].key)
+		parsed[i].hashed = hashes.tag(rawTag)
+		seenServiceKeys[parsed[i].sk] = struct{}{}
+	}
+	if err := hashes.commit(); err != nil {
+		return err
+	}
+
+	// the keys whose values this batch has set so far
+	replaced := map[tag.ServiceKey]struct{}{}
+
+	for i, rawTag := range rawTags {
+		s, k, v, sk, hashedTag := parsed[i].service, parsed[i].key, parsed[i].value, parsed[i].sk, parsed[i].hashed
+
 		// 'key' means something like: 'servers-status' in
 		// 'servers-status:maint'. this setup is to allow changing the value from
 		// 'maint' to 'live' or similar. this data structure stores the full
 		// tag values (index.Tag) for a given join (think 'hostname')
-		tagValueForJoins, ok := splitBuffer.tagToJoin[sk]
-		if !ok {
-			tagValueForJoins = map[split.Join]index.Tag{}
-			splitBuffer.tagToJoin[sk] = tagValueForJoins
-		}
-		// if/when we want to support joins with more than one
-		// value for a single tag key, we can change this to be a slice or
-		// map-set of tag values. for now I think the easiest thing to reason
-		// about is a single value per key.
-		tagValueForJoins[join] = hashedTags[i]
+		oldTags := splitBuffer.tagToJoin[sk][join]
+		if _, ok := replaced[sk]; !ok {
+			// the first value of a key in a batch replaces whatever the join had
+			replaced[sk] = struct{}{}
+			w.setJoinTags(indexName, splitBuffer, sk, join, []index.Tag{hashedTag})
+
+			joinsSeen, ok := splitBuffer.tagSeen[sk]
+			if !ok {
+				joinsSeen = map[split.Join]int64{}
+				splitBuffer.tagSeen[sk] = joinsSeen
+			}
+			joinsSeen[join] = now
+			splitBuffer.services[sk] = s
+		} else if !containsTag(oldTags, hashedTag) {
+			w.setJoinTags(indexName, splitBuffer, sk, join, append(oldTags, hashedTag))
+		}
+
+		splitBuffer.rawTags[hashedTag] = rawTag
+		if _, err := strconv.ParseFloat(v, 64); err == nil {
+			splitBuffer.numericTags[hashedTag] = v
+		}
 		w.toc.AddTag(indexName, s, k, v, uint64(join))
 	}
 
+	if replace {
+		for sk := range splitBuffer.tagToJoin {
+			if _, ok := seenServiceKeys[sk]; ok {
+				continue
+			}
+			w.setJoinTags(indexName, splitBuffer, sk, join, nil)
+		}
+	}
+
 	return nil
 }
 
-func (w *writeBuffer) BufferCustom(rawTags []string, rawMetrics []string) error {
+// setJoinTags sets the values of a key for a join, or removes the key from
+// the join if there are none, keeping count of the strings they use. Values
+// the join loses are removed from the table of contents, so that
+// 'servers-status:maint' doesn't linger there once the join is
+// 'servers-status:live'.
+func (w *writeBuffer) setJoinTags(indexName string, splitBuffer splitBuffer, sk tag.ServiceKey, join split.Join, tags []index.Tag) {
+	tagValueForJoins, ok := splitBuffer.tagToJoin[sk]
+	if !ok {
+		tagValueForJoins = map[split.Join][]index.Tag{}
+		splitBuffer.tagToJoin[sk] = tagValueForJoins
+	}
+	oldTags, had := tagValueForJoins[join]
+	w.joinTagsChanged(indexName, sk, join, oldTags, tags)
+
+	for _, hashedTag := range tags {
+		w.tagHashes.ref(uint64(hashedTag))
+		if !containsTag(oldTags, hashedTag) {
+			splitBuffer.tagJoins[hashedTag]++
+		}
+	}
+	for _, hashedTag := range oldTags {
+		w.tagHashes.unref(uint64(hashedTag))
+		if containsTag(tags, hashedTag) {
+			continue
+		}
+		w.removeFromToC(indexName, splitBuffer, hashedTag, join)
+		splitBuffer.tagJoins[hashedTag]--
+		if splitBuffer.tagJoins[hashedTag] <= 0 {
+			delete(splitBuffer.tagJoins, hashedTag)
+			delete(splitBuffer.rawTags, hashedTag)
+			delete(splitBuffer.numericTags, hashedTag)
+		}
+	}
+
+	if len(tags) > 0 {
+		tagValueForJoins[join] = tags
+		if !had {
+			w.joinHashes.ref(uint64(join))
+			w.serviceKeyHashes.ref(uint64(sk))
+		}
+		return
+	}
+
+	delete(tagValueForJoins, join)
+	delete(splitBuffer.tagSeen[sk], join)
+	if had {
+		w.joinHashes.unref(uint64(join))
+		w.serviceKeyHashes.unref(uint64(sk))
+	}
+	// no join has the key anymore
+	if len(tagValueForJoins) == 0 {
+		delete(splitBuffer.tagToJoin, sk)
+		delete(splitBuffer.tagSeen, sk)
+		delete(splitBuffer.services, sk)
+	}
+}
+
+// DeleteTags removes tags from a join. Tags the join doesn't have are ignored.
+func (w *writeBuffer) DeleteTags(indexName, rawJoin string, rawTags []string) error {
+	splitBuffer, ok := w.splits[indexName]
+	if !ok {
+		return fmt.Errorf("database write buffer: no write buffer for index %q", indexName)
+	}
+
+	join := w.lookupJoin(rawJoin)
+	for _, rawTag := range rawTags {
+		s, k, _, err := tag.Parse(rawTag)
+		if err != nil {
+			return fmt.Errorf("database write buffer: could not delete tags from split buffer -- failure to parse tag %q: %v", rawTag, err)
+		}
+		sk := w.lookupServiceKey(s + "-" + k)
+		hashedTag := w.lookupTag(rawTag)
+
+		joinTags := splitBuffer.tagToJoin[sk][join]
+		if !containsTag(joinTags, hashedTag) {
+			continue
+		}
+
+		remaining := make([]index.Tag, 0, len(joinTags)-1)
+		for _, existing := range joinTags {
+			if existing != hashedTag {
+				remaining = append(remaining, existing)
+			}
+		}
+		w.setJoinTags(indexName, splitBuffer, sk, join, remaining)
+	}
+	return nil
+}
+
+// DeleteMetrics removes metrics from a join. Metrics the join doesn't have are
+// ignored.
+func (w *writeBuffer) DeleteMetrics(indexName, rawJoin string, rawMetrics []string) error {
+	splitBuffer, ok := w.splits[indexName]
+	if !ok {
+		return fmt.Errorf("database write buffer: no write buffer for index %q", indexName)
+	}
+
+	join := w.lookupJoin(rawJoin)
+	joinMetrics, ok := splitBuffer.joinToMetric[join]
+	if !ok {
+		return nil
+	}
+
+	for _, rawMetric := range rawMetrics {
+		metric, ok := w.metrics.ID(rawMetric)
+		if !ok {
+			continue
+		}
+		if _, ok := joinMetrics[metric]; !ok {
+			continue
+		}
+		delete(joinMetrics, metric)
+		w.metrics.Unref(metric)
+		w.metricsChanged(indexName, join)
+	}
+
+	if len(joinMetrics) == 0 {
+		delete(splitBuffer.joinToMetric, join)
+		w.joinHashes.unref(uint64(join))
+	}
+	w.toc.SetMetricCount(indexName, uint64(join), len(joinMetrics))
+	return nil
+}
+
+// DeleteJoin removes everything known about a join: its metrics, tags and
+// links.
+func (w *writeBuffer) DeleteJoin(indexName, rawJoin string) error {
+	splitBuffer, ok := w.splits[indexName]
+	if !ok {
+		return fmt.Errorf("database write buffer: no write buffer for index %q", indexName)
+	}
+
+	join := w.lookupJoin(rawJoin)
+	if joinMetrics, ok := splitBuffer.joinToMetric[join]; ok {
+		for metric := range joinMetrics {
+			w.metrics.Unref(metric)
+		}
+		delete(splitBuffer.joinToMetric, join)
+		w.joinHashes.unref(uint64(join))
+		w.metricsChanged(indexName, join)
+	}
+
+	for sk := range splitBuffer.tagToJoin {
+		w.setJoinTags(indexName, splitBuffer, sk, join, nil)
+	}
+
+	w.removeLinks(indexName, splitBuffer, join)
+	w.toc.RemoveJoin(indexName, uint64(join))
+	return nil
+}
+
+// removeFromToC removes a join from the table of contents entry for one of its
+// tags
+func (w *writeBuffer) removeFromToC(indexName string, splitBuffer splitBuffer, hashedTag index.Tag, join split.Join) {
+	rawTag, ok := splitBuffer.rawTags[hashedTag]
+	if !ok {
+		panic(fmt.Sprintf("database write buffer: index %q has a tag without its raw form. this is a bug in BufferTags, which should record every tag it buffers", indexName))
+	}
+	s, k, v, err := tag.Parse(rawTag)
+	if err != nil {
+		panic(fmt.Sprintf("database write buffer: tag %q in index %q doesn't parse anymore: %v. it was parsed before going into the write buffer, hence the panic", rawTag, indexName, err))
+	}
+	w.toc.RemoveTag(indexName, s, k, v, uint64(join))
+}
+
+func containsTag(tags []index.Tag, needle index.Tag) bool {
+	for _, tag := range tags {
+		if tag == needle {
+			return true
+		}
+	}
+	return false
+}
+
+// BufferLinks sets the join keys in the linked index that a join key links to,
+// replacing whatever it linked to before
+func (w *writeBuffer) BufferLinks(indexName, rawJoin, linkedIndexName string, rawLinks []string, now int64) error {
+	if len(rawLinks) == 0 {
+		return fmt.Errorf("database write buffer: cannot link join %q to 0 join keys", rawJoin)
+	}
+
+	splitBuffer, ok := w.splits[indexName]
+	if !ok {
+		return fmt.Errorf("database write buffer: no write buffer for index %q", indexName)
+	}
+
+	hashes := w.newHashBatch()
+	join := hashes.join(rawJoin)
+	links := hashes.joins(rawLinks)
+	if err := hashes.commit(); err != nil {
+		return err
+	}
+
+	linkSet := make(map[split.Join]struct{}, len(links))
+	for _, link := range links {
+		if _, ok := linkSet[link]; !ok {
+			w.joinHashes.ref(uint64(link))
+		}
+		linkSet[link] = struct{}{}
+	}
+	oldLinks, had := splitBuffer.joinToLink[join]
+	for link := range oldLinks {
+		w.joinHashes.unref(uint64(link))
+	}
+	if !had {
+		w.joinHashes.ref(uint64(join))
+	}
+	if !had || !sameJoins(oldLinks, linkSet) {
+		w.linksChanged(indexName, join)
+	}
+	splitBuffer.joinToLink[join] = linkSet
+	splitBuffer.linkSeen[join] = now
+
+	linkHashes := make([]uint64, len(links))
+	for i, link := range links {
+		linkHashes[i] = uint64(link)
+	}
+	w.toc.SetLinks(indexName, uint64(join), linkedIndexName, linkHashes)
+	return nil
+}
+
+// removeLinks removes the links of a join, if it has any
+func (w *writeBuffer) removeLinks(indexName string, splitBuffer splitBuffer, join split.Join) {
+	links, ok := splitBuffer.joinToLink[join]
+	if !ok {
+		return
+	}
+	for link := range links {
+		w.joinHashes.unref(uint64(link))
+	}
+	w.joinHashes.unref(uint64(join))
+	delete(splitBuffer.joinToLink, join)
+	delete(splitBuffer.linkSeen, join)
+	w.linksChanged(indexName, join)
+}
+
+func sameJoins(a, b map[split.Join]struct{}) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for join := range a {
+		if _, ok := b[join]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (w *writeBuffer) BufferCustom(rawTags []string, rawMetrics []string, now int64) error {
 	if len(rawMetrics) == 0 {
 		return fmt.Errorf("database write buffer: can't associate tags with 0 metrics")
 	}
@@ -127,38 +539,96 @@ func (w *writeBuffer) BufferCustom(rawTags []string, rawMetrics []string) error
 		return fmt.Errorf("database write buffer: can't associate metrics with 0 tags")
 	}
 
-	tags := index.HashTags(rawTags)
-	metrics := index.HashMetrics(rawMetrics)
+	parsed := make([]parsedTag, len(rawTags))
+	for i, rawTag := range rawTags {
+		s, k, v, err := tag.Parse(rawTag)
+		if err != nil {
+			return fmt.Errorf("failure to add %v to full index buffer: parse error: %v", rawTag, err)
+		}
+		parsed[i] = parsedTag{service: s, key: k, value: v}
+	}
 
-	for _, metric := range rawMetrics {
-		w.metrics[metric] = struct{}{}
+	hashes := w.newHashBatch()
+	tags := hashes.tags(rawTags)
+	if err := hashes.commit(); err != nil {
+		return err
 	}
 
 	for i, hashedTag := range tags {
 		_, ok := w.full[hashedTag]
 		if !ok {
-			w.full[hashedTag] = map[index.Metric]struct{}{}
+			w.full[hashedTag] = map[index.Metric]int64{}
+			w.tagHashes.ref(uint64(hashedTag))
 		}
+		w.fullTags[hashedTag] = rawTags[i]
 
-		for _, metric := range metrics {
-			w.full[hashedTag][metric] = struct{}{}
+		for _, rawMetric := range rawMetrics {
+			metric, ok := w.metrics.ID(rawMetric)
+			if _, buffered := w.full[hashedTag][metric]; !ok || !buffered {
+				metric = w.metrics.Ref(rawMetric)
+				w.customTagChanged(hashedTag)
+			}
+			w.full[hashedTag][metric] = now
 		}
 
-		s, k, v, err := tag.Parse(rawTags[i])
+		w.toc.AddTag(w.fullIndexName, parsed[i].service, parsed[i].key, parsed[i].value, uint64(hashedTag))
+		w.toc.SetMetricCount(w.fullIndexName, uint64(hashedTag), len(w.full[hashedTag]))
+	}
+
+	return nil
+}
+
+// DeleteCustom removes the associations between the tags and the metrics.
+// Associations that don't exist are ignored.
+func (w *writeBuffer) DeleteCustom(rawTags []string, rawMetrics []string) error {
+	for _, rawTag := range rawTags {
+		s, k, v, err := tag.Parse(rawTag)
 		if err != nil {
-			return fmt.Errorf("failure to add %v to full index buffer: parse error: %v", rawTags[i], err)
+			return fmt.Errorf("failure to delete %v from full index buffer: parse error: %v", rawTag, err)
 		}
-		w.toc.AddTag(w.fullIndexName, s, k, v, uint64(hashedTag))
-		w.toc.SetMetricCount(w.fullIndexName, uint64(hashedTag), len(w.full[hashedTag]))
+
+		hashedTag := w.lookupTag(rawTag)
+		tagMetrics, ok := w.full[hashedTag]
+		if !ok {
+			continue
+		}
+
+		for _, rawMetric := range rawMetrics {
+			metric, ok := w.metrics.ID(rawMetric)
+			if !ok {
+				continue
+			}
+			if _, ok := tagMetrics[metric]; !ok {
+				continue
+			}
+			delete(tagMetrics, metric)
+			w.metrics.Unref(metric)
+			w.customTagChanged(hashedTag)
+		}
+
+		if len(tagMetrics) == 0 {
+			w.removeCustomTag(hashedTag)
+			w.toc.RemoveTag(w.fullIndexName, s, k, v, uint64(hashedTag))
+			continue
+		}
+		w.toc.SetMetricCount(w.fullIndexName, uint64(hashedTag), len(tagMetrics))
 	}
 
 	return nil
 }
 
+// removeCustomTag removes a custom tag that has no metrics left
+func (w *writeBuffer) removeCustomTag(hashedTag index.Tag) {
+	delete(w.full, hashedTag)
+	delete(w.fullTags, hashedTag)
+	w.tagHashes.unref(uint64(hashedTag))
+	w.customTagChanged(hashedTag)
+}
+
 func (w *writeBuffer) MetricList() []string {
-	list := make([]string, 0, len(w.metrics))
-	for metric := range w.metrics {
-		list = append(list, metric)
-	}
+	list := make([]string, 0, w.metrics.Len())
+	w.metrics.Each(func(_ index.Metric, name string) {
+		list = append(list, name)
+	})
 	return list
 }
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/kanatohodets/carbonsearch/consumer"
+	"github.com/kanatohodets/carbonsearch/database"
+)
+
+/*
+	the handoff moves the database from one carbonsearch process to the next
+	during a graceful restart (SIGUSR2), so the new one starts warm.
+
+	once its consumers have stopped, the old process listens on a unix socket
+	in a directory only its user can get into, and puts the path in the
+	environment the new process inherits. Connections from processes of other
+	users are refused, where the platform can tell (see handoff_linux.go). The new
+	process connects before starting its consumers and reads a database
+	snapshot (see database/snapshot.go), which has where each resumable
+	consumer stopped, like the offset of each Kafka partition or the last
+	message in the write-ahead log of the HTTP consumer. Its consumers then
+	continue from there instead of the configured offsets.
+
+	the old process only writes the snapshot file when it can't offer the
+	handoff. if anything goes wrong after that, the new process loads the
+	last periodic snapshot, or warms up as if there had been no handoff.
+*/
+
+const handoffEnv = "CARBONSEARCH_HANDOFF"
+
+// how long the old process waits for the new one to connect
+const handoffTimeout = 2 * time.Minute
+
+// offerHandoff gets ready to hand the database and the position of the
+// (stopped) consumers over to the next process. The socket goes in a new
+// private directory under dir (or the temporary directory, if dir is empty).
+func offerHandoff(db *database.Database, consumers []consumer.Consumer, dir string) error {
+	positions := consumerPositions(consumers)
+
+	// only this user can get into the directory, so only this user's
+	// processes can connect to the socket
+	private, err := ioutil.TempDir(dir, "carbonsearch-handoff-")
+	if err != nil {
+		return fmt.Errorf("handoff: could not make a directory for the socket: %v", err)
+	}
+	path := filepath.Join(private, "handoff.sock")
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		os.RemoveAll(private)
+		return fmt.Errorf("handoff: could not listen on %q: %v", path, err)
+	}
+	listener.SetDeadline(time.Now().Add(handoffTimeout))
+
+	err = os.Setenv(handoffEnv, path)
+	if err != nil {
+		listener.Close()
+		os.RemoveAll(private)
+		return fmt.Errorf("handoff: could not tell the new process about it: %v", err)
+	}
+
+	go func() {
+		// closing also removes the socket file
+		defer os.RemoveAll(private)
+		defer listener.Close()
+
+		for {
+			conn, err := listener.AcceptUnix()
+			if err != nil {
+				logger.Logf("handoff: the new process didn't connect: %v", err)
+				return
+			}
+
+			err = checkPeer(conn)
+			if err != nil {
+				logger.Logf("handoff: refusing a connection: %v", err)
+				conn.Close()
+				continue
+			}
+
+			start := time.Now()
+			err = sendHandoff(conn, db, positions)
+			conn.Close()
+			if err != nil {
+				logger.Logf("handoff: failed: %v", err)
+				return
+			}
+			logger.Logf("handoff: sent the database to the new process in %v", time.Since(start))
+			return
+		}
+	}()
+	return nil
+}
+
+func sendHandoff(conn net.Conn, db *database.Database, positions database.Positions) error {
+	w := bufio.NewWriter(conn)
+	err := db.Snapshot(w, positions)
+	if err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// receiveHandoff loads the database from the previous process, if it offered
+// one. It returns where each consumer should resume, and whether there was a
+// handoff at all.
+func receiveHandoff(db *database.Database) (database.Positions, bool) {
+	path := os.Getenv(handoffEnv)
+	if path == "" {
+		return nil, false
+	}
+	// only for this process, not the one after it
+	os.Unsetenv(handoffEnv)
+
+	conn, err := net.DialTimeout("unix", path, 10*time.Second)
+	if err != nil {
+		logger.Logf("handoff: could not connect to the previous process at %q, warming up from scratch: %v", path, err)
+		return nil, false
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	// a snapshot either loads completely or not at all, so a failed handoff
+	// leaves the database empty for warming up from scratch
+	positions, err := db.LoadSnapshot(bufio.NewReader(conn))
+	if err != nil {
+		logger.Logf("handoff: failed, warming up from scratch: %v", err)
+		return nil, false
+	}
+	logger.Logf("handoff: received the database from the previous process in %v", time.Since(start))
+	return positions, true
+}
+
+// consumerPositions is where each resumable consumer got to. Everything before
+// the positions is in the database, so a snapshot taken after them has it all.
+func consumerPositions(consumers []consumer.Consumer) database.Positions {
+	positions := database.Positions{}
+	for _, c := range consumers {
+		if resumable, ok := c.(consumer.Resumable); ok {
+			positions[c.Name()] = resumable.Position()
+		}
+	}
+	return positions
+}
+
+// resumeConsumer makes a consumer continue from where the previous process
+// (or the snapshot) left off, if it can. It returns false if the consumer
+// could have, but there's no position for it, so it starts from its
+// configured offsets and has catching up to do. Without a position it still
+// hears that the database isn't empty, so it doesn't replay its own log into
+// it.
+func resumeConsumer(c consumer.Consumer, positions database.Positions) bool {
+	resumable, ok := c.(consumer.Resumable)
+	if !ok {
+		return true
+	}
+	position, ok := positions[c.Name()]
+	resumable.ResumeFrom(position)
+	if !ok {
+		return false
+	}
+	logger.Logf("%s consumer resuming where the database left off", c.Name())
+	return true
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+// checkPeer refuses processes of other users, by the credentials the kernel
+// recorded for the other end of the socket
+func checkPeer(conn *net.UnixConn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return fmt.Errorf("handoff: could not get the socket's file descriptor: %v", err)
+	}
+
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err == nil {
+		err = credErr
+	}
+	if err != nil {
+		return fmt.Errorf("handoff: could not get the credentials of the other process: %v", err)
+	}
+
+	if int(cred.Uid) != os.Getuid() {
+		return fmt.Errorf("handoff: process %d runs as uid %d, not %d like this one", cred.Pid, cred.Uid, os.Getuid())
+	}
+	return nil
+}
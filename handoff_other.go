@@ -0,0 +1,13 @@
+// +build !linux
+
+package main
+
+import (
+	"net"
+)
+
+// checkPeer can't tell who the other process is on this platform, so it
+// relies on the socket's directory being private
+func checkPeer(conn *net.UnixConn) error {
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/kanatohodets/carbonsearch/consumer"
+	m "github.com/kanatohodets/carbonsearch/consumer/message"
+	"github.com/kanatohodets/carbonsearch/database"
+)
+
+type resumableConsumer struct {
+	position map[string]map[int32]int64
+}
+
+func (r *resumableConsumer) Name() string                           { return "resumable" }
+func (r *resumableConsumer) Start(*database.Database) error         { return nil }
+func (r *resumableConsumer) WaitUntilWarm(wg *sync.WaitGroup) error { wg.Done(); return nil }
+func (r *resumableConsumer) Stop() error                            { return nil }
+func (r *resumableConsumer) Position() map[string]map[int32]int64   { return r.position }
+func (r *resumableConsumer) ResumeFrom(position map[string]map[int32]int64) {
+	r.position = position
+}
+
+func TestHandoff(t *testing.T) {
+	splitIndexes := map[string][]string{"fqdn": {"servers"}}
+	old := database.New(100, 1000, "custom", "text", splitIndexes, stats)
+	err := old.InsertMetrics(&m.KeyMetric{Key: "fqdn", Value: "foohost", Metrics: []string{"server.foohost.cpu"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = old.InsertTags(&m.KeyTag{Key: "fqdn", Value: "foohost", Tags: []string{"servers-dc:lhr"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stopped := &resumableConsumer{position: map[string]map[int32]int64{"carbonsearch_tags": {0: 42, 1: 7}}}
+	err = offerHandoff(old, []consumer.Consumer{stopped}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Dir(os.Getenv(handoffEnv)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0700 {
+		t.Errorf("handoff: only this user should be able to get to the socket, but its directory is %v", info.Mode())
+	}
+
+	db := database.New(100, 1000, "custom", "text", splitIndexes, stats)
+	positions, ok := receiveHandoff(db)
+	if !ok {
+		t.Fatalf("handoff: expected to receive the database")
+	}
+	if os.Getenv(handoffEnv) != "" {
+		t.Errorf("handoff: the next process shouldn't try to connect to this one's socket")
+	}
+
+	if expected, table := old.TableOfContents(), db.TableOfContents(); !reflect.DeepEqual(expected, table) {
+		t.Errorf("handoff: table of contents expected %v, got %v", expected, table)
+	}
+
+	resumed := &resumableConsumer{}
+	if !resumeConsumer(resumed, positions) {
+		t.Errorf("handoff: the consumer should have resumed")
+	}
+	if !reflect.DeepEqual(stopped.position, resumed.position) {
+		t.Errorf("handoff: expected the consumer to resume from %v, got %v", stopped.position, resumed.position)
+	}
+
+	_, ok = receiveHandoff(database.New(100, 1000, "custom", "text", splitIndexes, stats))
+	if ok {
+		t.Errorf("handoff: there shouldn't be a handoff without a previous process")
+	}
+
+	if resumeConsumer(&resumableConsumer{}, database.Positions{}) {
+		t.Errorf("handoff: a consumer without a position has to catch up by itself")
+	}
+}
@@ -0,0 +1,138 @@
+package index
+
+/*
+	the metric dictionary interns metric names: each name is stored once, and
+	gets a dense ID the first time it's written. The indexes store those IDs
+	instead of hashes, so a query result maps back to names by indexing into a
+	slice.
+
+	the write buffer owns the dictionary, and counts how many joins and custom
+	tags have each metric. Once nothing has a metric anymore its ID is released.
+	The readable indexes may still have it until they're materialized again, so
+	released IDs are only handed out again after the next Publish: by then
+	every index has been rebuilt without them.
+*/
+
+// MetricDictionary assigns IDs to metric names. It isn't safe for concurrent
+// use: the write buffer's lock protects it.
+type MetricDictionary struct {
+	ids   map[string]Metric
+	names []string
+	// how many joins and custom tags have each metric
+	refs []uint32
+
+	// released before the last Publish, so free to use again
+	free []Metric
+	// released since the last Publish
+	released []Metric
+}
+
+func NewMetricDictionary() *MetricDictionary {
+	return &MetricDictionary{
+		ids: map[string]Metric{},
+	}
+}
+
+// Ref returns the ID of a metric name, interning it if it's new, and counts
+// one more reference to it
+func (d *MetricDictionary) Ref(name string) Metric {
+	id, ok := d.ids[name]
+	if !ok {
+		id = d.intern(name)
+	}
+	d.refs[id]++
+	return id
+}
+
+func (d *MetricDictionary) intern(name string) Metric {
+	var id Metric
+	if len(d.free) > 0 {
+		id = d.free[len(d.free)-1]
+		d.free = d.free[:len(d.free)-1]
+		d.names[id] = name
+	} else {
+		id = Metric(len(d.names))
+		d.names = append(d.names, name)
+		d.refs = append(d.refs, 0)
+	}
+	d.ids[name] = id
+	return id
+}
+
+// Unref drops a reference to a metric, releasing its ID once nothing refers
+// to it anymore
+func (d *MetricDictionary) Unref(id Metric) {
+	if int(id) >= len(d.refs) || d.refs[id] == 0 {
+		return
+	}
+	d.refs[id]--
+	if d.refs[id] == 0 {
+		delete(d.ids, d.names[id])
+		d.names[id] = ""
+		d.released = append(d.released, id)
+	}
+}
+
+// ID looks up the ID of a metric name
+func (d *MetricDictionary) ID(name string) (Metric, bool) {
+	id, ok := d.ids[name]
+	return id, ok
+}
+
+// Name looks up the name of a metric ID
+func (d *MetricDictionary) Name(id Metric) (string, bool) {
+	if int(id) >= len(d.names) || d.refs[id] == 0 {
+		return "", false
+	}
+	return d.names[id], true
+}
+
+// Len is the number of metrics in the dictionary
+func (d *MetricDictionary) Len() int {
+	return len(d.ids)
+}
+
+// Each calls f for every metric in the dictionary
+func (d *MetricDictionary) Each(f func(id Metric, name string)) {
+	for id, name := range d.names {
+		if d.refs[id] > 0 {
+			f(Metric(id), name)
+		}
+	}
+}
+
+// Publish returns a read-only copy of the dictionary for the next generation
+// of indexes. The names are shared, not copied. IDs released before this
+// call can be handed out again afterwards. Publish doesn't change any names,
+// so it can run alongside other readers, but not alongside itself.
+func (d *MetricDictionary) Publish() MetricNames {
+	names := make(MetricNames, len(d.names))
+	copy(names, d.names)
+
+	d.free = append(d.free, d.released...)
+	d.released = nil
+	return names
+}
+
+// MetricNames maps the metric IDs of one generation of indexes to names.
+// Released IDs map to "".
+type MetricNames []string
+
+// Name looks up the name of a metric ID
+func (n MetricNames) Name(id Metric) (string, bool) {
+	if int(id) >= len(n) || n[id] == "" {
+		return "", false
+	}
+	return n[id], true
+}
+
+// Len is the number of live metrics
+func (n MetricNames) Len() int {
+	live := 0
+	for _, name := range n {
+		if name != "" {
+			live++
+		}
+	}
+	return live
+}
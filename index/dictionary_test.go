@@ -0,0 +1,52 @@
+package index
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMetricDictionary(t *testing.T) {
+	d := NewMetricDictionary()
+	foo := d.Ref("foo")
+	bar := d.Ref("bar")
+	if foo != 0 || bar != 1 {
+		t.Errorf("dictionary test: expected dense IDs 0 and 1, got %d and %d", foo, bar)
+	}
+	if again := d.Ref("foo"); again != foo {
+		t.Errorf("dictionary test: interning 'foo' twice gave two IDs: %d and %d", foo, again)
+	}
+
+	// 'foo' has two references now
+	d.Unref(foo)
+	if name, ok := d.Name(foo); !ok || name != "foo" {
+		t.Errorf("dictionary test: 'foo' was released while it still had a reference")
+	}
+	d.Unref(foo)
+	if _, ok := d.ID("foo"); ok {
+		t.Errorf("dictionary test: 'foo' is still there after dropping all of its references")
+	}
+	if d.Len() != 1 {
+		t.Errorf("dictionary test: expected 1 metric, got %d", d.Len())
+	}
+
+	// the ID isn't reused until the indexes are rebuilt without it
+	if baz := d.Ref("baz"); baz == foo {
+		t.Errorf("dictionary test: the released ID %d was reused before publishing", foo)
+	}
+
+	names := d.Publish()
+	expected := MetricNames{"", "bar", "baz"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("dictionary test: expected to publish %q, got %q", expected, names)
+	}
+	if _, ok := names.Name(foo); ok {
+		t.Errorf("dictionary test: the published names still have the released 'foo'")
+	}
+
+	if qux := d.Ref("qux"); qux != foo {
+		t.Errorf("dictionary test: expected 'qux' to reuse the released ID %d, got %d", foo, qux)
+	}
+	if name, _ := names.Name(foo); name != "" {
+		t.Errorf("dictionary test: reusing an ID changed the names that were already published")
+	}
+}
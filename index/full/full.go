@@ -1,8 +1,6 @@
 package full
 
 import (
-	"sync"
-	"sync/atomic"
 	"time"
 
 	"github.com/dgryski/carbonzipper/mlog"
@@ -13,7 +11,11 @@ import (
 var logger mlog.Level
 
 type Index struct {
-	index atomic.Value //map[index.Tag][]index.Metric
+	// how the posting lists are stored. set before the index is used
+	format index.PostingsFormat
+	// the generation Materialize built last, which the next one starts from.
+	// only Materialize uses it, and it's never called concurrently
+	last *Generation
 
 	// reporting
 	readableTags   uint32
@@ -21,36 +23,70 @@ type Index struct {
 	generationTime int64 // time.Duration
 }
 
+// Generation is a read-only generation of the full index
+type Generation struct {
+	index map[index.Tag]index.Postings // of index.Metrics
+}
+
 func NewIndex() *Index {
-	fi := &Index{}
-	fi.index.Store(make(map[index.Tag][]index.Metric))
+	return &Index{
+		last: &Generation{index: map[index.Tag]index.Postings{}},
+	}
+}
 
-	return fi
+// SetPostingsFormat sets how the posting lists of the next generations are
+// stored. It has to be called before the index is used.
+func (fi *Index) SetPostingsFormat(format index.PostingsFormat) {
+	fi.format = format
 }
 
+// Current is the generation Materialize built last, or an empty one
+func (fi *Index) Current() *Generation {
+	return fi.last
+}
+
+// Materialize builds a new generation of the index. Only the posting lists of
+// the changed tags are rebuilt, the rest are shared with the last generation.
+// nil changes rebuild everything. The generation isn't used for anything
+// until the caller publishes it.
+//
 // Materialize should panic in case of any problems with the data -- that
 // should have been caught by validation before going into the write buffer
-func (fi *Index) Materialize(wg *sync.WaitGroup, fullBuffer map[index.Tag]map[index.Metric]struct{}) {
-	defer wg.Done()
+func (fi *Index) Materialize(fullBuffer map[index.Tag]map[index.Metric]int64, changed map[index.Tag]struct{}) *Generation {
 	start := time.Now()
 
-	fullIndex := make(map[index.Tag][]index.Metric)
-	var readableTags uint32
-	for tag, metricSet := range fullBuffer {
-		readableTags++
-		for metric, _ := range metricSet {
-			fullIndex[tag] = append(fullIndex[tag], metric)
+	var fullIndex map[index.Tag]index.Postings
+	if changed == nil {
+		fullIndex = make(map[index.Tag]index.Postings, len(fullBuffer))
+		changed = make(map[index.Tag]struct{}, len(fullBuffer))
+		for tag := range fullBuffer {
+			changed[tag] = struct{}{}
+		}
+	} else {
+		old := fi.last.index
+		fullIndex = make(map[index.Tag]index.Postings, len(old))
+		for tag, metrics := range old {
+			fullIndex[tag] = metrics
 		}
 	}
 
-	for _, metricList := range fullIndex {
-		index.SortMetrics(metricList)
+	for tag := range changed {
+		metricSet := fullBuffer[tag]
+		if len(metricSet) == 0 {
+			delete(fullIndex, tag)
+			continue
+		}
+		metricList := make([]uint64, 0, len(metricSet))
+		for metric := range metricSet {
+			metricList = append(metricList, uint64(metric))
+		}
+		index.SortIDs(metricList)
+		fullIndex[tag] = index.NewPostings(fi.format, metricList)
 	}
-
-	fi.index.Store(fullIndex)
+	fi.last = &Generation{index: fullIndex}
 
 	// update stats
-	fi.SetReadableTags(readableTags)
+	fi.SetReadableTags(uint32(len(fullIndex)))
 	fi.IncrementGeneration()
 
 	g := fi.Generation()
@@ -59,12 +95,17 @@ func (fi *Index) Materialize(wg *sync.WaitGroup, fullBuffer map[index.Tag]map[in
 	if index.Debug {
 		logger.Logf("full index: New generation %v took %v to generate", g, elapsed)
 	}
+	return fi.last
 }
 
-func (fi *Index) Query(q *index.Query) ([]index.Metric, error) {
-	in := fi.Index()
+func (g *Generation) Query(q *index.Query) ([]index.Metric, error) {
+	start := time.Now()
+	in := g.index
+	if q.Trace != nil {
+		g.traceTags(q)
+	}
 
-	metricSets := make([][]index.Metric, 0, len(q.Hashed))
+	metricSets := make([]index.Postings, 0, len(q.Hashed))
 	for _, tag := range q.Hashed {
 		metrics, ok := in[tag]
 		if !ok {
@@ -74,13 +115,50 @@ func (fi *Index) Query(q *index.Query) ([]index.Metric, error) {
 		metricSets = append(metricSets, metrics)
 	}
 
-	return index.IntersectMetrics(metricSets), nil
+	for _, union := range q.Unions {
+		unionSets := make([]index.Postings, 0, len(union))
+		for _, tag := range union {
+			metrics, ok := in[tag]
+			if ok {
+				unionSets = append(unionSets, metrics)
+			}
+		}
+
+		if len(unionSets) == 0 {
+			return []index.Metric{}, nil
+		}
+
+		metricSets = append(metricSets, index.UnionPostings(unionSets))
+	}
+
+	metrics := index.IntersectPostings(metricSets)
+	q.Trace.Step(g.Name(), "", "metrics after intersection", len(metrics), start)
+	return metrics.Metrics(), nil
+}
+
+// traceTags records how many metrics each tag in the query matched
+func (g *Generation) traceTags(q *index.Query) {
+	for i, tag := range q.Hashed {
+		q.Trace.Tag(g.Name(), q.Raw[i], index.PostingsLen(g.index[tag]), "metrics")
+	}
+
+	for i, union := range q.Unions {
+		for j, tag := range union {
+			q.Trace.Tag(g.Name(), q.RawUnions[i][j], index.PostingsLen(g.index[tag]), "metrics")
+		}
+	}
 }
 
-func (fi *Index) Index() map[index.Tag][]index.Metric {
-	return fi.index.Load().(map[index.Tag][]index.Metric)
+func (g *Generation) Index() map[index.Tag]index.Postings {
+	return g.index
+}
+
+func (g *Generation) Name() string {
+	return indexName
 }
 
 func (fi *Index) Name() string {
-	return "full index"
+	return indexName
 }
+
+const indexName = "full index"
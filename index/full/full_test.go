@@ -1,7 +1,6 @@
 package full
 
 import (
-	"sync"
 	"testing"
 
 	"github.com/kanatohodets/carbonsearch/index"
@@ -10,42 +9,37 @@ import (
 func TestQuery(t *testing.T) {
 	metricName := "server.hostname-1234"
 
-	hashedMetrics := index.HashMetrics([]string{metricName})
+	metric := index.NewMetricDictionary().Ref(metricName)
 	tags := index.HashTags([]string{"server-state:live", "server-dc:lhr"})
 	in := NewIndex()
 
-	buffer := map[index.Tag]map[index.Metric]struct{}{}
+	buffer := map[index.Tag]map[index.Metric]int64{}
 	for _, tag := range tags {
 		tagSet, ok := buffer[tag]
 		if !ok {
-			tagSet = map[index.Metric]struct{}{}
+			tagSet = map[index.Metric]int64{}
 			buffer[tag] = tagSet
 		}
-		for _, metric := range hashedMetrics {
-			tagSet[metric] = struct{}{}
-		}
+		tagSet[metric] = 0
 	}
 
-	wg := &sync.WaitGroup{}
-	wg.Add(1)
-	in.Materialize(wg, buffer)
-	wg.Wait()
+	g := in.Materialize(buffer, nil)
 
 	query := index.NewQuery([]string{"server-state:live"})
-	result, err := in.Query(query)
+	result, err := g.Query(query)
 	if err != nil {
 		t.Error(err)
 	}
 
 	if len(result) == 1 {
-		if result[0] != index.HashMetric(metricName) {
+		if result[0] != metric {
 			t.Errorf("full index test: %v was not found in the index", metricName)
 		}
 	} else {
 		t.Errorf("full index test: the index had %d search results. that value is wrong because it isn't 1", len(result))
 	}
 
-	emptyResult, err := in.Query(index.NewQuery([]string{"blorgtag"}))
+	emptyResult, err := g.Query(index.NewQuery([]string{"blorgtag"}))
 	if err != nil {
 		t.Errorf("error querying blorgtag: %v", err)
 	}
@@ -53,7 +47,7 @@ func TestQuery(t *testing.T) {
 		t.Errorf("full index text: found some results on a bogus query: %v", emptyResult)
 	}
 
-	emptyResult, err = in.Query(index.NewQuery([]string{"server-state:live", "server-dc:a_ship_in_the_ocean"}))
+	emptyResult, err = g.Query(index.NewQuery([]string{"server-state:live", "server-dc:a_ship_in_the_ocean"}))
 	if err != nil {
 		t.Errorf("error querying with missing tag value: %v", err)
 	}
@@ -61,7 +55,7 @@ func TestQuery(t *testing.T) {
 		t.Errorf("split index test: found some results on a partially (bad tag value) bogus query: %v", emptyResult)
 	}
 
-	emptyResult, err = in.Query(index.NewQuery([]string{"server-state:live", "server-foobar:baz"}))
+	emptyResult, err = g.Query(index.NewQuery([]string{"server-state:live", "server-foobar:baz"}))
 	if err != nil {
 		t.Errorf("error querying with missing tag key: %v", err)
 	}
@@ -7,7 +7,8 @@ import (
 	"github.com/kanatohodets/carbonsearch/util"
 )
 
-type Metric uint64
+// Metric is the ID of a metric name in the MetricDictionary
+type Metric uint32
 type MetricSlice []Metric
 
 func (a MetricSlice) Len() int           { return len(a) }
@@ -21,9 +22,28 @@ func (a TagSlice) Len() int           { return len(a) }
 func (a TagSlice) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a TagSlice) Less(i, j int) bool { return a[i] < a[j] }
 
+// Query is a set of tags that must all match (AND). Unions are groups of tags
+// where a match on any single tag in the group is enough (OR), like the
+// expansion of 'servers-dc:{lhr,ams}'. Each union is ANDed with the rest of
+// the query. Metrics matching any of the Negated tags are excluded from the
+// results (NOT): that exclusion is done by the caller, since it is a set
+// difference against the results of every index.
 type Query struct {
 	Raw    []string
 	Hashed []Tag
+
+	RawUnions [][]string
+	Unions    [][]Tag
+
+	RawNegated []string
+	Negated    []Tag
+
+	// Trace is nil unless the query is being explained
+	Trace *Trace
+
+	// Hasher hashes the tags added to the query. If it's nil, they're hashed
+	// without salts, like HashTag does.
+	Hasher *util.Hasher
 }
 
 func NewQuery(raw []string) *Query {
@@ -36,12 +56,44 @@ func NewQuery(raw []string) *Query {
 
 //TODO(btyler) -- think about whether this should dedupe
 func (q *Query) AddTags(raw []string) {
-	hashed := HashTags(raw)
+	hashed := q.hashTags(raw)
 	q.Raw = append(q.Raw, raw...)
 	q.Hashed = append(q.Hashed, hashed...)
 }
 
+// AddUnion adds a group of alternative tags to the query
+func (q *Query) AddUnion(raw []string) {
+	q.RawUnions = append(q.RawUnions, raw)
+	q.Unions = append(q.Unions, q.hashTags(raw))
+}
+
+// AddNegated adds tags which should exclude metrics from the result
+func (q *Query) AddNegated(raw []string) {
+	q.RawNegated = append(q.RawNegated, raw...)
+	q.Negated = append(q.Negated, q.hashTags(raw)...)
+}
+
+func (q *Query) hashTags(raw []string) []Tag {
+	result := make([]Tag, len(raw))
+	for i, tag := range raw {
+		result[i] = Tag(q.Hasher.Hash(tag))
+	}
+	return result
+}
+
+// Empty returns true if the query has no positive (non-negated) tags
+func (q *Query) Empty() bool {
+	return len(q.Hashed) == 0 && len(q.Unions) == 0
+}
+
+// Index is one of the indexes that services' tags go into. Queries don't run
+// against an Index, but against one of its read-only generations.
 type Index interface {
+	Name() string
+}
+
+// Generation is a read-only generation of an Index
+type Generation interface {
 	Query(*Query) ([]Metric, error)
 	Name() string
 }
@@ -58,18 +110,6 @@ func HashTags(tags []string) []Tag {
 	return result
 }
 
-func HashMetric(metric string) Metric {
-	return Metric(util.HashStr64(metric))
-}
-
-func HashMetrics(metrics []string) []Metric {
-	result := make([]Metric, len(metrics))
-	for i, metric := range metrics {
-		result[i] = HashMetric(metric)
-	}
-	return result
-}
-
 func SortMetrics(metrics []Metric) {
 	sort.Sort(MetricSlice(metrics))
 }
@@ -93,7 +133,13 @@ func (h *MetricSetsHeap) Pop() interface{} {
 }
 
 func UnionMetrics(metricSets [][]Metric) []Metric {
-	h := MetricSetsHeap(metricSets)
+	h := make(MetricSetsHeap, 0, len(metricSets))
+	for _, list := range metricSets {
+		// empty sets contribute nothing, and would break the heap ordering
+		if len(list) > 0 {
+			h = append(h, list)
+		}
+	}
 	heap.Init(&h)
 	set := []Metric{}
 	for h.Len() > 0 {
@@ -153,6 +199,32 @@ func IntersectMetrics(metricSets [][]Metric) []Metric {
 	return []Metric(result)
 }
 
+// DifferenceMetrics returns the metrics which are not in excluded. Both
+// slices must be sorted.
+func DifferenceMetrics(metrics, excluded []Metric) []Metric {
+	if len(excluded) == 0 {
+		return metrics
+	}
+
+	if Debug {
+		if !sort.IsSorted(MetricSlice(metrics)) || !sort.IsSorted(MetricSlice(excluded)) {
+			panic("DifferenceMetrics: passed unsorted slice")
+		}
+	}
+
+	result := make([]Metric, 0, len(metrics))
+	iter := newMetricIter(excluded)
+	for _, metric := range metrics {
+		if !iter.end() && iter.at() < metric {
+			iter.advance(metric)
+		}
+		if iter.end() || iter.at() != metric {
+			result = append(result, metric)
+		}
+	}
+	return result
+}
+
 func SortTags(tags []Tag) {
 	sort.Sort(TagSlice(tags))
 }
@@ -20,17 +20,15 @@ func TestHashTags(t *testing.T) {
 	}
 }
 
-func TestHashMetrics(t *testing.T) {
-	tags := []string{"foo", "bar"}
-	hashed := HashMetrics(tags)
-	if len(hashed) != 2 {
-		t.Errorf("index test: hashed 2 metrics, got %d values back", len(hashed))
-		return
-	}
-	expected := Metric(util.HashStr64("foo"))
-	if hashed[0] != expected {
-		t.Errorf("index test: hashed 'foo' and expected %v, but got %v", expected, hashed[0])
+// the tests use metric names interned here as their metrics
+var testMetrics = NewMetricDictionary()
+
+func internMetrics(names []string) []Metric {
+	result := make([]Metric, len(names))
+	for i, name := range names {
+		result[i] = testMetrics.Ref(name)
 	}
+	return result
 }
 
 func TestSortMetrics(t *testing.T) {
@@ -39,7 +37,7 @@ func TestSortMetrics(t *testing.T) {
 	SortMetrics(metrics)
 
 	// 1 item
-	metrics = HashMetrics([]string{"foo"})
+	metrics = internMetrics([]string{"foo"})
 	expectedFirst := metrics[0]
 	SortMetrics(metrics)
 	if metrics[0] != expectedFirst || len(metrics) > 1 {
@@ -48,7 +46,7 @@ func TestSortMetrics(t *testing.T) {
 	}
 
 	// create a deliberately unsorted 2 item list
-	metrics = HashMetrics([]string{"foo", "bar"})
+	metrics = internMetrics([]string{"foo", "bar"})
 	a, b := metrics[0], metrics[1]
 	expectedFirst = a
 	if b > a {
@@ -83,7 +81,7 @@ func unionMetricTest(t *testing.T, testName string, rawSets [][]string, expected
 func BenchmarkUnionMetricsSmallListSmallSets(b *testing.B) {
 	originalSets := make([][]Metric, 3)
 	for i, _ := range originalSets {
-		originalSets[i] = HashMetrics(test.GetMetricCorpus(10))
+		originalSets[i] = internMetrics(test.GetMetricCorpus(10))
 		SortMetrics(originalSets[i])
 	}
 
@@ -98,7 +96,7 @@ func BenchmarkUnionMetricsSmallListSmallSets(b *testing.B) {
 func BenchmarkUnionMetricsSmallListLargeSets(b *testing.B) {
 	originalSets := make([][]Metric, 3)
 	for i, _ := range originalSets {
-		originalSets[i] = HashMetrics(test.GetMetricCorpus(10000))
+		originalSets[i] = internMetrics(test.GetMetricCorpus(10000))
 		SortMetrics(originalSets[i])
 	}
 
@@ -113,7 +111,7 @@ func BenchmarkUnionMetricsSmallListLargeSets(b *testing.B) {
 func BenchmarkUnionMetricsLargeListSmallSets(b *testing.B) {
 	originalSets := make([][]Metric, 300)
 	for i, _ := range originalSets {
-		originalSets[i] = HashMetrics(test.GetMetricCorpus(10))
+		originalSets[i] = internMetrics(test.GetMetricCorpus(10))
 	}
 
 	copySets := make([][]Metric, len(originalSets))
@@ -128,7 +126,7 @@ func BenchmarkUnionMetricsLargeListSmallSets(b *testing.B) {
 func BenchmarkUnionMetricsLargeListLargeSets(b *testing.B) {
 	metricSets := make([][]Metric, 300)
 	for i, _ := range metricSets {
-		metricSets[i] = HashMetrics(test.GetMetricCorpus(10000))
+		metricSets[i] = internMetrics(test.GetMetricCorpus(10000))
 	}
 
 	b.ResetTimer()
@@ -142,7 +140,7 @@ func BenchmarkUnionMetricsLargeListLargeSets(b *testing.B) {
 func BenchmarkIntersectMetricsSmallListSmallSets(b *testing.B) {
 	metricSets := make([][]Metric, 3)
 	for i, _ := range metricSets {
-		metricSets[i] = HashMetrics(test.GetMetricCorpus(10))
+		metricSets[i] = internMetrics(test.GetMetricCorpus(10))
 		SortMetrics(metricSets[i])
 	}
 
@@ -155,7 +153,7 @@ func BenchmarkIntersectMetricsSmallListSmallSets(b *testing.B) {
 func BenchmarkIntersectMetricsSmallListLargeSets(b *testing.B) {
 	metricSets := make([][]Metric, 3)
 	for i, _ := range metricSets {
-		metricSets[i] = HashMetrics(test.GetMetricCorpus(10000))
+		metricSets[i] = internMetrics(test.GetMetricCorpus(10000))
 		SortMetrics(metricSets[i])
 	}
 
@@ -168,7 +166,7 @@ func BenchmarkIntersectMetricsSmallListLargeSets(b *testing.B) {
 func BenchmarkIntersectMetricsLargeListSmallSets(b *testing.B) {
 	metricSets := make([][]Metric, 300)
 	for i, _ := range metricSets {
-		metricSets[i] = HashMetrics(test.GetMetricCorpus(10))
+		metricSets[i] = internMetrics(test.GetMetricCorpus(10))
 		SortMetrics(metricSets[i])
 	}
 
@@ -181,7 +179,7 @@ func BenchmarkIntersectMetricsLargeListSmallSets(b *testing.B) {
 func BenchmarkIntersectMetricsSmallListLargeSetsOneEmpty(b *testing.B) {
 	metricSets := make([][]Metric, 3)
 	for i, _ := range metricSets {
-		metricSets[i] = HashMetrics(test.GetMetricCorpus(10000))
+		metricSets[i] = internMetrics(test.GetMetricCorpus(10000))
 		SortMetrics(metricSets[i])
 	}
 	metricSets = append(metricSets, []Metric{})
@@ -194,10 +192,10 @@ func BenchmarkIntersectMetricsSmallListLargeSetsOneEmpty(b *testing.B) {
 func BenchmarkIntersectMetricsSmallListOneLargeSet(b *testing.B) {
 	metricSets := make([][]Metric, 3)
 	for i, _ := range metricSets {
-		metricSets[i] = HashMetrics(test.GetMetricCorpus(100))
+		metricSets[i] = internMetrics(test.GetMetricCorpus(100))
 		SortMetrics(metricSets[i])
 	}
-	metricSets = append(metricSets, HashMetrics(test.GetMetricCorpus(100000)))
+	metricSets = append(metricSets, internMetrics(test.GetMetricCorpus(100000)))
 	SortMetrics(metricSets[len(metricSets)-1])
 
 	b.ResetTimer()
@@ -258,6 +256,35 @@ func TestIntersectMetrics(t *testing.T) {
 	intersectMetricTest(t, "intersect just one item", [][]string{{"foo"}}, []string{"foo"})
 }
 
+func TestDifferenceMetrics(t *testing.T) {
+	differenceMetricTest(t, "simple difference", [][]string{
+		{"foo", "bar", "baz"},
+		{"qux", "bar"},
+	}, []string{"foo", "baz"})
+
+	differenceMetricTest(t, "nothing excluded", [][]string{
+		{"foo", "bar", "baz"},
+		{},
+	}, []string{"foo", "bar", "baz"})
+
+	differenceMetricTest(t, "everything excluded", [][]string{
+		{"foo", "bar"},
+		{"foo", "bar", "baz"},
+	}, []string{})
+
+	differenceMetricTest(t, "nothing to exclude from", [][]string{
+		{},
+		{"foo", "bar", "baz"},
+	}, []string{})
+}
+
+func differenceMetricTest(t *testing.T, testName string, rawSets [][]string, expectedResults []string) {
+	difference := func(metricSets [][]Metric) []Metric {
+		return DifferenceMetrics(metricSets[0], metricSets[1])
+	}
+	metricSetFuncTest(t, testName, difference, rawSets, expectedResults)
+}
+
 func intersectMetricTest(t *testing.T, testName string, rawSets [][]string, expectedResults []string) {
 	metricSetFuncTest(t, testName, IntersectMetrics, rawSets, expectedResults)
 }
@@ -269,9 +296,9 @@ func metricSetFuncTest(t *testing.T, testName string, testFunc func([][]Metric)
 	for i, rawSet := range rawSets {
 		metricSets[i] = make([]Metric, len(rawSet), len(rawSet))
 		for j, rawMetric := range rawSet {
-			hashed := HashMetric(rawMetric)
-			mapping[hashed] = rawMetric
-			metricSets[i][j] = hashed
+			metric := testMetrics.Ref(rawMetric)
+			mapping[metric] = rawMetric
+			metricSets[i][j] = metric
 		}
 		SortMetrics(metricSets[i])
 	}
@@ -0,0 +1,398 @@
+package index
+
+import (
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+/*
+	postings are the sorted lists of ids (metrics, tags or join keys) that the
+	split and full indexes map tags and join keys to.
+
+	they come in two formats: raw, a plain []uint64, and compressed. A
+	compressed list is split into blocks of postingsBlockSize ids. The first id of
+	each block is kept as is, in a skip table, and the rest as varint encoded
+	deltas from the one before. Advancing to an id does a galloping search over
+	the skip table, then decodes at most one block. Deltas get smaller as the
+	ids get denser, so the saving depends a lot on how the ids are assigned.
+
+	intersection (galloping) and union (heap based) work on iterators, so they
+	don't care which format a list is in.
+*/
+
+type PostingsFormat int
+
+const (
+	RawPostingsFormat PostingsFormat = iota
+	CompressedPostingsFormat
+)
+
+// ParsePostingsFormat reads a postings format from the config: "raw" or
+// "compressed"
+func ParsePostingsFormat(format string) (PostingsFormat, error) {
+	switch format {
+	case "", "raw":
+		return RawPostingsFormat, nil
+	case "compressed":
+		return CompressedPostingsFormat, nil
+	}
+	return RawPostingsFormat, fmt.Errorf("index: unknown posting list format %q, it should be 'raw' or 'compressed'", format)
+}
+
+func (f PostingsFormat) String() string {
+	if f == CompressedPostingsFormat {
+		return "compressed"
+	}
+	return "raw"
+}
+
+// Postings is a sorted, deduplicated list of ids
+type Postings interface {
+	Len() int
+	Iter() PostingsIterator
+}
+
+// PostingsIterator walks a posting list in order. It starts at the first id.
+type PostingsIterator interface {
+	At() uint64
+	End() bool
+	// Next moves to the next id, returning false at the end of the list
+	Next() bool
+	// Advance moves to the first id >= the given one, returning false at the
+	// end of the list
+	Advance(uint64) bool
+}
+
+// NewPostings stores a sorted list of ids in the given format
+func NewPostings(format PostingsFormat, ids []uint64) Postings {
+	if format == CompressedPostingsFormat {
+		return compressPostings(ids)
+	}
+	return RawPostings(ids)
+}
+
+// PostingsLen is the length of a posting list that may be missing
+func PostingsLen(p Postings) int {
+	if p == nil {
+		return 0
+	}
+	return p.Len()
+}
+
+// SortIDs sorts a list of ids, to make postings out of it
+func SortIDs(ids []uint64) {
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+}
+
+// PatchPostings makes a new posting list out of an old one, adding the ids
+// the patch maps to true and removing the ones it maps to false. It returns
+// nil if no ids are left. old may be nil.
+func PatchPostings(format PostingsFormat, old Postings, patch map[uint64]bool) Postings {
+	ids := make([]uint64, 0, PostingsLen(old)+len(patch))
+	if old != nil {
+		for it := old.Iter(); !it.End(); it.Next() {
+			if _, patched := patch[it.At()]; !patched {
+				ids = append(ids, it.At())
+			}
+		}
+	}
+	for id, has := range patch {
+		if has {
+			ids = append(ids, id)
+		}
+	}
+
+	if len(ids) == 0 {
+		return nil
+	}
+	SortIDs(ids)
+	return NewPostings(format, ids)
+}
+
+// RawPostings is an uncompressed posting list
+type RawPostings []uint64
+
+func (p RawPostings) Len() int { return len(p) }
+
+func (p RawPostings) Iter() PostingsIterator {
+	return &rawIter{list: p}
+}
+
+// Metrics returns the ids as metrics
+func (p RawPostings) Metrics() []Metric {
+	metrics := make([]Metric, len(p))
+	for i, id := range p {
+		metrics[i] = Metric(id)
+	}
+	return metrics
+}
+
+type rawIter struct {
+	list RawPostings
+	idx  int
+}
+
+func (it *rawIter) Next() bool {
+	it.idx++
+	return !it.End()
+}
+
+func (it *rawIter) Advance(d uint64) bool {
+	// galloping search
+	bound := 1
+	for it.idx+bound < len(it.list) && d > it.list[it.idx+bound] {
+		bound *= 2
+	}
+
+	// binary search between the last two steps
+	low, high := it.idx+bound/2, it.idx+bound
+	if high > len(it.list) {
+		high = len(it.list)
+	}
+	for low < high {
+		mid := low + (high-low)/2
+		if it.list[mid] >= d {
+			high = mid
+		} else {
+			low = mid + 1
+		}
+	}
+
+	it.idx = low
+	return !it.End()
+}
+
+func (it *rawIter) End() bool {
+	return it.idx >= len(it.list)
+}
+
+func (it *rawIter) At() uint64 {
+	return it.list[it.idx]
+}
+
+const postingsBlockSize = 128
+
+// compressedPostings is a delta + varint encoded posting list
+type compressedPostings struct {
+	n int
+	// the first id of each block
+	skips []uint64
+	// where the deltas of each block start in data
+	offsets []uint32
+	data    []byte
+}
+
+func compressPostings(ids []uint64) *compressedPostings {
+	blocks := (len(ids) + postingsBlockSize - 1) / postingsBlockSize
+	p := &compressedPostings{
+		n:       len(ids),
+		skips:   make([]uint64, 0, blocks),
+		offsets: make([]uint32, 0, blocks),
+	}
+
+	buf := make([]byte, binary.MaxVarintLen64)
+	data := make([]byte, 0, len(ids)*2)
+	for i, id := range ids {
+		if i%postingsBlockSize == 0 {
+			p.skips = append(p.skips, id)
+			p.offsets = append(p.offsets, uint32(len(data)))
+			continue
+		}
+		n := binary.PutUvarint(buf, id-ids[i-1])
+		data = append(data, buf[:n]...)
+	}
+
+	// don't keep the extra capacity around
+	p.data = make([]byte, len(data))
+	copy(p.data, data)
+	return p
+}
+
+func (p *compressedPostings) Len() int { return p.n }
+
+func (p *compressedPostings) Iter() PostingsIterator {
+	it := &compressedIter{list: p}
+	if p.n > 0 {
+		it.cur = p.skips[0]
+	}
+	return it
+}
+
+type compressedIter struct {
+	list *compressedPostings
+	// position in the whole list
+	idx int
+	cur uint64
+	// where the next delta is
+	offset uint32
+}
+
+func (it *compressedIter) Next() bool {
+	it.idx++
+	if it.End() {
+		return false
+	}
+	if it.idx%postingsBlockSize == 0 {
+		it.jumpToBlock(it.idx / postingsBlockSize)
+		return true
+	}
+	delta, n := binary.Uvarint(it.list.data[it.offset:])
+	it.cur += delta
+	it.offset += uint32(n)
+	return true
+}
+
+func (it *compressedIter) Advance(d uint64) bool {
+	if it.End() || it.cur >= d {
+		return !it.End()
+	}
+
+	// find the last block starting at or before d, galloping over the skip
+	// table from the current block
+	skips := it.list.skips
+	block := it.idx / postingsBlockSize
+	bound := 1
+	for block+bound < len(skips) && skips[block+bound] <= d {
+		bound *= 2
+	}
+	low, high := block+bound/2, block+bound
+	if high > len(skips) {
+		high = len(skips)
+	}
+	// first block in [low, high) starting after d
+	for low < high {
+		mid := low + (high-low)/2
+		if skips[mid] > d {
+			high = mid
+		} else {
+			low = mid + 1
+		}
+	}
+	if target := low - 1; target > block {
+		it.jumpToBlock(target)
+	}
+
+	for it.cur < d {
+		if !it.Next() {
+			return false
+		}
+	}
+	return true
+}
+
+func (it *compressedIter) jumpToBlock(block int) {
+	it.idx = block * postingsBlockSize
+	it.cur = it.list.skips[block]
+	it.offset = it.list.offsets[block]
+}
+
+func (it *compressedIter) End() bool {
+	return it.idx >= it.list.n
+}
+
+func (it *compressedIter) At() uint64 {
+	return it.cur
+}
+
+// UnionPostings returns every id in any of the lists
+func UnionPostings(lists []Postings) RawPostings {
+	if len(lists) == 1 {
+		if raw, ok := lists[0].(RawPostings); ok {
+			return raw
+		}
+	}
+
+	h := make(postingsHeap, 0, len(lists))
+	for _, list := range lists {
+		// empty lists contribute nothing, and would break the heap ordering
+		if list.Len() > 0 {
+			h = append(h, list.Iter())
+		}
+	}
+	heap.Init(&h)
+	set := RawPostings{}
+	for h.Len() > 0 {
+		cur := h[0]
+		id := cur.At()
+		if len(set) == 0 || set[len(set)-1] != id {
+			set = append(set, id)
+		}
+		if !cur.Next() {
+			heap.Pop(&h)
+		} else {
+			heap.Fix(&h, 0)
+		}
+	}
+	return set
+}
+
+type postingsHeap []PostingsIterator
+
+func (h postingsHeap) Len() int           { return len(h) }
+func (h postingsHeap) Less(i, j int) bool { return h[i].At() < h[j].At() }
+func (h postingsHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *postingsHeap) Push(x interface{}) {
+	*h = append(*h, x.(PostingsIterator))
+}
+
+func (h *postingsHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[0 : n-1]
+	return x
+}
+
+// IntersectPostings returns the ids that are in all of the lists
+func IntersectPostings(lists []Postings) RawPostings {
+	if len(lists) == 0 {
+		return nil
+	}
+
+	if len(lists) == 1 {
+		return UnionPostings(lists)
+	}
+
+	sorted := make([]Postings, len(lists))
+	copy(sorted, lists)
+	for _, list := range sorted {
+		// any empty set --> empty intersection
+		if list.Len() == 0 {
+			return nil
+		}
+	}
+	// smallest first, so the intermediate results stay small
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Len() < sorted[j].Len() })
+
+	result := make(RawPostings, 0, sorted[0].Len())
+	docs := sorted[0].Iter()
+	for _, list := range sorted[1:] {
+		result = intersectPostingsPair(result[:0], docs, list.Iter())
+		if len(result) == 0 {
+			return nil
+		}
+		docs = result.Iter()
+	}
+
+	return result
+}
+
+// intersectPostingsPair returns the intersection of two posting lists
+func intersectPostingsPair(result RawPostings, ait, bit PostingsIterator) RawPostings {
+	for !ait.End() && !bit.End() {
+		a, b := ait.At(), bit.At()
+		switch {
+		case a == b:
+			result = append(result, a)
+			ait.Next()
+			bit.Next()
+		case a < b:
+			ait.Advance(b)
+		default:
+			bit.Advance(a)
+		}
+	}
+	return result
+}
@@ -0,0 +1,189 @@
+package index
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func randomIDs(r *rand.Rand, n int, max uint64) []uint64 {
+	seen := map[uint64]struct{}{}
+	for len(seen) < n {
+		seen[uint64(r.Int63n(int64(max)))] = struct{}{}
+	}
+	ids := make([]uint64, 0, n)
+	for id := range seen {
+		ids = append(ids, id)
+	}
+	SortIDs(ids)
+	return ids
+}
+
+func TestParsePostingsFormat(t *testing.T) {
+	cases := map[string]PostingsFormat{
+		"":           RawPostingsFormat,
+		"raw":        RawPostingsFormat,
+		"compressed": CompressedPostingsFormat,
+	}
+	for raw, expected := range cases {
+		format, err := ParsePostingsFormat(raw)
+		if err != nil || format != expected {
+			t.Errorf("postings test: parsing %q expected %v, got %v (err: %v)", raw, expected, format, err)
+		}
+	}
+
+	_, err := ParsePostingsFormat("roaring")
+	if err == nil {
+		t.Errorf("postings test: parsed a bogus postings format without an error")
+	}
+}
+
+func TestCompressedPostingsIter(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, n := range []int{0, 1, postingsBlockSize - 1, postingsBlockSize, postingsBlockSize*3 + 7} {
+		ids := randomIDs(r, n, 1<<40)
+		p := NewPostings(CompressedPostingsFormat, ids)
+		if p.Len() != n {
+			t.Errorf("postings test: compressed list of %d ids has length %d", n, p.Len())
+		}
+
+		got := []uint64{}
+		for it := p.Iter(); !it.End(); it.Next() {
+			got = append(got, it.At())
+		}
+		if n == 0 {
+			got = nil
+			ids = nil
+		}
+		if !reflect.DeepEqual(got, ids) {
+			t.Errorf("postings test: iterating a compressed list of %d ids didn't give them back", n)
+		}
+	}
+}
+
+func TestCompressedPostingsAdvance(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	ids := randomIDs(r, postingsBlockSize*5, 1<<20)
+	raw := NewPostings(RawPostingsFormat, ids)
+	compressed := NewPostings(CompressedPostingsFormat, ids)
+
+	for i := 0; i < 100; i++ {
+		rawIt, compressedIt := raw.Iter(), compressed.Iter()
+		for {
+			target := rawIt.At() + uint64(r.Int63n(1<<14))
+			rawOk, compressedOk := rawIt.Advance(target), compressedIt.Advance(target)
+			if rawOk != compressedOk {
+				t.Errorf("postings test: advancing to %d: raw list returned %v, compressed %v", target, rawOk, compressedOk)
+				return
+			}
+			if !rawOk {
+				break
+			}
+			if rawIt.At() != compressedIt.At() {
+				t.Errorf("postings test: advancing to %d: raw list is at %d, compressed at %d", target, rawIt.At(), compressedIt.At())
+				return
+			}
+		}
+	}
+}
+
+func TestPostingsSetOperations(t *testing.T) {
+	r := rand.New(rand.NewSource(3))
+	sets := [][]uint64{
+		randomIDs(r, 1000, 5000),
+		randomIDs(r, 300, 5000),
+		randomIDs(r, 2000, 5000),
+	}
+
+	expectedUnion := map[uint64]struct{}{}
+	counts := map[uint64]int{}
+	for _, set := range sets {
+		for _, id := range set {
+			expectedUnion[id] = struct{}{}
+			counts[id]++
+		}
+	}
+
+	for _, format := range []PostingsFormat{RawPostingsFormat, CompressedPostingsFormat} {
+		lists := make([]Postings, len(sets))
+		for i, set := range sets {
+			lists[i] = NewPostings(format, set)
+		}
+
+		union := UnionPostings(lists)
+		if len(union) != len(expectedUnion) {
+			t.Errorf("postings test: %v union expected %d ids, got %d", format, len(expectedUnion), len(union))
+		}
+		for i, id := range union {
+			if _, ok := expectedUnion[id]; !ok || (i > 0 && union[i-1] >= id) {
+				t.Errorf("postings test: %v union has an unexpected or unsorted id %d", format, id)
+				break
+			}
+		}
+
+		intersection := IntersectPostings(lists)
+		expectedIntersection := 0
+		for _, count := range counts {
+			if count == len(sets) {
+				expectedIntersection++
+			}
+		}
+		if len(intersection) != expectedIntersection {
+			t.Errorf("postings test: %v intersection expected %d ids, got %d", format, expectedIntersection, len(intersection))
+		}
+		for _, id := range intersection {
+			if counts[id] != len(sets) {
+				t.Errorf("postings test: %v intersection has %d, which isn't in every list", format, id)
+				break
+			}
+		}
+
+		empty := append(lists, NewPostings(format, nil))
+		if result := IntersectPostings(empty); len(result) != 0 {
+			t.Errorf("postings test: %v intersection with an empty list found %d ids", format, len(result))
+		}
+	}
+}
+
+func TestPatchPostings(t *testing.T) {
+	for _, format := range []PostingsFormat{RawPostingsFormat, CompressedPostingsFormat} {
+		old := NewPostings(format, []uint64{1, 3, 5, 7})
+		patched := PatchPostings(format, old, map[uint64]bool{2: true, 3: false, 7: true, 9: false})
+
+		ids := []uint64{}
+		for it := patched.Iter(); !it.End(); it.Next() {
+			ids = append(ids, it.At())
+		}
+		if expected := []uint64{1, 2, 5, 7}; !reflect.DeepEqual(ids, expected) {
+			t.Errorf("postings test: %v patch expected %v, got %v", format, expected, ids)
+		}
+
+		if emptied := PatchPostings(format, old, map[uint64]bool{1: false, 3: false, 5: false, 7: false}); emptied != nil {
+			t.Errorf("postings test: %v patch that removes every id should return nil, got %d ids", format, emptied.Len())
+		}
+		if added := PatchPostings(format, nil, map[uint64]bool{4: true}); PostingsLen(added) != 1 {
+			t.Errorf("postings test: %v patch of a nil list expected 1 id, got %d", format, PostingsLen(added))
+		}
+	}
+}
+
+func benchmarkIntersectPostings(b *testing.B, format PostingsFormat) {
+	r := rand.New(rand.NewSource(4))
+	lists := []Postings{
+		NewPostings(format, randomIDs(r, 100, 1<<30)),
+		NewPostings(format, randomIDs(r, 100000, 1<<30)),
+		NewPostings(format, randomIDs(r, 500000, 1<<30)),
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		IntersectPostings(lists)
+	}
+}
+
+func BenchmarkIntersectRawPostings(b *testing.B) {
+	benchmarkIntersectPostings(b, RawPostingsFormat)
+}
+
+func BenchmarkIntersectCompressedPostings(b *testing.B) {
+	benchmarkIntersectPostings(b, CompressedPostingsFormat)
+}
@@ -60,12 +60,26 @@ return final intersected set
 -------------------------------------
             |  JoinKey    => Metric |
             |<-RIGHT-RIGHT-RIGHT--->|
+
+a split index can also be linked to another split index, for data that's
+keyed by something other than the metrics are. For example, load balancer
+pool membership might be keyed by IP, while metrics are keyed by hostname. The
+'ip' index then has a third mini-index, mapping its join keys to join keys of
+the 'fqdn' index:
+
+[link]: {
+	10.1.2.3: [hostname-1234]
+}
+
+and a query for 'lb-pool:www' resolves to IPs, then to hostnames through the
+link, then to metrics in the 'fqdn' index (which may be linked onwards).
 */
 
 import (
+	"container/heap"
+	"fmt"
 	"sort"
-	"sync"
-	"sync/atomic"
+	"strconv"
 	"time"
 
 	"github.com/dgryski/carbonzipper/mlog"
@@ -83,17 +97,32 @@ func (a JoinSlice) Len() int           { return len(a) }
 func (a JoinSlice) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a JoinSlice) Less(i, j int) bool { return a[i] < a[j] }
 
+// numericValue is one entry in the per service-key table used to resolve
+// range comparisons ('servers-num_cpus:>=16') to concrete tag values
+type numericValue struct {
+	tag    index.Tag
+	number float64
+	value  string
+}
+
 type Index struct {
 	joinKey        string
 	generation     uint64
 	generationTime int64 // time.Duration
 
-	tagToJoin    atomic.Value //map[index.Tag][]Join
-	readableTags uint32
+	// how the posting lists are stored. set before the index is used
+	format index.PostingsFormat
+
+	// the generation Materialize built last, which the next one starts from
+	last *Generation
 
-	joinToMetric  atomic.Value //map[Join][]index.Metric
+	readableTags  uint32
 	readableJoins uint32
 
+	// the index that join keys are linked to, if any. not protected by a
+	// lock: it's set up before the index is used
+	link *Index
+
 	readableMetrics uint32
 
 	// we want "service-key" => Join => "service-key:val"
@@ -104,61 +133,120 @@ type Index struct {
 
 	writtenJoins   uint32
 	writtenMetrics uint32
+
+	// how many joins have each metric, for counting the readable metrics.
+	// only Materialize uses it (and last), and it's never called concurrently
+	metricJoins map[index.Metric]uint32
+}
+
+// Generation is a read-only generation of a split index
+type Generation struct {
+	name string
+
+	tagToJoin     map[index.Tag]index.Postings      // of Joins
+	joinToMetric  map[Join]index.Postings           // of index.Metrics
+	numericValues map[tag.ServiceKey][]numericValue // sorted by number
+	joinToLink    map[Join]index.Postings           // of Joins
+
+	// the generation of the linked index that join keys resolve to, if any
+	link *Generation
 }
 
 func NewIndex(joinKey string) *Index {
 	n := Index{
-		joinKey: joinKey,
+		joinKey:     joinKey,
+		metricJoins: map[index.Metric]uint32{},
+	}
+	n.last = &Generation{
+		name:          joinKey,
+		tagToJoin:     map[index.Tag]index.Postings{},
+		joinToMetric:  map[Join]index.Postings{},
+		numericValues: map[tag.ServiceKey][]numericValue{},
+		joinToLink:    map[Join]index.Postings{},
 	}
-	n.tagToJoin.Store(make(map[index.Tag][]Join))
-	n.joinToMetric.Store(make(map[Join][]index.Metric))
 
 	return &n
 }
 
-// Materialize copies the mutable indexes to new read-only ones and swaps out
-// the existing ones.
+// Current is the generation Materialize built last, or an empty one
+func (si *Index) Current() *Generation {
+	return si.last
+}
+
+// SetPostingsFormat sets how the posting lists of the next generations are
+// stored. It has to be called before the index is used.
+func (si *Index) SetPostingsFormat(format index.PostingsFormat) {
+	si.format = format
+}
+
+// Changes is what changed in a split index's write buffer since the index was
+// last materialized
+type Changes struct {
+	// joins whose metrics changed
+	Metrics map[Join]struct{}
+	// joins whose links changed
+	Links map[Join]struct{}
+	// the tags that joins gained or lost
+	Tags map[index.Tag]*TagChange
+}
+
+// TagChange is which joins gained (true) or lost (false) a tag
+type TagChange struct {
+	ServiceKey tag.ServiceKey
+	Joins      map[Join]bool
+}
+
+func NewChanges() *Changes {
+	return &Changes{
+		Metrics: map[Join]struct{}{},
+		Links:   map[Join]struct{}{},
+		Tags:    map[index.Tag]*TagChange{},
+	}
+}
+
+// Materialize copies the mutable indexes to a new read-only generation. Given
+// the changes since the last Materialize, it only rebuilds the posting lists
+// that changed, and shares the rest with the last generation. With nil
+// changes it rebuilds everything. The generation isn't used for anything
+// until the caller links it (see LinkTo) and publishes it.
 //
 // Materialize should panic in case of any problems with the data -- that
 // should have been caught by validation before going into the write buffer
 func (si *Index) Materialize(
-	wg *sync.WaitGroup,
-	joinToMetricBuffer map[Join]map[index.Metric]struct{},
-	tagToJoinBuffer map[tag.ServiceKey]map[Join]index.Tag,
-) {
-	defer wg.Done()
+	joinToMetricBuffer map[Join]map[index.Metric]int64,
+	tagToJoinBuffer map[tag.ServiceKey]map[Join][]index.Tag,
+	numericTagBuffer map[index.Tag]string,
+	joinToLinkBuffer map[Join]map[Join]struct{},
+	changes *Changes,
+) *Generation {
 	start := time.Now()
-	tagToJoin := make(map[index.Tag][]Join)
-	for _, joinTagPairs := range tagToJoinBuffer {
-		for join, tag := range joinTagPairs {
-			tagToJoin[tag] = append(tagToJoin[tag], join)
-		}
-	}
 
-	for _, joinList := range tagToJoin {
-		SortJoins(joinList)
+	var tagToJoin map[index.Tag]index.Postings
+	var numericValues map[tag.ServiceKey][]numericValue
+	var joinToMetric, joinToLink map[Join]index.Postings
+	if changes == nil {
+		tagToJoin, numericValues = si.buildTags(tagToJoinBuffer, numericTagBuffer)
+		si.metricJoins = map[index.Metric]uint32{}
+		joinToMetric = si.patchJoins(map[Join]index.Postings{}, si.metricLists(joinToMetricBuffer, nil), true)
+		joinToLink = si.patchJoins(map[Join]index.Postings{}, linkLists(joinToLinkBuffer, nil), false)
+	} else {
+		tagToJoin, numericValues = si.patchTags(changes.Tags, numericTagBuffer)
+		joinToMetric = si.patchJoins(si.last.joinToMetric, si.metricLists(joinToMetricBuffer, changes.Metrics), true)
+		joinToLink = si.patchJoins(si.last.joinToLink, linkLists(joinToLinkBuffer, changes.Links), false)
 	}
 
-	totalMetrics := map[index.Metric]struct{}{}
-	joinToMetric := make(map[Join][]index.Metric)
-	for join, metrics := range joinToMetricBuffer {
-		for metric, _ := range metrics {
-			totalMetrics[metric] = struct{}{}
-			joinToMetric[join] = append(joinToMetric[join], metric)
-		}
+	si.last = &Generation{
+		name:          si.joinKey,
+		tagToJoin:     tagToJoin,
+		joinToMetric:  joinToMetric,
+		numericValues: numericValues,
+		joinToLink:    joinToLink,
 	}
 
-	for _, metricList := range joinToMetric {
-		index.SortMetrics(metricList)
-	}
-
-	si.tagToJoin.Store(tagToJoin)
-	si.joinToMetric.Store(joinToMetric)
-
 	// update stats
 	si.SetReadableTags(uint32(len(tagToJoin)))
 	si.SetReadableJoins(uint32(len(joinToMetric)))
-	si.SetReadableMetrics(uint32(len(totalMetrics)))
+	si.SetReadableMetrics(uint32(len(si.metricJoins)))
 	si.IncrementGeneration()
 
 	g := si.Generation()
@@ -167,12 +255,223 @@ func (si *Index) Materialize(
 	if index.Debug {
 		logger.Logf("split index %s: New generation %v took %v to generate", si.Name(), g, elapsed)
 	}
+	return si.last
 }
 
-func (si *Index) Query(q *index.Query) ([]index.Metric, error) {
+// buildTags builds the tag posting lists and the numeric value tables from
+// scratch
+func (si *Index) buildTags(
+	tagToJoinBuffer map[tag.ServiceKey]map[Join][]index.Tag,
+	numericTagBuffer map[index.Tag]string,
+) (map[index.Tag]index.Postings, map[tag.ServiceKey][]numericValue) {
+	tagJoins := make(map[index.Tag][]uint64)
+	numericValues := make(map[tag.ServiceKey][]numericValue)
+	for serviceKey, joinTagPairs := range tagToJoinBuffer {
+		seen := map[index.Tag]struct{}{}
+		for join, tags := range joinTagPairs {
+			for _, tag := range tags {
+				tagJoins[tag] = append(tagJoins[tag], uint64(join))
+
+				rawValue, ok := numericTagBuffer[tag]
+				if !ok {
+					continue
+				}
+				if _, ok := seen[tag]; ok {
+					continue
+				}
+				seen[tag] = struct{}{}
+				numericValues[serviceKey] = append(numericValues[serviceKey], si.numericValue(tag, rawValue))
+			}
+		}
+	}
+
+	tagToJoin := make(map[index.Tag]index.Postings, len(tagJoins))
+	for tag, joinList := range tagJoins {
+		index.SortIDs(joinList)
+		tagToJoin[tag] = index.NewPostings(si.format, joinList)
+	}
+
+	for _, values := range numericValues {
+		sortNumericValues(values)
+	}
+	return tagToJoin, numericValues
+}
+
+// patchTags applies the changes in which joins have which tags to the
+// current tag posting lists and numeric value tables
+func (si *Index) patchTags(
+	changed map[index.Tag]*TagChange,
+	numericTagBuffer map[index.Tag]string,
+) (map[index.Tag]index.Postings, map[tag.ServiceKey][]numericValue) {
+	oldTagToJoin := si.last.tagToJoin
+	tagToJoin := make(map[index.Tag]index.Postings, len(oldTagToJoin))
+	for tag, joins := range oldTagToJoin {
+		tagToJoin[tag] = joins
+	}
+
+	// the changed numeric tags, by service key
+	numericTags := map[tag.ServiceKey][]index.Tag{}
+	for tag, change := range changed {
+		patch := make(map[uint64]bool, len(change.Joins))
+		for join, has := range change.Joins {
+			patch[uint64(join)] = has
+		}
+
+		joins := index.PatchPostings(si.format, oldTagToJoin[tag], patch)
+		if joins == nil {
+			delete(tagToJoin, tag)
+		} else {
+			tagToJoin[tag] = joins
+		}
+
+		if _, ok := numericTagBuffer[tag]; ok {
+			numericTags[change.ServiceKey] = append(numericTags[change.ServiceKey], tag)
+		}
+	}
+
+	oldNumericValues := si.last.numericValues
+	numericValues := make(map[tag.ServiceKey][]numericValue, len(oldNumericValues))
+	for serviceKey, values := range oldNumericValues {
+		numericValues[serviceKey] = values
+	}
+	for serviceKey, tags := range numericTags {
+		values := make([]numericValue, 0, len(oldNumericValues[serviceKey])+len(tags))
+		for _, value := range oldNumericValues[serviceKey] {
+			if _, ok := changed[value.tag]; !ok {
+				values = append(values, value)
+			}
+		}
+		for _, tag := range tags {
+			if _, ok := tagToJoin[tag]; ok {
+				values = append(values, si.numericValue(tag, numericTagBuffer[tag]))
+			}
+		}
+
+		if len(values) == 0 {
+			delete(numericValues, serviceKey)
+			continue
+		}
+		sortNumericValues(values)
+		numericValues[serviceKey] = values
+	}
+	return tagToJoin, numericValues
+}
+
+func (si *Index) numericValue(tag index.Tag, rawValue string) numericValue {
+	number, err := strconv.ParseFloat(rawValue, 64)
+	if err != nil {
+		panic(fmt.Sprintf("split index %s Materialize: numeric tag value %q is not a number: %v. this should have been caught before adding it to the write buffer, hence the panic", si.Name(), rawValue, err))
+	}
+	return numericValue{tag, number, rawValue}
+}
+
+func sortNumericValues(values []numericValue) {
+	sort.Slice(values, func(i, j int) bool { return values[i].number < values[j].number })
+}
+
+// metricLists returns the sorted metrics of the given joins, or of every join
+// if joins is nil. Joins without metrics get a nil list.
+func (si *Index) metricLists(joinToMetricBuffer map[Join]map[index.Metric]int64, joins map[Join]struct{}) map[Join][]uint64 {
+	if joins == nil {
+		joins = make(map[Join]struct{}, len(joinToMetricBuffer))
+		for join := range joinToMetricBuffer {
+			joins[join] = struct{}{}
+		}
+	}
+
+	lists := make(map[Join][]uint64, len(joins))
+	for join := range joins {
+		metrics, ok := joinToMetricBuffer[join]
+		if !ok || len(metrics) == 0 {
+			lists[join] = nil
+			continue
+		}
+		metricList := make([]uint64, 0, len(metrics))
+		for metric := range metrics {
+			metricList = append(metricList, uint64(metric))
+		}
+		index.SortIDs(metricList)
+		lists[join] = metricList
+	}
+	return lists
+}
+
+// linkLists is metricLists for links
+func linkLists(joinToLinkBuffer map[Join]map[Join]struct{}, joins map[Join]struct{}) map[Join][]uint64 {
+	if joins == nil {
+		joins = make(map[Join]struct{}, len(joinToLinkBuffer))
+		for join := range joinToLinkBuffer {
+			joins[join] = struct{}{}
+		}
+	}
+
+	lists := make(map[Join][]uint64, len(joins))
+	for join := range joins {
+		links, ok := joinToLinkBuffer[join]
+		if !ok || len(links) == 0 {
+			lists[join] = nil
+			continue
+		}
+		linkList := make([]uint64, 0, len(links))
+		for link := range links {
+			linkList = append(linkList, uint64(link))
+		}
+		index.SortIDs(linkList)
+		lists[join] = linkList
+	}
+	return lists
+}
+
+// patchJoins copies a join => postings map, replacing the posting lists of
+// the given joins. countMetrics keeps count of which metrics the index has,
+// for the joinToMetric map.
+func (si *Index) patchJoins(old map[Join]index.Postings, lists map[Join][]uint64, countMetrics bool) map[Join]index.Postings {
+	patched := make(map[Join]index.Postings, len(old)+len(lists))
+	for join, postings := range old {
+		patched[join] = postings
+	}
+
+	for join, list := range lists {
+		if countMetrics {
+			si.countMetrics(old[join], -1)
+		}
+		if len(list) == 0 {
+			delete(patched, join)
+			continue
+		}
+		patched[join] = index.NewPostings(si.format, list)
+		if countMetrics {
+			si.countMetrics(patched[join], 1)
+		}
+	}
+	return patched
+}
+
+// countMetrics adds (or removes) the metrics of a join to the number of joins
+// each metric has
+func (si *Index) countMetrics(metrics index.Postings, delta int) {
+	if metrics == nil {
+		return
+	}
+	for it := metrics.Iter(); !it.End(); it.Next() {
+		metric := index.Metric(it.At())
+		count := int(si.metricJoins[metric]) + delta
+		if count <= 0 {
+			delete(si.metricJoins, metric)
+			continue
+		}
+		si.metricJoins[metric] = uint32(count)
+	}
+}
+
+func (g *Generation) Query(q *index.Query) ([]index.Metric, error) {
+	start := time.Now()
 	// get a slice of all the join keys (for example, hostnames) associated with these tags
-	tagToJoin := si.TagIndex()
-	joinLists := [][]Join{}
+	tagToJoin := g.tagToJoin
+	if q.Trace != nil {
+		g.traceTags(q)
+	}
+	joinLists := []index.Postings{}
 	for _, tag := range q.Hashed {
 		list, ok := tagToJoin[tag]
 		if !ok {
@@ -182,29 +481,139 @@ func (si *Index) Query(q *index.Query) ([]index.Metric, error) {
 		joinLists = append(joinLists, list)
 	}
 
+	// each union contributes the join keys for any of its tags
+	for _, union := range q.Unions {
+		unionLists := make([]index.Postings, 0, len(union))
+		for _, tag := range union {
+			list, ok := tagToJoin[tag]
+			if ok {
+				unionLists = append(unionLists, list)
+			}
+		}
+
+		if len(unionLists) == 0 {
+			return []index.Metric{}, nil
+		}
+
+		joinLists = append(joinLists, index.UnionPostings(unionLists))
+	}
+
 	// intersect join keys
-	joinSet := IntersectJoins(joinLists)
+	joinSet := index.IntersectPostings(joinLists)
+	q.Trace.Step(g.Name(), "", "joins after intersection", len(joinSet), start)
 
 	// deduplicated union all of the metrics associated with those join keys
-	joinToMetric := si.MetricIndex()
-	metricSets := [][]index.Metric{}
-	for _, join := range joinSet {
-		list, ok := joinToMetric[join]
+	metrics := g.joinMetrics(joinSet, q.Trace, start)
+	q.Trace.Step(g.Name(), "", "metrics after union", len(metrics), start)
+	return metrics.Metrics(), nil
+}
+
+// joinMetrics returns the metrics for a set of join keys: the ones associated
+// with the join keys in this index, plus whatever they link to
+func (g *Generation) joinMetrics(joins index.RawPostings, trace *index.Trace, start time.Time) index.RawPostings {
+	joinToMetric := g.joinToMetric
+	metricSets := []index.Postings{}
+	for _, join := range joins {
+		list, ok := joinToMetric[Join(join)]
 		if ok {
 			metricSets = append(metricSets, list)
 		}
 	}
 
+	if g.link != nil {
+		joinToLink := g.joinToLink
+		linkLists := []index.Postings{}
+		for _, join := range joins {
+			list, ok := joinToLink[Join(join)]
+			if ok {
+				linkLists = append(linkLists, list)
+			}
+		}
+
+		linked := index.UnionPostings(linkLists)
+		trace.Step(g.Name(), "", "joins after following links to "+g.link.Name(), len(linked), start)
+		if len(linked) > 0 {
+			metricSets = append(metricSets, g.link.joinMetrics(linked, trace, start))
+		}
+	}
+
 	// map keys -> slice. except these need to be sorted, blorg!
-	metrics := index.UnionMetrics(metricSets)
-	return metrics, nil
+	return index.UnionPostings(metricSets)
 }
 
-func (si *Index) TagIndex() map[index.Tag][]Join {
-	return si.tagToJoin.Load().(map[index.Tag][]Join)
+// LinkTo makes the join keys of this index resolve to join keys of another
+// split index, as well as to their own metrics. It has to be called before the
+// index is used, and the links must not form a cycle.
+func (si *Index) LinkTo(target *Index) {
+	si.link = target
 }
-func (si *Index) MetricIndex() map[Join][]index.Metric {
-	return si.joinToMetric.Load().(map[Join][]index.Metric)
+
+// Link returns the index that this one is linked to, or nil
+func (si *Index) Link() *Index {
+	return si.link
+}
+
+// LinkTo makes the join keys of this generation resolve through a generation
+// of the linked index. It has to be called before the generation is used.
+func (g *Generation) LinkTo(target *Generation) {
+	g.link = target
+}
+
+// traceTags records how many join keys each tag in the query matched
+func (g *Generation) traceTags(q *index.Query) {
+	for i, tag := range q.Hashed {
+		q.Trace.Tag(g.Name(), q.Raw[i], index.PostingsLen(g.tagToJoin[tag]), "joins")
+	}
+
+	for i, union := range q.Unions {
+		for j, tag := range union {
+			q.Trace.Tag(g.Name(), q.RawUnions[i][j], index.PostingsLen(g.tagToJoin[tag]), "joins")
+		}
+	}
+}
+
+// CompareValues returns the raw values for a service-key (like
+// 'servers-num_cpus') that satisfy a numeric comparison, so they can be
+// unioned together in a query.
+func (g *Generation) CompareValues(serviceKey tag.ServiceKey, comparison tag.Comparison) []string {
+	values := g.numericValues[serviceKey]
+	operand := comparison.Operand
+
+	var matched []numericValue
+	switch comparison.Operator {
+	case ">=":
+		i := sort.Search(len(values), func(i int) bool { return values[i].number >= operand })
+		matched = values[i:]
+	case ">":
+		i := sort.Search(len(values), func(i int) bool { return values[i].number > operand })
+		matched = values[i:]
+	case "<=":
+		i := sort.Search(len(values), func(i int) bool { return values[i].number > operand })
+		matched = values[:i]
+	case "<":
+		i := sort.Search(len(values), func(i int) bool { return values[i].number >= operand })
+		matched = values[:i]
+	}
+
+	result := make([]string, len(matched))
+	for i, value := range matched {
+		result[i] = value.value
+	}
+	return result
+}
+
+func (g *Generation) TagIndex() map[index.Tag]index.Postings {
+	return g.tagToJoin
+}
+func (g *Generation) MetricIndex() map[Join]index.Postings {
+	return g.joinToMetric
+}
+func (g *Generation) LinkIndex() map[Join]index.Postings {
+	return g.joinToLink
+}
+
+func (g *Generation) Name() string {
+	return g.name
 }
 
 func (si *Index) Name() string {
@@ -231,6 +640,53 @@ func SortJoins(joins []Join) {
 	sort.Sort(JoinSlice(joins))
 }
 
+type JoinSetsHeap [][]Join
+
+func (h JoinSetsHeap) Len() int           { return len(h) }
+func (h JoinSetsHeap) Less(i, j int) bool { return h[i][0] < h[j][0] }
+func (h JoinSetsHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *JoinSetsHeap) Push(x interface{}) {
+	t := x.([]Join)
+	*h = append(*h, t)
+}
+
+func (h *JoinSetsHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[0 : n-1]
+	return x
+}
+
+func UnionJoins(joinSets [][]Join) []Join {
+	if len(joinSets) == 1 {
+		return joinSets[0]
+	}
+
+	h := make(JoinSetsHeap, 0, len(joinSets))
+	for _, list := range joinSets {
+		if len(list) > 0 {
+			h = append(h, list)
+		}
+	}
+	heap.Init(&h)
+	set := []Join{}
+	for h.Len() > 0 {
+		cur := h[0]
+		join := cur[0]
+		if len(set) == 0 || set[len(set)-1] != join {
+			set = append(set, join)
+		}
+		if len(cur) == 1 {
+			heap.Pop(&h)
+		} else {
+			h[0] = cur[1:]
+			heap.Fix(&h, 0)
+		}
+	}
+	return set
+}
+
 func IntersectJoins(joinSets [][]Join) []Join {
 	if len(joinSets) == 0 {
 		return nil
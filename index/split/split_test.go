@@ -2,7 +2,9 @@ package split
 
 import (
 	"fmt"
-	"sync"
+	"reflect"
+	"sort"
+	"strconv"
 	"testing"
 
 	"github.com/kanatohodets/carbonsearch/index"
@@ -53,26 +55,23 @@ func TestQuery(t *testing.T) {
 	tags := []string{"server-state:live", "server-dc:lhr"}
 	query := index.NewQuery([]string{"server-state:live"})
 
-	wg := &sync.WaitGroup{}
-	wg.Add(1)
-	joinToMetric, tagToJoin := prepareBuffer(host, tags, metrics)
-	in.Materialize(wg, joinToMetric, tagToJoin)
-	wg.Wait()
+	joinToMetric, tagToJoin, numericTags := prepareBuffer(host, tags, metrics)
+	g := in.Materialize(joinToMetric, tagToJoin, numericTags, nil, nil)
 
-	result, err := in.Query(query)
+	result, err := g.Query(query)
 	if err != nil {
 		t.Error(err)
 	}
 
 	if len(result) == 1 {
-		if result[0] != index.HashMetric(metricName) {
+		if result[0] != testMetric(metricName) {
 			t.Errorf("split index test: %v was not found in the index", metricName)
 		}
 	} else {
 		t.Errorf("split index test: the index had %d search results. that value is wrong because it isn't 1", len(result))
 	}
 
-	emptyResult, err := in.Query(index.NewQuery([]string{"blorgtag"}))
+	emptyResult, err := g.Query(index.NewQuery([]string{"blorgtag"}))
 	if err != nil {
 		t.Errorf("error querying blorgtag: %v", err)
 	}
@@ -80,7 +79,7 @@ func TestQuery(t *testing.T) {
 		t.Errorf("split index test: found some results on a bogus query: %v", emptyResult)
 	}
 
-	emptyResult, err = in.Query(index.NewQuery([]string{"server-state:live", "server-dc:a_ship_in_the_ocean"}))
+	emptyResult, err = g.Query(index.NewQuery([]string{"server-state:live", "server-dc:a_ship_in_the_ocean"}))
 	if err != nil {
 		t.Errorf("error querying with missing tag value: %v", err)
 	}
@@ -88,7 +87,7 @@ func TestQuery(t *testing.T) {
 		t.Errorf("split index test: found some results on a partially (bad tag value) bogus query: %v", emptyResult)
 	}
 
-	emptyResult, err = in.Query(index.NewQuery([]string{"server-state:live", "server-foobar:baz"}))
+	emptyResult, err = g.Query(index.NewQuery([]string{"server-state:live", "server-foobar:baz"}))
 	if err != nil {
 		t.Errorf("error querying with missing tag key: %v", err)
 	}
@@ -96,6 +95,117 @@ func TestQuery(t *testing.T) {
 		t.Errorf("split index test: found some results on a partially (tag with silly key) bogus query: %v", emptyResult)
 	}
 
+	unionQuery := index.NewQuery([]string{"server-state:live"})
+	unionQuery.AddUnion([]string{"server-dc:a_ship_in_the_ocean", "server-dc:lhr"})
+	result, err = g.Query(unionQuery)
+	if err != nil {
+		t.Errorf("error querying with a union: %v", err)
+	}
+	if len(result) != 1 || result[0] != testMetric(metricName) {
+		t.Errorf("split index test: union query expected %v, got %v", metricName, result)
+	}
+
+	emptyUnionQuery := index.NewQuery([]string{"server-state:live"})
+	emptyUnionQuery.AddUnion([]string{"server-dc:a_ship_in_the_ocean", "server-dc:the_moon"})
+	emptyResult, err = g.Query(emptyUnionQuery)
+	if err != nil {
+		t.Errorf("error querying with a union without matches: %v", err)
+	}
+	if len(emptyResult) != 0 {
+		t.Errorf("split index test: found some results on a union without any matching tags: %v", emptyResult)
+	}
+}
+
+func TestCompareValues(t *testing.T) {
+	in := NewIndex("host")
+	joinToMetric := map[Join]map[index.Metric]int64{}
+	tagToJoin := map[tag.ServiceKey]map[Join][]index.Tag{}
+	numericTags := map[index.Tag]string{}
+	hosts := map[string][]string{
+		"hostname-1": {"server-num_cpus:8", "server-dc:lhr"},
+		"hostname-2": {"server-num_cpus:16", "server-dc:ams"},
+		"hostname-3": {"server-num_cpus:32", "server-dc:lhr"},
+		"hostname-4": {"server-num_cpus:16.0", "server-dc:lhr"},
+	}
+	for host, tags := range hosts {
+		hostJoinToMetric, hostTagToJoin, hostNumericTags := prepareBuffer(host, tags, []string{"server." + host + ".cpu"})
+		for join, metrics := range hostJoinToMetric {
+			joinToMetric[join] = metrics
+		}
+		for sk, joins := range hostTagToJoin {
+			if _, ok := tagToJoin[sk]; !ok {
+				tagToJoin[sk] = map[Join][]index.Tag{}
+			}
+			for join, tags := range joins {
+				tagToJoin[sk][join] = tags
+			}
+		}
+		for tag, value := range hostNumericTags {
+			numericTags[tag] = value
+		}
+	}
+
+	g := in.Materialize(joinToMetric, tagToJoin, numericTags, nil, nil)
+
+	numCPUs := HashServiceKey("server-num_cpus")
+	cases := []struct {
+		comparison tag.Comparison
+		expected   []string
+	}{
+		{tag.Comparison{Operator: ">=", Operand: 16}, []string{"16", "16.0", "32"}},
+		{tag.Comparison{Operator: ">", Operand: 16}, []string{"32"}},
+		{tag.Comparison{Operator: "<=", Operand: 16}, []string{"8", "16", "16.0"}},
+		{tag.Comparison{Operator: "<", Operand: 16}, []string{"8"}},
+		{tag.Comparison{Operator: ">", Operand: 64}, []string{}},
+	}
+	for _, c := range cases {
+		values := g.CompareValues(numCPUs, c.comparison)
+		sort.Strings(values)
+		expected := c.expected
+		sort.Strings(expected)
+		if !reflect.DeepEqual(values, expected) {
+			t.Errorf("split index test: CompareValues %v expected %q, got %q", c.comparison, expected, values)
+		}
+	}
+
+	values := g.CompareValues(HashServiceKey("server-dc"), tag.Comparison{Operator: ">=", Operand: 0})
+	if len(values) != 0 {
+		t.Errorf("split index test: CompareValues on a non-numeric key found some values: %q", values)
+	}
+}
+
+func TestLinkedQuery(t *testing.T) {
+	hosts := NewIndex("fqdn")
+	joinToMetric, tagToJoin, numericTags := prepareBuffer("hostname-1234", []string{"server-state:live"}, []string{"server.hostname-1234.cpu"})
+	hostsGeneration := hosts.Materialize(joinToMetric, tagToJoin, numericTags, nil, nil)
+
+	ips := NewIndex("ip")
+	ips.LinkTo(hosts)
+	joinToMetric, tagToJoin, numericTags = prepareBuffer("10.1.2.3", []string{"lb-pool:www"}, nil)
+	joinToLink := map[Join]map[Join]struct{}{
+		HashJoin("10.1.2.3"): {HashJoin("hostname-1234"): struct{}{}},
+	}
+	g := ips.Materialize(joinToMetric, tagToJoin, numericTags, joinToLink, nil)
+	g.LinkTo(hostsGeneration)
+
+	trace := &index.Trace{}
+	query := index.NewQuery([]string{"lb-pool:www"})
+	query.Trace = trace
+	result, err := g.Query(query)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	expected := []index.Metric{testMetric("server.hostname-1234.cpu")}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("split index test: linked query expected %v, got %v", expected, result)
+	}
+
+	linkStep := trace.Steps[1]
+	if linkStep.Stage != "joins after following links to fqdn" || linkStep.Count != 1 {
+		t.Errorf("split index test: linked query trace is missing the link step: %+v", trace.Steps)
+	}
 }
 
 func BenchmarkSmallsetQuery(b *testing.B) {
@@ -105,16 +215,13 @@ func BenchmarkSmallsetQuery(b *testing.B) {
 	tags := []string{"server-state:live", "server-dc:lhr"}
 	metrics := []string{metricName}
 
-	wg := &sync.WaitGroup{}
-	wg.Add(1)
-	joinToMetric, tagToJoin := prepareBuffer(host, tags, metrics)
-	in.Materialize(wg, joinToMetric, tagToJoin)
-	wg.Wait()
+	joinToMetric, tagToJoin, numericTags := prepareBuffer(host, tags, metrics)
+	g := in.Materialize(joinToMetric, tagToJoin, numericTags, nil, nil)
 
 	query := index.NewQuery([]string{"server-state:live"})
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		in.Query(query)
+		g.Query(query)
 	}
 }
 
@@ -230,21 +337,32 @@ func TestIntersectJoins(t *testing.T) {
 }
 
 //TODO(btyler): fix up the APIs a bit so this is less of a pain/copy with database.writeBuffer.BufferMetrics/BufferTags
-func prepareBuffer(rawJoin string, rawTags, rawMetrics []string) (map[Join]map[index.Metric]struct{}, map[tag.ServiceKey]map[Join]index.Tag) {
-	joinToMetric := map[Join]map[index.Metric]struct{}{}
-	tagToJoin := map[tag.ServiceKey]map[Join]index.Tag{}
+// the tests use metric names interned here as their metrics
+var testMetrics = index.NewMetricDictionary()
+
+func testMetric(name string) index.Metric {
+	metric, ok := testMetrics.ID(name)
+	if !ok {
+		metric = testMetrics.Ref(name)
+	}
+	return metric
+}
+
+func prepareBuffer(rawJoin string, rawTags, rawMetrics []string) (map[Join]map[index.Metric]int64, map[tag.ServiceKey]map[Join][]index.Tag, map[index.Tag]string) {
+	joinToMetric := map[Join]map[index.Metric]int64{}
+	tagToJoin := map[tag.ServiceKey]map[Join][]index.Tag{}
+	numericTags := map[index.Tag]string{}
 
 	join := HashJoin(rawJoin)
 	tags := index.HashTags(rawTags)
 
-	joinToMetric[join] = map[index.Metric]struct{}{}
+	joinToMetric[join] = map[index.Metric]int64{}
 	for _, rawMetric := range rawMetrics {
-		metric := index.HashMetric(rawMetric)
-		joinToMetric[join][metric] = struct{}{}
+		joinToMetric[join][testMetric(rawMetric)] = 0
 	}
 
 	for i, rawTag := range rawTags {
-		s, k, _, err := tag.Parse(rawTag)
+		s, k, v, err := tag.Parse(rawTag)
 		if err != nil {
 			panic(fmt.Sprintf("failed to parse a tag %q for a test case: %v. this is a bug in the tests", rawTag, err))
 
@@ -252,10 +370,37 @@ func prepareBuffer(rawJoin string, rawTags, rawMetrics []string) (map[Join]map[i
 		sk := HashServiceKey(s + "-" + k)
 		tagValueForJoins, ok := tagToJoin[sk]
 		if !ok {
-			tagValueForJoins = map[Join]index.Tag{}
+			tagValueForJoins = map[Join][]index.Tag{}
 			tagToJoin[sk] = tagValueForJoins
 		}
-		tagValueForJoins[join] = tags[i]
+		tagValueForJoins[join] = append(tagValueForJoins[join], tags[i])
+		if _, err := strconv.ParseFloat(v, 64); err == nil {
+			numericTags[tags[i]] = v
+		}
+	}
+	return joinToMetric, tagToJoin, numericTags
+}
+
+func TestUnionJoins(t *testing.T) {
+	joins := [][]Join{
+		HashJoins([]string{"foo", "bar", "baz"}),
+		HashJoins([]string{"qux", "bar"}),
+		HashJoins([]string{}),
+	}
+
+	for _, joinList := range joins {
+		SortJoins(joinList)
+	}
+
+	union := UnionJoins(joins)
+	expected := HashJoins([]string{"foo", "bar", "baz", "qux"})
+	SortJoins(expected)
+	if fmt.Sprintf("%v", union) != fmt.Sprintf("%v", expected) {
+		t.Errorf("index test: join union expected %v, got %v", expected, union)
+	}
+
+	union = UnionJoins([][]Join{})
+	if len(union) > 0 {
+		t.Error("index test: join union on empty set returned non-empty")
 	}
-	return joinToMetric, tagToJoin
 }
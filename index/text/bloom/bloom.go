@@ -3,7 +3,6 @@ package bloom
 import (
 	"fmt"
 	"sync"
-	"sync/atomic"
 
 	"github.com/dgryski/carbonzipper/mlog"
 	"github.com/kanatohodets/carbonsearch/index"
@@ -18,18 +17,40 @@ type swappableBloom struct {
 	mut         sync.RWMutex
 	bloom       *bloomindex.Index
 	docToMetric map[bloomindex.DocID]index.Metric
+	metricToDoc map[index.Metric]bloomindex.DocID
 }
 
 type Index struct {
-	active    atomic.Value //*swappableBloom
-	standby   atomic.Value //*swappableBloom
-	metricMap atomic.Value //map[index.Metric]string
+	// active is the bloom the last generation uses. standby is the one the
+	// next generation is built in: it's behind by the last Materialize,
+	// whose changes are in catchUp
+	active  *swappableBloom
+	standby *swappableBloom
+	catchUp changes
+	// the metric names the index was last materialized with
+	names index.MetricNames
 
 	numHashes int
 	blockSize int
 	metaSize  int
 }
 
+// changes are what a Materialize did to a bloom, so they can be done to the
+// other one as well
+type changes struct {
+	// metrics whose documents are stale: they were deleted, or their ID now
+	// belongs to another name
+	staleMetrics []index.Metric
+	documents    []bloomindex.DocID
+	tokens       [][]uint32
+	metrics      []index.Metric
+}
+
+// Generation is a read-only generation of the bloom index
+type Generation struct {
+	bloom *swappableBloom
+}
+
 func NewIndex() *Index {
 	ti := Index{
 		//TODO(btyler): configurable?
@@ -38,127 +59,124 @@ func NewIndex() *Index {
 		metaSize:  512 * 2048,
 	}
 
-	ti.active.Store(&swappableBloom{
-		bloom:       bloomindex.NewIndex(ti.blockSize, ti.metaSize, ti.numHashes),
-		docToMetric: map[bloomindex.DocID]index.Metric{},
-	})
+	ti.active = ti.newBloom()
+	ti.standby = ti.newBloom()
+	return &ti
+}
 
-	ti.standby.Store(&swappableBloom{
+func (ti *Index) newBloom() *swappableBloom {
+	return &swappableBloom{
 		bloom:       bloomindex.NewIndex(ti.blockSize, ti.metaSize, ti.numHashes),
 		docToMetric: map[bloomindex.DocID]index.Metric{},
-	})
-
-	ti.metricMap.Store(map[index.Metric]string{})
-	return &ti
+		metricToDoc: map[index.Metric]bloomindex.DocID{},
+	}
 }
 
 func (ti *Index) Name() string {
 	return "bloom text index"
 }
 
-func (ti *Index) Query(tokens []uint32) ([]index.Metric, error) {
-	active := ti.Active()
-	active.mut.RLock()
-	defer active.mut.RUnlock()
-
-	docIDs := active.bloom.Query(tokens)
+// Query returns the metrics whose documents have all of the tokens. The bloom
+// may be catching up with a newer generation while it's queried, so a few of
+// the metrics might not be in the names of this generation.
+func (g *Generation) Query(tokens []uint32) ([]index.Metric, error) {
+	g.bloom.mut.RLock()
+	defer g.bloom.mut.RUnlock()
 
-	metrics, err := ti.docsToMetrics(active, docIDs)
-	if err != nil {
-		return nil, fmt.Errorf(
-			"%v Query: error unmapping doc IDs: %v",
-			ti.Name(),
-			err,
-		)
-	}
-	return metrics, nil
+	docIDs := g.bloom.bloom.Query(tokens)
+	return docsToMetrics(g.bloom, docIDs), nil
 }
 
-// TODO: active? should the docToMetric map live in the text index or internally to the backend?
-func (ti *Index) docsToMetrics(active *swappableBloom, docIDs []bloomindex.DocID) ([]index.Metric, error) {
+// docsToMetrics maps documents to metrics. documents can't be removed from a
+// bloom index, so the documents of metrics which were deleted are still in
+// there: they don't map to anything anymore.
+func docsToMetrics(active *swappableBloom, docIDs []bloomindex.DocID) []index.Metric {
 	metrics := make([]index.Metric, 0, len(docIDs))
 
 	docMap := active.docToMetric
 	for _, docID := range docIDs {
 		metric, ok := docMap[docID]
-		if !ok {
-			return nil, fmt.Errorf(
-				"docsToMetrics: docID %q was missing in the docToMetric map! this is awful!",
-				docID,
-			)
+		if ok {
+			metrics = append(metrics, metric)
 		}
-		metrics = append(metrics, metric)
 	}
 
-	return metrics, nil
+	return metrics
 }
 
-//TODO(btyler) synchronize this so it does the heavy lifting first, then waits to do atomic swap
+// Materialize builds the next generation in the standby bloom, which becomes
+// the active one. The formerly active bloom may still be queried through the
+// generation that used it, so it catches up with these changes at the start
+// of the next Materialize, rather than right away.
+//
 // Materialize should panic in case of any problems with the data -- that
 // should have been caught by validation before going into the write buffer
-func (ti *Index) Materialize(rawMetrics []string) int {
-	hashed := index.HashMetrics(rawMetrics)
-	standby := ti.Standby()
-	newMetricMap := map[index.Metric]string{}
-	oldMetricMap := ti.MetricMap()
+func (ti *Index) Materialize(names index.MetricNames) (*Generation, int) {
+	standby := ti.standby
+	standby.mut.Lock()
+	// counting on the two bloom indexes increasing document ID in lockstep
+	// with each other. dgryski says this is a reasonable assumption, and not
+	// breaking the encapsulation of the bloom index
+	for _, metric := range ti.catchUp.staleMetrics {
+		forget(standby, metric)
+	}
+	for i, docID := range ti.catchUp.documents {
+		standbyDocID := standby.bloom.AddDocument(ti.catchUp.tokens[i])
+		if docID != standbyDocID {
+			panic("bloom index: our bloom indexes have diverged, and are not creating documents in lockstep! yikes!")
+		}
 
-	// these are used to 'catch up' the formerly-active index after it goes off duty
-	recentDocuments := []bloomindex.DocID{}
-	recentTokens := [][]uint32{}
-	recentMetrics := []index.Metric{}
+		standby.docToMetric[standbyDocID] = ti.catchUp.metrics[i]
+		standby.metricToDoc[ti.catchUp.metrics[i]] = standbyDocID
+	}
 
-	standby.mut.Lock()
-	for i, rawMetric := range rawMetrics {
-		metric := hashed[i]
-		_, ok := oldMetricMap[metric]
-		if !ok {
-			tokens, err := document.Tokenize(rawMetric)
-			if err != nil {
-				panic(fmt.Sprintf("%s Materialize: can't tokenize %v: %v. this should have been caught by validation before adding the metric to the write buffer, hence the panic", ti.Name(), rawMetric, err))
+	recent := changes{}
+	readable := 0
+	for i, rawMetric := range names {
+		metric := index.Metric(i)
+		oldMetric, _ := ti.names.Name(metric)
+		if rawMetric == oldMetric {
+			if rawMetric != "" {
+				readable++
 			}
-			docID := standby.bloom.AddDocument(tokens)
-			recentDocuments = append(recentDocuments, docID)
-			recentTokens = append(recentTokens, tokens)
-			recentMetrics = append(recentMetrics, metric)
+			continue
+		}
 
-			standby.docToMetric[docID] = metric
+		if oldMetric != "" {
+			recent.staleMetrics = append(recent.staleMetrics, metric)
+			forget(standby, metric)
+		}
+		if rawMetric == "" {
+			continue
 		}
-		newMetricMap[metric] = rawMetric
-	}
-	standby.mut.Unlock()
 
-	// swap active/standby
-	active := ti.Active()
-	ti.standby.Store(active)
-	ti.active.Store(standby)
-
-	formerlyActive := ti.Standby()
-	formerlyActive.mut.Lock()
-	for i, docID := range recentDocuments {
-		// counting on the two bloom indexes increasing document ID in
-		// lockstep with each other. dgryski says this is a reasonable
-		// assumption, and not breaking the encapsulation of the bloom index
-		tokens := recentTokens[i]
-		standbyDocID := formerlyActive.bloom.AddDocument(tokens)
-		if docID != standbyDocID {
-			panic("bloom index: our bloom indexes have diverged, and are not creating documents in lockstep! yikes!")
+		readable++
+		tokens, err := document.IndexTokens(rawMetric)
+		if err != nil {
+			panic(fmt.Sprintf("%s Materialize: can't tokenize %v: %v. this should have been caught by validation before adding the metric to the write buffer, hence the panic", ti.Name(), rawMetric, err))
 		}
+		docID := standby.bloom.AddDocument(tokens)
+		recent.documents = append(recent.documents, docID)
+		recent.tokens = append(recent.tokens, tokens)
+		recent.metrics = append(recent.metrics, metric)
 
-		formerlyActive.docToMetric[standbyDocID] = recentMetrics[i]
+		standby.docToMetric[docID] = metric
+		standby.metricToDoc[metric] = docID
 	}
-	formerlyActive.mut.Unlock()
-
-	ti.metricMap.Store(newMetricMap)
-	return len(newMetricMap)
-}
+	standby.mut.Unlock()
 
-func (ti *Index) Active() *swappableBloom {
-	return ti.active.Load().(*swappableBloom)
-}
-func (ti *Index) Standby() *swappableBloom {
-	return ti.standby.Load().(*swappableBloom)
+	ti.active, ti.standby = standby, ti.active
+	ti.catchUp = recent
+	ti.names = names
+	return &Generation{bloom: standby}, readable
 }
 
-func (ti *Index) MetricMap() map[index.Metric]string {
-	return ti.metricMap.Load().(map[index.Metric]string)
+// forget unmaps the document of a metric
+func forget(bloom *swappableBloom, metric index.Metric) {
+	docID, ok := bloom.metricToDoc[metric]
+	if !ok {
+		return
+	}
+	delete(bloom.docToMetric, docID)
+	delete(bloom.metricToDoc, metric)
 }
@@ -1,6 +1,10 @@
 package document
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
 
 const N = 4
 
@@ -20,6 +24,51 @@ func Tokenize(term string) ([]uint32, error) {
 	return tokens, nil
 }
 
+// IndexTokens returns the ngrams to index a metric under: its own, plus those
+// of its case-folded form (if that's any different), so that the same index
+// can serve case sensitive and case-insensitive searches.
+func IndexTokens(metric string) ([]uint32, error) {
+	tokens, err := Tokenize(metric)
+	if err != nil {
+		return nil, err
+	}
+
+	folded := Fold(metric)
+	if folded == metric {
+		return tokens, nil
+	}
+
+	foldedTokens, err := Tokenize(folded)
+	if err != nil {
+		// folding non-ASCII can make a string shorter; the metric is still
+		// findable by its own ngrams
+		return tokens, nil
+	}
+	return append(tokens, foldedTokens...), nil
+}
+
+// Fold returns the case-folded form of a string, for case-insensitive
+// searches. It folds the way regular expressions do with '(?i)', so that
+// runes like 'ſ' (which only fold to 'S' and 's') fold to the same thing.
+func Fold(s string) string {
+	return strings.Map(foldRune, s)
+}
+
+func foldRune(r rune) rune {
+	if r <= unicode.MaxASCII {
+		return unicode.ToLower(r)
+	}
+	// SimpleFold goes around the runes that fold together; lowercase the
+	// smallest one, which is what the regexp parser keeps
+	min := r
+	for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+		if f < min {
+			min = f
+		}
+	}
+	return unicode.ToLower(min)
+}
+
 func ngramize(s [N]byte) uint32 {
 	return uint32(s[0])<<24 | uint32(s[1])<<16 | uint32(s[2])<<8 | uint32(s[3])
 }
@@ -0,0 +1,119 @@
+package text
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// the characters that make a text search a graphite glob
+const globCharacters = "*?[{"
+
+var closingBrackets = map[byte]byte{'[': ']', '{': '}'}
+
+// isGlob returns true if a search uses graphite glob syntax, like
+// 'servers.*.cpu.{user,system}'. Globs match whole metric names, rather than
+// substrings.
+func isGlob(search string) bool {
+	return strings.ContainsAny(search, globCharacters)
+}
+
+// compileGlob turns a graphite glob into a regular expression matching whole
+// metric names. As in graphite, the wildcards match inside of a single path
+// node: '*' and '?' never match a '.'.
+func compileGlob(glob string) (*regexp.Regexp, error) {
+	expr, err := globExpression(glob)
+	if err != nil {
+		return nil, err
+	}
+	return regexp.Compile("^" + expr + "$")
+}
+
+func globExpression(glob string) (string, error) {
+	var expr bytes.Buffer
+	for i := 0; i < len(glob); i++ {
+		switch glob[i] {
+		case '*':
+			expr.WriteString(`[^.]*`)
+		case '?':
+			expr.WriteString(`[^.]`)
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end == -1 {
+				return "", fmt.Errorf("text index: %q has an unclosed '['", glob)
+			}
+			class := glob[i+1 : i+1+end]
+			if class == "" {
+				return "", fmt.Errorf("text index: %q has an empty '[]'", glob)
+			}
+			if class[0] == '!' {
+				class = "^" + class[1:]
+			}
+			expr.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+			i += end + 1
+		case '{':
+			end := strings.IndexByte(glob[i+1:], '}')
+			if end == -1 {
+				return "", fmt.Errorf("text index: %q has an unclosed '{'", glob)
+			}
+			group := glob[i+1 : i+1+end]
+			if strings.IndexByte(group, '{') != -1 {
+				return "", fmt.Errorf("text index: %q has nested '{', which is not supported", glob)
+			}
+			alternatives := strings.Split(group, ",")
+			for j, alternative := range alternatives {
+				alternativeExpr, err := globExpression(alternative)
+				if err != nil {
+					return "", err
+				}
+				alternatives[j] = alternativeExpr
+			}
+			expr.WriteString("(?:" + strings.Join(alternatives, "|") + ")")
+			i += end + 1
+		default:
+			expr.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	return expr.String(), nil
+}
+
+// globTokens returns the ngrams of the literal parts of a glob: every metric
+// matching the glob contains all of them.
+func globTokens(glob string) ([]uint32, error) {
+	return literalTokens(glob, globLiterals(glob))
+}
+
+// globLiterals splits a glob into the runs of characters outside of any
+// wildcard, character class or alternation group
+func globLiterals(glob string) []string {
+	literals := []string{}
+	start := 0
+	for i := 0; i < len(glob); i++ {
+		end := i
+		switch glob[i] {
+		case '*', '?':
+		case '[', '{':
+			closing := strings.IndexByte(glob[i+1:], closingBrackets[glob[i]])
+			// unclosed groups are rejected by compileGlob
+			if closing == -1 {
+				end = len(glob)
+			} else {
+				end = i + 1 + closing
+			}
+		default:
+			continue
+		}
+
+		if i > start {
+			literals = append(literals, glob[start:i])
+		}
+		i = end
+		start = end + 1
+	}
+
+	if start < len(glob) {
+		literals = append(literals, glob[start:])
+	}
+	return literals
+}
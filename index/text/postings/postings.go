@@ -0,0 +1,140 @@
+package postings
+
+import (
+	"fmt"
+
+	"github.com/kanatohodets/carbonsearch/index"
+	"github.com/kanatohodets/carbonsearch/index/text/document"
+)
+
+/*
+	an inverted index from the ngrams of metric names to compressed posting
+	lists of the metrics that have them.
+
+	unlike the bloom index, it has no false positives of its own: a metric is
+	returned only if its name really has every ngram that was asked for. the
+	ngrams can still be in the wrong places, so the text filter has to run,
+	but on far fewer candidates. metrics that are deleted (or whose ID is
+	given to a new name) are taken out of the posting lists of their old
+	ngrams.
+*/
+
+type Index struct {
+	// the ngram posting lists and metric names the index was last
+	// materialized with. only Materialize uses them, and it's never called
+	// concurrently
+	tokens map[uint32]index.Postings // of index.Metrics
+	names  index.MetricNames
+}
+
+// Generation is a read-only generation of the posting list index
+type Generation struct {
+	tokens map[uint32]index.Postings
+}
+
+func NewIndex() *Index {
+	return &Index{
+		tokens: map[uint32]index.Postings{},
+	}
+}
+
+func (pi *Index) Name() string {
+	return "postings text index"
+}
+
+// Query returns the (sorted) metrics whose names have all of the tokens
+func (g *Generation) Query(tokens []uint32) ([]index.Metric, error) {
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("postings text index: no tokens to query")
+	}
+
+	lists := make([]index.Postings, 0, len(tokens))
+	seen := make(map[uint32]struct{}, len(tokens))
+	for _, token := range tokens {
+		if _, ok := seen[token]; ok {
+			continue
+		}
+		seen[token] = struct{}{}
+
+		list, ok := g.tokens[token]
+		if !ok {
+			// no metric has this ngram -> none can have all of them
+			return []index.Metric{}, nil
+		}
+		lists = append(lists, list)
+	}
+
+	return index.IntersectPostings(lists).Metrics(), nil
+}
+
+// Materialize builds a new generation from a generation of metric names. Only
+// the posting lists of the ngrams of metrics which were added, removed or
+// renamed since the last generation are rebuilt, the rest are shared with it.
+//
+// Materialize should panic in case of any problems with the data -- that
+// should have been caught by validation before going into the write buffer
+func (pi *Index) Materialize(names index.MetricNames) (*Generation, int) {
+	// token -> metric -> whether the metric has it now
+	patches := map[uint32]map[uint64]bool{}
+	patch := func(tokens []uint32, metric index.Metric, has bool) {
+		for _, token := range tokens {
+			metrics, ok := patches[token]
+			if !ok {
+				metrics = map[uint64]bool{}
+				patches[token] = metrics
+			}
+			metrics[uint64(metric)] = has
+		}
+	}
+
+	readable := 0
+	ids := len(names)
+	if len(pi.names) > ids {
+		ids = len(pi.names)
+	}
+	for i := 0; i < ids; i++ {
+		metric := index.Metric(i)
+		rawMetric, _ := names.Name(metric)
+		oldMetric, _ := pi.names.Name(metric)
+		if rawMetric != "" {
+			readable++
+		}
+		if rawMetric == oldMetric {
+			continue
+		}
+
+		// the old ngrams go first, so that the ones the new name shares
+		// with it are kept
+		if oldMetric != "" {
+			patch(pi.tokenize(oldMetric), metric, false)
+		}
+		if rawMetric != "" {
+			patch(pi.tokenize(rawMetric), metric, true)
+		}
+	}
+
+	tokens := make(map[uint32]index.Postings, len(pi.tokens))
+	for token, metrics := range pi.tokens {
+		tokens[token] = metrics
+	}
+	for token, metrics := range patches {
+		patched := index.PatchPostings(index.CompressedPostingsFormat, tokens[token], metrics)
+		if patched == nil {
+			delete(tokens, token)
+			continue
+		}
+		tokens[token] = patched
+	}
+
+	pi.tokens = tokens
+	pi.names = names
+	return &Generation{tokens: tokens}, readable
+}
+
+func (pi *Index) tokenize(rawMetric string) []uint32 {
+	tokens, err := document.IndexTokens(rawMetric)
+	if err != nil {
+		panic(fmt.Sprintf("%s Materialize: can't tokenize %v: %v. this should have been caught by validation before adding the metric to the write buffer, hence the panic", pi.Name(), rawMetric, err))
+	}
+	return tokens
+}
@@ -0,0 +1,79 @@
+package postings
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/kanatohodets/carbonsearch/index"
+	"github.com/kanatohodets/carbonsearch/index/text/document"
+)
+
+func queryTest(t *testing.T, testName string, g *Generation, search string, expected []index.Metric) {
+	tokens, err := document.Tokenize(search)
+	if err != nil {
+		t.Errorf("%s: %v", testName, err)
+		return
+	}
+	metrics, err := g.Query(tokens)
+	if err != nil {
+		t.Errorf("%s: %v", testName, err)
+		return
+	}
+	if !reflect.DeepEqual(metrics, expected) {
+		t.Errorf("%s: expected %v, got %v", testName, expected, metrics)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	pi := NewIndex()
+	g, readable := pi.Materialize(index.MetricNames{
+		"server.foohost.cpu",
+		"server.barhost.cpu",
+		"server.foohost.mem",
+		"",
+	})
+	if readable != 3 {
+		t.Errorf("expected 3 readable metrics, got %d", readable)
+	}
+
+	queryTest(t, "one ngram", g, "foohost", []index.Metric{0, 2})
+	queryTest(t, "all ngrams", g, "barhost.cpu", []index.Metric{1})
+	queryTest(t, "missing ngram", g, "bazhost", []index.Metric{})
+	queryTest(t, "case folded", g, "server", []index.Metric{0, 1, 2})
+
+	_, err := g.Query(nil)
+	if err == nil {
+		t.Errorf("a query without tokens should be an error")
+	}
+}
+
+func TestRemoval(t *testing.T) {
+	pi := NewIndex()
+	old, _ := pi.Materialize(index.MetricNames{
+		"server.foohost.cpu",
+		"server.barhost.cpu",
+		"server.foohost.mem",
+	})
+
+	// metric 0 is deleted, and the ID of metric 2 is given to a new name
+	g, readable := pi.Materialize(index.MetricNames{
+		"",
+		"server.barhost.cpu",
+		"server.bazhost.mem",
+	})
+	if readable != 2 {
+		t.Errorf("expected 2 readable metrics, got %d", readable)
+	}
+
+	queryTest(t, "deleted", g, "foohost", []index.Metric{})
+	queryTest(t, "renamed", g, "bazhost", []index.Metric{2})
+	queryTest(t, "kept ngrams of a renamed metric", g, "host.mem", []index.Metric{2})
+	queryTest(t, "untouched", g, "barhost", []index.Metric{1})
+	gone, _ := document.Tokenize("fooh")
+	if _, ok := g.tokens[gone[0]]; ok {
+		t.Errorf("an ngram no metric has anymore should be dropped")
+	}
+
+	// the old generation isn't changed
+	queryTest(t, "old generation", old, "foohost", []index.Metric{0, 2})
+}
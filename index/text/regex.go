@@ -0,0 +1,98 @@
+package text
+
+import (
+	"fmt"
+	"regexp/syntax"
+
+	"github.com/kanatohodets/carbonsearch/index/text/document"
+)
+
+// regexTokens returns the ngrams of the literal strings that every match of a
+// regular expression has to contain, like 'disk.sd' and '.io_time' in
+// 'disk\.sd[a-z]+\.io_time'.
+func regexTokens(expr string) ([]uint32, error) {
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return nil, fmt.Errorf("%q is not a valid regular expression: %v", expr, err)
+	}
+	return literalTokens(expr, requiredLiterals(re.Simplify()))
+}
+
+// requiredLiterals walks a parsed regular expression, collecting the literal
+// strings that any match must contain. Anything optional (alternation, '*',
+// '?') is skipped: the result only has to be a superset of the real matches,
+// since the filter stage runs the real regular expression. Case-insensitive
+// literals, as in '(?i)cpu', come back folded: the index has the ngrams of
+// the folded form of every metric too.
+func requiredLiterals(re *syntax.Regexp) []string {
+	switch re.Op {
+	case syntax.OpLiteral:
+		if literal, ok := exactLiteral(re); ok {
+			return []string{literal}
+		}
+		if literal, ok := foldedLiteral(re); ok {
+			return []string{literal}
+		}
+	case syntax.OpCapture, syntax.OpPlus:
+		return requiredLiterals(re.Sub[0])
+	case syntax.OpRepeat:
+		if re.Min > 0 {
+			return requiredLiterals(re.Sub[0])
+		}
+	case syntax.OpConcat:
+		// adjacent literals join up into longer ones, which is what makes
+		// 'a(b)cd' searchable
+		literals := []string{}
+		run := ""
+		for _, sub := range re.Sub {
+			if literal, ok := exactLiteral(sub); ok {
+				run += literal
+				continue
+			}
+
+			if run != "" {
+				literals = append(literals, run)
+				run = ""
+			}
+			literals = append(literals, requiredLiterals(sub)...)
+		}
+		if run != "" {
+			literals = append(literals, run)
+		}
+		return literals
+	}
+	return nil
+}
+
+// exactLiteral returns the string matched by re, if it only ever matches that
+// one (case sensitive) string
+func exactLiteral(re *syntax.Regexp) (string, bool) {
+	switch re.Op {
+	case syntax.OpLiteral:
+		if re.Flags&syntax.FoldCase != 0 {
+			return "", false
+		}
+		return string(re.Rune), true
+	case syntax.OpCapture:
+		return exactLiteral(re.Sub[0])
+	case syntax.OpConcat:
+		literal := ""
+		for _, sub := range re.Sub {
+			subLiteral, ok := exactLiteral(sub)
+			if !ok {
+				return "", false
+			}
+			literal += subLiteral
+		}
+		return literal, true
+	}
+	return "", false
+}
+
+// foldedLiteral returns the folded form of a case-insensitive literal
+func foldedLiteral(re *syntax.Regexp) (string, bool) {
+	if re.Op != syntax.OpLiteral || re.Flags&syntax.FoldCase == 0 {
+		return "", false
+	}
+	return document.Fold(string(re.Rune)), true
+}
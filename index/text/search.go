@@ -0,0 +1,118 @@
+package text
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/kanatohodets/carbonsearch/index/text/document"
+)
+
+type searchKind int
+
+const (
+	// a substring, optionally pinned with '^' and '$', or a graphite glob
+	matchSearch searchKind = iota
+	// the same as matchSearch, ignoring case
+	imatchSearch
+	// an RE2 regular expression
+	regexSearch
+)
+
+// search is a single text search from a query, without the tag prefix
+type search struct {
+	kind searchKind
+	text string
+}
+
+// tokenize returns the ngrams that a metric must contain to match the search
+func (s search) tokenize() ([]uint32, error) {
+	switch {
+	case s.kind == imatchSearch:
+		// the index has the ngrams of every metric's folded form as well
+		return s.folded().tokenize()
+	case s.kind == regexSearch:
+		return regexTokens(s.text)
+	case isGlob(s.text):
+		return globTokens(s.text)
+	}
+	return document.Tokenize(strings.Trim(s.text, "^$"))
+}
+
+// compile prepares the search for filtering metrics
+func (s search) compile() (matcher, error) {
+	switch {
+	case s.kind == imatchSearch:
+		m, err := s.folded().compile()
+		if err != nil {
+			return nil, err
+		}
+		return func(rawMetric string) bool {
+			return m(document.Fold(rawMetric))
+		}, nil
+	case s.kind == regexSearch:
+		re, err := regexp.Compile(s.text)
+		if err != nil {
+			return nil, fmt.Errorf("text index: %q is not a valid regular expression: %v", s.text, err)
+		}
+		return re.MatchString, nil
+	case isGlob(s.text):
+		re, err := compileGlob(s.text)
+		if err != nil {
+			return nil, err
+		}
+		return re.MatchString, nil
+	}
+
+	text := s.text
+	return func(rawMetric string) bool {
+		return match(text, rawMetric)
+	}, nil
+}
+
+// folded turns a case-insensitive search into a case sensitive one, for
+// matching against case-folded metrics
+func (s search) folded() search {
+	return search{kind: matchSearch, text: document.Fold(s.text)}
+}
+
+// a matcher checks a single text search against a metric
+type matcher func(rawMetric string) bool
+
+// matchers prepares the searches for filtering: globs and regular expressions
+// are compiled once, rather than for every metric
+func matchers(searches []search) []matcher {
+	result := make([]matcher, 0, len(searches))
+	for _, search := range searches {
+		m, err := search.compile()
+		if err != nil {
+			// Validate should have caught this
+			logger.Logf("text index: %v. this search will not match anything", err)
+			m = func(string) bool { return false }
+		}
+		result = append(result, m)
+	}
+	return result
+}
+
+// literalTokens returns the ngrams of the literal parts of a glob or regular
+// expression. Literals too short to tokenize are skipped, but at least one
+// has to be long enough, or there would be nothing to look up in the index.
+func literalTokens(s string, literals []string) ([]uint32, error) {
+	tokens := []uint32{}
+	for _, literal := range literals {
+		if len(literal) < document.N {
+			continue
+		}
+		literalTokens, err := document.Tokenize(literal)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, literalTokens...)
+	}
+
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("%s has no literal part long enough to search on (at least %d characters without wildcards)", s, document.N)
+	}
+	return tokens, nil
+}
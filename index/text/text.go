@@ -3,12 +3,11 @@ package text
 import (
 	"fmt"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/kanatohodets/carbonsearch/index"
 	"github.com/kanatohodets/carbonsearch/index/text/bloom"
-	"github.com/kanatohodets/carbonsearch/index/text/document"
+	"github.com/kanatohodets/carbonsearch/index/text/postings"
 
 	"github.com/dgryski/carbonzipper/mlog"
 )
@@ -16,28 +15,82 @@ import (
 var logger mlog.Level
 
 /*
+	the text index finds metrics by substrings of their names. a backend maps
+	the ngrams of the names to the metrics that have them: "bloom" keeps them
+	in a bloom index, which is small but has false positives, and "postings"
+	in exact posting lists. either way, the candidates are then filtered with
+	the searches themselves.
+*/
 
-* refactor bloom index into an implementation of some TextIndexBackend interface or something
-* once that's done and working well, implement a go-postings backend (w/ compression?)
-
- */
-
-type backendType int
+type BackendType int
 
 const (
-	BloomBackend backendType = iota
+	BloomBackend BackendType = iota
+	PostingsBackend
 )
 
+// ParseBackend reads a text index backend from the config: "bloom" or
+// "postings"
+func ParseBackend(backend string) (BackendType, error) {
+	switch backend {
+	case "", "bloom":
+		return BloomBackend, nil
+	case "postings":
+		return PostingsBackend, nil
+	}
+	return BloomBackend, fmt.Errorf("text index: unknown backend %q, it should be 'bloom' or 'postings'", backend)
+}
+
+func (b BackendType) String() string {
+	if b == PostingsBackend {
+		return "postings"
+	}
+	return "bloom"
+}
+
 type TextBackend interface {
+	// Materialize brings the backend up to date with a new generation of
+	// metric names, returning a read-only generation of the backend and how
+	// many metrics it has
+	Materialize(index.MetricNames) (BackendGeneration, int)
+}
+
+// BackendGeneration finds the metrics whose names have all of the given
+// ngrams. It may return some that don't: they're filtered out later.
+type BackendGeneration interface {
 	Query([]uint32) ([]index.Metric, error)
-	Materialize([]string) int
-	MetricMap() map[index.Metric]string
+}
+
+// bloomBackend is the bloom index as a TextBackend. The bloom package can't
+// import this one to return a BackendGeneration itself.
+type bloomBackend struct {
+	*bloom.Index
+}
+
+func (b bloomBackend) Materialize(names index.MetricNames) (BackendGeneration, int) {
+	g, readable := b.Index.Materialize(names)
+	return g, readable
+}
+
+// postingsBackend is the posting list index as a TextBackend
+type postingsBackend struct {
+	*postings.Index
+}
+
+func (b postingsBackend) Materialize(names index.MetricNames) (BackendGeneration, int) {
+	g, readable := b.Index.Materialize(names)
+	return g, readable
 }
 
 type Index struct {
 	backend TextBackend
+	// the generation Materialize built last. only Materialize uses it, and
+	// it's never called concurrently
+	last *Generation
 
-	textMatchPrefix string
+	textMatchPrefix  string
+	textIMatchPrefix string
+	textRegexPrefix  string
 
 	// reporting
 	readableMetrics uint32
@@ -46,123 +99,300 @@ type Index struct {
 	generationTime  int64 // time.Duration
 }
 
-func NewIndex(selectedBackend backendType, service string) *Index {
-	var backend TextBackend
+func NewIndex(selectedBackend BackendType, service string) *Index {
+	ti := Index{
+		textMatchPrefix:  service + "-match:",
+		textIMatchPrefix: service + "-imatch:",
+		textRegexPrefix:  service + "-regex:",
+	}
+	ti.SetBackend(selectedBackend)
+	return &ti
+}
+
+// SetBackend replaces the backend with an empty one of the given type. It has
+// to be called before the index is used.
+func (ti *Index) SetBackend(selectedBackend BackendType) {
 	switch selectedBackend {
 	case BloomBackend:
-		backend = bloom.NewIndex()
+		ti.backend = bloomBackend{bloom.NewIndex()}
+	case PostingsBackend:
+		ti.backend = postingsBackend{postings.NewIndex()}
 	default:
 		panic("no backend selected for text index")
 	}
-	ti := Index{
-		backend:         backend,
-		textMatchPrefix: service + "-match:",
-	}
-	return &ti
+	empty, _ := ti.backend.Materialize(index.MetricNames{})
+	ti.last = &Generation{ti: ti, backend: empty, names: index.MetricNames{}}
 }
 
-func (ti *Index) Query(q *index.Query) ([]index.Metric, error) {
-	searches := []string{}
-	for _, tag := range q.Raw {
-		if strings.HasPrefix(tag, ti.textMatchPrefix) {
-			search := strings.TrimPrefix(tag, ti.textMatchPrefix)
-			searches = append(searches, search)
+// Generation is a read-only generation of the text index: the backend and the
+// metric names it was built from
+type Generation struct {
+	ti      *Index
+	backend BackendGeneration
+	names   index.MetricNames
+}
+
+// Current is the generation Materialize built last, or an empty one
+func (ti *Index) Current() *Generation {
+	return ti.last
+}
+
+func (g *Generation) Query(q *index.Query) ([]index.Metric, error) {
+	ti := g.ti
+	searches := ti.searches(q.Raw)
+	unions := make([][]search, 0, len(q.RawUnions))
+	for _, rawUnion := range q.RawUnions {
+		unionSearches := ti.searches(rawUnion)
+		if len(unionSearches) > 0 {
+			unions = append(unions, unionSearches)
 		}
 	}
 
-	if len(searches) == 0 {
+	if len(searches) == 0 && len(unions) == 0 {
 		return nil, fmt.Errorf("%v Query: no text searches in query: %v", ti.Name(), q.Raw)
 	}
 
+	start := time.Now()
+	if q.Trace != nil {
+		err := g.traceSearches(q.Trace, searches, unions)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	metricSets := [][]index.Metric{}
+	if len(searches) > 0 {
+		metrics, err := g.query(searches)
+		if err != nil {
+			return nil, err
+		}
+		metricSets = append(metricSets, metrics)
+	}
+
+	// each alternative is queried on its own, then merged with the others
+	for _, union := range unions {
+		unionSets := make([][]index.Metric, 0, len(union))
+		for _, alternative := range union {
+			metrics, err := g.query([]search{alternative})
+			if err != nil {
+				return nil, err
+			}
+			unionSets = append(unionSets, metrics)
+		}
+		metricSets = append(metricSets, index.UnionMetrics(unionSets))
+	}
+
+	metrics := index.IntersectMetrics(metricSets)
+	q.Trace.Step(ti.Name(), "", "candidate metrics", len(metrics), start)
+	return metrics, nil
+}
+
+// traceSearches records how many candidate metrics each search matched on its
+// own. this means querying the backend again for every search, but it only
+// happens when a query is being explained.
+func (g *Generation) traceSearches(trace *index.Trace, searches []search, unions [][]search) error {
+	all := append([]search{}, searches...)
+	for _, union := range unions {
+		all = append(all, union...)
+	}
+
+	for _, s := range all {
+		metrics, err := g.query([]search{s})
+		if err != nil {
+			return err
+		}
+		trace.Tag(g.Name(), s.text, len(metrics), "metrics")
+	}
+	return nil
+}
+
+// searches strips the text match, imatch and regex prefixes from the text
+// tags in a query
+func (ti *Index) searches(tags []string) []search {
+	searches := []search{}
+	for _, tag := range tags {
+		if strings.HasPrefix(tag, ti.textMatchPrefix) {
+			searches = append(searches, search{kind: matchSearch, text: strings.TrimPrefix(tag, ti.textMatchPrefix)})
+		} else if strings.HasPrefix(tag, ti.textIMatchPrefix) {
+			searches = append(searches, search{kind: imatchSearch, text: strings.TrimPrefix(tag, ti.textIMatchPrefix)})
+		} else if strings.HasPrefix(tag, ti.textRegexPrefix) {
+			searches = append(searches, search{kind: regexSearch, text: strings.TrimPrefix(tag, ti.textRegexPrefix)})
+		}
+	}
+	return searches
+}
+
+// IsRegex returns true if the tag is a regular expression search, as in
+// 'text-regex:disk\.sd[a-z]+'. Regular expressions have their own meaning
+// for '{...}', so they can't use graphite-style alternation.
+func (ti *Index) IsRegex(tag string) bool {
+	return strings.HasPrefix(tag, ti.textRegexPrefix)
+}
+
+// query fetches the (sorted) metrics from the backend which contain all of the
+// ngrams in all of the given searches
+func (g *Generation) query(searches []search) ([]index.Metric, error) {
 	tokens := []uint32{}
 	for _, search := range searches {
-		nonpositional := strings.Trim(search, "^$")
-		searchTrigrams, err := document.Tokenize(nonpositional)
+		searchTrigrams, err := search.tokenize()
 		if err != nil {
-			return nil, fmt.Errorf("%v Query: error tokenizing %v: %v", ti.Name(), search, err)
+			return nil, fmt.Errorf("%v Query: error tokenizing %v: %v", g.Name(), search.text, err)
 		}
 
 		tokens = append(tokens, searchTrigrams...)
 	}
 
-	metrics, err := ti.backend.Query(tokens)
+	metrics, err := g.backend.Query(tokens)
 	if err != nil {
-		return nil, fmt.Errorf("%v Query: error querying text backend: %v", ti.Name(), err)
+		return nil, fmt.Errorf("%v Query: error querying text backend: %v", g.Name(), err)
 	}
 
-	index.SortMetrics(metrics)
-	return metrics, nil
+	// the backend may already be catching up with a newer generation, so it
+	// can have metrics that this one doesn't
+	known := metrics[:0]
+	for _, metric := range metrics {
+		if _, ok := g.names.Name(metric); ok {
+			known = append(known, metric)
+		}
+	}
+
+	index.SortMetrics(known)
+	return known, nil
 }
 
-// Filter filters a set of string metrics using a set of text tags
-// (text-match:foobar). Returns the string metrics which match all of the given
-// text tags.
-func (ti *Index) Filter(textTags, metrics []string) []string {
+// Validate checks that the search in a text tag can be run, so that a bad
+// glob or regular expression, or one without a literal long enough to look up
+// in the index, is reported when the query is parsed, rather than when it's
+// evaluated. Negated searches only filter, so they don't need one.
+func (ti *Index) Validate(tag string, negated bool) error {
+	for _, search := range ti.searches([]string{tag}) {
+		_, err := search.compile()
+		if err != nil {
+			return err
+		}
+		if negated {
+			continue
+		}
+		_, err = search.tokenize()
+		if err != nil {
+			return fmt.Errorf("text index: %v", err)
+		}
+	}
+	return nil
+}
+
+// Filter filters a set of string metrics using the text tags
+// (text-match:foobar) in a query. Returns the string metrics which match all
+// of the plain text tags, at least one text tag from each union, and none of
+// the negated text tags.
+func (ti *Index) Filter(q *index.Query, metrics []string) []string {
+	searches := matchers(ti.searches(q.Raw))
+	negated := matchers(ti.searches(q.RawNegated))
+	unions := make([][]matcher, 0, len(q.RawUnions))
+	for _, rawUnion := range q.RawUnions {
+		unionSearches := ti.searches(rawUnion)
+		if len(unionSearches) > 0 {
+			unions = append(unions, matchers(unionSearches))
+		}
+	}
+
 	matches := []string{}
-	intersectionCounts := make([]int, len(metrics))
-	for _, tag := range textTags {
-		search := strings.TrimPrefix(tag, ti.textMatchPrefix)
-		// broken pin -> no possible matches -> empty intersection
-		if search[0] == '$' || search[len(search)-1] == '^' {
-			return []string{}
-		}
-		caret := search[0] == '^'
-		dollar := search[len(search)-1] == '$'
-		nonpositional := strings.Trim(search, "^$")
-
-		// TODO: maybe this is slow? map based intersect and such
-		// this case is a little silly, since you should probably just query
-		// graphite for that metric directly
-		if caret && dollar {
-			for i, rawMetric := range metrics {
-				if rawMetric == nonpositional {
-					intersectionCounts[i]++
-					if intersectionCounts[i] == len(textTags) {
-						matches = append(matches, rawMetric)
-					}
-				}
-			}
-		} else if caret {
-			for i, rawMetric := range metrics {
-				if strings.HasPrefix(rawMetric, nonpositional) {
-					intersectionCounts[i]++
-					if intersectionCounts[i] == len(textTags) {
-						matches = append(matches, rawMetric)
-					}
-				}
-			}
-		} else if dollar {
-			for i, rawMetric := range metrics {
-				if strings.HasSuffix(rawMetric, nonpositional) {
-					intersectionCounts[i]++
-					if intersectionCounts[i] == len(textTags) {
-						matches = append(matches, rawMetric)
-					}
-				}
-			}
-		} else {
-			for i, rawMetric := range metrics {
-				if strings.Contains(rawMetric, nonpositional) {
-					intersectionCounts[i]++
-					if intersectionCounts[i] == len(textTags) {
-						matches = append(matches, rawMetric)
-					}
-				}
-			}
+	for _, rawMetric := range metrics {
+		if matchesAll(searches, rawMetric) && matchesUnions(unions, rawMetric) && !matchesAny(negated, rawMetric) {
+			matches = append(matches, rawMetric)
 		}
 	}
 
 	return matches
 }
 
-//TODO(btyler) synchronize this so it does the heavy lifting first, then waits to do atomic swap
+// FilterMetrics is Filter for metric IDs. The metrics stay in the same order.
+func (g *Generation) FilterMetrics(q *index.Query, metrics []index.Metric) ([]index.Metric, error) {
+	names := g.names
+	rawMetrics := make([]string, len(metrics))
+	for i, metric := range metrics {
+		raw, ok := names.Name(metric)
+		if !ok {
+			return nil, fmt.Errorf("text index: the metric ID '%d' has no mapping back to a string! this is awful", metric)
+		}
+		rawMetrics[i] = raw
+	}
+
+	matched := g.ti.Filter(q, rawMetrics)
+	filtered := make([]index.Metric, 0, len(matched))
+	for i, j := 0, 0; i < len(metrics) && j < len(matched); i++ {
+		// Filter keeps the order, and the names of distinct IDs are distinct
+		if rawMetrics[i] == matched[j] {
+			filtered = append(filtered, metrics[i])
+			j++
+		}
+	}
+	return filtered, nil
+}
+
+func matchesAll(searches []matcher, rawMetric string) bool {
+	for _, search := range searches {
+		if !search(rawMetric) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchesAny(searches []matcher, rawMetric string) bool {
+	for _, search := range searches {
+		if search(rawMetric) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesUnions(unions [][]matcher, rawMetric string) bool {
+	for _, union := range unions {
+		if !matchesAny(union, rawMetric) {
+			return false
+		}
+	}
+	return true
+}
+
+// match checks a single text search against a metric, respecting the '^' and
+// '$' pins
+func match(search, rawMetric string) bool {
+	// broken pin -> no possible matches. validation should keep empty
+	// searches out, but this runs in the query goroutine
+	if len(search) == 0 || search[0] == '$' || search[len(search)-1] == '^' {
+		return false
+	}
+	caret := search[0] == '^'
+	dollar := search[len(search)-1] == '$'
+	nonpositional := strings.Trim(search, "^$")
+
+	// this case is a little silly, since you should probably just query
+	// graphite for that metric directly
+	if caret && dollar {
+		return rawMetric == nonpositional
+	} else if caret {
+		return strings.HasPrefix(rawMetric, nonpositional)
+	} else if dollar {
+		return strings.HasSuffix(rawMetric, nonpositional)
+	}
+	return strings.Contains(rawMetric, nonpositional)
+}
+
+// Materialize builds a new generation of the index from a generation of metric
+// names. The generation isn't used for anything until the caller publishes
+// it, along with the generations of the other indexes built from the same
+// write buffer.
+//
 // Materialize should panic in case of any problems with the data -- that
 // should have been caught by validation before going into the write buffer
-func (ti *Index) Materialize(wg *sync.WaitGroup, rawMetrics []string) {
+func (ti *Index) Materialize(names index.MetricNames) *Generation {
 	start := time.Now()
-	defer wg.Done()
 
-	readableMetrics := ti.backend.Materialize(rawMetrics)
+	backend, readableMetrics := ti.backend.Materialize(names)
+	ti.last = &Generation{ti: ti, backend: backend, names: names}
 	ti.SetReadableMetrics(uint32(readableMetrics))
 
 	// update stats
@@ -174,21 +404,26 @@ func (ti *Index) Materialize(wg *sync.WaitGroup, rawMetrics []string) {
 	if index.Debug {
 		logger.Logf("text index %s: New generation %v took %v to generate", ti.Name(), g, elapsed)
 	}
+	return ti.last
 }
 
 func (ti *Index) Name() string {
 	return "text index"
 }
 
-// UnmapMetrics converts typed []uint64 metrics to string
-func (ti *Index) UnmapMetrics(metrics []index.Metric) ([]string, error) {
-	metricMap := ti.MetricMap()
+func (g *Generation) Name() string {
+	return g.ti.Name()
+}
+
+// UnmapMetrics converts metric IDs to names
+func (g *Generation) UnmapMetrics(metrics []index.Metric) ([]string, error) {
+	names := g.names
 	rawMetrics := make([]string, 0, len(metrics))
 
 	for _, metric := range metrics {
-		raw, ok := metricMap[metric]
+		raw, ok := names.Name(metric)
 		if !ok {
-			return nil, fmt.Errorf("text index: the hashed metric '%d' has no mapping back to a string! this is awful", metric)
+			return nil, fmt.Errorf("text index: the metric ID '%d' has no mapping back to a string! this is awful", metric)
 		}
 		rawMetrics = append(rawMetrics, raw)
 	}
@@ -196,6 +431,7 @@ func (ti *Index) UnmapMetrics(metrics []index.Metric) ([]string, error) {
 	return rawMetrics, nil
 }
 
-func (ti *Index) MetricMap() map[index.Metric]string {
-	return ti.backend.MetricMap()
+// MetricNames are the names of the metrics in the generation
+func (g *Generation) MetricNames() index.MetricNames {
+	return g.names
 }
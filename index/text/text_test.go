@@ -1,15 +1,18 @@
 package text
 
 import (
-	"sync"
+	"reflect"
+	"regexp/syntax"
 	"testing"
 
 	"github.com/kanatohodets/carbonsearch/index"
 )
 
-var testBackend backendType = BloomBackend
+var testBackend = BloomBackend
 var service = "tekst"
 var textMatchPrefix = service + "-match:"
+var textRegexPrefix = service + "-regex:"
+var textIMatchPrefix = service + "-imatch:"
 
 func TestQuery(t *testing.T) {
 	ti := NewIndex(testBackend, service)
@@ -19,15 +22,12 @@ func TestQuery(t *testing.T) {
 		"monitors.nginx.http.daily",
 	}
 
-	wg := &sync.WaitGroup{}
-	wg.Add(1)
-	ti.Materialize(wg, metrics)
-	wg.Wait()
+	g := ti.Materialize(index.MetricNames(metrics))
 
 	q := index.NewQuery([]string{
 		textMatchPrefix + "nginx",
 	})
-	results, err := ti.Query(q)
+	results, err := g.Query(q)
 	if err != nil {
 		t.Error(err)
 		return
@@ -38,9 +38,9 @@ func TestQuery(t *testing.T) {
 		return
 	}
 
-	hashed := index.HashMetrics(metrics)
-	if results[0] != hashed[2] {
-		t.Errorf("expected %q in search result, got %q", hashed[2], results[0])
+	// the IDs are the positions in the names
+	if results[0] != 2 {
+		t.Errorf("expected %d in search result, got %d", 2, results[0])
 		return
 	}
 
@@ -57,37 +57,34 @@ func TestQuery(t *testing.T) {
 		"kpopbazz",
 	}
 
-	wg = &sync.WaitGroup{}
-	wg.Add(1)
-	in.Materialize(wg, metrics)
-	wg.Wait()
+	g = in.Materialize(index.MetricNames(metrics))
 
 	// bad query
 	query := index.NewQuery([]string{})
-	results, err = in.Query(query)
+	results, err = g.Query(query)
 	if err == nil {
 		t.Errorf("bad query got results instead of error! results: %v", results)
 		return
 	}
 
-	searchTest(t, "zero results", in, []string{"quxx"}, []string{})
-	searchTest(t, "simple", in, []string{"foox"}, []string{"foox", "blorgfoox", "mug_foox_ugh"})
-	searchTest(t, "full long metric name", in, []string{"rose.daffodil.cron"}, []string{"rose.daffodil.cron"})
-	searchTest(t, "intersect, not union", in, []string{"kpop", "bazz"}, []string{"kpopbazz"})
+	searchTest(t, "zero results", g, []string{"quxx"}, []string{})
+	searchTest(t, "simple", g, []string{"foox"}, []string{"foox", "blorgfoox", "mug_foox_ugh"})
+	searchTest(t, "full long metric name", g, []string{"rose.daffodil.cron"}, []string{"rose.daffodil.cron"})
+	searchTest(t, "intersect, not union", g, []string{"kpop", "bazz"}, []string{"kpopbazz"})
 
 	emptyIndex := NewIndex(testBackend, service)
-	searchTest(t, "zero results", emptyIndex, []string{"quxx"}, []string{})
-	searchTest(t, "simple", emptyIndex, []string{"foox"}, []string{})
+	searchTest(t, "zero results", emptyIndex.Current(), []string{"quxx"}, []string{})
+	searchTest(t, "simple", emptyIndex.Current(), []string{"foox"}, []string{})
 }
 
-func searchTest(t *testing.T, testName string, in *Index, searches []string, expectedResults []string) {
+func searchTest(t *testing.T, testName string, g *Generation, searches []string, expectedResults []string) {
 	tags := []string{}
 	for _, search := range searches {
 		tags = append(tags, textMatchPrefix+search)
 	}
 
 	query := index.NewQuery(tags)
-	results, err := in.Query(query)
+	results, err := g.Query(query)
 	if err != nil {
 		t.Errorf("%s query %v returned an error: %v", testName, query, err)
 		return
@@ -98,9 +95,13 @@ func searchTest(t *testing.T, testName string, in *Index, searches []string, exp
 		return
 	}
 
+	ids := map[string]index.Metric{}
+	for id, name := range g.MetricNames() {
+		ids[name] = index.Metric(id)
+	}
 	expectedSet := map[index.Metric]string{}
 	for _, expected := range expectedResults {
-		expectedSet[index.HashMetric(expected)] = expected
+		expectedSet[ids[expected]] = expected
 	}
 
 	for _, result := range results {
@@ -112,7 +113,227 @@ func searchTest(t *testing.T, testName string, in *Index, searches []string, exp
 		delete(expectedSet, result)
 	}
 
-	for hash, metric := range expectedSet {
-		t.Errorf("%s query %v expected to find %v (hash: %v), but it wasn't there", testName, query, metric, hash)
+	for id, metric := range expectedSet {
+		t.Errorf("%s query %v expected to find %v (ID: %v), but it wasn't there", testName, query, metric, id)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	cases := map[string]bool{
+		"nginx":     true,
+		"^monitors": true,
+		"daily$":    true,
+		"^nginx":    false,
+		"$monitors": false,
+		"daily^":    false,
+		"":          false,
+		"^":         false,
+	}
+	for search, expected := range cases {
+		if match(search, "monitors.nginx.http.daily") != expected {
+			t.Errorf("match %q: expected %v, got %v", search, expected, !expected)
+		}
+	}
+}
+
+func TestGlob(t *testing.T) {
+	globTest(t, "servers.*.cpu.user", "servers.host-1.cpu.user", true)
+	globTest(t, "servers.*.cpu.user", "servers.host-1.extra.cpu.user", false)
+	globTest(t, "servers.*", "servers.host-1.cpu.user", false)
+	globTest(t, "servers.host-?.cpu.user", "servers.host-1.cpu.user", true)
+	globTest(t, "servers.host-?.cpu.user", "servers.host-10.cpu.user", false)
+	globTest(t, "servers.host-[12].cpu.user", "servers.host-2.cpu.user", true)
+	globTest(t, "servers.host-[!12].cpu.user", "servers.host-2.cpu.user", false)
+	globTest(t, "servers.*.cpu.{user,system}", "servers.host-1.cpu.system", true)
+	globTest(t, "servers.*.cpu.{user,system}", "servers.host-1.cpu.iowait", false)
+	globTest(t, "servers.{web*,db?}.cpu", "servers.web-lhr.cpu", true)
+	globTest(t, "servers.{web*,db?}.cpu", "servers.db12.cpu", false)
+	globTest(t, "servers.(host)+.cpu", "servers.(host)+.cpu", true)
+
+	for _, bad := range []string{"servers.[ab", "servers.{a,b", "servers.{a,{b}}", "servers.[].cpu"} {
+		_, err := compileGlob(bad)
+		if err == nil {
+			t.Errorf("glob %q: expected a compile error", bad)
+		}
+	}
+}
+
+func globTest(t *testing.T, glob, metric string, expected bool) {
+	re, err := compileGlob(glob)
+	if err != nil {
+		t.Errorf("glob %q: unexpected error: %v", glob, err)
+		return
+	}
+	if re.MatchString(metric) != expected {
+		t.Errorf("glob %q against %q: expected %v, got %v", glob, metric, expected, !expected)
+	}
+}
+
+func TestGlobLiterals(t *testing.T) {
+	cases := map[string][]string{
+		"servers.*.cpu.user":          {"servers.", ".cpu.user"},
+		"servers.host-?.cpu":          {"servers.host-", ".cpu"},
+		"servers.[ab]x.{user,system}": {"servers.", "x."},
+		"*":                           {},
+		"servers.[ab":                 {"servers."},
+	}
+
+	for glob, expected := range cases {
+		literals := globLiterals(glob)
+		if !reflect.DeepEqual(literals, expected) {
+			t.Errorf("glob literals of %q: expected %q, got %q", glob, expected, literals)
+		}
+	}
+}
+
+func TestGlobQuery(t *testing.T) {
+	in := NewIndex(testBackend, service)
+	metrics := []string{
+		"servers.host-1.cpu.user",
+		"servers.host-2.cpu.system",
+		"servers.host-1.mem.free",
+	}
+
+	g := in.Materialize(index.MetricNames(metrics))
+
+	// the bloom query only uses the literal parts, so it's a superset
+	searchTest(t, "glob", g, []string{"servers.*.cpu.{user,system}"}, []string{"servers.host-1.cpu.user", "servers.host-2.cpu.system"})
+
+	query := index.NewQuery([]string{textMatchPrefix + "servers.*.cpu.{user,iowait}"})
+	filtered := in.Filter(query, metrics)
+	if !reflect.DeepEqual(filtered, []string{"servers.host-1.cpu.user"}) {
+		t.Errorf("glob filter: expected only servers.host-1.cpu.user, got %v", filtered)
+	}
+
+	err := in.Validate(textMatchPrefix+"servers.[ab", false)
+	if err == nil {
+		t.Errorf("glob validate: expected an error for an unclosed '['")
+	}
+}
+
+func TestRequiredLiterals(t *testing.T) {
+	cases := map[string][]string{
+		`disk\.sd[a-z]+\.io_time`:  {"disk.sd", ".io_time"},
+		`^servers\.(web|db)\.cpu$`: {"servers.", ".cpu"},
+		`a(bc)d+`:                  {"abc", "d"},
+		`(foo)?bar`:                {"bar"},
+		`(?i)cpu\.user`:            {"cpu.user"},
+		`(?i)CPU\.user`:            {"cpu.user"},
+		`(?i)\x{212A}elvin`:        {"kelvin"},
+		`(?i)ſerver`:               {"server"},
+		`x{2}yz`:                   {"xxyz"},
+	}
+
+	for expr, expected := range cases {
+		re, err := syntax.Parse(expr, syntax.Perl)
+		if err != nil {
+			t.Errorf("required literals of %q: %v", expr, err)
+			continue
+		}
+
+		literals := requiredLiterals(re.Simplify())
+		if literals == nil {
+			literals = []string{}
+		}
+		if !reflect.DeepEqual(literals, expected) {
+			t.Errorf("required literals of %q: expected %q, got %q", expr, expected, literals)
+		}
+	}
+}
+
+func TestRegexQuery(t *testing.T) {
+	in := NewIndex(testBackend, service)
+	metrics := []string{
+		"servers.host-1.disk.sda.io_time",
+		"servers.host-1.disk.sdb1.io_time",
+		"servers.host-1.disk.nvme0.io_time",
+	}
+
+	g := in.Materialize(index.MetricNames(metrics))
+
+	query := index.NewQuery([]string{textRegexPrefix + `disk\.sd[a-z]+\.io_time`})
+	candidates, err := g.Query(query)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	// 'disk.sd' and '.io_time' rule out nvme0 in the index already
+	if len(candidates) != 2 {
+		t.Errorf("regex query: expected 2 candidates, got %v", len(candidates))
+	}
+
+	filtered := in.Filter(query, metrics)
+	if !reflect.DeepEqual(filtered, []string{"servers.host-1.disk.sda.io_time"}) {
+		t.Errorf("regex filter: expected only servers.host-1.disk.sda.io_time, got %v", filtered)
+	}
+
+	err = in.Validate(textRegexPrefix+"disk(", false)
+	if err == nil {
+		t.Errorf("regex validate: expected an error for an unclosed '('")
+	}
+
+	// nothing to look up in the index, unless it only filters
+	err = in.Validate(textRegexPrefix+`sd[a-z]+\.io`, false)
+	if err == nil {
+		t.Errorf("regex validate: expected an error for a regex without a literal long enough to search on")
+	}
+	err = in.Validate(textRegexPrefix+`sd[a-z]+\.io`, true)
+	if err != nil {
+		t.Errorf("regex validate: a negated regex doesn't need a literal to search on, got %v", err)
+	}
+}
+
+func TestCaseInsensitiveQuery(t *testing.T) {
+	in := NewIndex(testBackend, service)
+	metrics := []string{
+		"servers.host-1.CPU.user",
+		"servers.host-2.cpu.user",
+		"servers.host-3.Cpu.user",
+		"servers.host-1.mem.free",
+	}
+
+	g := in.Materialize(index.MetricNames(metrics))
+
+	imatch := index.NewQuery([]string{textIMatchPrefix + "cPu.User"})
+	candidates, err := g.Query(imatch)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(candidates) != 3 {
+		t.Errorf("imatch query: expected 3 candidates, got %v", len(candidates))
+	}
+
+	filtered := in.Filter(imatch, metrics)
+	if !reflect.DeepEqual(filtered, metrics[:3]) {
+		t.Errorf("imatch filter: expected %v, got %v", metrics[:3], filtered)
+	}
+
+	// case-insensitive regular expressions use the folded ngrams too
+	iregex := index.NewQuery([]string{textRegexPrefix + `(?i)host-[12]\.cpu\.USER`})
+	candidates, err = g.Query(iregex)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(candidates) != 3 {
+		t.Errorf("(?i) regex query: expected 3 candidates, got %v", len(candidates))
+	}
+	filtered = in.Filter(iregex, metrics)
+	if !reflect.DeepEqual(filtered, metrics[:2]) {
+		t.Errorf("(?i) regex filter: expected %v, got %v", metrics[:2], filtered)
+	}
+
+	// the same index still serves case sensitive searches
+	match := index.NewQuery([]string{textMatchPrefix + "CPU.user"})
+	filtered = in.Filter(match, metrics)
+	if !reflect.DeepEqual(filtered, []string{"servers.host-1.CPU.user"}) {
+		t.Errorf("match filter: expected only servers.host-1.CPU.user, got %v", filtered)
+	}
+
+	glob := index.NewQuery([]string{textIMatchPrefix + "SERVERS.*.cpu.{user,system}"})
+	filtered = in.Filter(glob, metrics)
+	if !reflect.DeepEqual(filtered, metrics[:3]) {
+		t.Errorf("imatch glob filter: expected %v, got %v", metrics[:3], filtered)
 	}
 }
@@ -0,0 +1,59 @@
+package index
+
+import (
+	"time"
+)
+
+// Trace collects cardinalities and timings while a query runs, so that it's
+// possible to tell which tag or step eliminated everything from a result. All
+// of the methods are safe to call on a nil *Trace, which records nothing:
+// that's the normal, non-explain case.
+//
+// A Trace is not safe for concurrent use.
+type Trace struct {
+	Tags  []TagTrace  `json:"tags"`
+	Steps []StepTrace `json:"steps"`
+}
+
+// TagTrace is how much a single tag matched in an index, before being
+// combined with anything else
+type TagTrace struct {
+	Index   string `json:"index"`
+	Tag     string `json:"tag"`
+	Matched int    `json:"matched"`
+	// what was matched: "joins" for split indexes, "metrics" otherwise
+	Unit string `json:"unit"`
+}
+
+// StepTrace is the size of the result after one step of running a query
+type StepTrace struct {
+	Index string `json:"index,omitempty"`
+	// which part of the query this step belongs to, for steps done by the
+	// database rather than an index
+	Query string        `json:"query,omitempty"`
+	Stage string        `json:"stage"`
+	Count int           `json:"count"`
+	Took  time.Duration `json:"took_ns"`
+}
+
+// Tag records how many joins or metrics a tag matched
+func (t *Trace) Tag(indexName, tag string, matched int, unit string) {
+	if t == nil {
+		return
+	}
+	t.Tags = append(t.Tags, TagTrace{Index: indexName, Tag: tag, Matched: matched, Unit: unit})
+}
+
+// Step records the size of the result after a step that began at start
+func (t *Trace) Step(indexName, query, stage string, count int, start time.Time) {
+	if t == nil {
+		return
+	}
+	t.Steps = append(t.Steps, StepTrace{
+		Index: indexName,
+		Query: query,
+		Stage: stage,
+		Count: count,
+		Took:  time.Since(start),
+	})
+}
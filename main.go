@@ -12,6 +12,7 @@ import (
 	_ "net/http/pprof"
 	"net/url"
 	"os"
+	"path/filepath"
 	"runtime"
 	"runtime/debug"
 	"runtime/pprof"
@@ -25,6 +26,8 @@ import (
 	"github.com/kanatohodets/carbonsearch/consumer/httpapi"
 	"github.com/kanatohodets/carbonsearch/consumer/kafka"
 	"github.com/kanatohodets/carbonsearch/database"
+	"github.com/kanatohodets/carbonsearch/index"
+	"github.com/kanatohodets/carbonsearch/index/text"
 	"github.com/kanatohodets/carbonsearch/util"
 
 	pb2 "github.com/dgryski/carbonzipper/carbonzipperpb"
@@ -50,6 +53,11 @@ var Config = struct {
 	QueryLimit  int    `yaml:"query_limit"`
 	ResultLimit int    `yaml:"result_limit"`
 
+	QueryCacheSize int `yaml:"query_cache_size"`
+	// return the first result_limit metrics of queries that select too many
+	// (in JSON responses), rather than an error
+	TruncateResults bool `yaml:"truncate_results"`
+
 	IndexRotationRate string            `yaml:"index_rotation_rate"`
 	GraphiteHost      string            `yaml:"graphite_host"`
 	Consumers         map[string]string `yaml:"consumers"`
@@ -57,6 +65,22 @@ var Config = struct {
 	FullIndexService string              `yaml:"full_index_service"`
 	TextIndexService string              `yaml:"text_index_service"`
 	SplitIndexes     map[string][]string `yaml:"split_indexes"`
+	// how the split and full indexes store posting lists: raw or compressed
+	PostingsFormat string `yaml:"postings_format"`
+	// how the text index finds candidate metrics: bloom or postings
+	TextIndexBackend string `yaml:"text_index_backend"`
+	// what to do with a string whose hash collides with another's: reject or salt
+	HashCollisions string `yaml:"hash_collisions"`
+	// split index services whose keys can have more than one value per join
+	MultiValuedServices []string `yaml:"multi_valued_services"`
+	// how long things live without being written again, by split index (join
+	// key) and by service. anything not listed lives forever
+	IndexTTLs   map[string]string `yaml:"index_ttls"`
+	ServiceTTLs map[string]string `yaml:"service_ttls"`
+	// where to keep a snapshot of the indexed data, so a restart doesn't have
+	// to wait for the consumers to warm up again
+	SnapshotPath     string `yaml:"snapshot_path"`
+	SnapshotInterval string `yaml:"snapshot_interval"`
 }{
 	Port: 8070,
 
@@ -66,6 +90,8 @@ var Config = struct {
 	ResultLimit: 20000,
 
 	IndexRotationRate: "60s",
+
+	SnapshotInterval: "5m",
 }
 
 var logger mlog.Level
@@ -122,8 +148,8 @@ func makeFindHandler(db *database.Database, stats *util.Stats, virtPrefix string
 		return result, nil
 	}
 
-	handleQuery := func(rawQuery string, query map[string][]string) (pb3.GlobResponse, error) {
-		metrics, err := db.Query(query)
+	handleQuery := func(rawQuery string, query database.Node) (pb3.GlobResponse, error) {
+		metrics, err := db.Evaluate(query)
 		var result pb3.GlobResponse
 		if err != nil {
 			return result, err
@@ -138,6 +164,25 @@ func makeFindHandler(db *database.Database, stats *util.Stats, virtPrefix string
 		return result, nil
 	}
 
+	handlePage := func(rawQuery string, query database.Node, offset, limit int) (findPage, error) {
+		page, err := db.EvaluatePage(query, offset, limit)
+		var result findPage
+		if err != nil {
+			return result, err
+		}
+
+		result.Name = rawQuery
+		result.Matches = make([]*pb3.GlobMatch, 0, len(page.Metrics))
+		for _, metric := range page.Metrics {
+			result.Matches = append(result.Matches, &pb3.GlobMatch{Path: metric, IsLeaf: true})
+		}
+		result.Offset = offset
+		result.Total = page.Total
+		result.Truncated = page.Truncated
+
+		return result, nil
+	}
+
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		uri, _ := url.ParseRequestURI(req.URL.RequestURI())
 		uriQuery := uri.Query()
@@ -151,6 +196,21 @@ func makeFindHandler(db *database.Database, stats *util.Stats, virtPrefix string
 			return
 		}
 
+		rawQuery := queries[0]
+		if !strings.HasPrefix(rawQuery, virtPrefix) {
+			err := fmt.Errorf("main: the query is not a valid virtual metric (must start with %q): %s", virtPrefix, rawQuery)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		trimmedQuery := strings.TrimPrefix(rawQuery, virtPrefix)
+
+		// explanations are always JSON, so 'format' doesn't matter
+		if uriQuery.Get("explain") == "1" {
+			writeExplanation(w, db, trimmedQuery)
+			return
+		}
+
 		formats := uriQuery["format"]
 		if len(formats) != 1 {
 			err := fmt.Errorf("req validation: there must be exactly one 'format' url param")
@@ -165,14 +225,20 @@ func makeFindHandler(db *database.Database, stats *util.Stats, virtPrefix string
 			return
 		}
 
-		rawQuery := queries[0]
-		if !strings.HasPrefix(rawQuery, virtPrefix) {
-			err := fmt.Errorf("main: the query is not a valid virtual metric (must start with %q): %s", virtPrefix, rawQuery)
+		offset, limit, paged, err := parsePagination(uriQuery)
+		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		trimmedQuery := strings.TrimPrefix(rawQuery, virtPrefix)
+		// protobuf responses have nowhere to say that they were truncated, so
+		// those callers get an error for queries that select too many metrics
+		if paged && format != "json" {
+			err := fmt.Errorf("main: 'limit' and 'offset' are only supported with format=json")
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		truncate := format == "json" && (paged || Config.TruncateResults)
 
 		var result pb3.GlobResponse
 		// query = serv*
@@ -181,6 +247,8 @@ func makeFindHandler(db *database.Database, stats *util.Stats, virtPrefix string
 		// query = servers-stat*
 		// query = servers-status:*
 		// query = servers-status:live.*
+		// a glob anywhere else is a search: servers-hw:dell*.servers-status:live
+		// globs in the last tag need quoting to be a search: servers-hw:<dell*>
 		if strings.HasSuffix(trimmedQuery, "*") {
 			var err error
 			result, err = handleAutocomplete(rawQuery, trimmedQuery)
@@ -190,13 +258,30 @@ func makeFindHandler(db *database.Database, stats *util.Stats, virtPrefix string
 			}
 			logger.Logf("autocomplete: %q returned %v options in %v", trimmedQuery, len(result.Matches), time.Since(start))
 		} else {
-			queryTags, err := db.ParseQuery(trimmedQuery)
+			query, err := db.Parse(trimmedQuery)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
 
-			result, err = handleQuery(rawQuery, queryTags)
+			if truncate {
+				page, err := handlePage(rawQuery, query, offset, limit)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				logger.Logf("search: %q returned %v of %v metrics in %v", trimmedQuery, len(page.Matches), page.Total, time.Since(start))
+
+				w.Header().Set("Content-Type", "application/json")
+				enc := json.NewEncoder(w)
+				err = enc.Encode(page)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+				}
+				return
+			}
+
+			result, err = handleQuery(rawQuery, query)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
@@ -242,6 +327,71 @@ func makeFindHandler(db *database.Database, stats *util.Stats, virtPrefix string
 	})
 }
 
+// findPage is the JSON response for a search in truncation mode: a sorted
+// slice of the results, and how many there were in total
+type findPage struct {
+	Name      string           `json:"name"`
+	Matches   []*pb3.GlobMatch `json:"matches"`
+	Offset    int              `json:"offset"`
+	Total     int              `json:"total"`
+	Truncated bool             `json:"truncated"`
+}
+
+// parsePagination reads the 'offset' and 'limit' url params. The boolean
+// result is true if either was given.
+func parsePagination(uriQuery url.Values) (int, int, bool, error) {
+	offset, limit := 0, 0
+	paged := false
+	if rawOffset, ok := uriQuery["offset"]; ok {
+		var err error
+		offset, err = strconv.Atoi(rawOffset[0])
+		if err != nil || offset < 0 || len(rawOffset) != 1 {
+			return 0, 0, false, fmt.Errorf("req validation: 'offset' must be given once, as a number 0 or larger")
+		}
+		paged = true
+	}
+
+	if rawLimit, ok := uriQuery["limit"]; ok {
+		var err error
+		limit, err = strconv.Atoi(rawLimit[0])
+		if err != nil || limit < 1 || len(rawLimit) != 1 {
+			return 0, 0, false, fmt.Errorf("req validation: 'limit' must be given once, as a number 1 or larger")
+		}
+		paged = true
+	}
+
+	return offset, limit, paged, nil
+}
+
+func makeExplainHandler(db *database.Database, stats *util.Stats, virtPrefix string) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		queries := req.URL.Query()["query"]
+		if len(queries) != 1 {
+			err := fmt.Errorf("req validation: there must be exactly one 'query' url param")
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		rawQuery := queries[0]
+		if !strings.HasPrefix(rawQuery, virtPrefix) {
+			err := fmt.Errorf("main: the query is not a valid virtual metric (must start with %q): %s", virtPrefix, rawQuery)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		writeExplanation(w, db, strings.TrimPrefix(rawQuery, virtPrefix))
+	})
+}
+
+func writeExplanation(w http.ResponseWriter, db *database.Database, query string) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	err := enc.Encode(db.Explain(query))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
 func makeTocHandler(db *database.Database, stats *util.Stats, virtPrefix string) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
@@ -253,6 +403,17 @@ func makeTocHandler(db *database.Database, stats *util.Stats, virtPrefix string)
 	})
 }
 
+func makeLinksHandler(db *database.Database, stats *util.Stats, virtPrefix string) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		err := enc.Encode(db.Links())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
 func makeMetricListHandler(db *database.Database, stats *util.Stats, virtPrefix string) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
@@ -282,6 +443,14 @@ func createMux(db *database.Database, stats *util.Stats, virtPrefix string) *htt
 		),
 	)
 
+	mux.Handle("/admin/explain/",
+		gziphandler.GzipHandler(
+			loggingHandler(
+				httputil.TrackConnections(makeExplainHandler(db, stats, virtPrefix)),
+			),
+		),
+	)
+
 	mux.Handle("/admin/toc/",
 		gziphandler.GzipHandler(
 			loggingHandler(
@@ -290,6 +459,14 @@ func createMux(db *database.Database, stats *util.Stats, virtPrefix string) *htt
 		),
 	)
 
+	mux.Handle("/admin/links/",
+		gziphandler.GzipHandler(
+			loggingHandler(
+				httputil.TrackConnections(makeLinksHandler(db, stats, virtPrefix)),
+			),
+		),
+	)
+
 	mux.Handle("/admin/metric_list/",
 		gziphandler.GzipHandler(
 			loggingHandler(
@@ -394,9 +571,20 @@ func main() {
 		hostname = strings.Replace(hostname, ".", "_", -1)
 
 		graphite.Register(fmt.Sprintf("carbon.search.%s.custom_messages", hostname), stats.CustomMessages)
+		graphite.Register(fmt.Sprintf("carbon.search.%s.delete_messages", hostname), stats.DeleteMessages)
+		graphite.Register(fmt.Sprintf("carbon.search.%s.expired_metrics", hostname), stats.ExpiredMetrics)
+		graphite.Register(fmt.Sprintf("carbon.search.%s.expired_tags", hostname), stats.ExpiredTags)
+		graphite.Register(fmt.Sprintf("carbon.search.%s.expired_links", hostname), stats.ExpiredLinks)
+		graphite.Register(fmt.Sprintf("carbon.search.%s.snapshots_written", hostname), stats.SnapshotsWritten)
+		graphite.Register(fmt.Sprintf("carbon.search.%s.snapshot_errors", hostname), stats.SnapshotErrors)
+		graphite.Register(fmt.Sprintf("carbon.search.%s.hash_collisions", hostname), stats.HashCollisions)
 		graphite.Register(fmt.Sprintf("carbon.search.%s.metric_indexed", hostname), stats.MetricsIndexed)
 		graphite.Register(fmt.Sprintf("carbon.search.%s.metric_messages", hostname), stats.MetricMessages)
 		graphite.Register(fmt.Sprintf("carbon.search.%s.requests", hostname), stats.QueriesHandled)
+		graphite.Register(fmt.Sprintf("carbon.search.%s.query_cache_hits", hostname), stats.QueryCacheHits)
+		graphite.Register(fmt.Sprintf("carbon.search.%s.query_cache_misses", hostname), stats.QueryCacheMisses)
+		graphite.Register(fmt.Sprintf("carbon.search.%s.query_cache_evictions", hostname), stats.QueryCacheEvictions)
+		graphite.Register(fmt.Sprintf("carbon.search.%s.query_cache_coalesced", hostname), stats.QueryCacheCoalesced)
 		graphite.Register(fmt.Sprintf("carbon.search.%s.tag_indexed", hostname), stats.TagsIndexed)
 		graphite.Register(fmt.Sprintf("carbon.search.%s.tag_messages", hostname), stats.TagMessages)
 		graphite.Register(fmt.Sprintf("carbon.search.%s.uptime", hostname), stats.Uptime)
@@ -444,6 +632,46 @@ func main() {
 		Config.SplitIndexes,
 		stats,
 	)
+	db.EnableQueryCache(Config.QueryCacheSize)
+	postingsFormat, err := index.ParsePostingsFormat(Config.PostingsFormat)
+	if err != nil {
+		printErrorAndExit(1, "config error: 'postings_format': %s", err)
+	}
+	db.SetPostingsFormat(postingsFormat)
+	textBackend, err := text.ParseBackend(Config.TextIndexBackend)
+	if err != nil {
+		printErrorAndExit(1, "config error: 'text_index_backend': %s", err)
+	}
+	db.SetTextBackend(textBackend)
+	collisionPolicy, err := database.ParseCollisionPolicy(Config.HashCollisions)
+	if err != nil {
+		printErrorAndExit(1, "config error: 'hash_collisions': %s", err)
+	}
+	db.SetCollisionPolicy(collisionPolicy)
+	err = db.EnableMultiValuedServices(Config.MultiValuedServices)
+	if err != nil {
+		printErrorAndExit(1, "config error: 'multi_valued_services': %s", err)
+	}
+	err = db.EnableExpiry(parseTTLs("index_ttls", Config.IndexTTLs), parseTTLs("service_ttls", Config.ServiceTTLs))
+	if err != nil {
+		printErrorAndExit(1, "config error: %s", err)
+	}
+
+	// the snapshot has to be loaded before the consumers start writing. during
+	// a graceful restart the previous process hands over its database instead
+	resumePositions, warmFromSnapshot := receiveHandoff(db)
+	if !warmFromSnapshot && Config.SnapshotPath != "" {
+		snapshotStart := time.Now()
+		resumePositions, err = db.LoadSnapshotFile(Config.SnapshotPath)
+		if err == nil {
+			warmFromSnapshot = true
+			logger.Logf("loaded snapshot %q in %v", Config.SnapshotPath, time.Since(snapshotStart))
+		} else if os.IsNotExist(err) {
+			logger.Logf("no snapshot at %q yet, warming up from the consumers", Config.SnapshotPath)
+		} else {
+			logger.Logf("not using snapshot %q, warming up from the consumers: %v", Config.SnapshotPath, err)
+		}
+	}
 
 	constructors := map[string]func(string) (consumer.Consumer, error){
 		"kafka": func(confPath string) (consumer.Consumer, error) {
@@ -457,6 +685,9 @@ func main() {
 	}
 
 	consumers := []consumer.Consumer{}
+	// consumers that could have resumed from the snapshot, but it had no
+	// position for them
+	unresumed := []consumer.Consumer{}
 	for consumerName, consumerConfigPath := range Config.Consumers {
 		constructor, ok := constructors[consumerName]
 		if !ok {
@@ -467,6 +698,9 @@ func main() {
 			printErrorAndExit(1, "could not create new %s consumer: %s", consumerName, err)
 		}
 
+		if warmFromSnapshot && !resumeConsumer(consumer, resumePositions) {
+			unresumed = append(unresumed, consumer)
+		}
 		err = consumer.Start(db)
 		if err != nil {
 			printErrorAndExit(1, "could not start %s consumer: %s", consumerName, err)
@@ -480,6 +714,11 @@ func main() {
 		printErrorAndExit(1, "config index_rotation_rate %q cannot be parsed as a duration. Please check https://golang.org/pkg/time/#ParseDuration for valid expressions", Config.IndexRotationRate)
 	}
 
+	snapshotInterval, err := time.ParseDuration(Config.SnapshotInterval)
+	if err != nil || snapshotInterval <= 0 {
+		printErrorAndExit(1, "config snapshot_interval %q cannot be parsed as a positive duration. Please check https://golang.org/pkg/time/#ParseDuration for valid expressions", Config.SnapshotInterval)
+	}
+
 	httputil.PublishTrackedConnections("httptrack")
 	expvar.Publish("requestBuckets", expvar.Func(renderTimeBuckets))
 	expvar.Publish("Config", expvar.Func(func() interface{} { return Config }))
@@ -487,9 +726,17 @@ func main() {
 	warmStart := time.Now()
 	if *coldStart {
 		logger.Logln("skipping warmup period: -coldStart specified")
+	} else if warmFromSnapshot && len(unresumed) == 0 {
+		logger.Logln("skipping warmup period: the database came from a snapshot or the previous process")
 	} else {
+		waitFor := consumers
+		if warmFromSnapshot {
+			// the rest are already caught up
+			waitFor = unresumed
+			logger.Logln("the database came from a snapshot or the previous process, but some consumers are starting from their configured offsets. waiting for them to warm up")
+		}
 		wg := &sync.WaitGroup{}
-		for _, consumer := range consumers {
+		for _, consumer := range waitFor {
 			wg.Add(1)
 			go consumer.WaitUntilWarm(wg)
 		}
@@ -513,6 +760,24 @@ func main() {
 		}
 	}()
 
+	stopSnapshots := make(chan bool)
+	if Config.SnapshotPath != "" {
+		go func() {
+			for {
+				select {
+				case <-stopSnapshots:
+					return
+				case <-time.After(snapshotInterval):
+					// positions first: the snapshot has everything before them
+					err := db.SnapshotToFile(Config.SnapshotPath, consumerPositions(consumers))
+					if err != nil {
+						logger.Logf("snapshot failed: %v", err)
+					}
+				}
+			}
+		}()
+	}
+
 	portStr := fmt.Sprintf(":%d", Config.Port)
 	expvar.NewString("BuildVersion").Set(BuildVersion)
 	logger.Logln("Starting carbonsearch", BuildVersion)
@@ -527,6 +792,27 @@ func main() {
 			}
 		}
 		stopMaterialize <- true
+		if Config.SnapshotPath != "" {
+			stopSnapshots <- true
+		}
+		// next to the snapshot, if there is one: the data directory is
+		// likely less shared than the temporary directory
+		handoffDir := ""
+		if Config.SnapshotPath != "" {
+			handoffDir = filepath.Dir(Config.SnapshotPath)
+		}
+		err := offerHandoff(db, consumers, handoffDir)
+		if err != nil && Config.SnapshotPath != "" {
+			// the new process loads this one instead, so it has everything
+			// up to now
+			logger.Logf("the new process will load a snapshot instead: %v", err)
+			err = db.SnapshotToFile(Config.SnapshotPath, consumerPositions(consumers))
+			if err != nil {
+				logger.Logf("snapshot before restarting failed: %v", err)
+			}
+		} else if err != nil {
+			logger.Logf("the new process will have to warm up by itself: %v", err)
+		}
 		debug.FreeOSMemory()
 		return nil
 	}
@@ -549,6 +835,18 @@ func main() {
 	}
 }
 
+func parseTTLs(configKey string, rawTTLs map[string]string) map[string]time.Duration {
+	ttls := make(map[string]time.Duration, len(rawTTLs))
+	for name, rawTTL := range rawTTLs {
+		ttl, err := time.ParseDuration(rawTTL)
+		if err != nil {
+			printErrorAndExit(1, "config %s: the TTL for %q (%q) cannot be parsed as a duration. Please check https://golang.org/pkg/time/#ParseDuration for valid expressions", configKey, name, rawTTL)
+		}
+		ttls[name] = ttl
+	}
+	return ttls
+}
+
 func printErrorAndExit(code int, format string, values ...interface{}) {
 	fmt.Fprintf(os.Stderr, "ERROR: %s\n", fmt.Sprintf(format, values...))
 	fmt.Fprintln(os.Stderr)
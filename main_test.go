@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
@@ -14,8 +15,9 @@ import (
 	"github.com/kanatohodets/carbonsearch/util"
 )
 
+var stats = util.InitStats()
+
 func TestFindHandler(t *testing.T) {
-	stats := util.InitStats()
 	initTimeBuckets(Config.Buckets + 1)
 	db := database.New(
 		100,
@@ -34,6 +36,14 @@ func TestFindHandler(t *testing.T) {
 	pb2FindTest(t, mux)
 	pb3FindTest(t, mux)
 	jsonFindTest(t, mux)
+	jsonGlobFindTest(t, mux)
+	jsonBooleanFindTest(t, mux)
+	jsonPageFindTest(t, mux, "limit=1", `"matches":[{"path":"host.foohost_prod_example_com.cpu.loadavg","isLeaf":true}],"offset":0,"total":1,"truncated":false}`)
+	jsonPageFindTest(t, mux, "offset=1", `"matches":[],"offset":1,"total":1,"truncated":true}`)
+	protobufPageFindTest(t, mux)
+	badRegexFindTest(t, mux)
+	explainTest(t, mux, "/admin/explain/?query=virt.v1.*.servers-status:live")
+	explainTest(t, mux, "/metrics/find/?query=virt.v1.*.servers-status:live&explain=1")
 }
 
 func pb2FindTest(t *testing.T, mux *http.ServeMux) {
@@ -112,6 +122,102 @@ func jsonFindTest(t *testing.T, mux *http.ServeMux) {
 	}
 }
 
+// a trailing '*' asks for autocompletion, so a glob at the end of a query
+// must be quoted
+func jsonGlobFindTest(t *testing.T, mux *http.ServeMux) {
+	recorder := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/metrics/find/?query=virt.v1.*.servers-status:<li*>&format=json", nil)
+	if err != nil {
+		t.Errorf("JSON glob test: could not create http request: %v", err)
+		return
+	}
+
+	mux.ServeHTTP(recorder, req)
+	expected := `{"name":"virt.v1.*.servers-status:\u003cli*\u003e","matches":[{"path":"host.foohost_prod_example_com.cpu.loadavg","isLeaf":true}]}` + "\n"
+	if expected != string(recorder.Body.Bytes()) {
+		t.Errorf("JSON glob test: bad response! expected %q, got %q", expected, string(recorder.Body.Bytes()))
+	}
+}
+
+func jsonBooleanFindTest(t *testing.T, mux *http.ServeMux) {
+	recorder := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/metrics/find/?query=virt.v1.*.(servers-status:live|servers-status:borked).!servers-dc:lhr&format=json", nil)
+	if err != nil {
+		t.Errorf("JSON boolean test: could not create http request: %v", err)
+		return
+	}
+
+	mux.ServeHTTP(recorder, req)
+	expected := `{"name":"virt.v1.*.(servers-status:live|servers-status:borked).!servers-dc:lhr","matches":[{"path":"host.foohost_prod_example_com.cpu.loadavg","isLeaf":true}]}` + "\n"
+	if expected != string(recorder.Body.Bytes()) {
+		t.Errorf("JSON boolean test: bad response! expected %q, got %q", expected, string(recorder.Body.Bytes()))
+	}
+}
+
+func jsonPageFindTest(t *testing.T, mux *http.ServeMux, params, expectedTail string) {
+	recorder := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/metrics/find/?query=virt.v1.*.servers-status:live&format=json&"+params, nil)
+	if err != nil {
+		t.Errorf("JSON page test: could not create http request: %v", err)
+		return
+	}
+
+	mux.ServeHTTP(recorder, req)
+	expected := `{"name":"virt.v1.*.servers-status:live",` + expectedTail + "\n"
+	if expected != string(recorder.Body.Bytes()) {
+		t.Errorf("JSON page test: %v: bad response! expected %q, got %q", params, expected, string(recorder.Body.Bytes()))
+	}
+}
+
+func protobufPageFindTest(t *testing.T, mux *http.ServeMux) {
+	recorder := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/metrics/find/?query=virt.v1.*.servers-status:live&format=protobuf&limit=1", nil)
+	if err != nil {
+		t.Errorf("protobuf page test: could not create http request: %v", err)
+		return
+	}
+
+	mux.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("protobuf page test: expected status %d, got %d: %q", http.StatusBadRequest, recorder.Code, string(recorder.Body.Bytes()))
+	}
+}
+
+func badRegexFindTest(t *testing.T, mux *http.ServeMux) {
+	recorder := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/metrics/find/?query=virt.v1.*.servers-status:live.text-regex:<loadavg(>&format=json", nil)
+	if err != nil {
+		t.Errorf("bad regex test: could not create http request: %v", err)
+		return
+	}
+
+	mux.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("bad regex test: expected status %d, got %d: %q", http.StatusBadRequest, recorder.Code, string(recorder.Body.Bytes()))
+	}
+}
+
+func explainTest(t *testing.T, mux *http.ServeMux, url string) {
+	recorder := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Errorf("explain test: could not create http request: %v", err)
+		return
+	}
+
+	mux.ServeHTTP(recorder, req)
+	var explanation database.Explanation
+	err = json.Unmarshal(recorder.Body.Bytes(), &explanation)
+	if err != nil {
+		t.Errorf("explain test: %v: could not decode response %q: %v", url, string(recorder.Body.Bytes()), err)
+		return
+	}
+
+	if explanation.Count != 1 || len(explanation.Trace.Tags) != 1 || explanation.Trace.Tags[0].Matched != 1 {
+		t.Errorf("explain test: %v: bad explanation: %+v", url, explanation)
+	}
+}
+
 func populateDb(db *database.Database) {
 	metrics := &m.KeyMetric{
 		Key:   "fqdn",
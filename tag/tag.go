@@ -2,6 +2,7 @@ package tag
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 )
 
@@ -10,6 +11,8 @@ type Key uint64
 
 const serviceToKey = "-"
 const keyToValue = ":"
+const negation = "!"
+const globCharacters = "*?["
 
 // Parse separates a "service-key:value" tag into "service", "key", and "value". If the tag is malformed an error is returned.
 func Parse(tag string) (string, string, string, error) {
@@ -90,3 +93,130 @@ func NeedsValue(partialTag string) bool {
 	firstKeyToValue := strings.Index(partialTag, keyToValue)
 	return firstKeyToValue == len(partialTag)-1
 }
+
+// Expand performs graphite-style alternation on a tag, so that
+// "servers-dc:{lhr,ams}" becomes ["servers-dc:lhr", "servers-dc:ams"].
+// Multiple groups in a single tag expand to every combination, up to limit
+// tags. Nested groups are not supported. A tag without any alternation is
+// returned as-is.
+func Expand(tag string, limit int) ([]string, error) {
+	openBrace := strings.IndexRune(tag, '{')
+	closeBrace := strings.IndexRune(tag, '}')
+	if openBrace == -1 && closeBrace == -1 {
+		return []string{tag}, nil
+	}
+
+	if openBrace == -1 || closeBrace < openBrace {
+		return nil, fmt.Errorf("tag: %q has unbalanced alternation braces", tag)
+	}
+
+	if nested := strings.IndexRune(tag[openBrace+1:closeBrace], '{'); nested != -1 {
+		return nil, fmt.Errorf("tag: %q has nested alternation braces, which are not supported", tag)
+	}
+
+	head := tag[:openBrace]
+	alternatives := strings.Split(tag[openBrace+1:closeBrace], ",")
+	tails, err := Expand(tag[closeBrace+1:], limit)
+	if err != nil {
+		return nil, err
+	}
+
+	// checked before building them, so that a short tag with a lot of groups
+	// can't ask for millions
+	if len(alternatives)*len(tails) > limit {
+		return nil, fmt.Errorf("tag: %q expands to more than %d tags", tag, limit)
+	}
+
+	expanded := make([]string, 0, len(alternatives)*len(tails))
+	seen := map[string]struct{}{}
+	for _, alternative := range alternatives {
+		for _, tail := range tails {
+			candidate := head + alternative + tail
+			if _, ok := seen[candidate]; ok {
+				continue
+			}
+			seen[candidate] = struct{}{}
+			expanded = append(expanded, candidate)
+		}
+	}
+	return expanded, nil
+}
+
+// IsGlob returns true if the value portion of the tag is a glob pattern, as
+// in: servers-hw:dell*
+func IsGlob(tag string) bool {
+	_, _, v, err := Parse(tag)
+	if err != nil {
+		return false
+	}
+	return strings.ContainsAny(v, globCharacters)
+}
+
+// IsComparison returns true if the tag value starts with a numeric comparison
+// operator, as in: servers-num_cpus:>=16
+func IsComparison(tag string) bool {
+	_, _, v, err := Parse(tag)
+	if err != nil {
+		return false
+	}
+	_, ok, _ := ParseComparison(v)
+	return ok
+}
+
+// HasAlternation returns true if the tag contains a graphite-style
+// alternation group, as in: servers-dc:{lhr,ams}
+func HasAlternation(tag string) bool {
+	return strings.ContainsAny(tag, "{}")
+}
+
+// ParseNegation strips the negation prefix from a query tag, as in:
+// !servers-state:maint. The boolean result is true if the tag was negated.
+func ParseNegation(tag string) (string, bool) {
+	if strings.HasPrefix(tag, negation) {
+		return strings.TrimPrefix(tag, negation), true
+	}
+	return tag, false
+}
+
+// comparison operators, longest first so that '>=' isn't mistaken for '>'
+var comparisonOperators = []string{">=", "<=", ">", "<"}
+
+// Comparison is a numeric comparison on a tag value, as in:
+// servers-num_cpus:>=16
+type Comparison struct {
+	Operator string
+	Operand  float64
+}
+
+// Matches returns true if n satisfies the comparison
+func (c Comparison) Matches(n float64) bool {
+	switch c.Operator {
+	case ">=":
+		return n >= c.Operand
+	case "<=":
+		return n <= c.Operand
+	case ">":
+		return n > c.Operand
+	case "<":
+		return n < c.Operand
+	}
+	return false
+}
+
+// ParseComparison checks whether a tag value is a numeric comparison, like
+// '>=16' or '<128'. The boolean result is false if the value doesn't start
+// with a comparison operator; an error is returned if it does, but the
+// operand is not a number.
+func ParseComparison(value string) (Comparison, bool, error) {
+	for _, operator := range comparisonOperators {
+		if strings.HasPrefix(value, operator) {
+			rawOperand := strings.TrimPrefix(value, operator)
+			operand, err := strconv.ParseFloat(rawOperand, 64)
+			if err != nil {
+				return Comparison{}, true, fmt.Errorf("tag: %q is a comparison, but %q is not a number", value, rawOperand)
+			}
+			return Comparison{Operator: operator, Operand: operand}, true, nil
+		}
+	}
+	return Comparison{}, false, nil
+}
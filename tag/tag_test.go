@@ -1,6 +1,7 @@
 package tag
 
 import (
+	"reflect"
 	"testing"
 )
 
@@ -146,3 +147,127 @@ func TestNeedsValue(t *testing.T) {
 		}
 	}
 }
+
+func TestExpand(t *testing.T) {
+	cases := map[string][]string{
+		"server-state:live":            {"server-state:live"},
+		"server-dc:{lhr,ams}":          {"server-dc:lhr", "server-dc:ams"},
+		"server-dc:{lhr}":              {"server-dc:lhr"},
+		"server-dc:{lhr,lhr}":          {"server-dc:lhr"},
+		"server-{dc,region}:{lhr,ams}": {"server-dc:lhr", "server-dc:ams", "server-region:lhr", "server-region:ams"},
+		"server-dc:us_{east,west}_1":   {"server-dc:us_east_1", "server-dc:us_west_1"},
+		"text-match:foo.{bar,baz}.qux": {"text-match:foo.bar.qux", "text-match:foo.baz.qux"},
+	}
+
+	for input, expected := range cases {
+		expanded, err := Expand(input, 10)
+		if err != nil {
+			t.Errorf("tag Expand test: %q failed to expand: %v", input, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(expanded, expected) {
+			t.Errorf("tag Expand test: %q expanded to %q, expected %q", input, expanded, expected)
+		}
+	}
+
+	invalidCases := []string{
+		"server-dc:{lhr,ams",
+		"server-dc:lhr,ams}",
+		"server-dc:}lhr,ams{",
+		"server-dc:{lhr,{ams,fra}}",
+		// 3^3 = 27 tags, over the limit
+		"server-{a,b,c}{d,e,f}:{g,h,i}",
+	}
+
+	for _, invalid := range invalidCases {
+		expanded, err := Expand(invalid, 10)
+		if err == nil {
+			t.Errorf("tag Expand test: %q failed to error while expanding. got: %q", invalid, expanded)
+		}
+	}
+}
+
+func TestParseNegation(t *testing.T) {
+	cases := map[string][]interface{}{
+		"server-state:live":   {"server-state:live", false},
+		"!server-state:live":  {"server-state:live", true},
+		"server-state:!live":  {"server-state:!live", false},
+		"!!server-state:live": {"!server-state:live", true},
+	}
+	for test, expected := range cases {
+		stripped, negated := ParseNegation(test)
+		if stripped != expected[0] || negated != expected[1] {
+			t.Errorf("tag ParseNegation test: %q got (%q, %v), expected (%q, %v)", test, stripped, negated, expected[0], expected[1])
+		}
+	}
+}
+
+func TestParseComparison(t *testing.T) {
+	cases := map[string]Comparison{
+		">=16":  {Operator: ">=", Operand: 16},
+		"<=16":  {Operator: "<=", Operand: 16},
+		">16":   {Operator: ">", Operand: 16},
+		"<0.5":  {Operator: "<", Operand: 0.5},
+		">=-10": {Operator: ">=", Operand: -10},
+	}
+	for test, expected := range cases {
+		comparison, ok, err := ParseComparison(test)
+		if err != nil || !ok {
+			t.Errorf("tag ParseComparison test: %q failed to parse as a comparison: %v", test, err)
+			continue
+		}
+		if comparison != expected {
+			t.Errorf("tag ParseComparison test: %q got %v, expected %v", test, comparison, expected)
+		}
+	}
+
+	for _, notComparison := range []string{"16", "live", "=16"} {
+		_, ok, err := ParseComparison(notComparison)
+		if ok || err != nil {
+			t.Errorf("tag ParseComparison test: %q is not a comparison, but got (%v, %v)", notComparison, ok, err)
+		}
+	}
+
+	for _, invalid := range []string{">=", "<lots", ">=16gb"} {
+		_, ok, err := ParseComparison(invalid)
+		if !ok || err == nil {
+			t.Errorf("tag ParseComparison test: %q failed to error while parsing", invalid)
+		}
+	}
+}
+
+func TestIsComparison(t *testing.T) {
+	cases := map[string]bool{
+		"servers-num_cpus:>=16": true,
+		"servers-ram_gb:<128":   true,
+		"servers-ram_gb:<lots":  true,
+		"servers-ram_gb:128":    false,
+		"servers-ram_gb":        false,
+	}
+	for test, expected := range cases {
+		if IsComparison(test) != expected {
+			t.Errorf("tag IsComparison test: %q should be %v", test, expected)
+		}
+	}
+}
+
+func TestComparisonMatches(t *testing.T) {
+	cases := []struct {
+		comparison Comparison
+		n          float64
+		expected   bool
+	}{
+		{Comparison{">=", 16}, 16, true},
+		{Comparison{">", 16}, 16, false},
+		{Comparison{"<=", 16}, 16, true},
+		{Comparison{"<", 16}, 16, false},
+		{Comparison{"<", 128}, 64, true},
+		{Comparison{">=", 16}, 8, false},
+	}
+	for _, c := range cases {
+		if c.comparison.Matches(c.n) != c.expected {
+			t.Errorf("tag Comparison.Matches test: %v on %v should be %v", c.comparison, c.n, c.expected)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package util
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/dgryski/go-sip13"
+)
+
+// Hasher hashes the strings of one domain, like tags or join keys. A string
+// that collided with another string of the domain can be given a salted hash,
+// which Hash returns for it from then on. Salts are per Hasher, so each
+// database has its own.
+type Hasher struct {
+	mut    sync.Mutex
+	salted atomic.Value //map[string]uint64, copied on write: salting is rare
+}
+
+func NewHasher() *Hasher {
+	h := &Hasher{}
+	h.salted.Store(map[string]uint64{})
+	return h
+}
+
+// Hash hashes a string. A nil Hasher hashes it without any salt.
+func (h *Hasher) Hash(data string) uint64 {
+	if h != nil {
+		if hash, ok := h.salted.Load().(map[string]uint64)[data]; ok {
+			return hash
+		}
+	}
+	return HashStr64(data)
+}
+
+// Snapshot returns a Hasher that hashes the way this one does now, whatever
+// is salted or unsalted here later
+func (h *Hasher) Snapshot() *Hasher {
+	snapshot := &Hasher{}
+	// never changed in place, so it can be shared
+	snapshot.salted.Store(h.salted.Load())
+	return snapshot
+}
+
+// Salt rehashes a string with increasing salts until free accepts the hash.
+// It doesn't change what Hash returns for the string: that's SetSalted.
+func (h *Hasher) Salt(data string, free func(uint64) bool) uint64 {
+	for salt := uint64(1); ; salt++ {
+		hash := sip13.Sum64Str(salt, 0, data)
+		if free(hash) {
+			return hash
+		}
+	}
+}
+
+// SetSalted makes a string hash to the given value from now on
+func (h *Hasher) SetSalted(data string, hash uint64) {
+	h.update(func(salted map[string]uint64) {
+		salted[data] = hash
+	})
+}
+
+// Unsalt makes a string hash to its plain hash again
+func (h *Hasher) Unsalt(data string) {
+	if _, ok := h.salted.Load().(map[string]uint64)[data]; !ok {
+		return
+	}
+	h.update(func(salted map[string]uint64) {
+		delete(salted, data)
+	})
+}
+
+func (h *Hasher) update(change func(map[string]uint64)) {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+
+	old := h.salted.Load().(map[string]uint64)
+	salted := make(map[string]uint64, len(old)+1)
+	for k, v := range old {
+		salted[k] = v
+	}
+	change(salted)
+	h.salted.Store(salted)
+}
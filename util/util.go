@@ -21,9 +21,32 @@ type Stats struct {
 	FullIndexTags    *expvar.Int
 	FullIndexMetrics *expvar.Int
 
+	LinkMessages *expvar.Int
+
+	DeleteMessages *expvar.Int
+
+	// what expired: join->metric and custom associations, tag assignments
+	// and links
+	ExpiredMetrics *expvar.Int
+	ExpiredTags    *expvar.Int
+	ExpiredLinks   *expvar.Int
+
+	SnapshotsWritten *expvar.Int
+	SnapshotErrors   *expvar.Int
+
+	// tags, join keys and service keys that hashed to the same value as a
+	// different one
+	HashCollisions *expvar.Int
+
 	QueriesHandled     *expvar.Int
 	QueryTagsByService *expvar.Map
 
+	QueryCacheHits      *expvar.Int
+	QueryCacheMisses    *expvar.Int
+	QueryCacheEvictions *expvar.Int
+	// queries that waited for an identical query that was already running
+	QueryCacheCoalesced *expvar.Int
+
 	Progress *expvar.Map
 
 	ServicesByIndex *expvar.Map
@@ -49,9 +72,27 @@ func InitStats() *Stats {
 		FullIndexTags:    expvar.NewInt("FullIndexTags"),
 		FullIndexMetrics: expvar.NewInt("FullIndexMetrics"),
 
+		LinkMessages: expvar.NewInt("LinkMessages"),
+
+		DeleteMessages: expvar.NewInt("DeleteMessages"),
+
+		ExpiredMetrics: expvar.NewInt("ExpiredMetrics"),
+		ExpiredTags:    expvar.NewInt("ExpiredTags"),
+		ExpiredLinks:   expvar.NewInt("ExpiredLinks"),
+
+		SnapshotsWritten: expvar.NewInt("SnapshotsWritten"),
+		SnapshotErrors:   expvar.NewInt("SnapshotErrors"),
+
+		HashCollisions: expvar.NewInt("HashCollisions"),
+
 		QueriesHandled:     expvar.NewInt("QueriesHandled"),
 		QueryTagsByService: expvar.NewMap("QueryTagsByService"),
 
+		QueryCacheHits:      expvar.NewInt("QueryCacheHits"),
+		QueryCacheMisses:    expvar.NewInt("QueryCacheMisses"),
+		QueryCacheEvictions: expvar.NewInt("QueryCacheEvictions"),
+		QueryCacheCoalesced: expvar.NewInt("QueryCacheCoalesced"),
+
 		Progress: expvar.NewMap("Progress"),
 
 		SplitIndexes: expvar.NewMap("SplitIndexes"),